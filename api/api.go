@@ -37,6 +37,11 @@ func UserChangePassword(login, password string) error {
 	return core.UserChangePassword(login, password)
 }
 
+// UserSetRateLimits sets rate limits overrides of an user
+func UserSetRateLimits(login string, msgPerHour, rcptPerDay int) error {
+	return core.UserSetRateLimits(login, msgPerHour, rcptPerDay)
+}
+
 // ALIAS
 
 // AliasAdd add an alias
@@ -123,6 +128,18 @@ func QueueBounceMsg(id int64) error {
 	return m.Bounce()
 }
 
+// QueueJanitor republishes stuck and lost messages and removes orphaned
+// raw messages from store
+func QueueJanitor() (core.QueueJanitorSummary, error) {
+	return core.QueueJanitor()
+}
+
+// DeliverdThrottleStates returns deliverd throttle state by destination
+// domain
+func DeliverdThrottleStates() []core.ThrottleState {
+	return core.DeliverdThrottleStates()
+}
+
 // QueuePurge delete expired message
 // WARNING use at your own risks...
 func QueuePurge() error {
@@ -147,8 +164,8 @@ func RoutesGet() ([]core.Route, error) {
 }
 
 // RoutesAdd adds en new route
-func RoutesAdd(host, localIp, remoteHost string, remotePort, priority int, user, mailFrom, smtpAuthLogin, smtpAuthPasswd string) error {
-	return core.AddRoute(host, localIp, remoteHost, remotePort, priority, user, mailFrom, smtpAuthLogin, smtpAuthPasswd)
+func RoutesAdd(host, localIp, remoteHost string, remotePort, priority int, user, mailFrom, smtpAuthLogin, smtpAuthPasswd, tlsMode, tlsServerName, tlsCAFile, tlsClientCert, tlsClientKey string, tlsImplicit bool) error {
+	return core.AddRoute(host, localIp, remoteHost, remotePort, priority, user, mailFrom, smtpAuthLogin, smtpAuthPasswd, tlsMode, tlsServerName, tlsCAFile, tlsClientCert, tlsClientKey, tlsImplicit)
 }
 
 // RoutesDel delete route routeId
@@ -40,7 +40,7 @@ var Queue = cgCli.Command{
 
 						msg := fmt.Sprintf("%d - From: %s - To: %s - Status: %s - Added: %v ", m.Id, m.MailFrom, m.RcptTo, status, m.AddedAt)
 						if m.Status != 0 {
-							msg += fmt.Sprintf("- Next delivery process scheduled at: %v", m.NextDeliveryScheduledAt)
+							msg += fmt.Sprintf("- Failed attempts: %d - Next delivery process scheduled at: %v", m.DeliveryFailedCount, m.NextDeliveryScheduledAt)
 						}
 						println(msg)
 					}
@@ -86,6 +86,17 @@ var Queue = cgCli.Command{
 				cliDieOk()
 			},
 		},
+		{
+			Name:        "janitor",
+			Usage:       "Sync queue and nsqd: republish stuck or lost messages, remove orphaned messages from store",
+			Description: "tmail queue janitor",
+			Action: func(c *cgCli.Context) {
+				summary, err := api.QueueJanitor()
+				cliHandleErr(err)
+				println(summary.String())
+				cliDieOk()
+			},
+		},
 		{
 			Name:        "purge",
 			Usage:       "Purge expired message from queue",
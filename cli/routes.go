@@ -70,6 +70,23 @@ var Routes = cgCli.Command{
 							line += ":25"
 						}
 
+						// TLS
+						if route.TLSImplicit {
+							line += " - implicit TLS"
+						}
+						if route.TLSMode.Valid && route.TLSMode.String != "" {
+							line += " - TLS: " + route.TLSMode.String
+						}
+						if route.TLSServerName.Valid && route.TLSServerName.String != "" {
+							line += " - TLS server name: " + route.TLSServerName.String
+						}
+						if route.TLSCAFile.Valid && route.TLSCAFile.String != "" {
+							line += " - TLS CA: " + route.TLSCAFile.String
+						}
+						if route.TLSClientCert.Valid && route.TLSClientCert.String != "" {
+							line += " - TLS client cert: " + route.TLSClientCert.String
+						}
+
 						println(line)
 					}
 				}
@@ -79,7 +96,7 @@ var Routes = cgCli.Command{
 		{
 			Name:        "add",
 			Usage:       "Add a route",
-			Description: "tmail routes add -d DESTINATION_HOST -rh REMOTE_HOST [-rp REMOTE_PORT] [-p PRORITY] [-l LOCAL_IP] [-u AUTHENTIFIED_USER] [-f MAIL_FROM] [-rl REMOTE_LOGIN] [-rpwd REMOTE_PASSWD]",
+			Description: "tmail routes add -d DESTINATION_HOST -rh REMOTE_HOST [-rp REMOTE_PORT] [-p PRORITY] [-l LOCAL_IP] [-u AUTHENTIFIED_USER] [-f MAIL_FROM] [-rl REMOTE_LOGIN] [-rpwd REMOTE_PASSWD] [-tls none|opportunistic|required|verify] [-tlsServerName NAME] [-tlsCA CA_BUNDLE] [-tlsCert CLIENT_CERT] [-tlsKey CLIENT_KEY] [-tlsImplicit]",
 			Flags: []cgCli.Flag{
 				cgCli.StringFlag{
 					Name:  "destination, d",
@@ -126,6 +143,35 @@ var Routes = cgCli.Command{
 					Value: "",
 					Usage: "SMTPauth passwd for remote host",
 				},
+				cgCli.StringFlag{
+					Name:  "tls",
+					Value: "",
+					Usage: "TLS mode: none, opportunistic, required or verify. Default: global config (deliverd_remote_tls_*)",
+				},
+				cgCli.StringFlag{
+					Name:  "tlsServerName",
+					Value: "",
+					Usage: "Expected name in remote certificate (SNI). Default: remote host",
+				},
+				cgCli.StringFlag{
+					Name:  "tlsCA",
+					Value: "",
+					Usage: "CA bundle (PEM file) used to verify remote certificate. Default: system CAs",
+				},
+				cgCli.StringFlag{
+					Name:  "tlsCert",
+					Value: "",
+					Usage: "Client certificate (PEM file) for mutual TLS",
+				},
+				cgCli.StringFlag{
+					Name:  "tlsKey",
+					Value: "",
+					Usage: "Client key (PEM file) for mutual TLS. Default: in client certificate file",
+				},
+				cgCli.BoolFlag{
+					Name:  "tlsImplicit",
+					Usage: "Implicit TLS: TLS handshake on connect, without STARTTLS (SMTPS, usually port 465)",
+				},
 			},
 			Action: func(c *cgCli.Context) {
 				// si la destination n'est pas renseignée on wildcard
@@ -133,8 +179,8 @@ var Routes = cgCli.Command{
 				if host == "" {
 					host = "*"
 				}
-				// (host, localIp, remoteHost string, remotePort, priority int64, user, mailFrom, smtpAuthLogin, smtpAuthPasswd string)
-				err := api.RoutesAdd(host, c.String("l"), c.String("rh"), c.Int("rp"), c.Int("p"), c.String("u"), c.String("f"), c.String("rl"), c.String("rpwd"))
+				// (host, localIp, remoteHost string, remotePort, priority int64, user, mailFrom, smtpAuthLogin, smtpAuthPasswd, tlsMode, tlsServerName, tlsCAFile, tlsClientCert, tlsClientKey string, tlsImplicit bool)
+				err := api.RoutesAdd(host, c.String("l"), c.String("rh"), c.Int("rp"), c.Int("p"), c.String("u"), c.String("f"), c.String("rl"), c.String("rpwd"), c.String("tls"), c.String("tlsServerName"), c.String("tlsCA"), c.String("tlsCert"), c.String("tlsKey"), c.Bool("tlsImplicit"))
 				cliHandleErr(err)
 			},
 		},
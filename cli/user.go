@@ -58,26 +58,48 @@ var user = cgCli.Command{
 			},
 		},
 		// Update to change proprieties of an user
-		// for now only password change is handled
+		// for now only password and rate limits changes are handled
 		{
 			Name:        "update",
 			Usage:       "change proprieties of an user",
-			Description: "tmail user update USER -p NEW_PASSWORD",
+			Description: "tmail user update USER [-p NEW_PASSWORD] [--msg-per-hour N] [--rcpt-per-day N]",
 			Flags: []cgCli.Flag{
 				cgCli.StringFlag{
 					Name:  "password, p",
 					Usage: "update user password",
 				},
+				cgCli.IntFlag{
+					Name:  "msg-per-hour",
+					Usage: "max messages per hour (0: smtpd default, -1: unlimited)",
+				},
+				cgCli.IntFlag{
+					Name:  "rcpt-per-day",
+					Usage: "max recipients per day (0: smtpd default, -1: unlimited)",
+				},
 			},
 			Action: func(c *cgCli.Context) {
 				if len(c.Args()) != 1 {
 					cliDieBadArgs(c)
 				}
+				if c.String("p") == "" && !c.IsSet("msg-per-hour") && !c.IsSet("rcpt-per-day") {
+					cliDieBadArgs(c)
+				}
 				if c.String("p") != "" {
 					cliHandleErr(api.UserChangePassword(c.Args()[0], c.String("p")))
-					cliDieOk()
 				}
-				cliDieBadArgs(c)
+				if c.IsSet("msg-per-hour") || c.IsSet("rcpt-per-day") {
+					user, err := api.UserGetByLogin(c.Args()[0])
+					cliHandleErr(err)
+					msgPerHour, rcptPerDay := user.MaxMsgPerHour, user.MaxRcptPerDay
+					if c.IsSet("msg-per-hour") {
+						msgPerHour = c.Int("msg-per-hour")
+					}
+					if c.IsSet("rcpt-per-day") {
+						rcptPerDay = c.Int("rcpt-per-day")
+					}
+					cliHandleErr(api.UserSetRateLimits(c.Args()[0], msgPerHour, rcptPerDay))
+				}
+				cliDieOk()
 			},
 		},
 		{
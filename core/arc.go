@@ -0,0 +1,355 @@
+package core
+
+// ARC - Authenticated Received Chain (RFC 8617)
+// Chains of inbound mails are validated by smtpd, and mails forwarded by
+// deliverd (aliases) are sealed with the DKIM key of the forwarding domain.
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/teamnsrg/tmail/message"
+	"github.com/toorop/go-dkim"
+)
+
+// max number of ARC sets in a chain
+const arcMaxInstances = 50
+
+// ARC results (chain validation status)
+const (
+	ARCNone = "none"
+	ARCPass = "pass"
+	ARCFail = "fail"
+)
+
+// headers signed by ARC-Message-Signature (if present)
+var arcSignedHeaders = []string{"from", "to", "cc", "subject", "date", "message-id", "reply-to", "in-reply-to", "references", "mime-version", "content-type", "content-transfer-encoding", "dkim-signature"}
+
+// resolver used to get ARC keys (can be replaced for tests)
+var arcResolver txtResolver = netResolver{}
+
+// arcSet is an ARC set: headers of the same instance
+type arcSet struct {
+	aar, ams, as string
+}
+
+// rxEmptyB matches b= tag value of a signature header
+var rxEmptyB = regexp.MustCompile(`(^|[;:\s])b=[^;]*`)
+
+// headerName returns lower case name of raw header h
+func headerName(h string) string {
+	p := strings.Index(h, ":")
+	if p == -1 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(h[:p]))
+}
+
+// parseTags parses tag list of raw header h (RFC 6376 3.2)
+func parseTags(h string) map[string]string {
+	tags := map[string]string{}
+	h = h[strings.Index(h, ":")+1:]
+	for _, field := range strings.Split(h, ";") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(kv[0])
+		value := strings.TrimSpace(kv[1])
+		switch key {
+		case "b", "bh", "h":
+			// FWS is ignored
+			value = strings.Join(strings.Fields(value), "")
+		}
+		tags[key] = value
+	}
+	return tags
+}
+
+// relaxedHeader returns relaxed canonicalization of raw header h (RFC 6376
+// 3.4.2)
+func relaxedHeader(h string) string {
+	p := strings.Index(h, ":")
+	return strings.ToLower(strings.TrimSpace(h[:p])) + ":" + strings.Join(strings.Fields(h[p+1:]), " ") + "\r\n"
+}
+
+// signedData returns canonicalized (relaxed or simple) signed headers (h=
+// selection, from bottom) followed by signature header sig without b= value
+func signedData(headers []string, names []string, sig string, relaxed bool) []byte {
+	canonicalize := relaxedHeader
+	if !relaxed {
+		canonicalize = func(h string) string { return h }
+	}
+	var b bytes.Buffer
+	used := map[int]bool{}
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		for i := len(headers) - 1; i >= 0; i-- {
+			if !used[i] && headerName(headers[i]) == name {
+				used[i] = true
+				b.WriteString(canonicalize(headers[i]))
+				break
+			}
+		}
+	}
+	b.WriteString(strings.TrimSuffix(canonicalize(rxEmptyB.ReplaceAllString(sig, "${1}b=")), "\r\n"))
+	return b.Bytes()
+}
+
+// arcSealData returns data signed by ARC-Seal of instance len(sets)
+func arcSealData(sets []arcSet) []byte {
+	var b bytes.Buffer
+	for i, set := range sets {
+		b.WriteString(relaxedHeader(set.aar))
+		b.WriteString(relaxedHeader(set.ams))
+		if i == len(sets)-1 {
+			b.WriteString(strings.TrimSuffix(relaxedHeader(rxEmptyB.ReplaceAllString(set.as, "${1}b=")), "\r\n"))
+		} else {
+			b.WriteString(relaxedHeader(set.as))
+		}
+	}
+	return b.Bytes()
+}
+
+// arcVerifySignature verifies signature (tags b, a, d and s) of data
+func arcVerifySignature(tags map[string]string, data []byte) error {
+	if tags["a"] != "rsa-sha256" {
+		return errors.New("unsupported algorithm " + tags["a"])
+	}
+	if tags["d"] == "" || tags["s"] == "" {
+		return errors.New("missing d or s tag")
+	}
+	pubKey, _, err := dkim.NewPubKeyRespFromDNS(tags["s"], tags["d"], dkim.DNSOptLookupTXT(arcResolver.LookupTXT))
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	return rsa.VerifyPKCS1v15(&pubKey.PubKey, crypto.SHA256, sum[:], sig)
+}
+
+// arcSign returns base64 signature of data
+func arcSign(key *rsa.PrivateKey, data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// getARCSets returns ARC sets of headers (ordered by instance)
+func getARCSets(headers []string) ([]arcSet, error) {
+	sets := []arcSet{}
+	for _, h := range headers {
+		name := headerName(h)
+		if name != "arc-authentication-results" && name != "arc-message-signature" && name != "arc-seal" {
+			continue
+		}
+		var i int
+		var err error
+		if name == "arc-authentication-results" {
+			// i=N; authserv-id; ...
+			value := strings.TrimSpace(h[strings.Index(h, ":")+1:])
+			if !strings.HasPrefix(value, "i=") {
+				return nil, errors.New("missing instance in ARC-Authentication-Results")
+			}
+			i, err = strconv.Atoi(strings.TrimSpace(strings.SplitN(value[2:], ";", 2)[0]))
+		} else {
+			i, err = strconv.Atoi(parseTags(h)["i"])
+		}
+		if err != nil || i < 1 || i > arcMaxInstances {
+			return nil, errors.New("bad instance in " + name)
+		}
+		for len(sets) < i {
+			sets = append(sets, arcSet{})
+		}
+		set := &sets[i-1]
+		var field *string
+		switch name {
+		case "arc-authentication-results":
+			field = &set.aar
+		case "arc-message-signature":
+			field = &set.ams
+		default:
+			field = &set.as
+		}
+		if *field != "" {
+			return nil, fmt.Errorf("duplicated %s for instance %d", name, i)
+		}
+		*field = h
+	}
+	for i, set := range sets {
+		if set.aar == "" || set.ams == "" || set.as == "" {
+			return nil, fmt.Errorf("incomplete ARC set %d", i+1)
+		}
+	}
+	return sets, nil
+}
+
+// VerifyARC validates ARC chain of message read from r (RFC 8617 5.2)
+// It returns none, pass or fail
+func VerifyARC(r io.Reader) (string, error) {
+	_, result, arcErr, err := verifyMessage(r)
+	if err != nil {
+		return ARCFail, err
+	}
+	return result, arcErr
+}
+
+// verifyARCChain validates ARC chain of headers, bodyHash is the relaxed
+// SHA-256 body hash of the message
+func verifyARCChain(headers []string, bodyHash string) (string, error) {
+	sets, err := getARCSets(headers)
+	if err != nil {
+		return ARCFail, err
+	}
+	if len(sets) == 0 {
+		return ARCNone, nil
+	}
+	// chain status
+	for i, set := range sets {
+		cv := parseTags(set.as)["cv"]
+		if (i == 0 && cv != ARCNone) || (i != 0 && cv != ARCPass) {
+			return ARCFail, fmt.Errorf("bad cv=%s in ARC-Seal %d", cv, i+1)
+		}
+	}
+	// most recent ARC-Message-Signature
+	ams := parseTags(sets[len(sets)-1].ams)
+	if ams["bh"] != bodyHash {
+		return ARCFail, errors.New("body hash of ARC-Message-Signature did not verify")
+	}
+	if err = arcVerifySignature(ams, signedData(headers, strings.Split(ams["h"], ":"), sets[len(sets)-1].ams, true)); err != nil {
+		return ARCFail, errors.New("ARC-Message-Signature did not verify - " + err.Error())
+	}
+	// ARC-Seals
+	for i := len(sets); i > 0; i-- {
+		if err = arcVerifySignature(parseTags(sets[i-1].as), arcSealData(sets[:i])); err != nil {
+			return ARCFail, fmt.Errorf("ARC-Seal %d did not verify - %s", i, err.Error())
+		}
+	}
+	return ARCPass, nil
+}
+
+// parsePrivateKey parses PEM (PKCS1 or PKCS8) RSA private key
+func parsePrivateKey(privKey string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(privKey))
+	if block == nil {
+		return nil, errors.New("unable to decode private key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not a RSA key")
+	}
+	return rsaKey, nil
+}
+
+// getAuthResults returns results of the Authentication-Results header added
+// by smtpd (authserv-id is Me, above our Received header), empty if there is
+// none
+func getAuthResults(headers []string) string {
+	for _, h := range headers {
+		if headerName(h) == "received" {
+			break
+		}
+		if servID, results := parseAuthResults(h); strings.EqualFold(servID, Cfg.GetMe()) {
+			return results
+		}
+	}
+	return ""
+}
+
+// SealARC returns the ARC set (headers to prepend) sealing message read from
+// r, signed with DKIM key of domain
+// Message must have been authenticated by smtpd (Authentication-Results) and
+// its chain must not be failed
+func SealARC(r io.Reader, domain string) (string, error) {
+	headers, hashes, err := readMessage(r, func([]string) []bodyHashSpec {
+		return []bodyHashSpec{arcBodyHashSpec}
+	})
+	if err != nil {
+		return "", err
+	}
+	results := getAuthResults(headers)
+	if results == "" {
+		return "", errors.New("message has not been authenticated")
+	}
+	dkc, err := DkimGetConfig(domain)
+	if err != nil {
+		return "", err
+	}
+	if dkc == nil {
+		return "", errors.New("DKIM is not enabled on " + domain)
+	}
+	key, err := parsePrivateKey(dkc.PrivKey)
+	if err != nil {
+		return "", err
+	}
+	cv, err := verifyARCChain(headers, hashes[arcBodyHashSpec])
+	if cv == ARCFail {
+		return "", errors.New("ARC chain is failed - " + err.Error())
+	}
+	sets, _ := getARCSets(headers)
+	i := len(sets) + 1
+	if i > arcMaxInstances {
+		return "", errors.New("too many ARC sets")
+	}
+	if !strings.Contains(results, "arc=") {
+		results += "; arc=" + cv
+	}
+	t := time.Now().Unix()
+
+	// ARC-Authentication-Results
+	aar := []byte(fmt.Sprintf("ARC-Authentication-Results: i=%d; %s; %s", i, Cfg.GetMe(), results))
+	message.FoldHeader(&aar)
+	set := arcSet{aar: string(aar) + "\r\n"}
+
+	// ARC-Message-Signature
+	names := []string{}
+	for _, name := range arcSignedHeaders {
+		for _, h := range headers {
+			if headerName(h) == name {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	set.ams = fmt.Sprintf("ARC-Message-Signature: i=%d; a=rsa-sha256; c=relaxed/relaxed;\r\n\td=%s; s=%s; t=%d;\r\n\th=%s;\r\n\tbh=%s;\r\n\tb=", i, domain, dkc.Selector, t, strings.Join(names, ":"), hashes[arcBodyHashSpec])
+	sig, err := arcSign(key, signedData(headers, names, set.ams, true))
+	if err != nil {
+		return "", err
+	}
+	set.ams += sig + "\r\n"
+
+	// ARC-Seal
+	set.as = fmt.Sprintf("ARC-Seal: i=%d; a=rsa-sha256; t=%d; cv=%s;\r\n\td=%s; s=%s;\r\n\tb=", i, t, cv, domain, dkc.Selector)
+	if sig, err = arcSign(key, arcSealData(append(sets, set))); err != nil {
+		return "", err
+	}
+	set.as += sig + "\r\n"
+
+	return set.as + set.ams + set.aar, nil
+}
@@ -0,0 +1,137 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+// setupARCTest opens an in-memory DB with DKIM keys of domains and replaces
+// ARC resolver
+func setupARCTest(t testing.TB, domains ...string) {
+	Cfg = &Config{}
+	Cfg.cfg.Me = "mx.example.com"
+	var err error
+	DB, err = gorm.Open("sqlite3", ":memory:")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.NoError(t, AutoMigrateDB(DB))
+	resolver := stubTXTResolver{}
+	for _, domain := range domains {
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		assert.NoError(t, err)
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		assert.NoError(t, err)
+		privKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		assert.NoError(t, DB.Save(&DkimConfig{Domain: domain, PrivKey: string(privKey), Selector: "s1"}).Error)
+		resolver["s1._domainkey."+domain] = []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)}
+	}
+	arcResolver = resolver
+	t.Cleanup(func() {
+		DB.Close()
+		DB = nil
+		arcResolver = netResolver{}
+	})
+}
+
+func Test_getARCSets(t *testing.T) {
+	aar := func(i string) string { return "ARC-Authentication-Results: i=" + i + "; mx.example.com; spf=pass\r\n" }
+	ams := func(i string) string { return "ARC-Message-Signature: i=" + i + "; a=rsa-sha256; d=example.com\r\n" }
+	as := func(i string) string { return "ARC-Seal: i=" + i + "; a=rsa-sha256; cv=none\r\n" }
+	tests := []struct {
+		name    string
+		headers []string
+		sets    int
+		valid   bool
+	}{
+		{"no set", []string{"From: a@example.com\r\n"}, 0, true},
+		{"one set", []string{as("1"), ams("1"), aar("1"), "From: a@example.com\r\n"}, 1, true},
+		{"two sets", []string{as("2"), ams("2"), aar("2"), as("1"), ams("1"), aar("1")}, 2, true},
+		{"incomplete set", []string{as("1"), aar("1")}, 0, false},
+		{"missing set", []string{as("2"), ams("2"), aar("2")}, 0, false},
+		{"duplicated header", []string{as("1"), ams("1"), ams("1"), aar("1")}, 0, false},
+		{"bad instance", []string{as("0"), ams("0"), aar("0")}, 0, false},
+		{"too many sets", []string{as("51"), ams("51"), aar("51")}, 0, false},
+		{"AAR without instance", []string{as("1"), ams("1"), "ARC-Authentication-Results: mx.example.com; i=1\r\n"}, 0, false},
+	}
+	for _, tt := range tests {
+		sets, err := getARCSets(tt.headers)
+		assert.Equal(t, tt.valid, err == nil, tt.name)
+		assert.Len(t, sets, tt.sets, tt.name)
+	}
+
+	sets, err := getARCSets(tests[2].headers)
+	assert.NoError(t, err)
+	assert.Equal(t, arcSet{aar("1"), ams("1"), as("1")}, sets[0])
+}
+
+func Test_SealARC(t *testing.T) {
+	setupARCTest(t, "fwd.example.com", "list.example.org")
+	raw := "Authentication-Results: mx.example.com; spf=pass; dkim=none\r\n" +
+		"Received: from mail.example.net\r\n" +
+		"From: john@example.net\r\nTo: alias@fwd.example.com\r\nSubject:  hello  \tworld\r\n\r\n" +
+		"body  \t line\r\n\r\n\r\n"
+	unfold := func(headers string) string { return strings.Join(strings.Fields(headers), " ") + " " }
+
+	result, err := VerifyARC(strings.NewReader(raw))
+	assert.NoError(t, err)
+	assert.Equal(t, ARCNone, result)
+
+	// first hop
+	set, err := SealARC(strings.NewReader(raw), "fwd.example.com")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(set, "ARC-Seal: i=1; a=rsa-sha256; "))
+	assert.Contains(t, set, "cv=none;")
+	assert.Contains(t, unfold(set), "ARC-Authentication-Results: i=1; mx.example.com; spf=pass; dkim=none; arc=none ")
+	sealed := set + raw
+	result, err = VerifyARC(strings.NewReader(sealed))
+	assert.NoError(t, err)
+	assert.Equal(t, ARCPass, result)
+
+	// second hop
+	raw = "Authentication-Results: mx.example.com; spf=fail; arc=pass\r\nReceived: from mx.fwd.example.com\r\n" + sealed
+	set, err = SealARC(strings.NewReader(raw), "list.example.org")
+	assert.NoError(t, err)
+	assert.Contains(t, set, "cv=pass;")
+	assert.Contains(t, unfold(set), "ARC-Authentication-Results: i=2; mx.example.com; spf=fail; arc=pass ")
+	sealed = set + raw
+	result, err = VerifyARC(strings.NewReader(sealed))
+	assert.NoError(t, err)
+	assert.Equal(t, ARCPass, result)
+
+	// modified body, modified ARC set, modified signed header
+	for _, tamper := range [][2]string{
+		{"body  \t line", "body  \t lines"},
+		{"i=1; mx.example.com; spf=pass", "i=1; mx.example.com; spf=fail"},
+		{"Subject:  hello", "Subject: bye"},
+	} {
+		result, err = VerifyARC(strings.NewReader(strings.Replace(sealed, tamper[0], tamper[1], 1)))
+		assert.Error(t, err, tamper[1])
+		assert.Equal(t, ARCFail, result, tamper[1])
+	}
+
+	// failed chain is not sealed
+	_, err = SealARC(strings.NewReader(strings.Replace(sealed, "body  \t line", "body  \t lines", 1)), "list.example.org")
+	assert.Error(t, err)
+
+	// not authenticated by us (no header or header below our Received
+	// header), no DKIM key
+	for _, raw := range []string{
+		"From: john@example.net\r\n\r\nbody\r\n",
+		"Authentication-Results: mx.example.org; spf=pass\r\nFrom: john@example.net\r\n\r\nbody\r\n",
+		"Received: from mail.example.net\r\nAuthentication-Results: mx.example.com; spf=pass\r\n\r\nbody\r\n",
+	} {
+		_, err = SealARC(strings.NewReader(raw), "fwd.example.com")
+		assert.Error(t, err, raw)
+	}
+	_, err = SealARC(strings.NewReader("Authentication-Results: mx.example.com; spf=pass\r\n\r\nbody\r\n"), "example.com")
+	assert.Error(t, err)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -48,6 +49,25 @@ type Config struct {
 		SmtpdClamavEnabled       bool   `name:"smtpd_scan_clamav_enabled" default:"false"`
 		SmtpdClamavDsns          string `name:"smtpd_scan_clamav_dsns" default:""`
 		SmtpdConcurrencyIncoming int    `name:"smtpd_concurrency_incoming" default:"20"`
+		SmtpdAuthMechanisms      string `name:"smtpd_auth_mechanisms" default:"plain;login"`
+		SmtpdAuthRequireTLS      bool   `name:"smtpd_auth_require_tls" default:"true"`
+		SmtpdSPF                 string `name:"smtpd_spf" default:"off"`
+		SmtpdDKIMVerify          bool   `name:"smtpd_dkim_verify" default:"false"`
+		SmtpdDMARC               bool   `name:"smtpd_dmarc" default:"false"`
+		SmtpdDMARCReports        bool   `name:"smtpd_dmarc_reports" default:"false"`
+		SmtpdDNSBLZones          string `name:"smtpd_dnsbl_zones" default:"_"`
+		SmtpdDNSBLThreshold      int    `name:"smtpd_dnsbl_threshold" default:"1"`
+		SmtpdDNSBLAction         string `name:"smtpd_dnsbl_action" default:"tag"`
+		SmtpdDNSBLTimeout        int    `name:"smtpd_dnsbl_timeout" default:"5"`
+		SmtpdDNSBLCacheTTL       int    `name:"smtpd_dnsbl_cache_ttl" default:"3600"`
+		SmtpdGreylisting         bool   `name:"smtpd_greylisting" default:"false"`
+		SmtpdGreylistingMinDelay int    `name:"smtpd_greylisting_min_delay" default:"300"`
+		SmtpdGreylistingMaxDelay int    `name:"smtpd_greylisting_max_delay" default:"86400"`
+		SmtpdGreylistingTTL      int    `name:"smtpd_greylisting_ttl" default:"3110400"`
+		SmtpdRateLimitConnPerIP  int    `name:"smtpd_ratelimit_conn_per_ip" default:"0"`
+		SmtpdRateLimitConnWindow int    `name:"smtpd_ratelimit_conn_window" default:"60"`
+		SmtpdRateLimitMsgPerHour int    `name:"smtpd_ratelimit_msg_per_hour" default:"0"`
+		SmtpdRateLimitRcptPerDay int    `name:"smtpd_ratelimit_rcpt_per_day" default:"0"`
 
 		LaunchDeliverd               bool   `name:"deliverd_launch" default:"false"`
 		LocalIps                     string `name:"deliverd_local_ips" default:"_"`
@@ -55,10 +75,27 @@ type Config struct {
 		DeliverdConcurrencyRemote    int    `name:"deliverd_concurrency_remote" default:"50"`
 		DeliverdQueueLifetime        int    `name:"deliverd_queue_lifetime" default:"10080"`
 		DeliverdQueueBouncesLifetime int    `name:"deliverd_queue_bounces_lifetime" default:"10080"`
+		DeliverdDelayWarnings        string `name:"deliverd_delay_warnings" default:"240;1440"`
+		DeliverdRetrySchedule        string `name:"deliverd_retry_schedule" default:"5m,10m,30m,1h,2h,4h"`
+		DeliverdRetryScheduleDomains string `name:"deliverd_retry_schedule_domains" default:"_"`
+		DeliverdJanitorInterval      int    `name:"deliverd_janitor_interval" default:"15"`
+		DeliverdJanitorTimeout       int    `name:"deliverd_janitor_timeout" default:"120"`
 		DeliverdRemoteTimeout        int    `name:"deliverd_remote_timeout" default:"300"`
+		DeliverdRemoteMaxRcpt        int    `name:"deliverd_remote_max_rcpt" default:"100"`
+		DeliverdRemoteMaxConnPerHost int    `name:"deliverd_remote_max_conn_per_host" default:"20"`
+		DeliverdPoolMaxMessages      int    `name:"deliverd_remote_pool_max_messages" default:"100"`
+		DeliverdPoolIdleTimeout      int    `name:"deliverd_remote_pool_idle_timeout" default:"30"`
+		DeliverdThrottleMaxConn      int    `name:"deliverd_throttle_max_conn" default:"10"`
+		DeliverdThrottleMaxPerMinute int    `name:"deliverd_throttle_max_per_minute" default:"300"`
+		DeliverdThrottleDomains      string `name:"deliverd_throttle_domains" default:"_"`
 		DeliverdRemoteTLSSkipVerify  bool   `name:"deliverd_remote_tls_skipverify" default:"false"`
 		DeliverdRemoteTLSFallback    bool   `name:"deliverd_remote_tls_fallback" default:"false"`
+		DeliverdMTASTS               bool   `name:"deliverd_mtasts" default:"true"`
+		DeliverdDANE                 bool   `name:"deliverd_dane" default:"false"`
+		DeliverdDANEResolver         string `name:"deliverd_dane_resolver" default:"127.0.0.1:53"`
+		DeliverdTLSRPT               bool   `name:"deliverd_tlsrpt" default:"false"`
 		DeliverdDkimSign             bool   `name:"deliverd_dkim_sign" default:"false"`
+		DeliverdARCSeal              bool   `name:"deliverd_arc_seal" default:"false"`
 
 		// RFC compliance
 		// RFC 5321 2.3.5: the domain name givent MUST be either a primary hostname
@@ -346,6 +383,162 @@ func (c *Config) GetSmtpdConcurrencyIncoming() int {
 	return c.cfg.SmtpdConcurrencyIncoming
 }
 
+// GetSmtpdAuthMechanisms returns SASL mechanisms enabled for smtpd AUTH
+func (c *Config) GetSmtpdAuthMechanisms() (mechanisms []string) {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.SmtpdAuthMechanisms == "_" {
+		return
+	}
+	for _, m := range strings.Split(c.cfg.SmtpdAuthMechanisms, ";") {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		if m != "" {
+			mechanisms = append(mechanisms, m)
+		}
+	}
+	return
+}
+
+// GetSmtpdAuthRequireTLS returns true if AUTH is only allowed over TLS
+func (c *Config) GetSmtpdAuthRequireTLS() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdAuthRequireTLS
+}
+
+// GetSmtpdSPF returns SPF policy for inbound mails: off, tag or reject
+func (c *Config) GetSmtpdSPF() string {
+	c.Lock()
+	defer c.Unlock()
+	return strings.ToLower(c.cfg.SmtpdSPF)
+}
+
+// GetSmtpdDKIMVerify returns true if DKIM signatures of inbound mails must
+// be verified
+func (c *Config) GetSmtpdDKIMVerify() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdDKIMVerify
+}
+
+// GetSmtpdDMARC returns true if DMARC policies of inbound mails must be
+// evaluated and applied
+func (c *Config) GetSmtpdDMARC() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdDMARC
+}
+
+// GetSmtpdDMARCReports returns true if DMARC aggregate reports must be sent
+func (c *Config) GetSmtpdDMARCReports() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdDMARCReports
+}
+
+// GetSmtpdDNSBLZones returns DNSBL zones (zone[:weight[:codes]];...)
+func (c *Config) GetSmtpdDNSBLZones() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.SmtpdDNSBLZones == "_" {
+		return ""
+	}
+	return c.cfg.SmtpdDNSBLZones
+}
+
+// GetSmtpdDNSBLThreshold returns the score from which a client is
+// considered as listed
+func (c *Config) GetSmtpdDNSBLThreshold() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdDNSBLThreshold
+}
+
+// GetSmtpdDNSBLAction returns action for listed clients: tag or reject
+func (c *Config) GetSmtpdDNSBLAction() string {
+	c.Lock()
+	defer c.Unlock()
+	return strings.ToLower(c.cfg.SmtpdDNSBLAction)
+}
+
+// GetSmtpdDNSBLTimeout returns timeout (in seconds) of DNSBL lookups
+func (c *Config) GetSmtpdDNSBLTimeout() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdDNSBLTimeout
+}
+
+// GetSmtpdDNSBLCacheTTL returns how long (in seconds) DNSBL results are
+// cached
+func (c *Config) GetSmtpdDNSBLCacheTTL() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdDNSBLCacheTTL
+}
+
+// GetSmtpdGreylisting returns true if inbound mails have to be greylisted
+func (c *Config) GetSmtpdGreylisting() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdGreylisting
+}
+
+// GetSmtpdGreylistingMinDelay returns the delay (in seconds) before a
+// greylisted triplet is accepted
+func (c *Config) GetSmtpdGreylistingMinDelay() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdGreylistingMinDelay
+}
+
+// GetSmtpdGreylistingMaxDelay returns the delay (in seconds) after which a
+// greylisted triplet which has not been retried is forgotten
+func (c *Config) GetSmtpdGreylistingMaxDelay() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdGreylistingMaxDelay
+}
+
+// GetSmtpdGreylistingTTL returns how long (in seconds) a whitelisted
+// triplet is kept since it was last seen
+func (c *Config) GetSmtpdGreylistingTTL() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdGreylistingTTL
+}
+
+// GetSmtpdRateLimitConnPerIP returns max number of connections per client IP
+// during the connection window (0: unlimited)
+func (c *Config) GetSmtpdRateLimitConnPerIP() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdRateLimitConnPerIP
+}
+
+// GetSmtpdRateLimitConnWindow returns the window (in seconds) of the
+// connections rate limit
+func (c *Config) GetSmtpdRateLimitConnWindow() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdRateLimitConnWindow
+}
+
+// GetSmtpdRateLimitMsgPerHour returns default max number of messages per hour
+// an authenticated user can send (0: unlimited)
+func (c *Config) GetSmtpdRateLimitMsgPerHour() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdRateLimitMsgPerHour
+}
+
+// GetSmtpdRateLimitRcptPerDay returns default max number of recipients per
+// day an authenticated user can send to (0: unlimited)
+func (c *Config) GetSmtpdRateLimitRcptPerDay() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdRateLimitRcptPerDay
+}
+
 // GetLaunchDeliverd returns true if deliverd have to be launched
 func (c *Config) GetLaunchDeliverd() bool {
 	c.Lock()
@@ -590,6 +783,64 @@ func (c *Config) GetDeliverdRemoteTimeout() int {
 	return c.cfg.DeliverdRemoteTimeout
 }
 
+// GetDeliverdRemoteMaxRcpt returns max number of recipients delivered in one
+// SMTP transaction
+func (c *Config) GetDeliverdRemoteMaxRcpt() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdRemoteMaxRcpt
+}
+
+// GetDeliverdRemoteMaxConnPerHost returns max number of connections opened
+// to a remote host (0: unlimited)
+func (c *Config) GetDeliverdRemoteMaxConnPerHost() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdRemoteMaxConnPerHost
+}
+
+// GetDeliverdRemotePoolMaxMessages returns max number of messages sent
+// through a pooled connection (0: no pooling)
+func (c *Config) GetDeliverdRemotePoolMaxMessages() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdPoolMaxMessages
+}
+
+// GetDeliverdRemotePoolIdleTimeout returns time in seconds an idle
+// connection is kept in pool
+func (c *Config) GetDeliverdRemotePoolIdleTimeout() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdPoolIdleTimeout
+}
+
+// GetDeliverdThrottleLimits returns max concurrent deliveries and max
+// deliveries per minute for destination domain (0: unlimited)
+func (c *Config) GetDeliverdThrottleLimits(domain string) (maxConn, maxPerMinute int) {
+	c.Lock()
+	defer c.Unlock()
+	maxConn, maxPerMinute = c.cfg.DeliverdThrottleMaxConn, c.cfg.DeliverdThrottleMaxPerMinute
+	if c.cfg.DeliverdThrottleDomains == "_" {
+		return
+	}
+	// domain:maxConn:maxPerMinute;...
+	for _, dl := range strings.Split(c.cfg.DeliverdThrottleDomains, ";") {
+		p := strings.Split(dl, ":")
+		if len(p) != 3 || !strings.EqualFold(strings.TrimSpace(p[0]), domain) {
+			continue
+		}
+		if v, err := strconv.Atoi(strings.TrimSpace(p[1])); err == nil {
+			maxConn = v
+		}
+		if v, err := strconv.Atoi(strings.TrimSpace(p[2])); err == nil {
+			maxPerMinute = v
+		}
+		break
+	}
+	return
+}
+
 // GetDeliverdQueueLifetime return queue lifetime in minutes
 func (c *Config) GetDeliverdQueueLifetime() int {
 	c.Lock()
@@ -604,6 +855,70 @@ func (c *Config) GetDeliverdQueueBouncesLifetime() int {
 	return c.cfg.DeliverdQueueBouncesLifetime
 }
 
+// GetDeliverdDelayWarnings returns delays (since message was queued) after
+// which a delayed delivery warning is sent to sender
+func (c *Config) GetDeliverdDelayWarnings() (delays []time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.DeliverdDelayWarnings == "_" {
+		return
+	}
+	var minutes []int
+	for _, d := range strings.Split(c.cfg.DeliverdDelayWarnings, ";") {
+		m, err := strconv.Atoi(strings.TrimSpace(d))
+		if err == nil && m > 0 {
+			minutes = append(minutes, m)
+		}
+	}
+	sort.Ints(minutes)
+	for _, m := range minutes {
+		delays = append(delays, time.Duration(m)*time.Minute)
+	}
+	return
+}
+
+// GetDeliverdRetrySchedule returns default retry schedule
+func (c *Config) GetDeliverdRetrySchedule() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdRetrySchedule
+}
+
+// GetDeliverdRetryScheduleDomains returns retry schedules by destination
+// domain
+func (c *Config) GetDeliverdRetryScheduleDomains() map[string]string {
+	c.Lock()
+	defer c.Unlock()
+	schedules := make(map[string]string)
+	if c.cfg.DeliverdRetryScheduleDomains == "_" {
+		return schedules
+	}
+	for _, ds := range strings.Split(c.cfg.DeliverdRetryScheduleDomains, ";") {
+		p := strings.SplitN(ds, ":", 2)
+		if len(p) != 2 {
+			continue
+		}
+		schedules[strings.ToLower(strings.TrimSpace(p[0]))] = p[1]
+	}
+	return schedules
+}
+
+// GetDeliverdJanitorInterval returns interval in minutes between two queue
+// janitor runs
+func (c *Config) GetDeliverdJanitorInterval() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdJanitorInterval
+}
+
+// GetDeliverdJanitorTimeout returns delay in minutes after which the queue
+// janitor considers a message as stuck or lost
+func (c *Config) GetDeliverdJanitorTimeout() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdJanitorTimeout
+}
+
 // GetDeliverdRemoteTLSFallback return DeliverdRemoteTLSFallback
 func (c *Config) GetDeliverdRemoteTLSFallback() bool {
 	c.Lock()
@@ -611,6 +926,36 @@ func (c *Config) GetDeliverdRemoteTLSFallback() bool {
 	return c.cfg.DeliverdRemoteTLSFallback
 }
 
+// GetDeliverdMTASTS returns true if MTA-STS policies of recipient domains
+// must be honored
+func (c *Config) GetDeliverdMTASTS() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdMTASTS
+}
+
+// GetDeliverdDANE returns true if TLSA records of MX hosts must be honored
+func (c *Config) GetDeliverdDANE() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdDANE
+}
+
+// GetDeliverdDANEResolver returns address (ip:port) of the DNSSEC validating
+// resolver used for TLSA lookups
+func (c *Config) GetDeliverdDANEResolver() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdDANEResolver
+}
+
+// GetDeliverdTLSRPT returns true if TLS reports (RFC 8460) must be sent
+func (c *Config) GetDeliverdTLSRPT() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdTLSRPT
+}
+
 // GetDeliverdRemoteTLSSkipVerify return DeliverdRemoteTLSSkipVerify
 func (c *Config) GetDeliverdRemoteTLSSkipVerify() bool {
 	c.Lock()
@@ -625,6 +970,14 @@ func (c *Config) GetDeliverdDkimSign() bool {
 	return c.cfg.DeliverdDkimSign
 }
 
+// GetDeliverdARCSeal returns true if forwarded mails (aliases) must be ARC
+// sealed
+func (c *Config) GetDeliverdARCSeal() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdARCSeal
+}
+
 // GetUsersHomeBase returns users home base
 func (c *Config) GetUsersHomeBase() string {
 	c.Lock()
@@ -0,0 +1,194 @@
+package core
+
+// DANE for SMTP (RFC 7672)
+// TLSA records of MX hosts (_25._tcp.MX) are used to authenticate the
+// server certificate. Only DANE-TA(2) and DANE-EE(3) usages are supported.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TLSA usages
+const (
+	tlsaUsageDANETA = 2
+	tlsaUsageDANEEE = 3
+)
+
+// tlsaRecord represents a TLSA record (RFC 6698)
+type tlsaRecord struct {
+	Usage        uint8
+	Selector     uint8 // 0: full certificate, 1: SubjectPublicKeyInfo
+	MatchingType uint8 // 0: exact match, 1: SHA-256, 2: SHA-512
+	Data         []byte
+}
+
+// String implements fmt.Stringer
+func (r tlsaRecord) String() string {
+	return fmt.Sprintf("%d %d %d %s", r.Usage, r.Selector, r.MatchingType, hex.EncodeToString(r.Data))
+}
+
+// usable returns true if record can be used for SMTP (RFC 7672 3.1)
+func (r tlsaRecord) usable() bool {
+	return (r.Usage == tlsaUsageDANETA || r.Usage == tlsaUsageDANEEE) && r.Selector < 2 && r.MatchingType < 3
+}
+
+// match returns true if cert matches record selector and matching type
+func (r tlsaRecord) match(cert *x509.Certificate) bool {
+	data := cert.Raw
+	if r.Selector == 1 {
+		data = cert.RawSubjectPublicKeyInfo
+	}
+	switch r.MatchingType {
+	case 1:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case 2:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	}
+	return bytes.Equal(data, r.Data)
+}
+
+// tlsaResolver looks up TLSA records
+type tlsaResolver interface {
+	// LookupTLSA returns TLSA records of name. secure is true if answer
+	// (or its absence) has been validated by DNSSEC
+	LookupTLSA(name string) (records []tlsaRecord, secure bool, err error)
+}
+
+// dnssecResolver queries a DNSSEC validating resolver and trusts its AD bit
+// (the resolver should be local)
+type dnssecResolver struct{}
+
+// LookupTLSA implements tlsaResolver
+func (dnssecResolver) LookupTLSA(name string) (records []tlsaRecord, secure bool, err error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeTLSA)
+	m.SetEdns0(4096, true)
+	m.AuthenticatedData = true
+	c := &dns.Client{Timeout: 10 * time.Second}
+	r, _, err := c.Exchange(m, Cfg.GetDeliverdDANEResolver())
+	if err != nil {
+		return nil, false, err
+	}
+	switch r.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return nil, false, errors.New("TLSA lookup of " + name + " failed - " + dns.RcodeToString[r.Rcode])
+	}
+	for _, rr := range r.Answer {
+		if t, ok := rr.(*dns.TLSA); ok {
+			data, err := hex.DecodeString(t.Certificate)
+			if err != nil {
+				continue
+			}
+			records = append(records, tlsaRecord{t.Usage, t.Selector, t.MatchingType, data})
+		}
+	}
+	return records, r.AuthenticatedData, nil
+}
+
+// resolver used for DANE (can be replaced for tests)
+var daneResolver tlsaResolver = dnssecResolver{}
+
+// getDANERecords returns usable TLSA records of route (nil if DANE doesn't
+// apply). An error means that TLSA records can't be trusted and delivery
+// via this route must be deferred (RFC 7672 2.2)
+func getDANERecords(route *Route) ([]tlsaRecord, error) {
+	if !Cfg.GetDeliverdDANE() || !route.IsMX {
+		return nil, nil
+	}
+	host := strings.TrimSuffix(route.RemoteHost, ".")
+	records, secure, err := daneResolver.LookupTLSA("_" + strconv.FormatInt(route.RemotePort.Int64, 10) + "._tcp." + host)
+	if err != nil {
+		return nil, err
+	}
+	if !secure {
+		return nil, nil
+	}
+	usable := []tlsaRecord{}
+	for _, r := range records {
+		if r.usable() {
+			usable = append(usable, r)
+		}
+	}
+	if len(records) != 0 && len(usable) == 0 {
+		return nil, errors.New("no usable TLSA record for " + host)
+	}
+	if len(usable) == 0 {
+		return nil, nil
+	}
+	return usable, nil
+}
+
+// errDANEMismatch is returned by daneVerifier when server certificate doesn't
+// match TLSA records
+var errDANEMismatch = errors.New("DANE: server certificate doesn't match any TLSA record")
+
+// daneVerifier returns a tls.Config VerifyPeerCertificate func which checks
+// peer certificates against records
+// - DANE-EE: server certificate must match (name and dates are not checked)
+// - DANE-TA: a certificate of the chain must match and server certificate
+// must be issued (directly or not) by it for serverName
+func daneVerifier(records []tlsaRecord, serverName string) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		certs := []*x509.Certificate{}
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs = append(certs, cert)
+		}
+		if len(certs) == 0 {
+			return errors.New("DANE: no server certificate")
+		}
+		for _, r := range records {
+			if r.Usage == tlsaUsageDANEEE {
+				if r.match(certs[0]) {
+					return nil
+				}
+				continue
+			}
+			// DANE-TA
+			for i, cert := range certs {
+				if !r.match(cert) {
+					continue
+				}
+				if i == 0 {
+					// TA is the server certificate itself
+					if err := certs[0].VerifyHostname(serverName); err == nil {
+						return nil
+					}
+					continue
+				}
+				roots := x509.NewCertPool()
+				roots.AddCert(cert)
+				intermediates := x509.NewCertPool()
+				for _, c := range certs[1:i] {
+					intermediates.AddCert(c)
+				}
+				if _, err := certs[0].Verify(x509.VerifyOptions{
+					DNSName:       serverName,
+					Roots:         roots,
+					Intermediates: intermediates,
+					KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+				}); err == nil {
+					return nil
+				}
+			}
+		}
+		return errDANEMismatch
+	}
+}
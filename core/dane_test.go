@@ -0,0 +1,201 @@
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// stubTLSAResolver is a TLSA resolver for tests
+type stubTLSAResolver struct {
+	records []tlsaRecord
+	secure  bool
+	err     error
+	name    string // last looked up name
+}
+
+func (r *stubTLSAResolver) LookupTLSA(name string) ([]tlsaRecord, bool, error) {
+	r.name = name
+	return r.records, r.secure, r.err
+}
+
+// newTestCert returns a certificate for cn signed by parent (self signed if
+// parent is nil)
+func newTestCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, ca bool) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	if !ca {
+		template.DNSNames = []string{cn}
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(raw)
+	assert.NoError(t, err)
+	return cert, key
+}
+
+func Test_tlsaRecord(t *testing.T) {
+	cert, _ := newTestCert(t, "mx.example.com", nil, nil, false)
+	other, _ := newTestCert(t, "mx.example.com", nil, nil, false)
+	sha256Cert, sha256SPKI := sha256.Sum256(cert.Raw), sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	sha512Cert := sha512.Sum512(cert.Raw)
+	for _, r := range []tlsaRecord{
+		{3, 0, 0, cert.Raw},
+		{3, 1, 0, cert.RawSubjectPublicKeyInfo},
+		{3, 0, 1, sha256Cert[:]},
+		{3, 1, 1, sha256SPKI[:]},
+		{2, 0, 2, sha512Cert[:]},
+	} {
+		assert.True(t, r.match(cert), r.String())
+		assert.False(t, r.match(other), r.String())
+		assert.True(t, r.usable(), r.String())
+	}
+
+	// PKIX-TA(0) and PKIX-EE(1) usages, unknown selectors and matching types
+	for _, r := range []tlsaRecord{{0, 0, 1, nil}, {1, 0, 1, nil}, {3, 2, 1, nil}, {3, 1, 3, nil}} {
+		assert.False(t, r.usable(), r.String())
+	}
+}
+
+func Test_getDANERecords(t *testing.T) {
+	Cfg = &Config{}
+	Cfg.cfg.DeliverdDANE = true
+	resolver := &stubTLSAResolver{secure: true}
+	daneResolver = resolver
+	defer func() { daneResolver = dnssecResolver{} }()
+	ee := tlsaRecord{3, 1, 1, []byte{1}}
+	pkixEE := tlsaRecord{1, 1, 1, []byte{2}}
+	route := &Route{RemoteHost: "mx.example.com.", RemotePort: sql.NullInt64{Int64: 25, Valid: true}, IsMX: true}
+
+	// usable records only
+	resolver.records = []tlsaRecord{ee, pkixEE}
+	records, err := getDANERecords(route)
+	assert.NoError(t, err)
+	assert.Equal(t, []tlsaRecord{ee}, records)
+	assert.Equal(t, "_25._tcp.mx.example.com", resolver.name)
+
+	// no usable record: delivery must be deferred
+	resolver.records = []tlsaRecord{pkixEE}
+	_, err = getDANERecords(route)
+	assert.Error(t, err)
+
+	// DNS failure
+	resolver.records, resolver.err = []tlsaRecord{ee}, errors.New("SERVFAIL")
+	_, err = getDANERecords(route)
+	assert.Error(t, err)
+	resolver.err = nil
+
+	// DANE doesn't apply: no record, insecure answer, route from DB, DANE
+	// disabled
+	resolver.records = nil
+	records, err = getDANERecords(route)
+	assert.NoError(t, err)
+	assert.Nil(t, records)
+	resolver.records, resolver.secure = []tlsaRecord{ee}, false
+	records, err = getDANERecords(route)
+	assert.NoError(t, err)
+	assert.Nil(t, records)
+	resolver.secure = true
+	records, err = getDANERecords(&Route{RemoteHost: "mx.example.com", RemotePort: sql.NullInt64{Int64: 25, Valid: true}})
+	assert.NoError(t, err)
+	assert.Nil(t, records)
+	Cfg.cfg.DeliverdDANE = false
+	records, err = getDANERecords(route)
+	assert.NoError(t, err)
+	assert.Nil(t, records)
+}
+
+func Test_daneVerifier(t *testing.T) {
+	root, rootKey := newTestCert(t, "root", nil, nil, true)
+	intermediate, intermediateKey := newTestCert(t, "intermediate", root, rootKey, true)
+	leaf, _ := newTestCert(t, "mx.example.com", intermediate, intermediateKey, false)
+	selfSigned, _ := newTestCert(t, "mx.example.com", nil, nil, false)
+	chain := [][]byte{leaf.Raw, intermediate.Raw, root.Raw}
+	digest := func(cert *x509.Certificate) []byte {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		return sum[:]
+	}
+	ee := tlsaRecord{tlsaUsageDANEEE, 1, 1, digest(leaf)}
+	taRoot := tlsaRecord{tlsaUsageDANETA, 1, 1, digest(root)}
+	taIntermediate := tlsaRecord{tlsaUsageDANETA, 1, 1, digest(intermediate)}
+	taSelfSigned := tlsaRecord{tlsaUsageDANETA, 1, 1, digest(selfSigned)}
+
+	tests := []struct {
+		name       string
+		records    []tlsaRecord
+		serverName string
+		chain      [][]byte
+		valid      bool
+	}{
+		{"DANE-EE", []tlsaRecord{ee}, "mx.example.com", chain, true},
+		{"DANE-EE name is not checked", []tlsaRecord{ee}, "other.example.com", chain[:1], true},
+		{"DANE-EE mismatch", []tlsaRecord{ee}, "mx.example.com", [][]byte{selfSigned.Raw}, false},
+		{"DANE-TA root", []tlsaRecord{taRoot}, "mx.example.com", chain, true},
+		{"DANE-TA intermediate", []tlsaRecord{taIntermediate}, "mx.example.com", chain[:2], true},
+		{"DANE-TA bad name", []tlsaRecord{taRoot}, "other.example.com", chain, false},
+		{"DANE-TA not in chain", []tlsaRecord{taRoot}, "mx.example.com", chain[:2], false},
+		{"DANE-TA server certificate", []tlsaRecord{taSelfSigned}, "mx.example.com", [][]byte{selfSigned.Raw}, true},
+		{"second record", []tlsaRecord{taSelfSigned, ee}, "mx.example.com", chain, true},
+		{"no certificate", []tlsaRecord{ee}, "mx.example.com", nil, false},
+	}
+	for _, tt := range tests {
+		err := daneVerifier(tt.records, tt.serverName)(tt.chain, nil)
+		assert.Equal(t, tt.valid, err == nil, tt.name)
+	}
+	assert.Equal(t, errDANEMismatch, daneVerifier([]tlsaRecord{ee}, "mx.example.com")([][]byte{selfSigned.Raw}, nil))
+}
+
+func Test_remoteTLSConfig(t *testing.T) {
+	Cfg = &Config{}
+	Cfg.cfg.DeliverdRemoteTLSSkipVerify = true
+	d := &Delivery{}
+	route := &Route{RemoteHost: "mx.example.com.", IsMX: true}
+	ee := tlsaRecord{3, 1, 1, []byte{1}}
+
+	// DANE: certificate is checked against TLSA records only
+	config, err := d.remoteTLSConfig(route, []tlsaRecord{ee})
+	assert.NoError(t, err)
+	assert.Equal(t, "mx.example.com", config.ServerName)
+	assert.True(t, config.InsecureSkipVerify)
+	assert.NotNil(t, config.VerifyPeerCertificate)
+
+	// global config, route TLS mode
+	config, err = d.remoteTLSConfig(route, nil)
+	assert.NoError(t, err)
+	assert.True(t, config.InsecureSkipVerify)
+	assert.Nil(t, config.VerifyPeerCertificate)
+	route.TLSMode = sql.NullString{String: routeTLSVerify, Valid: true}
+	config, err = d.remoteTLSConfig(route, nil)
+	assert.NoError(t, err)
+	assert.False(t, config.InsecureSkipVerify)
+
+	// MTA-STS: certificate must be valid whatever route TLS mode
+	route.TLSMode = sql.NullString{String: routeTLSNone, Valid: true}
+	d.RequireTLS = true
+	config, err = d.remoteTLSConfig(route, nil)
+	assert.NoError(t, err)
+	assert.False(t, config.InsecureSkipVerify)
+}
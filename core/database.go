@@ -34,6 +34,18 @@ func IsOkDB(DB *gorm.DB) bool {
 	if !DB.HasTable(&DkimConfig{}) {
 		return false
 	}
+	if !DB.HasTable(&TLSRPTResult{}) {
+		return false
+	}
+	if !DB.HasTable(&DMARCResult{}) {
+		return false
+	}
+	if !DB.HasTable(&GreylistEntry{}) {
+		return false
+	}
+	if !DB.HasTable(&RateLimitEvent{}) {
+		return false
+	}
 	return true
 }
 
@@ -113,13 +125,53 @@ func InitDB(DB *gorm.DB) error {
 		}
 	}
 
+	if !DB.HasTable(&TLSRPTResult{}) {
+		if err = DB.CreateTable(&TLSRPTResult{}).Error; err != nil {
+			return errors.New("Unable to create table tlsrpt_results - " + err.Error())
+		}
+		// Index
+		if err = DB.Model(&TLSRPTResult{}).AddIndex("idx_tlsrpt_day_domain", "day", "policy_domain").Error; err != nil {
+			return errors.New("Unable to add index idx_tlsrpt_day_domain on table tlsrpt_results - " + err.Error())
+		}
+	}
+
+	if !DB.HasTable(&DMARCResult{}) {
+		if err = DB.CreateTable(&DMARCResult{}).Error; err != nil {
+			return errors.New("Unable to create table dmarc_results - " + err.Error())
+		}
+		// Index
+		if err = DB.Model(&DMARCResult{}).AddIndex("idx_dmarc_day_domain", "day", "policy_domain").Error; err != nil {
+			return errors.New("Unable to add index idx_dmarc_day_domain on table dmarc_results - " + err.Error())
+		}
+	}
+
+	if !DB.HasTable(&GreylistEntry{}) {
+		if err = DB.CreateTable(&GreylistEntry{}).Error; err != nil {
+			return errors.New("Unable to create table greylist_entries - " + err.Error())
+		}
+		// Index
+		if err = DB.Model(&GreylistEntry{}).AddUniqueIndex("idx_greylist_triplet", "network", "mail_from", "rcpt_to").Error; err != nil {
+			return errors.New("Unable to add index idx_greylist_triplet on table greylist_entries - " + err.Error())
+		}
+	}
+
+	if !DB.HasTable(&RateLimitEvent{}) {
+		if err = DB.CreateTable(&RateLimitEvent{}).Error; err != nil {
+			return errors.New("Unable to create table rate_limit_events - " + err.Error())
+		}
+		// Index
+		if err = DB.Model(&RateLimitEvent{}).AddIndex("idx_ratelimit_counter_created", "counter", "created").Error; err != nil {
+			return errors.New("Unable to add index idx_ratelimit_counter_created on table rate_limit_events - " + err.Error())
+		}
+	}
+
 	return nil
 }
 
 // AutoMigrateDB will keep tables reflecting structs
 func AutoMigrateDB(DB *gorm.DB) error {
 	// if tables exists check if they reflects struts
-	if err := DB.AutoMigrate(&User{}, &Alias{}, &RcptHost{}, &RelayIpOk{}, &QMessage{}, &Route{}, &DkimConfig{}).Error; err != nil {
+	if err := DB.AutoMigrate(&User{}, &Alias{}, &RcptHost{}, &RelayIpOk{}, &QMessage{}, &Route{}, &DkimConfig{}, &TLSRPTResult{}, &DMARCResult{}, &GreylistEntry{}, &RateLimitEvent{}).Error; err != nil {
 		return errors.New("Unable autoMigrateDB - " + err.Error())
 	}
 	return nil
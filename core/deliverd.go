@@ -20,6 +20,9 @@ func New() *deliverd {
 
 // LaunchDeliverd launch deliverd
 func LaunchDeliverd() {
+	if err := checkRetrySchedules(); err != nil {
+		log.Fatalln(err)
+	}
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	cfg := nsq.NewConfig()
@@ -56,6 +59,12 @@ func LaunchDeliverd() {
 
 	Logger.Info("deliverd launched")
 
+	// sync DB queue and nsqd
+	go LaunchQueueJanitor()
+
+	// TLS reporting
+	go LaunchTLSReporter()
+
 	for {
 		select {
 		case <-consumer.StopChan:
@@ -1,19 +1,14 @@
 package core
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"math/rand"
-	"path"
+	"io"
 	"runtime/debug"
-	"text/template"
 	"time"
 
 	"github.com/jinzhu/gorm"
 	"github.com/nsqio/go-nsq"
-	"github.com/teamnsrg/tmail/message"
 )
 
 // Delivery is a deliver process
@@ -21,14 +16,17 @@ type Delivery struct {
 	ID                     string
 	NSQMsg                 *nsq.Message
 	QMsg                   *QMessage
-	RawData                *[]byte
+	RawData                io.ReadCloser // raw message from store (can only be read once)
 	QStore                 Storer
 	StartAt                time.Time
 	IsLocal                bool
 	LocalAddr              string
 	RemoteRoutes           []Route
+	RequireTLS             bool          // STARTTLS with a verified certificate is required (MTA-STS)
+	MTASTSPolicy           *mtastsPolicy // MTA-STS policy of recipient domain (if any)
 	RemoteAddr             string
 	RemoteSMTPresponseCode int
+	RemoteSMTPresponseMsg  string
 	Success                bool
 }
 
@@ -97,6 +95,15 @@ func (d *Delivery) processMsg() {
 		return
 	}
 
+	// Too early ? (eg message republished after a nsqd restart)
+	if d.QMsg.Status == 2 {
+		if wait := d.QMsg.NextDeliveryScheduledAt.Sub(time.Now()); wait > time.Second {
+			Logger.Debug(fmt.Sprintf("deliverd %s : queued message %s is scheduled for %v, requeued", d.ID, d.QMsg.Uuid, d.QMsg.NextDeliveryScheduledAt))
+			d.NSQMsg.RequeueWithoutBackoff(nsqRequeueDelay(wait))
+			return
+		}
+	}
+
 	// Discard ?
 	if d.QMsg.Status == 1 {
 		d.QMsg.Status = 0
@@ -111,8 +118,21 @@ func (d *Delivery) processMsg() {
 	}
 
 	// update status to: delivery in progress
-	d.QMsg.Status = 0
-	d.QMsg.SaveInDb()
+	// the claim is atomic as the message may be processed at the same time by
+	// another process (eg: duplicate republished by the queue janitor)
+	now := time.Now()
+	res := DB.Model(&QMessage{}).Where("id = ? AND status = ?", d.QMsg.Id, d.QMsg.Status).Updates(map[string]interface{}{"status": 0, "last_update": now})
+	if res.Error != nil {
+		Logger.Error(fmt.Sprintf("deliverd %s : unable to mark queued message %s as being in delivery - %s", d.ID, d.QMsg.Uuid, res.Error))
+		d.requeue()
+		return
+	}
+	if res.RowsAffected != 1 {
+		Logger.Info(fmt.Sprintf("deliverd %s : queued message %s has been claimed by another process", d.ID, d.QMsg.Uuid))
+		d.NSQMsg.RequeueWithoutBackoff(time.Duration(600 * time.Second))
+		return
+	}
+	d.QMsg.Status, d.QMsg.LastUpdate = 0, now
 
 	// {"Id":7,"Key":"7f88b72858ae57c17b6f5e89c1579924615d7876","MailFrom":"toorop@toorop.fr",
 	// "RcptTo":"toorop@toorop.fr","Host":"toorop.fr","AddedAt":"2014-12-02T09:05:59.342268145+01:00",
@@ -131,21 +151,14 @@ func (d *Delivery) processMsg() {
 		return
 	}
 	//d.QStore = QStore
-	dataReader, err := d.QStore.Get(d.QMsg.Uuid)
+	// get RawData (message is streamed from the store, never fully loaded)
+	d.RawData, err = d.QStore.Get(d.QMsg.Uuid)
 	if err != nil {
 		Logger.Error("unable to retrieve raw mail from store. " + err.Error())
 		d.dieTemp("unable to retrieve raw mail from store", false)
 		return
 	}
-
-	// get RawData
-	t, err := ioutil.ReadAll(dataReader)
-	if err != nil {
-		Logger.Error("unable to read raw mail from dataReader. " + err.Error())
-		d.dieTemp("unable to read raw mail from dataReader", false)
-		return
-	}
-	d.RawData = &t
+	defer d.RawData.Close()
 
 	// Bounce  ?
 	if flagBounce {
@@ -176,7 +189,7 @@ func (d *Delivery) dieOk() {
 	if err := d.QMsg.Delete(); err != nil {
 		Logger.Error("deliverd " + d.ID + ": unable remove queued message " + d.QMsg.Uuid + " from queue." + err.Error())
 	}
-	d.NSQMsg.Finish()
+	d.nsqFinish()
 }
 
 // dieTemp die when a 4** error occured
@@ -192,6 +205,7 @@ func (d *Delivery) dieTemp(msg string, logit bool) {
 	}
 
 	if time.Since(d.QMsg.AddedAt) < time.Duration(Cfg.GetDeliverdQueueLifetime())*time.Minute {
+		d.warnDelay(msg)
 		d.requeue()
 		return
 	}
@@ -199,6 +213,44 @@ func (d *Delivery) dieTemp(msg string, logit bool) {
 	d.diePerm(msg, logit)
 }
 
+// warnDelay sends a delayed delivery warning to sender if message has been
+// in queue for longer than the next configured delay
+// warnings sent are saved in QMsg by requeue
+func (d *Delivery) warnDelay(msg string) {
+	// never for bounces
+	if d.QMsg.MailFrom == "" || d.QMsg.MailFrom == "#@[]" {
+		return
+	}
+	// RFC 3461 4.1: without NOTIFY we may send delay warnings
+	if d.QMsg.DSNNotify != "" && !d.QMsg.dsnNotify("DELAY") {
+		return
+	}
+	delays := Cfg.GetDeliverdDelayWarnings()
+	// NOTIFY=DELAY without configured warnings: warn once on first failure
+	if len(delays) == 0 && d.QMsg.DSNNotify != "" {
+		delays = []time.Duration{0}
+	}
+	// count thresholds reached
+	reached := uint32(0)
+	queuedFor := time.Since(d.QMsg.AddedAt)
+	for _, delay := range delays {
+		if queuedFor >= delay {
+			reached++
+		}
+	}
+	if reached <= d.QMsg.DelayWarningsSent {
+		return
+	}
+	id, err := d.sendDeliveryReport("delayed", msg)
+	if err != nil {
+		Logger.Error("deliverd " + d.ID + ": unable to queue delay warning for message queued as " + d.QMsg.Uuid + " " + err.Error())
+		return
+	}
+	Logger.Info(fmt.Sprintf("deliverd %s: message queued as %s is delayed for %s, warning queued with id %s", d.ID, d.QMsg.Uuid, queuedFor.String(), id))
+	// if several thresholds have been reached only one warning is sent
+	d.QMsg.DelayWarningsSent = reached
+}
+
 // diePerm when a 5** error occured
 func (d *Delivery) diePerm(msg string, logit bool) {
 	if logit {
@@ -216,7 +268,7 @@ func (d *Delivery) discard() {
 		Logger.Error("deliverd " + d.ID + ": unable remove message queued as " + d.QMsg.Uuid + " from queue. " + err.Error())
 		d.requeue(1)
 	} else {
-		d.NSQMsg.Finish()
+		d.nsqFinish()
 	}
 	return
 }
@@ -230,7 +282,7 @@ func (d *Delivery) bounce(errMsg string) {
 			Logger.Error("deliverd " + d.ID + ": unable remove message queued as " + d.QMsg.Uuid + " from queue. " + err.Error())
 			d.requeue(1)
 		} else {
-			d.NSQMsg.Finish()
+			d.nsqFinish()
 		}
 		return
 	}
@@ -242,65 +294,20 @@ func (d *Delivery) bounce(errMsg string) {
 			Logger.Error("deliverd " + d.ID + ": unable remove message " + d.QMsg.Uuid + " from queue. " + err.Error())
 			d.requeue(1)
 		} else {
-			d.NSQMsg.Finish()
+			d.nsqFinish()
 		}
 		return
 	}
 
-	type templateData struct {
-		Date        string
-		Me          string
-		RcptTo      string
-		OriRcptTo   string
-		ErrMsg      string
-		BouncedMail string
-	}
-
-	// Si ça bounce car le mail a disparu de la queue:
-	if d.RawData == nil {
-		t := []byte("Raw mail was not found in the store")
-		d.RawData = &t
-	}
-
-	tData := templateData{time.Now().Format(Time822), Cfg.GetMe(), d.QMsg.MailFrom, d.QMsg.RcptTo, errMsg, string(*d.RawData)}
-	t, err := template.ParseFiles(path.Join(GetBasePath(), "tpl/bounce.tpl"))
-	if err != nil {
-		Logger.Error("deliverd " + d.ID + ": unable to bounce message queued as " + d.QMsg.Uuid + " " + err.Error())
-		d.requeue(3)
-		return
-	}
-
-	bouncedMailBuf := new(bytes.Buffer)
-	err = t.Execute(bouncedMailBuf, tData)
-	if err != nil {
-		Logger.Error("deliverd " + d.ID + ": unable to bounce message queued as " + d.QMsg.Uuid + " " + err.Error())
-		d.requeue(3)
-		return
-	}
-	b, err := ioutil.ReadAll(bouncedMailBuf)
-	if err != nil {
-		Logger.Error("deliverd " + d.ID + ": unable to bounce message queued as " + d.QMsg.Uuid + " " + err.Error())
-		d.requeue(3)
-		return
-	}
-
-	// unix2dos it
-	err = Unix2dos(&b)
-	if err != nil {
-		Logger.Error("deliverd " + d.ID + ": unable to convert bounce from unix to dos. " + err.Error())
-		d.requeue(3)
+	// NOTIFY=NEVER (or without FAILURE)
+	if !d.QMsg.dsnNotify("FAILURE") {
+		Logger.Info("deliverd " + d.ID + ": message from: " + d.QMsg.MailFrom + " to: " + d.QMsg.RcptTo + " failed, sender does not want to be notified (NOTIFY=" + d.QMsg.DSNNotify + "): discarding")
+		d.discard()
 		return
 	}
 
-	// enqueue
-	envelope := message.Envelope{MailFrom: "", RcptTo: []string{d.QMsg.MailFrom}}
-	/*message, err := message.New(&b)
-	if err != nil {
-		Logger.Error("deliverd " + d.ID + ": unable to bounce message " + d.QMsg.Key + " " + err.Error())
-		d.requeue(3)
-		return
-	}*/
-	id, err := QueueAddMessage(&b, envelope, "")
+	// multipart/report (RFC 3464)
+	id, err := d.sendDeliveryReport("failed", errMsg)
 	if err != nil {
 		Logger.Error("deliverd " + d.ID + ": unable to bounce message queued as " + d.QMsg.Uuid + " " + err.Error())
 		d.requeue(3)
@@ -311,7 +318,7 @@ func (d *Delivery) bounce(errMsg string) {
 		Logger.Error("deliverd " + d.ID + ": unable remove bounced message queued as " + d.QMsg.Uuid + " from queue. " + err.Error())
 		d.requeue(1)
 	} else {
-		d.NSQMsg.Finish()
+		d.nsqFinish()
 	}
 
 	Logger.Info("deliverd " + d.ID + ": message from: " + d.QMsg.MailFrom + " to: " + d.QMsg.RcptTo + " queued with id " + id + " for being bounced.")
@@ -332,21 +339,28 @@ func (d *Delivery) requeue(newStatus ...uint32) {
 	//if d.QMsg.Status == 1 || d.QMsg.Status == 3 {
 	//	return
 	//}
-	// Calcul du delais, pour le moment on accroit betement de 60 secondes a chaque tentative
-	// + random
-	rand.Seed(rand.Int63())
-	delay := time.Duration(d.NSQMsg.Attempts*uint16(rand.Intn(180)+60)) * time.Second
-	if delay >= time.Hour {
-		delay = time.Duration(rand.Intn(2000)+1599) * time.Second
-	}
-	// Todo update next delivery en DB
+	// delay is computed from failures count saved in DB, not from NSQ
+	// attempts, so the schedule survives a nsqd restart
+	if status == 2 {
+		d.QMsg.DeliveryFailedCount++
+	}
+	delay := getRetryPolicy(d.QMsg.Host).delay(d.QMsg.DeliveryFailedCount)
 	d.QMsg.NextDeliveryScheduledAt = time.Now().Add(delay)
 	d.QMsg.Status = status
 	d.QMsg.SaveInDb() // Todo: check error
-	d.NSQMsg.RequeueWithoutBackoff(delay)
+	d.nsqRequeue(delay)
 	return
 }
 
+// postpone requeues the message without counting a delivery failure
+// (eg: max connections to remote host reached)
+func (d *Delivery) postpone(delay time.Duration) {
+	d.QMsg.NextDeliveryScheduledAt = time.Now().Add(delay)
+	d.QMsg.Status = 2
+	d.QMsg.SaveInDb()
+	d.nsqRequeue(delay)
+}
+
 // handleSmtpError handles SMTP error response
 func (d *Delivery) handleSMTPError(code int, message string) {
 	if code > 499 {
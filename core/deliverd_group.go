@@ -0,0 +1,118 @@
+package core
+
+// Grouped delivery
+// recipients of a message (same Uuid) which share the same route are
+// delivered in one SMTP transaction (one MAIL FROM, several RCPT TO, one DATA)
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// routesKey returns a key identifying routes
+func routesKey(routes []Route) string {
+	key := ""
+	for _, r := range routes {
+		key += r.LocalIp.String + "|" + r.RemoteHost + "|" + strconv.FormatInt(r.RemotePort.Int64, 10) + "|" + r.SmtpAuthLogin.String + "|" + routeTLSKey(r) + ";"
+	}
+	return key
+}
+
+// claimGroupedRecipients claims (status 2 -> 0) other recipients of the
+// message, due for delivery and sharing routes of d, and returns deliveries
+// for them. At most max-1 recipients are claimed.
+// Grouped deliveries have no NSQ message: their own NSQ message, if it comes
+// while they are being delivered, is requeued by processMsg (status 0) and
+// will find them delivered (discard) or rescheduled
+func (d *Delivery) claimGroupedRecipients(max int) (group []*Delivery) {
+	if max < 2 {
+		return
+	}
+	candidates := []QMessage{}
+	err := DB.Where("uuid = ? AND id <> ? AND status = ? AND next_delivery_scheduled_at <= ?", d.QMsg.Uuid, d.QMsg.Id, 2, time.Now()).Limit(max - 1).Find(&candidates).Error
+	if err != nil {
+		Logger.Error(fmt.Sprintf("deliverd-remote %s - unable to get other recipients of message %s - %s", d.ID, d.QMsg.Uuid, err))
+		return
+	}
+	key := routesKey(d.RemoteRoutes) + strconv.FormatBool(d.RequireTLS)
+	// routes by host
+	hostKeys := map[string]string{d.QMsg.Host: key}
+	for i := range candidates {
+		m := &candidates[i]
+		hostKey, ok := hostKeys[m.Host]
+		if !ok {
+			routes, err := getRoutes(m.MailFrom, m.Host, m.AuthUser)
+			if err != nil {
+				Logger.Debug(fmt.Sprintf("deliverd-remote %s - unable to get routes for %s - %s", d.ID, m.Host, err))
+			}
+			// MTA-STS policy of host must lead to the same routes
+			routes, policy, err := applyMTASTS(m.Host, routes)
+			if err != nil {
+				Logger.Debug(fmt.Sprintf("deliverd-remote %s - %s", d.ID, err))
+			}
+			hostKey = routesKey(routes) + strconv.FormatBool(policy.enforced())
+			hostKeys[m.Host] = hostKey
+		}
+		if hostKey != key {
+			continue
+		}
+		// claim
+		res := DB.Model(&QMessage{}).Where("id = ? AND status = ?", m.Id, 2).Updates(map[string]interface{}{"status": 0, "last_update": time.Now()})
+		if res.Error != nil || res.RowsAffected != 1 {
+			continue
+		}
+		m.Status = 0
+		group = append(group, &Delivery{
+			ID:           d.ID,
+			QMsg:         m,
+			QStore:       d.QStore,
+			StartAt:      d.StartAt,
+			RemoteRoutes: d.RemoteRoutes,
+			RequireTLS:   d.RequireTLS,
+			MTASTSPolicy: d.MTASTSPolicy,
+			RemoteAddr:   d.RemoteAddr,
+			LocalAddr:    d.LocalAddr,
+		})
+	}
+	if len(group) != 0 {
+		Logger.Info(fmt.Sprintf("deliverd-remote %s - %d other recipients of message %s grouped in this transaction", d.ID, len(group), d.QMsg.Uuid))
+	}
+	return
+}
+
+// setGroupRemoteResponse sets remote SMTP reply for each delivery of group
+func setGroupRemoteResponse(group []*Delivery, code int, msg string) {
+	for _, d := range group {
+		d.RemoteSMTPresponseCode = code
+		d.RemoteSMTPresponseMsg = msg
+	}
+}
+
+// handleGroupSMTPError handles SMTP error for each delivery of group
+func handleGroupSMTPError(group []*Delivery, code int, message string) {
+	for _, d := range group {
+		d.handleSMTPError(code, message)
+	}
+}
+
+// dieTempGroup handles temp failure for each delivery of group
+func dieTempGroup(group []*Delivery, message string) {
+	for _, d := range group {
+		d.dieTemp(message, false)
+	}
+}
+
+// nsqFinish finishes NSQ message of d (if any)
+func (d *Delivery) nsqFinish() {
+	if d.NSQMsg != nil {
+		d.NSQMsg.Finish()
+	}
+}
+
+// nsqRequeue requeues NSQ message of d (if any)
+func (d *Delivery) nsqRequeue(delay time.Duration) {
+	if d.NSQMsg != nil {
+		d.NSQMsg.RequeueWithoutBackoff(nsqRequeueDelay(delay))
+	}
+}
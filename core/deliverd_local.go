@@ -1,7 +1,6 @@
 package core
 
 import (
-	"bytes"
 	"fmt"
 	"io"
 	"os/exec"
@@ -17,7 +16,6 @@ import (
 
 // deliverLocal handle local delivery
 func deliverLocal(d *Delivery) {
-	var dataBuf *bytes.Buffer
 	mailboxAvailable := false
 	localRcpt := []string{}
 
@@ -64,8 +62,6 @@ func deliverLocal(d *Delivery) {
 				// 0: OK
 				// 4: temp fail
 				// 5: perm fail
-				dataBuf := bytes.NewBuffer(*d.RawData)
-
 				cmd := exec.Command(strings.Join(strings.Split(alias.Pipe, " "), ","))
 				stdin, err := cmd.StdinPipe()
 				if err != nil {
@@ -79,7 +75,7 @@ func deliverLocal(d *Delivery) {
 					d.dieTemp(fmt.Sprintf("delivery-local %s: unable to exec pipe  %s. %s", d.ID, alias.Pipe, err.Error()), true)
 					return
 				}
-				_, err = io.Copy(stdin, dataBuf)
+				_, err = io.Copy(stdin, d.RawData)
 				if err != nil {
 					d.dieTemp(fmt.Sprintf("delivery-local %s: unable to pipe mail to cmd %s. %s", d.ID, alias.Pipe, err.Error()), true)
 					return
@@ -121,13 +117,57 @@ func deliverLocal(d *Delivery) {
 				// rem: no minilist for domainAlias
 				if enveloppe.MailFrom != "" && alias.IsMiniList && !alias.IsDomAlias {
 					enveloppe.MailFrom = alias.Alias
+				} else {
+					// RFC 3461 6.2.7.1: DSN parameters are passed on to aliased rcpt
+					orcpt := d.QMsg.DSNOrcpt
+					if orcpt == "" {
+						orcpt = "rfc822;" + xtextEncode(d.QMsg.RcptTo)
+					}
+					enveloppe.DSNRet = d.QMsg.DSNRet
+					enveloppe.DSNEnvID = d.QMsg.DSNEnvID
+					enveloppe.DSNRcpt = make(map[string]message.RcptDSN)
+					for _, rcpt := range localRcpt {
+						enveloppe.DSNRcpt[rcpt] = message.RcptDSN{Notify: d.QMsg.DSNNotify, Orcpt: orcpt}
+					}
+				}
+				// if there was a pipe RawData has already been read
+				rawData := io.Reader(d.RawData)
+				if alias.Pipe != "" {
+					r, err := d.QStore.Get(d.QMsg.Uuid)
+					if err != nil {
+						d.dieTemp(fmt.Sprintf("delivery-local %s: unable to retrieve raw mail from store: %s", d.ID, err), true)
+						return
+					}
+					defer r.Close()
+					rawData = r
+				}
+				// ARC: message is read from store to be sealed, ARC set is
+				// prepended to it
+				if Cfg.GetDeliverdARCSeal() && len(localDom) == 2 {
+					r, err := d.QStore.Get(d.QMsg.Uuid)
+					if err != nil {
+						d.dieTemp(fmt.Sprintf("delivery-local %s: unable to retrieve raw mail from store: %s", d.ID, err), true)
+						return
+					}
+					set, err := SealARC(r, strings.ToLower(localDom[1]))
+					r.Close()
+					if err != nil {
+						Logger.Info(fmt.Sprintf("delivery-local %s: message not ARC sealed - %s", d.ID, err))
+					} else {
+						rawData = io.MultiReader(strings.NewReader(set), rawData)
+					}
 				}
-				uuid, err := QueueAddMessage(d.RawData, enveloppe, "")
+				uuid, err := QueueAddMessage(rawData, enveloppe, "")
 				if err != nil {
 					d.dieTemp(fmt.Sprintf("delivery-local %s: unable to requeue aliased msg: %s", d.ID, err), true)
 					return
 				}
 				Logger.Info(fmt.Sprintf("delivery-local %s: rcpt is an alias, mail is requeue with ID %s for final rcpt: %s", d.ID, uuid, strings.Join(localRcpt, " ")))
+				if enveloppe.MailFrom != d.QMsg.MailFrom {
+					d.notifySuccess("expanded")
+				}
+			} else {
+				d.notifySuccess("delivered")
 			}
 			d.dieOk()
 			return
@@ -146,16 +186,17 @@ func deliverLocal(d *Delivery) {
 	// TODO Remove return path
 	//msg.DelHeader("return-path")
 
-	// Received
-	*d.RawData = append([]byte("Received: tmail deliverd local "+d.ID+"; "+time.Now().Format(Time822)+"\r\n"), *d.RawData...)
+	// headers are prepended to message read from store
+	// Return path
+	headers := "Return-Path: " + d.QMsg.MailFrom + "\r\n"
 
 	// Delivered-To
-	*d.RawData = append([]byte("Delivered-To: "+deliverTo+"\r\n"), *d.RawData...)
+	headers += "Delivered-To: " + deliverTo + "\r\n"
 
-	// Return path
-	*d.RawData = append([]byte("Return-Path: "+d.QMsg.MailFrom+"\r\n"), *d.RawData...)
+	// Received
+	headers += "Received: tmail deliverd local " + d.ID + "; " + time.Now().Format(Time822) + "\r\n"
 
-	dataBuf = bytes.NewBuffer(*d.RawData)
+	dataBuf := io.MultiReader(strings.NewReader(headers), d.RawData)
 
 	cmd := exec.Command(Cfg.GetDovecotLda(), "-d", deliverTo)
 	stdin, err := cmd.StdinPipe()
@@ -203,5 +244,6 @@ func deliverLocal(d *Delivery) {
 	}
 	Logger.Info(fmt.Sprintf("delivery-local %s: delivered to %s", d.ID, deliverTo))
 
+	d.notifySuccess("delivered")
 	d.dieOk()
 }
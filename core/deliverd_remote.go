@@ -1,24 +1,26 @@
 package core
 
 import (
-	"bytes"
 	"crypto/tls"
 	"fmt"
 	"io"
 	"strings"
 	"time"
-
-	"github.com/toorop/go-dkim"
 )
 
+// bdatChunkSize is the max size of a chunk sent via BDAT
+const bdatChunkSize = 1 << 20
+
 func deliverRemote(d *Delivery) {
 	var err error
 	ChDeliverdConcurrencyRemoteCount <- 1
 	defer func() { ChDeliverdConcurrencyRemoteCount <- -1 }()
 
 	// > concurrency remote ?
+	// not a delivery failure, we will try later
 	if DeliverdConcurrencyRemoteCount >= Cfg.GetDeliverdConcurrencyRemote() {
-		d.requeue()
+		Logger.Debug(fmt.Sprintf("deliverd-remote %s - max remote concurrency reached, postponed", d.ID))
+		d.postpone(time.Minute)
 		return
 	}
 
@@ -54,14 +56,268 @@ func deliverRemote(d *Delivery) {
 		return
 	}
 
-	// Get client
+	// MTA-STS
+	d.RemoteRoutes, d.MTASTSPolicy, err = applyMTASTS(d.QMsg.Host, d.RemoteRoutes)
+	if err != nil {
+		d.recordTLSResult(nil, nil, "validation-failure", "no MX allowed by MTA-STS policy")
+		d.dieTemp(err.Error(), true)
+		return
+	}
+	d.RequireTLS = d.MTASTSPolicy.enforced()
+
+	// throttling
+	if ok, retryIn := throttle.acquire(d.QMsg.Host); !ok {
+		Logger.Info(fmt.Sprintf("deliverd-remote %s - delivery to %s throttled, postponed for %v", d.ID, d.QMsg.Host, retryIn))
+		d.postpone(retryIn)
+		return
+	}
+	defer func() {
+		throttle.release(d.QMsg.Host, d.RemoteSMTPresponseCode, d.RemoteSMTPresponseMsg)
+	}()
+
+	// Get client: an idle one from pool or a new one
+	client := smtpPool.get(d.RemoteRoutes, d.RequireTLS)
+	if client != nil {
+		d.RemoteAddr = client.RemoteAddr()
+		d.LocalAddr = client.LocalAddr()
+		Logger.Info(fmt.Sprintf("deliverd-remote %s - %s - reusing connection (%d messages already sent)", d.ID, client.RemoteAddr(), client.messages))
+	} else {
+		var ok bool
+		if client, ok = newRemoteClient(d); !ok {
+			return
+		}
+	}
+	// if transaction ends properly client is put back in pool
+	reuse := false
+	defer func() {
+		if reuse {
+			smtpPool.put(client)
+		} else {
+			client.close()
+		}
+	}()
+
+	// recipients delivered in this transaction
+	group := append([]*Delivery{d}, d.claimGroupedRecipients(Cfg.GetDeliverdRemoteMaxRcpt())...)
+
+	// MAIL FROM
+	mailParams := []string{}
+	if d.QMsg.Body != "" {
+		if ok, _ := client.Extension("8BITMIME"); ok {
+			mailParams = append(mailParams, "BODY="+d.QMsg.Body)
+		} else if d.QMsg.Body == "8BITMIME" {
+			// RFC 6152 3: 8bit data must not be sent to a server which
+			// doesn't support 8BITMIME (we don't downgrade)
+			for _, rd := range group {
+				rd.diePerm(fmt.Sprintf("deliverd-remote %s - %s - remote server does not support 8BITMIME, needed for %s -> %s", d.ID, client.RemoteAddr(), rd.QMsg.MailFrom, rd.QMsg.RcptTo), true)
+			}
+			return
+		}
+	}
+	if d.QMsg.SMTPUTF8 {
+		if ok, _ := client.Extension("SMTPUTF8"); ok {
+			mailParams = append(mailParams, "SMTPUTF8")
+		} else {
+			// RFC 6531 3.2: we can't downgrade non ASCII addresses
+			downgradable := []*Delivery{}
+			for _, rd := range group {
+				if !isASCII(rd.QMsg.MailFrom) || !isASCII(rd.QMsg.RcptTo) {
+					rd.diePerm(fmt.Sprintf("deliverd-remote %s - %s - remote server does not support SMTPUTF8, needed for %s -> %s", d.ID, client.RemoteAddr(), rd.QMsg.MailFrom, rd.QMsg.RcptTo), true)
+					continue
+				}
+				downgradable = append(downgradable, rd)
+			}
+			if len(downgradable) == 0 {
+				return
+			}
+			group = downgradable
+		}
+	}
+	// DSN (RFC 3461) are passed to remote server if it supports them
+	remoteDSN, _ := client.Extension("DSN")
+	if remoteDSN {
+		if d.QMsg.DSNRet != "" {
+			mailParams = append(mailParams, "RET="+d.QMsg.DSNRet)
+		}
+		if d.QMsg.DSNEnvID != "" {
+			mailParams = append(mailParams, "ENVID="+d.QMsg.DSNEnvID)
+		}
+	}
+	code, msg, err := client.Mail(d.QMsg.MailFrom, mailParams...)
+	if err != nil {
+		message := fmt.Sprintf("deliverd-remote %s - %s - MAIL FROM %s failed %s - %s", d.ID, client.RemoteAddr(), d.QMsg.MailFrom, msg, err)
+		Logger.Error(message)
+		setGroupRemoteResponse(group, code, msg)
+		handleGroupSMTPError(group, code, message)
+		return
+	}
+
+	// RCPT TO
+	// each recipient reply is handled on its own, accepted recipients
+	// are kept in group
+	accepted := []*Delivery{}
+	for i, rd := range group {
+		rcptParams := []string{}
+		if remoteDSN {
+			if rd.QMsg.DSNNotify != "" {
+				rcptParams = append(rcptParams, "NOTIFY="+rd.QMsg.DSNNotify)
+			}
+			orcpt := rd.QMsg.DSNOrcpt
+			if orcpt == "" {
+				orcpt = "rfc822;" + xtextEncode(rd.QMsg.RcptTo)
+			}
+			rcptParams = append(rcptParams, "ORCPT="+orcpt)
+		}
+		code, msg, err = client.Rcpt(rd.QMsg.RcptTo, rcptParams...)
+		rd.RemoteSMTPresponseCode = code
+		rd.RemoteSMTPresponseMsg = msg
+		if err != nil {
+			message := fmt.Sprintf("deliverd-remote %s - %s - RCPT TO %s failed - %s - %s", d.ID, client.RemoteAddr(), rd.QMsg.RcptTo, msg, err)
+			Logger.Error(message)
+			// no reply (timeout, connection lost,...): transaction is aborted
+			if code == 0 {
+				dieTempGroup(append(accepted, group[i:]...), message)
+				return
+			}
+			rd.handleSMTPError(code, message)
+			continue
+		}
+		accepted = append(accepted, rd)
+	}
+	if len(accepted) == 0 {
+		reuse = true
+		return
+	}
+	group = accepted
+
+	// add Received headers
+	var rawData io.Reader
+	rawData = io.MultiReader(strings.NewReader("Received: tmail deliverd remote "+d.ID+"; "+time.Now().Format(Time822)+"\r\n"), d.RawData)
+
+	// DKIM ?
+	if Cfg.GetDeliverdDkimSign() {
+		userDomain := strings.SplitN(d.QMsg.MailFrom, "@", 2)
+		if len(userDomain) == 2 {
+			dkc, err := DkimGetConfig(userDomain[1])
+			if err != nil {
+				message := "deliverd-remote " + d.ID + " - unable to get DKIM config for domain " + userDomain[1] + " - " + err.Error()
+				Logger.Error(message)
+				dieTempGroup(group, message)
+				return
+			}
+			if dkc != nil {
+				Logger.Debug(fmt.Sprintf("deliverd-remote %s: add dkim sign", d.ID))
+				// message is read from store to be signed, signature is
+				// prepended to it
+				r, err := d.QStore.Get(d.QMsg.Uuid)
+				if err != nil {
+					message := "deliverd-remote " + d.ID + " - unable to read raw mail from store - " + err.Error()
+					Logger.Error(message)
+					dieTempGroup(group, message)
+					return
+				}
+				sig, err := DKIMSign(r, userDomain[1], dkc)
+				r.Close()
+				if err != nil {
+					Logger.Error("deliverd-remote " + d.ID + " - unable to DKIM sign message - " + err.Error())
+				} else {
+					rawData = io.MultiReader(strings.NewReader(sig), rawData)
+				}
+				Logger.Debug(fmt.Sprintf("deliverd-remote %s: end dkim sign", d.ID))
+			}
+		}
+	}
+
+	// CHUNKING (RFC 3030) ?
+	if ok, _ := client.Extension("CHUNKING"); ok {
+		code, msg, err = client.Bdat(rawData, bdatChunkSize)
+		setGroupRemoteResponse(group, code, msg)
+		Logger.Info(fmt.Sprintf("deliverd-remote %s - %s - reply to BDAT cmd: %d - %s - %v", d.ID, client.RemoteAddr(), code, msg, err))
+		if err != nil {
+			message := fmt.Sprintf("deliverd-remote %s - %s - BDAT command failed - %d - %s - %s", d.ID, client.RemoteAddr(), code, msg, err)
+			Logger.Error(message)
+			if code == 0 {
+				dieTempGroup(group, message)
+			} else {
+				handleGroupSMTPError(group, code, message)
+			}
+			return
+		}
+	} else {
+		// DATA
+		dataPipe, code, msg, err := client.Data()
+		setGroupRemoteResponse(group, code, msg)
+		if err != nil {
+			message := fmt.Sprintf("deliverd-remote %s - %s - DATA command failed - %s - %s", d.ID, client.RemoteAddr(), msg, err)
+			Logger.Error(message)
+			handleGroupSMTPError(group, code, message)
+			return
+		}
+
+		_, err = io.Copy(dataPipe, rawData)
+		if err != nil {
+			message := "deliverd-remote " + d.ID + " - " + client.RemoteAddr() + " - unable to copy dataBuf to dataPipe DKIM config for domain " + " - " + err.Error()
+			Logger.Error(message)
+			dieTempGroup(group, message)
+			return
+		}
+
+		dataPipe.WriteCloser.Close()
+		code, msg, err = dataPipe.s.text.ReadResponse(-1)
+		setGroupRemoteResponse(group, code, msg)
+		Logger.Info(fmt.Sprintf("deliverd-remote %s - %s - reply to DATA cmd: %d - %s - %v", d.ID, client.RemoteAddr(), code, msg, err))
+		if err != nil {
+			message := fmt.Sprintf("deliverd-remote %s - %s - DATA command failed - %s - %s", d.ID, client.RemoteAddr(), msg, err)
+			Logger.Error(message)
+			dieTempGroup(group, message)
+			return
+		}
+
+		if code != 250 {
+			message := fmt.Sprintf("deliverd-remote %s - %s - DATA command failed - %d - %s", d.ID, client.RemoteAddr(), code, msg)
+			Logger.Error(message)
+			handleGroupSMTPError(group, code, message)
+			return
+		}
+	}
+
+	reuse = true
+	// RFC 3461 4.1: if remote server doesn't support DSN we are the last
+	// MTA able to honor NOTIFY=SUCCESS
+	for _, rd := range group {
+		if !remoteDSN {
+			rd.notifySuccess("relayed")
+		}
+		rd.dieOk()
+	}
+}
+
+// newRemoteClient returns a new SMTP client ready to send a message
+// (EHLO, STARTTLS and AUTH done)
+// if ok is false delivery has been handled (failure or postponed)
+func newRemoteClient(d *Delivery) (client *smtpClient, ok bool) {
 	client, err := newSMTPClient(d, d.RemoteRoutes, Cfg.GetDeliverdRemoteTimeout())
 	if err != nil {
 		Logger.Error(fmt.Sprintf("deliverd-remote %s - %s", d.ID, err.Error()))
+		if err == errRemoteHostsBusy {
+			// not a failure, we will try later
+			d.postpone(time.Minute)
+			return
+		}
+		if _, isDANE := err.(*daneLookupError); isDANE {
+			d.recordTLSResult(nil, nil, "tlsa-invalid", err.Error())
+			d.dieTemp(fmt.Sprintf("deliverd-remote %s - %s", d.ID, err), true)
+			return
+		}
 		d.dieTemp("unable to get client", false)
 		return
 	}
-	defer client.close()
+	// client is closed if something goes wrong
+	defer func() {
+		if !ok && client != nil {
+			client.close()
+		}
+	}()
 
 	d.RemoteAddr = client.RemoteAddr()
 	d.LocalAddr = client.LocalAddr()
@@ -69,6 +325,7 @@ func deliverRemote(d *Delivery) {
 	// EHLO
 	code, msg, err := client.Hello()
 	d.RemoteSMTPresponseCode = code
+	d.RemoteSMTPresponseMsg = msg
 	if err != nil {
 		switch {
 		case code > 399 && code < 500:
@@ -86,17 +343,50 @@ func deliverRemote(d *Delivery) {
 	// 2013-06-22 14:19:30.670252500 delivery 196893: deferral: Sorry_but_i_don't_understand_SMTP_response_:_local_error:_unexpected_message_/
 	// 2013-06-18 10:08:29.273083500 delivery 856840: deferral: Sorry_but_i_don't_understand_SMTP_response_:_failed_to_parse_certificate_from_server:_negative_serial_number_/
 	// https://code.google.com/p/go/issues/detail?id=3930data
-	if ok, _ := client.Extension("STARTTLS"); ok {
-		var config tls.Config
-		config.InsecureSkipVerify = Cfg.GetDeliverdRemoteTLSSkipVerify()
-		//config.ServerName = Cfg.GetMe()
-		code, msg, err = client.StartTLS(&config)
+	// DANE: TLSA records of MX host (implicit TLS handshake has already
+	// checked server certificate against them)
+	daneRecords := client.daneRecords
+	// TLS mode of route ("" for global config)
+	routeTLS := client.route.TLSMode.String
+	requireTLS := d.RequireTLS || daneRecords != nil || routeTLS == routeTLSRequired || routeTLS == routeTLSVerify
+	if daneRecords != nil {
+		Logger.Info(fmt.Sprintf("deliverd-remote %s - %s - DANE: %d usable TLSA records for %s", d.ID, client.RemoteAddr(), len(daneRecords), client.route.RemoteHost))
+	}
+
+	// (skipped if TLS is implicit)
+	hasTLS, _ := client.Extension("STARTTLS")
+	if client.tls {
+		d.recordTLSResult(client, daneRecords, "", "")
+	} else if !hasTLS && daneRecords != nil {
+		d.recordTLSResult(client, daneRecords, "dane-required", "STARTTLS not supported")
+	} else if !hasTLS {
+		d.recordTLSResult(client, daneRecords, "starttls-not-supported", "")
+	}
+	if !hasTLS && requireTLS && !client.tls {
+		d.dieTemp(fmt.Sprintf("deliverd-remote %s - %s - STARTTLS not supported but required by route TLS mode, DANE or MTA-STS policy of %s", d.ID, client.RemoteAddr(), d.QMsg.Host), true)
+		return
+	}
+	// TLS required by DANE or MTA-STS overrides route TLS mode none
+	if hasTLS && (routeTLS != routeTLSNone || requireTLS) && !client.tls {
+		config, err := d.remoteTLSConfig(client.route, daneRecords)
+		if err != nil {
+			d.dieTemp(fmt.Sprintf("deliverd-remote %s - %s - bad TLS config for route %d - %s", d.ID, client.RemoteAddr(), client.route.Id, err), true)
+			return
+		}
+		code, msg, err = client.StartTLS(config)
 		d.RemoteSMTPresponseCode = code
+		d.RemoteSMTPresponseMsg = msg
 		// Warning debug
 		//err := fmt.Errorf("fake tls error")
 		if err != nil {
 			Logger.Info(fmt.Sprintf("deliverd-remote %s - %s - TLS negociation failed %d - %s - %v .", d.ID, client.conn.RemoteAddr().String(), code, msg, err))
-			if Cfg.GetDeliverdRemoteTLSFallback() {
+			fallback := !requireTLS && (routeTLS == routeTLSOpportunistic || (routeTLS == "" && Cfg.GetDeliverdRemoteTLSFallback()))
+			reason := err.Error()
+			if fallback {
+				reason = "fallback to plaintext - " + reason
+			}
+			d.recordTLSResult(client, daneRecords, tlsResultType(err, daneRecords != nil, d.MTASTSPolicy != nil), reason)
+			if fallback {
 				// fall back to noTLS
 				Logger.Info(fmt.Sprintf("deliverd-remote %s - %s - fallback to no TLS.", d.ID, client.conn.RemoteAddr().String()))
 				client.close()
@@ -106,7 +396,6 @@ func deliverRemote(d *Delivery) {
 					d.dieTemp("unable to get client", false)
 					return
 				}
-				defer client.close()
 				code, msg, err = client.Hello()
 				if err != nil {
 					switch {
@@ -128,6 +417,10 @@ func deliverRemote(d *Delivery) {
 			}
 		} else {
 			Logger.Info(fmt.Sprintf("deliverd-remote %s - %s - TLS negociation succeed - %s %s", d.ID, client.RemoteAddr(), client.TLSGetVersion(), client.TLSGetCipherSuite()))
+			d.recordTLSResult(client, daneRecords, "", "")
+			if daneRecords != nil {
+				Logger.Info(fmt.Sprintf("deliverd-remote %s - %s - DANE: server certificate verified", d.ID, client.RemoteAddr()))
+			}
 		}
 	}
 
@@ -150,93 +443,27 @@ func deliverRemote(d *Delivery) {
 			}
 		}
 	}
+	return client, true
+}
 
-	// MAIL FROM
-	code, msg, err = client.Mail(d.QMsg.MailFrom)
-	d.RemoteSMTPresponseCode = code
-	if err != nil {
-		message := fmt.Sprintf("deliverd-remote %s - %s - MAIL FROM %s failed %s - %s", d.ID, client.RemoteAddr(), d.QMsg.MailFrom, msg, err)
-		Logger.Error(message)
-		d.handleSMTPError(code, message)
-		return
-	}
-
-	// RCPT TO
-	code, msg, err = client.Rcpt(d.QMsg.RcptTo)
-	d.RemoteSMTPresponseCode = code
-	if err != nil {
-		message := fmt.Sprintf("deliverd-remote %s - %s - RCPT TO %s failed - %s - %s", d.ID, client.RemoteAddr(), d.QMsg.RcptTo, msg, err)
-		Logger.Error(message)
-		d.handleSMTPError(code, message)
-		return
-	}
-
-	// DATA
-	dataPipe, code, msg, err := client.Data()
-	d.RemoteSMTPresponseCode = code
-	if err != nil {
-		message := fmt.Sprintf("deliverd-remote %s - %s - DATA command failed - %s - %s", d.ID, client.RemoteAddr(), msg, err)
-		Logger.Error(message)
-		d.handleSMTPError(code, message)
-		return
-	}
-
-	// add Received headers
-	*d.RawData = append([]byte("Received: tmail deliverd remote "+d.ID+"; "+time.Now().Format(Time822)+"\r\n"), *d.RawData...)
-
-	// DKIM ?
-	if Cfg.GetDeliverdDkimSign() {
-		userDomain := strings.SplitN(d.QMsg.MailFrom, "@", 2)
-		if len(userDomain) == 2 {
-			dkc, err := DkimGetConfig(userDomain[1])
-			if err != nil {
-				message := "deliverd-remote " + d.ID + " - unable to get DKIM config for domain " + userDomain[1] + " - " + err.Error()
-				Logger.Error(message)
-				d.dieTemp(message, false)
-				return
-			}
-			if dkc != nil {
-				Logger.Debug(fmt.Sprintf("deliverd-remote %s: add dkim sign", d.ID))
-				dkimOptions := dkim.NewSigOptions()
-				dkimOptions.PrivateKey = []byte(dkc.PrivKey)
-				dkimOptions.AddSignatureTimestamp = true
-				dkimOptions.Domain = userDomain[1]
-				dkimOptions.Selector = dkc.Selector
-				dkimOptions.Headers = []string{"from", "subject", "date", "message-id"}
-				dkim.Sign(d.RawData, dkimOptions)
-				Logger.Debug(fmt.Sprintf("deliverd-remote %s: end dkim sign", d.ID))
-			}
-		}
-	}
-
-	dataBuf := bytes.NewBuffer(*d.RawData)
-	_, err = io.Copy(dataPipe, dataBuf)
-	if err != nil {
-		message := "deliverd-remote " + d.ID + " - " + client.RemoteAddr() + " - unable to copy dataBuf to dataPipe DKIM config for domain " + " - " + err.Error()
-		Logger.Error(message)
-		d.dieTemp(message, false)
-		return
-	}
-
-	dataPipe.WriteCloser.Close()
-	code, msg, err = dataPipe.s.text.ReadResponse(-1)
-	d.RemoteSMTPresponseCode = code
-	Logger.Info(fmt.Sprintf("deliverd-remote %s - %s - reply to DATA cmd: %d - %s - %v", d.ID, client.RemoteAddr(), code, msg, err))
+// remoteTLSConfig returns TLS config used to deliver via route: server
+// certificate is checked against TLSA records (DANE), must be valid for MX
+// host (MTA-STS) or is checked according to route TLS mode
+func (d *Delivery) remoteTLSConfig(route *Route, daneRecords []tlsaRecord) (*tls.Config, error) {
+	config, err := route.tlsConfig()
 	if err != nil {
-		message := fmt.Sprintf("deliverd-remote %s - %s - DATA command failed - %s - %s", d.ID, client.RemoteAddr(), msg, err)
-		Logger.Error(message)
-		d.dieTemp(message, false)
-		return
+		return nil, err
 	}
-
-	if code != 250 {
-		message := fmt.Sprintf("deliverd-remote %s - %s - DATA command failed - %d - %s", d.ID, client.RemoteAddr(), code, msg)
-		Logger.Error(message)
-		d.handleSMTPError(code, message)
-		return
+	switch {
+	case daneRecords != nil:
+		// certificate is checked against TLSA records only
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = daneVerifier(daneRecords, config.ServerName)
+	case d.RequireTLS:
+		// MTA-STS: certificate must be valid for MX host
+		config.InsecureSkipVerify = false
+	default:
+		config.InsecureSkipVerify = route.tlsSkipVerify()
 	}
-
-	// Bye
-	client.Quit()
-	d.dieOk()
+	return config, nil
 }
@@ -0,0 +1,298 @@
+package core
+
+// Delivery Status Notifications (RFC 3464)
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/textproto"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/teamnsrg/tmail/message"
+)
+
+// dsnHeaders are header fields of DSN which are not taken from templates
+var dsnHeaders = map[string]bool{
+	"Date":                      true,
+	"To":                        true,
+	"Message-Id":                true,
+	"Auto-Submitted":            true,
+	"Mime-Version":              true,
+	"Content-Type":              true,
+	"Content-Transfer-Encoding": true,
+}
+
+// enhancedStatusCodeRe matches enhanced status code (RFC 3463) at the
+// beginning of a SMTP reply
+var enhancedStatusCodeRe = regexp.MustCompile(`^([245])\.(\d{1,3})\.(\d{1,3})\b`)
+
+// deliveryReport represents a delivery status notification for a recipient
+type deliveryReport struct {
+	Action         string // failed, delayed,...
+	Status         string // enhanced status code (eg 5.1.1)
+	DiagnosticCode string // remote SMTP reply (may be empty)
+	RemoteMTA      string
+	ErrMsg         string // human readable reason
+	HeadersOnly    bool   // return only headers of the original message
+}
+
+// newDeliveryReport returns report for a failed or delayed delivery d
+func newDeliveryReport(d *Delivery, action, errMsg string) *deliveryReport {
+	r := &deliveryReport{
+		Action: action,
+		ErrMsg: errMsg,
+	}
+	switch action {
+	case "failed":
+		r.Status = "5.0.0"
+	case "delayed":
+		r.Status = "4.0.0"
+	default:
+		r.Status = "2.0.0"
+	}
+	if action != "delivered" && action != "relayed" && action != "expanded" && d.RemoteSMTPresponseCode > 399 {
+		r.DiagnosticCode = strings.Replace(fmt.Sprintf("%d %s", d.RemoteSMTPresponseCode, d.RemoteSMTPresponseMsg), "\n", " ", -1)
+		if m := enhancedStatusCodeRe.FindString(d.RemoteSMTPresponseMsg); m != "" {
+			r.Status = m
+		} else {
+			r.Status = fmt.Sprintf("%d.0.0", d.RemoteSMTPresponseCode/100)
+		}
+		// status class must be consistent with action
+		if action == "failed" && r.Status[0] == '4' {
+			r.Status = "5" + r.Status[1:]
+		}
+	}
+	if d.RemoteAddr != "" {
+		host, _, err := net.SplitHostPort(d.RemoteAddr)
+		if err == nil {
+			r.RemoteMTA = host
+		}
+	}
+	return r
+}
+
+// splitTemplateHeaders splits rendered template tpl in header fields and
+// human readable text (header fields are optional, if present they are
+// followed by an empty line)
+func splitTemplateHeaders(tpl []byte) (textproto.MIMEHeader, []byte) {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(tpl)))
+	header, err := r.ReadMIMEHeader()
+	if err != nil || len(header) == 0 {
+		return nil, tpl
+	}
+	text, err := ioutil.ReadAll(r.R)
+	if err != nil {
+		return nil, tpl
+	}
+	return header, text
+}
+
+// Reader returns the multipart/report message
+// tpl is the template (in tpl directory) used for the human readable part,
+// it may start with header fields (eg From, Subject) of the report
+// original is the original message (can be nil)
+func (r *deliveryReport) Reader(d *Delivery, tpl string, original io.Reader) (io.Reader, error) {
+	// unknown fields (eg BouncedMail of old templates) are empty
+	tData := map[string]string{
+		"Date":      time.Now().Format(Time822),
+		"Me":        Cfg.GetMe(),
+		"RcptTo":    d.QMsg.MailFrom,
+		"OriRcptTo": d.QMsg.RcptTo,
+		"ErrMsg":    r.ErrMsg,
+	}
+	t, err := template.New(tpl).Option("missingkey=zero").ParseFiles(path.Join(GetBasePath(), "tpl", tpl))
+	if err != nil {
+		return nil, err
+	}
+	humanPart := new(bytes.Buffer)
+	if err = t.Execute(humanPart, tData); err != nil {
+		return nil, err
+	}
+	human := humanPart.Bytes()
+	if err = Unix2dos(&human); err != nil {
+		return nil, err
+	}
+	tplHeader, human := splitTemplateHeaders(human)
+
+	boundary, err := NewUUID()
+	if err != nil {
+		return nil, err
+	}
+	// default From & Subject (templates may override them)
+	from := "MAILER-DAEMON@" + Cfg.GetMe()
+	subject := "failure notice"
+	switch r.Action {
+	case "delayed":
+		subject = "delivery delayed notice"
+	case "delivered", "relayed", "expanded":
+		subject = "delivery status notification (success)"
+	}
+	if v := tplHeader.Get("From"); v != "" {
+		from = v
+	}
+	if v := tplHeader.Get("Subject"); v != "" {
+		subject = v
+	}
+
+	report := new(bytes.Buffer)
+	// headers
+	fmt.Fprintf(report, "Date: %s\r\n", time.Now().Format(Time822))
+	fmt.Fprintf(report, "From: %s\r\n", from)
+	fmt.Fprintf(report, "To: <%s>\r\n", d.QMsg.MailFrom)
+	fmt.Fprintf(report, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(report, "Message-ID: <%s@%s>\r\n", boundary, Cfg.GetMe())
+	// other header fields of template
+	names := []string{}
+	for name := range tplHeader {
+		if name != "From" && name != "Subject" && !dsnHeaders[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range tplHeader[name] {
+			fmt.Fprintf(report, "%s: %s\r\n", name, mime.QEncoding.Encode("utf-8", v))
+		}
+	}
+	report.WriteString("Auto-Submitted: auto-replied\r\n")
+	report.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(report, "Content-Type: multipart/report; report-type=delivery-status;\r\n\tboundary=\"%s\"\r\n\r\n", boundary)
+	report.WriteString("This is a MIME-encapsulated message.\r\n\r\n")
+
+	// human readable part
+	fmt.Fprintf(report, "--%s\r\n", boundary)
+	report.WriteString("Content-Description: Notification\r\n")
+	report.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	report.Write(human)
+	if !bytes.HasSuffix(human, []byte("\r\n")) {
+		report.WriteString("\r\n")
+	}
+
+	// delivery-status part
+	fmt.Fprintf(report, "\r\n--%s\r\n", boundary)
+	report.WriteString("Content-Description: Delivery report\r\n")
+	report.WriteString("Content-Type: message/delivery-status\r\n\r\n")
+	// per message fields
+	fmt.Fprintf(report, "Reporting-MTA: dns; %s\r\n", Cfg.GetMe())
+	if d.QMsg.DSNEnvID != "" {
+		if envID, err := xtextDecode(d.QMsg.DSNEnvID); err == nil {
+			fmt.Fprintf(report, "Original-Envelope-Id: %s\r\n", envID)
+		}
+	}
+	fmt.Fprintf(report, "Arrival-Date: %s\r\n", d.QMsg.AddedAt.Format(Time822))
+	// per recipient fields
+	report.WriteString("\r\n")
+	if t := strings.SplitN(d.QMsg.DSNOrcpt, ";", 2); len(t) == 2 {
+		if orcpt, err := xtextDecode(t[1]); err == nil {
+			fmt.Fprintf(report, "Original-Recipient: %s; %s\r\n", t[0], orcpt)
+		}
+	}
+	fmt.Fprintf(report, "Final-Recipient: rfc822; %s\r\n", d.QMsg.RcptTo)
+	fmt.Fprintf(report, "Action: %s\r\n", r.Action)
+	fmt.Fprintf(report, "Status: %s\r\n", r.Status)
+	if r.RemoteMTA != "" {
+		fmt.Fprintf(report, "Remote-MTA: dns; [%s]\r\n", r.RemoteMTA)
+	}
+	if r.DiagnosticCode != "" {
+		fmt.Fprintf(report, "Diagnostic-Code: smtp; %s\r\n", r.DiagnosticCode)
+	}
+	fmt.Fprintf(report, "Last-Attempt-Date: %s\r\n", time.Now().Format(Time822))
+	if r.Action == "delayed" {
+		fmt.Fprintf(report, "Will-Retry-Until: %s\r\n", d.QMsg.AddedAt.Add(time.Duration(Cfg.GetDeliverdQueueLifetime())*time.Minute).Format(Time822))
+	}
+
+	// original message
+	if original == nil {
+		fmt.Fprintf(report, "\r\n--%s--\r\n", boundary)
+		return report, nil
+	}
+	fmt.Fprintf(report, "\r\n--%s\r\n", boundary)
+	if r.HeadersOnly {
+		report.WriteString("Content-Description: Undelivered Message Headers\r\n")
+		report.WriteString("Content-Type: text/rfc822-headers\r\n")
+		headers := &headersBuffer{}
+		buf := make([]byte, 4096)
+		for !headers.done {
+			n, err := original.Read(buf)
+			headers.Write(buf[:n])
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		original = bytes.NewReader(headers.Bytes())
+	} else {
+		report.WriteString("Content-Description: Undelivered Message\r\n")
+		report.WriteString("Content-Type: message/rfc822\r\n")
+		if d.QMsg.Body == "8BITMIME" {
+			report.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+		}
+	}
+	report.WriteString("\r\n")
+
+	return io.MultiReader(report, original, strings.NewReader(fmt.Sprintf("\r\n--%s--\r\n", boundary))), nil
+}
+
+// sendDeliveryReport queues a delivery status notification (action is one of
+// failed, delayed, delivered, relayed or expanded) for sender of d
+func (d *Delivery) sendDeliveryReport(action, errMsg string) (id string, err error) {
+	r := newDeliveryReport(d, action, errMsg)
+	// RFC 3461 4.3: full message is only returned for failures
+	r.HeadersOnly = action != "failed" || d.QMsg.DSNRet == "HDRS"
+
+	// original message (streamed from store)
+	// RawData may have been (partially) read so we get a new reader
+	var original io.Reader
+	if d.QStore != nil {
+		raw, err := d.QStore.Get(d.QMsg.Uuid)
+		if err == nil {
+			defer raw.Close()
+			original = raw
+		}
+	}
+	// Si ça bounce car le mail a disparu de la queue:
+	if original == nil {
+		original = strings.NewReader("Raw mail was not found in the store\r\n")
+	}
+
+	tpl := "bounce.tpl"
+	switch action {
+	case "delayed":
+		tpl = "delay.tpl"
+	case "delivered", "relayed", "expanded":
+		tpl = "success.tpl"
+	}
+	reportMail, err := r.Reader(d, tpl, original)
+	if err != nil {
+		return "", err
+	}
+	// returned message may contain 8bit data or non ASCII headers
+	envelope := message.Envelope{MailFrom: "", RcptTo: []string{d.QMsg.MailFrom}, Body: d.QMsg.Body, SMTPUTF8: d.QMsg.SMTPUTF8}
+	return QueueAddMessage(reportMail, envelope, "")
+}
+
+// notifySuccess sends a success DSN if sender asked for it (NOTIFY=SUCCESS)
+// action is delivered, relayed or expanded
+func (d *Delivery) notifySuccess(action string) {
+	if d.QMsg.MailFrom == "" || !d.QMsg.dsnNotify("SUCCESS") {
+		return
+	}
+	id, err := d.sendDeliveryReport(action, "")
+	if err != nil {
+		Logger.Error("deliverd " + d.ID + ": unable to queue success notification for message queued as " + d.QMsg.Uuid + " " + err.Error())
+		return
+	}
+	Logger.Info("deliverd " + d.ID + ": success notification (" + action + ") queued with id " + id)
+}
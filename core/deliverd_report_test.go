@@ -0,0 +1,170 @@
+package core
+
+import (
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setupReportTest writes templates in tpl directory
+func setupReportTest(t *testing.T, templates map[string]string) {
+	Cfg = &Config{}
+	Cfg.cfg.Me = "mx.example.com"
+	Cfg.cfg.DeliverdQueueLifetime = 60
+	dir := filepath.Join(GetBasePath(), "tpl")
+	if !assert.NoError(t, os.MkdirAll(dir, 0755)) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	for name, content := range templates {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+}
+
+// readReport parses report and returns its header and parts
+func readReport(t *testing.T, r io.Reader) (mail.Header, []*multipart.Part, []string) {
+	msg, err := mail.ReadMessage(r)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	assert.NoError(t, err)
+	assert.Equal(t, "multipart/report", mediaType)
+	assert.Equal(t, "delivery-status", params["report-type"])
+	parts, contents := []*multipart.Part{}, []string{}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		content, err := ioutil.ReadAll(p)
+		assert.NoError(t, err)
+		parts, contents = append(parts, p), append(contents, string(content))
+	}
+	return msg.Header, parts, contents
+}
+
+func Test_newDeliveryReport(t *testing.T) {
+	tests := []struct {
+		action     string
+		code       int
+		msg        string
+		status     string
+		diagnostic string
+	}{
+		{"failed", 0, "", "5.0.0", ""},
+		{"delayed", 0, "", "4.0.0", ""},
+		{"relayed", 0, "", "2.0.0", ""},
+		{"failed", 550, "5.1.1 unknown user", "5.1.1", "550 5.1.1 unknown user"},
+		{"failed", 550, "unknown user", "5.0.0", "550 unknown user"},
+		{"failed", 450, "4.2.0 mailbox busy\nretry later", "5.2.0", "450 4.2.0 mailbox busy retry later"},
+		{"delayed", 421, "4.7.0 try later", "4.7.0", "421 4.7.0 try later"},
+		{"delivered", 550, "5.1.1 unknown user", "2.0.0", ""},
+	}
+	for _, tt := range tests {
+		d := &Delivery{QMsg: &QMessage{}, RemoteSMTPresponseCode: tt.code, RemoteSMTPresponseMsg: tt.msg, RemoteAddr: "192.0.2.1:25"}
+		r := newDeliveryReport(d, tt.action, "error")
+		assert.Equal(t, tt.status, r.Status, tt.action+" "+tt.msg)
+		assert.Equal(t, tt.diagnostic, r.DiagnosticCode, tt.action+" "+tt.msg)
+		assert.Equal(t, "192.0.2.1", r.RemoteMTA)
+	}
+}
+
+func Test_deliveryReportReader(t *testing.T) {
+	setupReportTest(t, map[string]string{
+		"bounce.tpl": "From: Mail Delivery <postmaster@{{.Me}}>\nSubject: Undeliverable: échec\nX-Report: yes\nTo: ignored@example.com\n\nUnable to deliver to <{{.OriRcptTo}}>:\n{{.ErrMsg}}\n",
+		"old.tpl":    "Date: {{.Date}}\nFrom: MAILER-DAEMON@{{.Me}}\nTo: {{.RcptTo}}\nSubject: failure notice\n\n<{{.RcptTo}}>:\n{{.ErrMsg}}\n\n--- Below this line is a copy of the message.\n\n{{.BouncedMail}}",
+		"plain.tpl":  "Hi. This is the tmail deliverd program at {{.Me}}\n<{{.OriRcptTo}}>: {{.ErrMsg}}\n",
+	})
+	d := &Delivery{
+		QMsg: &QMessage{
+			MailFrom: "john@example.net",
+			RcptTo:   "jane@example.com",
+			DSNEnvID: "QQ314159+2B1",
+			DSNOrcpt: "rfc822;Jane+2BDoe@example.com",
+			Body:     "8BITMIME",
+			AddedAt:  time.Now(),
+		},
+		RemoteAddr:             "192.0.2.1:25",
+		RemoteSMTPresponseCode: 550,
+		RemoteSMTPresponseMsg:  "5.1.1 unknown user",
+	}
+	original := "From: john@example.net\r\nSubject: hello\r\n\r\nbody\r\n"
+
+	// template with header fields
+	r := newDeliveryReport(d, "failed", "no such user")
+	report, err := r.Reader(d, "bounce.tpl", strings.NewReader(original))
+	assert.NoError(t, err)
+	header, parts, contents := readReport(t, report)
+	assert.Equal(t, "Mail Delivery <postmaster@mx.example.com>", header.Get("From"))
+	subject, err := new(mime.WordDecoder).DecodeHeader(header.Get("Subject"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Undeliverable: échec", subject)
+	assert.Equal(t, "yes", header.Get("X-Report"))
+	assert.Equal(t, "<john@example.net>", header.Get("To"))
+	assert.Equal(t, "auto-replied", header.Get("Auto-Submitted"))
+	if assert.Len(t, parts, 3) {
+		assert.Equal(t, "Unable to deliver to <jane@example.com>:\r\nno such user\r\n", contents[0])
+		assert.Equal(t, "message/delivery-status", parts[1].Header.Get("Content-Type"))
+		for _, field := range []string{
+			"Reporting-MTA: dns; mx.example.com\r\n",
+			"Original-Envelope-Id: QQ314159+1\r\n",
+			"Original-Recipient: rfc822; Jane+Doe@example.com\r\n",
+			"Final-Recipient: rfc822; jane@example.com\r\n",
+			"Action: failed\r\n",
+			"Status: 5.1.1\r\n",
+			"Remote-MTA: dns; [192.0.2.1]\r\n",
+			"Diagnostic-Code: smtp; 550 5.1.1 unknown user\r\n",
+		} {
+			assert.Contains(t, contents[1], field)
+		}
+		assert.Equal(t, "message/rfc822", parts[2].Header.Get("Content-Type"))
+		assert.Equal(t, "8bit", parts[2].Header.Get("Content-Transfer-Encoding"))
+		assert.Equal(t, original, contents[2])
+	}
+
+	// template of previous versions
+	report, err = r.Reader(d, "old.tpl", strings.NewReader(original))
+	assert.NoError(t, err)
+	header, _, contents = readReport(t, report)
+	assert.Equal(t, "failure notice", header.Get("Subject"))
+	assert.Equal(t, "<john@example.net>", header.Get("To"))
+	assert.True(t, strings.HasPrefix(contents[0], "<john@example.net>:\r\nno such user\r\n"))
+
+	// template without header fields, headers only, delayed
+	r = newDeliveryReport(d, "delayed", "mailbox busy")
+	r.HeadersOnly = true
+	report, err = r.Reader(d, "plain.tpl", strings.NewReader(original))
+	assert.NoError(t, err)
+	header, parts, contents = readReport(t, report)
+	assert.Equal(t, "MAILER-DAEMON@mx.example.com", header.Get("From"))
+	assert.Equal(t, "delivery delayed notice", header.Get("Subject"))
+	assert.Equal(t, "Hi. This is the tmail deliverd program at mx.example.com\r\n<jane@example.com>: mailbox busy\r\n", contents[0])
+	assert.Contains(t, contents[1], "Action: delayed\r\n")
+	assert.Contains(t, contents[1], "Will-Retry-Until: ")
+	if assert.Len(t, parts, 3) {
+		assert.Equal(t, "text/rfc822-headers", parts[2].Header.Get("Content-Type"))
+		assert.Equal(t, "From: john@example.net\r\nSubject: hello\r\n\r\n", contents[2])
+	}
+
+	// no original message, missing template
+	report, err = r.Reader(d, "plain.tpl", nil)
+	assert.NoError(t, err)
+	_, parts, _ = readReport(t, report)
+	assert.Len(t, parts, 2)
+	_, err = r.Reader(d, "missing.tpl", nil)
+	assert.Error(t, err)
+}
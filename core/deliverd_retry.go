@@ -0,0 +1,97 @@
+package core
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// retryPolicy is a backoff schedule
+// delay before the nth retry is retryPolicy[n-1], the last delay is
+// repeated until the message expires (deliverd_queue_lifetime)
+type retryPolicy []time.Duration
+
+// defaultRetryPolicy is used if the configured schedule is invalid
+var defaultRetryPolicy = retryPolicy{5 * time.Minute, 10 * time.Minute, 30 * time.Minute, time.Hour, 2 * time.Hour, 4 * time.Hour}
+
+// maxNSQRequeueDelay is the max requeue delay accepted by nsqd (--max-req-timeout)
+// longer delays are reached by requeueing the message several times
+const maxNSQRequeueDelay = time.Hour
+
+// nsqRequeueDelay returns delay to use for requeueing a message in NSQ
+// delivery is scheduled by QMessage.NextDeliveryScheduledAt
+func nsqRequeueDelay(delay time.Duration) time.Duration {
+	if delay > maxNSQRequeueDelay {
+		return maxNSQRequeueDelay
+	}
+	return delay
+}
+
+// parseRetrySchedule parses a comma separated list of durations (eg "5m,10m,1h")
+func parseRetrySchedule(schedule string) (retryPolicy, error) {
+	policy := retryPolicy{}
+	for _, s := range strings.Split(schedule, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		delay, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, err
+		}
+		if delay <= 0 {
+			return nil, errors.New("retry delay must be positive, " + s + " given")
+		}
+		policy = append(policy, delay)
+	}
+	if len(policy) == 0 {
+		return nil, errors.New("empty retry schedule")
+	}
+	return policy, nil
+}
+
+// delay returns delay before next attempt after failedCount failures
+// a jitter of +/- 10% is added to spread retries
+func (p retryPolicy) delay(failedCount uint32) time.Duration {
+	i := int(failedCount) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(p) {
+		i = len(p) - 1
+	}
+	delay := p[i]
+	jitter := int64(delay / 10)
+	if jitter > 0 {
+		delay += time.Duration(rand.Int63n(2*jitter) - jitter)
+	}
+	return delay
+}
+
+// getRetryPolicy returns retry policy for destination domain
+func getRetryPolicy(domain string) retryPolicy {
+	schedule, ok := Cfg.GetDeliverdRetryScheduleDomains()[strings.ToLower(domain)]
+	if !ok {
+		schedule = Cfg.GetDeliverdRetrySchedule()
+	}
+	policy, err := parseRetrySchedule(schedule)
+	if err != nil {
+		Logger.Error("deliverd: invalid retry schedule " + schedule + " for domain " + domain + " - " + err.Error() + ". Default schedule will be used.")
+		return defaultRetryPolicy
+	}
+	return policy
+}
+
+// checkRetrySchedules checks retry schedules in config
+func checkRetrySchedules() error {
+	if _, err := parseRetrySchedule(Cfg.GetDeliverdRetrySchedule()); err != nil {
+		return errors.New("bad deliverd_retry_schedule - " + err.Error())
+	}
+	for domain, schedule := range Cfg.GetDeliverdRetryScheduleDomains() {
+		if _, err := parseRetrySchedule(schedule); err != nil {
+			return errors.New("bad deliverd_retry_schedule_domains for " + domain + " - " + err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseRetrySchedule(t *testing.T) {
+	tests := []struct {
+		schedule string
+		want     retryPolicy
+		valid    bool
+	}{
+		{"5m,10m,30m,1h,2h,4h", defaultRetryPolicy, true},
+		{" 30s , 1m30s,,2h ", retryPolicy{30 * time.Second, 90 * time.Second, 2 * time.Hour}, true},
+		{"1h", retryPolicy{time.Hour}, true},
+		{"", nil, false},
+		{" , ", nil, false},
+		{"5m,10", nil, false},
+		{"5m,0s", nil, false},
+		{"-5m", nil, false},
+	}
+	for _, tt := range tests {
+		policy, err := parseRetrySchedule(tt.schedule)
+		if !tt.valid {
+			assert.Error(t, err, tt.schedule)
+			continue
+		}
+		assert.NoError(t, err, tt.schedule)
+		assert.Equal(t, tt.want, policy, tt.schedule)
+	}
+}
+
+func Test_retryPolicyDelay(t *testing.T) {
+	policy := retryPolicy{10 * time.Minute, time.Hour, 4 * time.Hour}
+	tests := []struct {
+		failedCount uint32
+		want        time.Duration
+	}{
+		{0, 10 * time.Minute},
+		{1, 10 * time.Minute},
+		{2, time.Hour},
+		{3, 4 * time.Hour},
+		{10, 4 * time.Hour},
+	}
+	for _, tt := range tests {
+		min, max := tt.want, tt.want
+		for i := 0; i < 100; i++ {
+			delay := policy.delay(tt.failedCount)
+			// jitter: +/- 10%
+			assert.True(t, delay >= tt.want-tt.want/10 && delay < tt.want+tt.want/10, tt.failedCount, delay)
+			if delay < min {
+				min = delay
+			}
+			if delay > max {
+				max = delay
+			}
+		}
+		// retries are spread
+		assert.True(t, min < tt.want && max > tt.want, tt.failedCount)
+	}
+	// no jitter below 10ns
+	assert.Equal(t, 5*time.Nanosecond, retryPolicy{5 * time.Nanosecond}.delay(1))
+}
+
+func Test_nsqRequeueDelay(t *testing.T) {
+	assert.Equal(t, 10*time.Minute, nsqRequeueDelay(10*time.Minute))
+	assert.Equal(t, maxNSQRequeueDelay, nsqRequeueDelay(4*time.Hour))
+}
+
+func Test_getRetryPolicy(t *testing.T) {
+	Cfg = &Config{}
+	if Logger == nil {
+		Logger = logrus.New()
+	}
+	Cfg.cfg.DeliverdRetrySchedule = "1m,2m"
+	Cfg.cfg.DeliverdRetryScheduleDomains = "Example.com: 1h ,2h;example.net:bad"
+	assert.Equal(t, retryPolicy{time.Minute, 2 * time.Minute}, getRetryPolicy("example.org"))
+	assert.Equal(t, retryPolicy{time.Hour, 2 * time.Hour}, getRetryPolicy("EXAMPLE.com"))
+	assert.Equal(t, defaultRetryPolicy, getRetryPolicy("example.net"))
+	assert.Error(t, checkRetrySchedules())
+
+	Cfg.cfg.DeliverdRetryScheduleDomains = "example.com:1h,2h"
+	assert.NoError(t, checkRetrySchedules())
+	Cfg.cfg.DeliverdRetrySchedule = "soon"
+	assert.Error(t, checkRetrySchedules())
+}
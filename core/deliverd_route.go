@@ -2,8 +2,11 @@ package core
 
 import (
 	//"errors"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
 	"errors"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"sort"
@@ -22,8 +25,28 @@ type Route struct {
 	SmtpAuthPasswd sql.NullString
 	MailFrom       sql.NullString
 	User           sql.NullString
+	TLSMode        sql.NullString // none, opportunistic, required or verify (default: global config)
+	TLSServerName  sql.NullString // expected name of remote certificate (default: RemoteHost)
+	TLSCAFile      sql.NullString // CA bundle (PEM) used to verify remote certificate
+	TLSClientCert  sql.NullString // client certificate (PEM) for mutual TLS
+	TLSClientKey   sql.NullString // client key (PEM), default: TLSClientCert
+	TLSImplicit    bool           // TLS handshake on connect (SMTPS, port 465)
+	IsMX           bool           `sql:"-"` // route from recipient domain MX (not in DB)
 }
 
+// Route TLS modes
+const (
+	// no STARTTLS
+	routeTLSNone = "none"
+	// STARTTLS if available, certificate not checked, fallback to plaintext
+	// if negotiation fails
+	routeTLSOpportunistic = "opportunistic"
+	// STARTTLS is mandatory, certificate not checked
+	routeTLSRequired = "required"
+	// STARTTLS is mandatory, certificate must be valid
+	routeTLSVerify = "verify"
+)
+
 // routes represents all the routes allowed to access remote MX
 /*type matchingRoutes struct {
 	localIp    []net.IP
@@ -42,7 +65,7 @@ func GetAllRoutes() (routes []Route, err error) {
 }
 
 // AddRoute add a new route
-func AddRoute(host, localIp, remoteHost string, remotePort, priority int, user, mailFrom, smtpAuthLogin, smtpAuthPasswd string) error {
+func AddRoute(host, localIp, remoteHost string, remotePort, priority int, user, mailFrom, smtpAuthLogin, smtpAuthPasswd, tlsMode, tlsServerName, tlsCAFile, tlsClientCert, tlsClientKey string, tlsImplicit bool) error {
 	var err error
 	route := new(Route)
 
@@ -112,9 +135,89 @@ func AddRoute(host, localIp, remoteHost string, remotePort, priority int, user,
 		}
 	}
 
+	// TLS
+	tlsMode = strings.ToLower(strings.TrimSpace(tlsMode))
+	switch tlsMode {
+	case "":
+	case routeTLSNone, routeTLSOpportunistic, routeTLSRequired, routeTLSVerify:
+		route.TLSMode.Scan(tlsMode)
+	default:
+		return errors.New("TLS mode must be one of none, opportunistic, required or verify")
+	}
+	if tlsServerName = strings.TrimSpace(tlsServerName); tlsServerName != "" {
+		route.TLSServerName.Scan(tlsServerName)
+	}
+	if tlsCAFile = strings.TrimSpace(tlsCAFile); tlsCAFile != "" {
+		route.TLSCAFile.Scan(tlsCAFile)
+	}
+	if tlsClientCert = strings.TrimSpace(tlsClientCert); tlsClientCert != "" {
+		route.TLSClientCert.Scan(tlsClientCert)
+	}
+	if tlsClientKey = strings.TrimSpace(tlsClientKey); tlsClientKey != "" {
+		if tlsClientCert == "" {
+			return errors.New("TLS client key needs a client certificate")
+		}
+		route.TLSClientKey.Scan(tlsClientKey)
+	}
+	if tlsImplicit {
+		if tlsMode == routeTLSNone {
+			return errors.New("implicit TLS and TLS mode none are incompatible")
+		}
+		route.TLSImplicit = true
+	}
+	// check CA bundle & client certificate
+	if _, err = route.tlsConfig(); err != nil {
+		return err
+	}
+
 	return DB.Create(route).Error
 }
 
+// tlsSkipVerify returns true if remote certificate must not be checked
+// (DANE and MTA-STS excepted)
+func (r *Route) tlsSkipVerify() bool {
+	switch r.TLSMode.String {
+	case routeTLSVerify:
+		return false
+	case routeTLSOpportunistic, routeTLSRequired:
+		return true
+	}
+	return Cfg.GetDeliverdRemoteTLSSkipVerify()
+}
+
+// tlsConfig returns TLS config for route: server name, CA bundle and client
+// certificate
+func (r *Route) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: strings.TrimSuffix(r.RemoteHost, "."),
+	}
+	if r.TLSServerName.Valid && r.TLSServerName.String != "" {
+		config.ServerName = r.TLSServerName.String
+	}
+	if r.TLSCAFile.Valid && r.TLSCAFile.String != "" {
+		pem, err := ioutil.ReadFile(r.TLSCAFile.String)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in CA bundle " + r.TLSCAFile.String)
+		}
+	}
+	if r.TLSClientCert.Valid && r.TLSClientCert.String != "" {
+		keyFile := r.TLSClientCert.String
+		if r.TLSClientKey.Valid && r.TLSClientKey.String != "" {
+			keyFile = r.TLSClientKey.String
+		}
+		cert, err := tls.LoadX509KeyPair(r.TLSClientCert.String, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
 // DelRoute delete a route
 func DelRoute(id int64) error {
 	r := Route{
@@ -224,6 +327,7 @@ func getRoutes(mailFrom, host, authUser string) (routes []Route, err error) {
 				RemoteHost: mx.Host,
 				RemotePort: sql.NullInt64{25, true},
 				Priority:   sql.NullInt64{int64(mx.Pref), true},
+				IsMX:       true,
 			})
 		}
 	}
@@ -0,0 +1,178 @@
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestPEM writes cert (and key if not nil) PEM blocks to name in dir
+func writeTestPEM(t *testing.T, dir, name string, cert *x509.Certificate, key *ecdsa.PrivateKey) string {
+	var data []byte
+	if cert != nil {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	if key != nil {
+		raw, err := x509.MarshalECPrivateKey(key)
+		assert.NoError(t, err)
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: raw})...)
+	}
+	path := filepath.Join(dir, name)
+	assert.NoError(t, ioutil.WriteFile(path, data, 0600))
+	return path
+}
+
+// setupRouteTest writes a CA bundle, a client certificate and its key,
+// as separate and combined files, in a temporary directory
+func setupRouteTest(t *testing.T) (dir, caFile, certFile, keyFile, pairFile string, ca *x509.Certificate) {
+	dir = t.TempDir()
+	ca, caKey := newTestCert(t, "Test CA", nil, nil, true)
+	cert, key := newTestCert(t, "client.example.com", ca, caKey, false)
+	caFile = writeTestPEM(t, dir, "ca.pem", ca, nil)
+	certFile = writeTestPEM(t, dir, "client.crt", cert, nil)
+	keyFile = writeTestPEM(t, dir, "client.key", nil, key)
+	pairFile = writeTestPEM(t, dir, "client.pem", cert, key)
+	return
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func Test_routeTLSConfig(t *testing.T) {
+	dir, caFile, certFile, keyFile, pairFile, ca := setupRouteTest(t)
+	emptyFile := writeTestPEM(t, dir, "empty.pem", nil, nil)
+
+	tests := []struct {
+		route      Route
+		serverName string
+		rootCAs    bool
+		clientCert bool
+		err        bool
+	}{
+		{Route{RemoteHost: "mx.example.com."}, "mx.example.com", false, false, false},
+		{Route{RemoteHost: "10.0.0.1", TLSServerName: nullString("smtp.example.com")}, "smtp.example.com", false, false, false},
+		{Route{RemoteHost: "mx.example.com", TLSCAFile: nullString(caFile)}, "mx.example.com", true, false, false},
+		{Route{RemoteHost: "mx.example.com", TLSCAFile: nullString(emptyFile)}, "", false, false, true},
+		{Route{RemoteHost: "mx.example.com", TLSCAFile: nullString(filepath.Join(dir, "missing.pem"))}, "", false, false, true},
+		{Route{RemoteHost: "mx.example.com", TLSClientCert: nullString(pairFile)}, "mx.example.com", false, true, false},
+		{Route{RemoteHost: "mx.example.com", TLSClientCert: nullString(certFile), TLSClientKey: nullString(keyFile)}, "mx.example.com", false, true, false},
+		// key not in cert file
+		{Route{RemoteHost: "mx.example.com", TLSClientCert: nullString(certFile)}, "", false, false, true},
+		{Route{RemoteHost: "mx.example.com", TLSClientCert: nullString(certFile), TLSClientKey: nullString(caFile)}, "", false, false, true},
+	}
+	for i, tt := range tests {
+		config, err := tt.route.tlsConfig()
+		if tt.err {
+			assert.Error(t, err, "test %d", i)
+			assert.Nil(t, config, "test %d", i)
+			continue
+		}
+		if !assert.NoError(t, err, "test %d", i) {
+			continue
+		}
+		assert.Equal(t, tt.serverName, config.ServerName, "test %d", i)
+		assert.Equal(t, tt.rootCAs, config.RootCAs != nil, "test %d", i)
+		assert.Equal(t, tt.clientCert, len(config.Certificates) == 1, "test %d", i)
+	}
+
+	// the CA bundle is the only trusted root
+	config, err := (&Route{RemoteHost: "mx.example.com", TLSCAFile: nullString(caFile)}).tlsConfig()
+	assert.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	assert.True(t, pool.Equal(config.RootCAs))
+}
+
+func Test_routeTLSSkipVerify(t *testing.T) {
+	Cfg = &Config{}
+	tests := []struct {
+		mode       string
+		skipVerify bool
+		expected   bool
+	}{
+		{"", false, false},
+		{"", true, true},
+		{routeTLSNone, false, false},
+		{routeTLSNone, true, true},
+		{routeTLSOpportunistic, false, true},
+		{routeTLSRequired, false, true},
+		{routeTLSVerify, true, false},
+	}
+	for _, tt := range tests {
+		Cfg.cfg.DeliverdRemoteTLSSkipVerify = tt.skipVerify
+		r := Route{TLSMode: nullString(tt.mode)}
+		assert.Equal(t, tt.expected, r.tlsSkipVerify(), "mode %q, skipverify %v", tt.mode, tt.skipVerify)
+	}
+}
+
+func Test_AddRoute(t *testing.T) {
+	_, caFile, certFile, keyFile, _, _ := setupRouteTest(t)
+	var err error
+	DB, err = gorm.Open("sqlite3", ":memory:")
+	if !assert.NoError(t, err) {
+		return
+	}
+	DB.DB().SetMaxOpenConns(1)
+	DB.LogMode(false)
+	t.Cleanup(func() {
+		DB.Close()
+		DB = nil
+	})
+	assert.NoError(t, AutoMigrateDB(DB))
+
+	tests := []struct {
+		host, localIp, remoteHost                       string
+		tlsMode, tlsCAFile, tlsClientCert, tlsClientKey string
+		tlsImplicit                                     bool
+		err                                             bool
+	}{
+		{"", "", "mx.example.com", "", "", "", "", false, true},
+		{"example.com", "10.0.0.1&10.0.0.2|10.0.0.3", "mx.example.com", "", "", "", "", false, true},
+		{"example.com", "", " ", "", "", "", "", false, true},
+		{"example.com", "", "mx.example.com", "strict", "", "", "", false, true},
+		{"example.com", "", "mx.example.com", "", "", "", keyFile, false, true},
+		{"example.com", "", "mx.example.com", "none", "", "", "", true, true},
+		{"example.com", "", "mx.example.com", "verify", keyFile, "", "", false, true},
+		{"example.com", "", "mx.example.com", "verify", "", certFile, caFile, false, true},
+		{"example.com", "", "mx.example.com", "verify", caFile, certFile, keyFile, true, false},
+		{"example.net", "", "mx.example.net", "", "", "", "", false, false},
+	}
+	for i, tt := range tests {
+		err := AddRoute(tt.host, tt.localIp, tt.remoteHost, 0, 1, "", "", "", "", tt.tlsMode, "", tt.tlsCAFile, tt.tlsClientCert, tt.tlsClientKey, tt.tlsImplicit)
+		if tt.err {
+			assert.Error(t, err, "test %d", i)
+		} else {
+			assert.NoError(t, err, "test %d", i)
+		}
+	}
+
+	// only valid routes are stored
+	routes, err := GetAllRoutes()
+	assert.NoError(t, err)
+	if !assert.Len(t, routes, 2) {
+		return
+	}
+
+	// stored values are normalized
+	assert.NoError(t, AddRoute(" Example.ORG ", "", " MX.Example.org ", 0, 0, "", "", "", "", " Required ", "", "", "", "", true))
+	routes, err = GetAllRoutes()
+	assert.NoError(t, err)
+	if !assert.Len(t, routes, 3) {
+		return
+	}
+	r := routes[2]
+	assert.Equal(t, "example.org", r.Host)
+	assert.Equal(t, "mx.example.org", r.RemoteHost)
+	assert.Equal(t, int64(25), r.RemotePort.Int64)
+	assert.Equal(t, routeTLSRequired, r.TLSMode.String)
+	assert.True(t, r.TLSImplicit)
+	assert.False(t, r.TLSCAFile.Valid)
+}
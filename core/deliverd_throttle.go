@@ -0,0 +1,222 @@
+package core
+
+// Throttling of remote deliveries by destination domain
+// - max concurrent deliveries
+// - max messages per minute
+// Limits are automatically lowered when remote hosts ask us to slow down
+// (421 or 4.7.x replies) and restored step by step on successful deliveries.
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// throttlePurgeInterval is the interval between purges of idle states
+	throttlePurgeInterval = 10 * time.Minute
+	// throttleMinBackoff is the initial pause after a throttling reply
+	throttleMinBackoff = time.Minute
+	// throttleMaxBackoff is the max pause after successive throttling replies
+	throttleMaxBackoff = 30 * time.Minute
+	// throttleRecoverAfter is the number of successful deliveries needed to
+	// raise limits one step
+	throttleRecoverAfter = 10
+)
+
+// ThrottleState represents throttle state of a destination domain
+type ThrottleState struct {
+	Domain         string
+	MaxConn        int       // configured
+	MaxPerMinute   int       // configured (0: unlimited)
+	Factor         float64   // 1: configured limits, < 1 limits lowered
+	Active         int       // deliveries in progress
+	SentLastMinute int       // deliveries started during last minute
+	PausedUntil    time.Time // no delivery before
+	Backoff        string    // current backoff (pause after next throttling reply)
+	LastThrottle   string    // last throttling reply
+	LastThrottleAt time.Time
+
+	backoff   time.Duration
+	starts    []time.Time
+	successes int
+}
+
+// effectiveMaxConn returns current max concurrent deliveries
+func (t *ThrottleState) effectiveMaxConn() int {
+	if t.MaxConn <= 0 {
+		return 0
+	}
+	max := int(float64(t.MaxConn) * t.Factor)
+	if max < 1 {
+		max = 1
+	}
+	return max
+}
+
+// effectiveMaxPerMinute returns current max deliveries per minute
+func (t *ThrottleState) effectiveMaxPerMinute() int {
+	if t.MaxPerMinute <= 0 {
+		return 0
+	}
+	max := int(float64(t.MaxPerMinute) * t.Factor)
+	if max < 1 {
+		max = 1
+	}
+	return max
+}
+
+// deliverdThrottle keeps throttle states by domain
+type deliverdThrottle struct {
+	sync.Mutex
+	states    map[string]*ThrottleState
+	lastPurge time.Time
+}
+
+var throttle = &deliverdThrottle{
+	states: make(map[string]*ThrottleState),
+}
+
+// purge removes idle states (no delivery in progress or during last minute,
+// limits not lowered, not paused), at most every throttlePurgeInterval
+// throttle must be locked
+func (t *deliverdThrottle) purge(now time.Time) {
+	if now.Sub(t.lastPurge) < throttlePurgeInterval {
+		return
+	}
+	t.lastPurge = now
+	for domain, s := range t.states {
+		if s.Active != 0 || s.Factor < 1 || now.Before(s.PausedUntil) {
+			continue
+		}
+		if len(s.starts) != 0 && now.Sub(s.starts[len(s.starts)-1]) < time.Minute {
+			continue
+		}
+		delete(t.states, domain)
+	}
+}
+
+// state returns (and creates if needed) throttle state of domain
+// throttle must be locked
+func (t *deliverdThrottle) state(domain string) *ThrottleState {
+	s, ok := t.states[domain]
+	if !ok {
+		maxConn, maxPerMinute := Cfg.GetDeliverdThrottleLimits(domain)
+		s = &ThrottleState{
+			Domain:       domain,
+			MaxConn:      maxConn,
+			MaxPerMinute: maxPerMinute,
+			Factor:       1,
+			backoff:      throttleMinBackoff,
+		}
+		t.states[domain] = s
+	}
+	return s
+}
+
+// acquire reserves a delivery slot for domain
+// if it returns false, retryIn is the delay before a slot may be available
+func (t *deliverdThrottle) acquire(domain string) (ok bool, retryIn time.Duration) {
+	domain = strings.ToLower(domain)
+	now := time.Now()
+	t.Lock()
+	defer t.Unlock()
+	t.purge(now)
+	s := t.state(domain)
+	if now.Before(s.PausedUntil) {
+		return false, s.PausedUntil.Sub(now)
+	}
+	if max := s.effectiveMaxConn(); max > 0 && s.Active >= max {
+		return false, 30 * time.Second
+	}
+	// forget starts older than 1 minute
+	for len(s.starts) != 0 && now.Sub(s.starts[0]) >= time.Minute {
+		s.starts = s.starts[1:]
+	}
+	if max := s.effectiveMaxPerMinute(); max > 0 && len(s.starts) >= max {
+		return false, time.Minute - now.Sub(s.starts[0])
+	}
+	s.starts = append(s.starts, now)
+	s.Active++
+	return true, 0
+}
+
+// release releases a delivery slot for domain
+// code and msg are the last reply of the remote server, they are used to
+// adapt limits
+func (t *deliverdThrottle) release(domain string, code int, msg string) {
+	domain = strings.ToLower(domain)
+	t.Lock()
+	defer t.Unlock()
+	s := t.state(domain)
+	if s.Active > 0 {
+		s.Active--
+	}
+	switch {
+	case isThrottlingReply(code, msg):
+		// slow down
+		s.Factor /= 2
+		if s.Factor < 0.1 {
+			s.Factor = 0.1
+		}
+		s.PausedUntil = time.Now().Add(s.backoff)
+		s.LastThrottle = strconv.Itoa(code) + " " + strings.Replace(msg, "\n", " ", -1)
+		s.LastThrottleAt = time.Now()
+		s.successes = 0
+		Logger.Info("deliverd throttle: " + domain + " asks us to slow down (" + s.LastThrottle + "), deliveries paused for " + s.backoff.String())
+		s.backoff *= 2
+		if s.backoff > throttleMaxBackoff {
+			s.backoff = throttleMaxBackoff
+		}
+	case code > 199 && code < 300 && s.Factor < 1:
+		// recover
+		s.successes++
+		if s.successes >= throttleRecoverAfter {
+			s.successes = 0
+			s.Factor *= 2
+			if s.Factor >= 1 {
+				s.Factor = 1
+				s.backoff = throttleMinBackoff
+			}
+		}
+	}
+}
+
+// isThrottlingReply returns true if SMTP reply means "slow down"
+// 421 or enhanced status code 4.7.x
+func isThrottlingReply(code int, msg string) bool {
+	if code == 421 {
+		return true
+	}
+	return code > 399 && code < 500 && strings.HasPrefix(enhancedStatusCodeRe.FindString(msg), "4.7.")
+}
+
+// DeliverdThrottleStates returns current throttle states (sorted by domain)
+func DeliverdThrottleStates() []ThrottleState {
+	now := time.Now()
+	t := throttle
+	t.Lock()
+	defer t.Unlock()
+	domains := []string{}
+	for domain := range t.states {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	states := []ThrottleState{}
+	for _, domain := range domains {
+		s := t.states[domain]
+		state := *s
+		state.SentLastMinute = 0
+		for _, start := range s.starts {
+			if now.Sub(start) < time.Minute {
+				state.SentLastMinute++
+			}
+		}
+		state.Backoff = s.backoff.String()
+		state.starts = nil
+		states = append(states, state)
+	}
+	return states
+}
@@ -0,0 +1,167 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestThrottle returns an empty throttle, limits are maxConn concurrent
+// deliveries and maxPerMinute deliveries per minute (example.net: 1 and 0)
+func newTestThrottle(maxConn, maxPerMinute int) *deliverdThrottle {
+	Cfg = &Config{}
+	Cfg.cfg.DeliverdThrottleMaxConn = maxConn
+	Cfg.cfg.DeliverdThrottleMaxPerMinute = maxPerMinute
+	Cfg.cfg.DeliverdThrottleDomains = "Example.net:1:0"
+	if Logger == nil {
+		Logger = logrus.New()
+	}
+	return &deliverdThrottle{states: make(map[string]*ThrottleState), lastPurge: time.Now()}
+}
+
+func Test_GetDeliverdThrottleLimits(t *testing.T) {
+	newTestThrottle(10, 300)
+	tests := []struct {
+		domain       string
+		maxConn      int
+		maxPerMinute int
+	}{
+		{"example.com", 10, 300},
+		{"example.net", 1, 0},
+		{"EXAMPLE.NET", 1, 0},
+	}
+	for _, tt := range tests {
+		maxConn, maxPerMinute := Cfg.GetDeliverdThrottleLimits(tt.domain)
+		assert.Equal(t, tt.maxConn, maxConn, tt.domain)
+		assert.Equal(t, tt.maxPerMinute, maxPerMinute, tt.domain)
+	}
+}
+
+func Test_isThrottlingReply(t *testing.T) {
+	tests := []struct {
+		code int
+		msg  string
+		want bool
+	}{
+		{421, "4.3.2 service shutting down", true},
+		{421, "too many connections", true},
+		{450, "4.7.0 too many messages, slow down", true},
+		{451, "4.7.1 greylisted", true},
+		{450, "4.2.1 mailbox busy", false},
+		{451, "temporary error", false},
+		{550, "5.7.1 rejected", false},
+		{250, "2.0.0 ok", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, isThrottlingReply(tt.code, tt.msg), tt.msg)
+	}
+}
+
+func Test_deliverdThrottleConn(t *testing.T) {
+	th := newTestThrottle(2, 0)
+	for i := 0; i < 2; i++ {
+		ok, _ := th.acquire("Example.com")
+		assert.True(t, ok)
+	}
+	ok, retryIn := th.acquire("example.com")
+	assert.False(t, ok)
+	assert.Equal(t, 30*time.Second, retryIn)
+	// limits are by domain
+	ok, _ = th.acquire("example.net")
+	assert.True(t, ok)
+	ok, _ = th.acquire("example.net")
+	assert.False(t, ok)
+
+	th.release("example.com", 250, "2.0.0 ok")
+	ok, _ = th.acquire("example.com")
+	assert.True(t, ok)
+	assert.Equal(t, 2, th.states["example.com"].Active)
+}
+
+func Test_deliverdThrottlePerMinute(t *testing.T) {
+	th := newTestThrottle(0, 3)
+	for i := 0; i < 3; i++ {
+		ok, _ := th.acquire("example.com")
+		assert.True(t, ok)
+		th.release("example.com", 250, "2.0.0 ok")
+	}
+	ok, retryIn := th.acquire("example.com")
+	assert.False(t, ok)
+	assert.True(t, retryIn > 55*time.Second && retryIn <= time.Minute, retryIn)
+
+	// sliding window: starts older than a minute are forgotten
+	s := th.states["example.com"]
+	s.starts[0] = time.Now().Add(-61 * time.Second)
+	ok, _ = th.acquire("example.com")
+	assert.True(t, ok)
+	assert.Len(t, s.starts, 3)
+	ok, retryIn = th.acquire("example.com")
+	assert.False(t, ok)
+	assert.True(t, retryIn <= time.Minute, retryIn)
+}
+
+func Test_deliverdThrottleBackoff(t *testing.T) {
+	th := newTestThrottle(8, 0)
+	ok, _ := th.acquire("example.com")
+	assert.True(t, ok)
+	th.release("example.com", 421, "4.7.0 slow down")
+	s := th.states["example.com"]
+	assert.Equal(t, 0.5, s.Factor)
+	assert.Equal(t, 4, s.effectiveMaxConn())
+	assert.Equal(t, "421 4.7.0 slow down", s.LastThrottle)
+	assert.Equal(t, 2*throttleMinBackoff, s.backoff)
+
+	// paused
+	ok, retryIn := th.acquire("example.com")
+	assert.False(t, ok)
+	assert.True(t, retryIn > 55*time.Second && retryIn <= throttleMinBackoff, retryIn)
+
+	// limits are lowered down to 10%, backoff is bounded
+	for i := 0; i < 10; i++ {
+		th.release("example.com", 450, "4.7.1 too fast")
+	}
+	assert.Equal(t, 0.1, s.Factor)
+	assert.Equal(t, 1, s.effectiveMaxConn())
+	assert.Equal(t, throttleMaxBackoff, s.backoff)
+
+	// limits are restored step by step on successful deliveries
+	s.PausedUntil = time.Time{}
+	for i := 0; i < throttleRecoverAfter; i++ {
+		ok, _ = th.acquire("example.com")
+		assert.True(t, ok)
+		th.release("example.com", 250, "2.0.0 ok")
+	}
+	assert.Equal(t, 0.2, s.Factor)
+	for i := 0; i < 3*throttleRecoverAfter; i++ {
+		th.release("example.com", 250, "2.0.0 ok")
+	}
+	assert.Equal(t, 1.0, s.Factor)
+	assert.Equal(t, throttleMinBackoff, s.backoff)
+
+	// other failures don't change limits
+	th.release("example.com", 550, "5.7.1 rejected")
+	th.release("example.com", 451, "4.3.0 local error")
+	assert.Equal(t, 1.0, s.Factor)
+}
+
+func Test_deliverdThrottlePurge(t *testing.T) {
+	th := newTestThrottle(2, 0)
+	th.acquire("active.example.com")
+	th.acquire("sent.example.com")
+	th.release("sent.example.com", 250, "2.0.0 ok")
+	th.acquire("throttled.example.com")
+	th.release("throttled.example.com", 421, "slow down")
+	th.acquire("idle.example.com")
+	th.release("idle.example.com", 250, "2.0.0 ok")
+	th.states["idle.example.com"].starts[0] = time.Now().Add(-2 * time.Minute)
+
+	// at most every throttlePurgeInterval
+	th.purge(time.Now())
+	assert.Len(t, th.states, 4)
+	th.purge(time.Now().Add(throttlePurgeInterval))
+	assert.Len(t, th.states, 2)
+	assert.Contains(t, th.states, "active.example.com")
+	assert.Contains(t, th.states, "throttled.example.com")
+}
@@ -0,0 +1,53 @@
+package core
+
+// DKIM signing of outbound mails (RFC 6376)
+// Messages are signed while they are read from the store: only headers are
+// kept in memory, bodies are hashed on the fly.
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// headers signed by DKIM-Signature (if present)
+var dkimSignedHeaders = []string{"from", "subject", "date", "message-id"}
+
+// body hash of DKIM-Signature (simple canonicalization)
+var dkimSignBodyHashSpec = bodyHashSpec{relaxed: false, algo: crypto.SHA256, limit: -1}
+
+// DKIMSign returns the DKIM-Signature header (to prepend) of message read
+// from r, signed with DKIM config dkc of domain
+func DKIMSign(r io.Reader, domain string, dkc *DkimConfig) (string, error) {
+	if dkc == nil {
+		return "", errors.New("DKIM is not enabled on " + domain)
+	}
+	key, err := parsePrivateKey(dkc.PrivKey)
+	if err != nil {
+		return "", err
+	}
+	headers, hashes, err := readMessage(r, func([]string) []bodyHashSpec {
+		return []bodyHashSpec{dkimSignBodyHashSpec}
+	})
+	if err != nil {
+		return "", err
+	}
+	names := []string{}
+	for _, name := range dkimSignedHeaders {
+		for _, h := range headers {
+			if headerName(h) == name {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	header := fmt.Sprintf("DKIM-Signature: v=1; a=rsa-sha256; c=simple/simple; q=dns/txt;\r\n\td=%s; s=%s; t=%d;\r\n\th=%s;\r\n\tbh=%s;\r\n\tb=", domain, dkc.Selector, time.Now().Unix(), strings.Join(names, ":"), hashes[dkimSignBodyHashSpec])
+	sig, err := arcSign(key, signedData(headers, names, header, false))
+	if err != nil {
+		return "", err
+	}
+	return header + sig + "\r\n", nil
+}
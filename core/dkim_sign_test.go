@@ -0,0 +1,61 @@
+package core
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/toorop/go-dkim"
+)
+
+func Test_DKIMSign(t *testing.T) {
+	setupARCTest(t, "example.com")
+	dkimResolver = arcResolver
+	t.Cleanup(func() { dkimResolver = netResolver{} })
+	dkc, err := DkimGetConfig("example.com")
+	assert.NoError(t, err)
+
+	raw := "Received: from client.example.com\r\n" +
+		"From: john@example.com\r\nTo: jane@example.net\r\nSubject: hello\r\n\tworld\r\n" +
+		"Message-ID: <1@example.com>\r\n\r\n" +
+		"body  \t line\r\n\r\n\r\n"
+	header, err := DKIMSign(strings.NewReader(raw), "example.com", dkc)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(header, "DKIM-Signature: v=1; a=rsa-sha256; c=simple/simple;"))
+	assert.Contains(t, header, "h=from:subject:message-id;")
+	signed := header + raw
+
+	results, err := VerifyDKIM(strings.NewReader(signed))
+	assert.NoError(t, err)
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, DKIMPass, results[0].Result)
+		assert.Equal(t, "example.com", results[0].Domain)
+	}
+	email := []byte(signed)
+	status, err := dkim.Verify(&email, dkim.DNSOptLookupTXT(dkimResolver.LookupTXT))
+	assert.NoError(t, err)
+	assert.Equal(t, dkim.SUCCESS, status)
+
+	// headers prepended after signing (Received) are not signed, modified
+	// body or signed header are
+	tests := []struct {
+		name   string
+		signed string
+		want   string
+	}{
+		{"prepended header", "Received: from mx.example.com\r\n" + signed, DKIMPass},
+		{"modified body", strings.Replace(signed, "body  \t line", "body \t line", 1), DKIMFail},
+		{"modified header", strings.Replace(signed, "Subject: hello", "Subject: bye", 1), DKIMFail},
+		{"modified unsigned header", strings.Replace(signed, "To: jane", "To: joe", 1), DKIMPass},
+	}
+	for _, tt := range tests {
+		results, err := VerifyDKIM(strings.NewReader(tt.signed))
+		assert.NoError(t, err, tt.name)
+		if assert.Len(t, results, 1, tt.name) {
+			assert.Equal(t, tt.want, results[0].Result, tt.name)
+		}
+	}
+
+	_, err = DKIMSign(strings.NewReader(raw), "example.org", nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,518 @@
+package core
+
+// Verification of DKIM signatures of inbound mails (RFC 6376) and
+// Authentication-Results header (RFC 8601)
+// Messages are verified while they are read: only headers are kept in
+// memory, bodies are hashed on the fly.
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/toorop/go-dkim"
+)
+
+// max number of DKIM signatures verified per message
+const dkimMaxSignatures = 5
+
+// max size of headers of a verified message
+const dkimMaxHeadersSize = 1 << 20
+
+// DKIM results (RFC 8601 2.7.1)
+const (
+	DKIMNone      = "none"
+	DKIMPass      = "pass"
+	DKIMFail      = "fail"
+	DKIMNeutral   = "neutral"
+	DKIMTemperror = "temperror"
+	DKIMPermerror = "permerror"
+)
+
+// DKIMResult is the result of the verification of a DKIM signature
+type DKIMResult struct {
+	Domain    string // d=
+	Selector  string // s=
+	Signature string // b= (first chars, to identify the signature)
+	Result    string // pass, fail, neutral, temperror or permerror
+	Err       error
+}
+
+// resolver used to get DKIM keys (can be replaced for tests)
+var dkimResolver txtResolver = netResolver{}
+
+// bodyHashSpec identifies a body hash: canonicalization, hash algorithm and
+// length limit (l= tag, -1 for the whole body)
+type bodyHashSpec struct {
+	relaxed bool
+	algo    crypto.Hash
+	limit   int64
+}
+
+// body hash of ARC-Message-Signature
+var arcBodyHashSpec = bodyHashSpec{relaxed: true, algo: crypto.SHA256, limit: -1}
+
+// bodyHasher hashes canonicalized body (RFC 6376 3.4.3 and 3.4.4) written to
+// it
+type bodyHasher struct {
+	spec    bodyHashSpec
+	h       hash.Hash
+	written int64  // canonicalized bytes hashed
+	crlf    int    // pending CRLF (empty lines at the end of body are ignored)
+	cr      bool   // pending CR
+	wsp     bool   // pending WSP (relaxed)
+	content bool   // body is not empty
+	buf     []byte // canonicalized bytes not yet hashed
+}
+
+// newBodyHasher returns a bodyHasher for spec
+func newBodyHasher(spec bodyHashSpec) *bodyHasher {
+	var h hash.Hash
+	if spec.algo == crypto.SHA1 {
+		h = sha1.New()
+	} else {
+		h = sha256.New()
+	}
+	return &bodyHasher{spec: spec, h: h, buf: make([]byte, 0, 4096)}
+}
+
+// Write implements io.Writer
+func (b *bodyHasher) Write(p []byte) (int, error) {
+	for _, c := range p {
+		if b.cr {
+			b.cr = false
+			if c == '\n' {
+				b.wsp = false
+				b.crlf++
+				continue
+			}
+			b.emit('\r')
+		}
+		switch {
+		case c == '\r':
+			b.cr = true
+		case b.spec.relaxed && (c == ' ' || c == '\t'):
+			b.wsp = true
+		default:
+			b.emit(c)
+		}
+	}
+	return len(p), nil
+}
+
+// emit adds c (and pending CRLF and WSP) to canonicalized body
+func (b *bodyHasher) emit(c byte) {
+	for ; b.crlf > 0; b.crlf-- {
+		b.buf = append(b.buf, '\r', '\n')
+	}
+	if b.wsp {
+		b.buf = append(b.buf, ' ')
+		b.wsp = false
+	}
+	b.buf = append(b.buf, c)
+	b.content = true
+	if len(b.buf) >= 4096 {
+		b.flush()
+	}
+}
+
+// flush hashes buffered bytes (up to length limit)
+func (b *bodyHasher) flush() {
+	p := b.buf
+	if b.spec.limit >= 0 && b.written+int64(len(p)) > b.spec.limit {
+		p = p[:b.spec.limit-b.written]
+	}
+	b.h.Write(p)
+	b.written += int64(len(p))
+	b.buf = b.buf[:0]
+}
+
+// Sum returns base64 hash of body, it must be called once the whole body has
+// been written
+func (b *bodyHasher) Sum() string {
+	if b.cr {
+		b.cr = false
+		b.emit('\r')
+	}
+	b.wsp = false
+	// simple: an empty body is a CRLF, relaxed: an empty body is empty
+	if b.content || !b.spec.relaxed {
+		b.buf = append(b.buf, '\r', '\n')
+	}
+	b.flush()
+	return base64.StdEncoding.EncodeToString(b.h.Sum(nil))
+}
+
+// readHeaders reads raw headers (each one with its continuation lines and
+// its CRLF) from r, r is then positioned at the beginning of the body
+func readHeaders(r *bufio.Reader) (headers []string, err error) {
+	size := 0
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if line == "\r\n" || line == "\n" || line == "" {
+			return headers, nil
+		}
+		if size += len(line); size > dkimMaxHeadersSize {
+			return nil, errors.New("headers are too large")
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) != 0 {
+			headers[len(headers)-1] += line
+		} else {
+			headers = append(headers, line)
+		}
+		if err == io.EOF {
+			return headers, nil
+		}
+	}
+}
+
+// readMessage reads message from r: headers are returned and body is hashed
+// for each spec returned by specs(headers)
+func readMessage(r io.Reader, specs func(headers []string) []bodyHashSpec) (headers []string, hashes map[bodyHashSpec]string, err error) {
+	br := bufio.NewReader(r)
+	if headers, err = readHeaders(br); err != nil {
+		return nil, nil, err
+	}
+	hashers := map[bodyHashSpec]*bodyHasher{}
+	writers := []io.Writer{}
+	for _, spec := range specs(headers) {
+		if hashers[spec] == nil {
+			hashers[spec] = newBodyHasher(spec)
+			writers = append(writers, hashers[spec])
+		}
+	}
+	if _, err = io.Copy(io.MultiWriter(writers...), br); err != nil {
+		return nil, nil, err
+	}
+	hashes = map[bodyHashSpec]string{}
+	for spec, h := range hashers {
+		hashes[spec] = h.Sum()
+	}
+	return headers, hashes, nil
+}
+
+// dkimSignature is a parsed DKIM-Signature header
+type dkimSignature struct {
+	header  string
+	tags    map[string]string
+	relaxed bool // header canonicalization
+	body    bodyHashSpec
+	result  DKIMResult // set if signature can't be verified
+}
+
+// parseDKIMSignature parses and checks DKIM-Signature header h (RFC 6376
+// 3.5 and 6.1.1)
+func parseDKIMSignature(h string) *dkimSignature {
+	sig := &dkimSignature{header: h, tags: parseTags(h)}
+	sig.result.Domain, sig.result.Selector = strings.ToLower(sig.tags["d"]), sig.tags["s"]
+	sig.result.Signature = sig.tags["b"]
+	if len(sig.result.Signature) > 8 {
+		sig.result.Signature = sig.result.Signature[:8]
+	}
+	if err := sig.check(); err != nil {
+		sig.result.Result, sig.result.Err = DKIMPermerror, err
+	}
+	return sig
+}
+
+// check checks tags of signature
+func (sig *dkimSignature) check() error {
+	if sig.tags["v"] != "1" {
+		return errors.New("bad or missing version")
+	}
+	for _, tag := range []string{"a", "b", "bh", "d", "h", "s"} {
+		if sig.tags[tag] == "" {
+			return errors.New("missing tag " + tag)
+		}
+	}
+	switch sig.tags["a"] {
+	case "rsa-sha256":
+		sig.body.algo = crypto.SHA256
+	case "rsa-sha1":
+		sig.body.algo = crypto.SHA1
+	default:
+		return errors.New("unsupported algorithm " + sig.tags["a"])
+	}
+	c := strings.SplitN(strings.ToLower(sig.tags["c"]), "/", 2)
+	for i, canonicalization := range c {
+		switch canonicalization {
+		case "", "simple":
+		case "relaxed":
+			if i == 0 {
+				sig.relaxed = true
+			} else {
+				sig.body.relaxed = true
+			}
+		default:
+			return errors.New("unsupported canonicalization " + sig.tags["c"])
+		}
+	}
+	from := false
+	for _, name := range strings.Split(sig.tags["h"], ":") {
+		if strings.EqualFold(strings.TrimSpace(name), "from") {
+			from = true
+		}
+	}
+	if !from {
+		return errors.New("From header is not signed")
+	}
+	if i, ok := sig.tags["i"]; ok {
+		p := strings.LastIndex(i, "@")
+		domain := strings.ToLower(i[p+1:])
+		if p == -1 || (domain != sig.result.Domain && !strings.HasSuffix(domain, "."+sig.result.Domain)) {
+			return errors.New("domain of i= is not d= or one of its subdomains")
+		}
+	}
+	if q, ok := sig.tags["q"]; ok && !strings.Contains(q, "dns/txt") {
+		return errors.New("unsupported query method " + q)
+	}
+	sig.body.limit = -1
+	if l, ok := sig.tags["l"]; ok {
+		limit, err := strconv.ParseInt(l, 10, 64)
+		if err != nil || limit < 0 {
+			return errors.New("bad l= tag")
+		}
+		sig.body.limit = limit
+	}
+	if x, ok := sig.tags["x"]; ok {
+		if _, err := strconv.ParseInt(x, 10, 64); err != nil {
+			return errors.New("bad x= tag")
+		}
+	}
+	return nil
+}
+
+// verify verifies signature against headers (all headers of the message) and
+// body hash
+func (sig *dkimSignature) verify(headers []string, bodyHash string) DKIMResult {
+	r := sig.result
+	if r.Result != "" {
+		return r
+	}
+	if x, ok := sig.tags["x"]; ok {
+		if expire, _ := strconv.ParseInt(x, 10, 64); time.Now().Unix() > expire {
+			r.Result, r.Err = DKIMFail, dkim.ErrVerifySignatureHasExpired
+			return r
+		}
+	}
+	pubKey, status, err := dkim.NewPubKeyRespFromDNS(sig.tags["s"], sig.tags["d"], dkim.DNSOptLookupTXT(dkimResolver.LookupTXT))
+	if err != nil {
+		r.Result, r.Err = DKIMPermerror, err
+		if status == dkim.TEMPFAIL {
+			r.Result = DKIMTemperror
+		}
+		return r
+	}
+	algo := strings.TrimPrefix(sig.tags["a"], "rsa-")
+	if !IsStringInSlice(algo, pubKey.HashAlgo) {
+		r.Result, r.Err = DKIMPermerror, dkim.ErrVerifyInappropriateHashAlgo
+		return r
+	}
+	if !IsStringInSlice("all", pubKey.ServiceType) && !IsStringInSlice("email", pubKey.ServiceType) {
+		r.Result, r.Err = DKIMPermerror, errors.New("key is not usable for email")
+		return r
+	}
+	if i, ok := sig.tags["i"]; ok && pubKey.FlagIMustBeD && !strings.EqualFold(i[strings.LastIndex(i, "@")+1:], sig.tags["d"]) {
+		r.Result, r.Err = DKIMPermerror, errors.New("domain of i= must be d=")
+		return r
+	}
+	r.Result = DKIMPass
+	if bodyHash != sig.tags["bh"] {
+		r.Result, r.Err = DKIMFail, dkim.ErrVerifyBodyHash
+	} else if b, err := base64.StdEncoding.DecodeString(sig.tags["b"]); err != nil {
+		r.Result, r.Err = DKIMPermerror, errors.New("bad b= tag")
+	} else {
+		h := sig.body.algo.New()
+		h.Write(signedData(headers, strings.Split(sig.tags["h"], ":"), sig.header, sig.relaxed))
+		if err = rsa.VerifyPKCS1v15(&pubKey.PubKey, sig.body.algo, h.Sum(nil), b); err != nil {
+			r.Result, r.Err = DKIMFail, errors.New("signature did not verify")
+		}
+	}
+	if pubKey.FlagTesting && r.Result != DKIMPermerror {
+		// testing mode (t=y): signature must be treated as unverified
+		r.Result = DKIMNeutral
+	}
+	return r
+}
+
+// dkimSignatures returns (at most dkimMaxSignatures) DKIM signatures of
+// headers
+func dkimSignatures(headers []string) (sigs []*dkimSignature) {
+	for _, h := range headers {
+		if headerName(h) == "dkim-signature" && len(sigs) < dkimMaxSignatures {
+			sigs = append(sigs, parseDKIMSignature(h))
+		}
+	}
+	return sigs
+}
+
+// verifyMessage verifies DKIM signatures and ARC chain of message read from r
+func verifyMessage(r io.Reader) (results []DKIMResult, arcResult string, arcErr error, err error) {
+	var sigs []*dkimSignature
+	headers, hashes, err := readMessage(r, func(headers []string) []bodyHashSpec {
+		sigs = dkimSignatures(headers)
+		specs := []bodyHashSpec{arcBodyHashSpec}
+		for _, sig := range sigs {
+			if sig.result.Result == "" {
+				specs = append(specs, sig.body)
+			}
+		}
+		return specs
+	})
+	if err != nil {
+		return nil, "", nil, err
+	}
+	for _, sig := range sigs {
+		results = append(results, sig.verify(headers, hashes[sig.body]))
+	}
+	arcResult, arcErr = verifyARCChain(headers, hashes[arcBodyHashSpec])
+	return results, arcResult, arcErr, nil
+}
+
+// VerifyDKIM verifies DKIM signatures of message read from r
+func VerifyDKIM(r io.Reader) ([]DKIMResult, error) {
+	results, _, _, err := verifyMessage(r)
+	return results, err
+}
+
+// GetDKIMResult returns DKIM result for domain: pass if one of its
+// signatures is valid, none if message is not signed by domain
+func (s *SMTPServerSession) GetDKIMResult(domain string) string {
+	domain = strings.ToLower(domain)
+	result := DKIMNone
+	for _, r := range s.DKIMResults {
+		if r.Domain != domain {
+			continue
+		}
+		if r.Result == DKIMPass {
+			return DKIMPass
+		}
+		if result == DKIMNone {
+			result = r.Result
+		}
+	}
+	return result
+}
+
+// verifyDKIM verifies DKIM signatures and ARC chain of current inbound
+// message (if DKIM verification or DMARC is enabled)
+func (s *SMTPServerSession) verifyDKIM() {
+	if !(Cfg.GetSmtpdDKIMVerify() || Cfg.GetSmtpdDMARC()) || !s.isInbound() || s.dataSpool == nil {
+		return
+	}
+	r, err := s.dataSpool.Reader()
+	if err != nil {
+		s.LogError("DKIM - unable to read spooled message - " + err.Error())
+		return
+	}
+	var arcErr error
+	s.DKIMResults, s.ARCResult, arcErr, err = verifyMessage(r)
+	if err != nil {
+		s.LogError("DKIM - unable to read spooled message - " + err.Error())
+		return
+	}
+	s.dkimChecked = true
+	for _, r := range s.DKIMResults {
+		msg := fmt.Sprintf("DKIM - d=%s s=%s: %s", r.Domain, r.Selector, r.Result)
+		if r.Err != nil {
+			msg += " - " + r.Err.Error()
+		}
+		s.Log(msg)
+	}
+	if s.ARCResult != ARCNone {
+		msg := "ARC - " + s.ARCResult
+		if arcErr != nil {
+			msg += " - " + arcErr.Error()
+		}
+		s.Log(msg)
+	}
+}
+
+// authResultsHeader returns the Authentication-Results header of current
+// message (empty if no check has been done)
+func (s *SMTPServerSession) authResultsHeader() string {
+	results := []string{}
+	if s.spfResult != "" {
+		property, value := "smtp.mailfrom", s.spfSender
+		if s.spfIdentity == "helo" {
+			property, value = "smtp.helo", s.helo
+		}
+		results = append(results, fmt.Sprintf("spf=%s %s=%s", s.spfResult, property, authResultsValue(value)))
+	}
+	if s.dkimChecked {
+		if len(s.DKIMResults) == 0 {
+			results = append(results, "dkim=none")
+		}
+		for _, r := range s.DKIMResults {
+			result := "dkim=" + r.Result
+			if r.Err != nil && r.Result != DKIMPass {
+				result += " (" + strings.NewReplacer("(", "", ")", "", "\\", "").Replace(r.Err.Error()) + ")"
+			}
+			if r.Domain != "" {
+				result += " header.d=" + authResultsValue(r.Domain) + " header.s=" + authResultsValue(r.Selector) + " header.b=" + authResultsValue(r.Signature)
+			}
+			results = append(results, result)
+		}
+		results = append(results, "arc="+s.ARCResult)
+	}
+	if s.DMARC != nil {
+		result := "dmarc=" + s.DMARC.Result
+		if s.DMARC.Policy != "" {
+			result += " (p=" + s.DMARC.Policy + " dis=" + s.DMARC.Disposition + ")"
+		}
+		results = append(results, result+" header.from="+authResultsValue(s.DMARC.From))
+	}
+	if len(results) == 0 {
+		return ""
+	}
+	return "Authentication-Results: " + Cfg.GetMe() + "; " + strings.Join(results, "; ")
+}
+
+// parseAuthResults returns authserv-id and results of raw header h, empty if
+// h is not an Authentication-Results header
+func parseAuthResults(h string) (servID, results string) {
+	if headerName(h) != "authentication-results" {
+		return "", ""
+	}
+	value := strings.Join(strings.Fields(h[strings.Index(h, ":")+1:]), " ")
+	parts := strings.SplitN(value, ";", 2)
+	// authserv-id [version]
+	if fields := strings.Fields(parts[0]); len(fields) != 0 {
+		servID = fields[0]
+	}
+	if len(parts) == 2 {
+		results = strings.TrimSpace(parts[1])
+	}
+	return servID, results
+}
+
+// filterHeader removes Authentication-Results headers of incoming message
+// using our authserv-id: they are forged (RFC 8601 5)
+func (s *SMTPServerSession) filterHeader(header []byte) []byte {
+	if servID, _ := parseAuthResults(string(header)); strings.EqualFold(servID, Cfg.GetMe()) {
+		s.Log("DATA - forged Authentication-Results header removed")
+		return nil
+	}
+	return header
+}
+
+// authResultsValue returns value quoted if needed (RFC 2045 token)
+func authResultsValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t()<>,;:\\\"/[]?=") {
+		return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(value) + "\""
+	}
+	return value
+}
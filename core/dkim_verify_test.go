@@ -0,0 +1,15 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseAuthResults(t *testing.T) {
+	servID, results := parseAuthResults("authentication-results:  mx.example.com 1;\r\n\tspf=pass smtp.mailfrom=a@b.c\r\n")
+	assert.Equal(t, "mx.example.com", servID)
+	assert.Equal(t, "spf=pass smtp.mailfrom=a@b.c", results)
+	servID, _ = parseAuthResults("Subject: mx.example.com; x\r\n")
+	assert.Equal(t, "", servID)
+}
@@ -0,0 +1,609 @@
+package core
+
+// DMARC (RFC 7489)
+// Policies of RFC5322.From domains of inbound mails are evaluated against
+// SPF and DKIM results, evaluations are recorded in DB, aggregated by day and
+// policy domain, and reported to domains requesting aggregate reports (rua).
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/teamnsrg/tmail/message"
+	"golang.org/x/net/publicsuffix"
+)
+
+// DMARC results
+const (
+	DMARCNone      = "none"
+	DMARCPass      = "pass"
+	DMARCFail      = "fail"
+	DMARCTemperror = "temperror"
+)
+
+// dmarcRecord represents a DMARC policy record
+type dmarcRecord struct {
+	Domain string // domain where record has been found
+	P      string // none, quarantine or reject
+	SP     string // policy for subdomains
+	ADKIM  string // r or s
+	ASPF   string // r or s
+	Pct    int
+	Rua    []string
+}
+
+// resolver used to get DMARC records (can be replaced for tests)
+var dmarcResolver txtResolver = netResolver{}
+
+// parseDMARCRecord parses DMARC record txt of domain
+func parseDMARCRecord(domain, txt string) (*dmarcRecord, error) {
+	r := &dmarcRecord{Domain: domain, ADKIM: "r", ASPF: "r", Pct: 100}
+	fields := strings.Split(txt, ";")
+	if strings.Replace(strings.TrimSpace(fields[0]), " ", "", -1) != "v=DMARC1" {
+		return nil, errors.New("not a DMARC record")
+	}
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case "p":
+			r.P = strings.ToLower(value)
+		case "sp":
+			r.SP = strings.ToLower(value)
+		case "adkim":
+			r.ADKIM = strings.ToLower(value)
+		case "aspf":
+			r.ASPF = strings.ToLower(value)
+		case "pct":
+			pct, err := strconv.Atoi(value)
+			if err != nil || pct < 0 || pct > 100 {
+				return nil, errors.New("invalid pct value " + value)
+			}
+			r.Pct = pct
+		case "rua":
+			for _, uri := range strings.Split(value, ",") {
+				uri = strings.TrimSpace(uri)
+				// size limit (!10m) is ignored
+				if p := strings.LastIndex(uri, "!"); p != -1 {
+					uri = uri[:p]
+				}
+				if uri != "" {
+					r.Rua = append(r.Rua, uri)
+				}
+			}
+		}
+	}
+	// RFC 7489 6.6.3: invalid p is treated as none if rua is valid
+	if r.P != DMARCNone && r.P != "quarantine" && r.P != "reject" {
+		if len(r.Rua) == 0 {
+			return nil, errors.New("invalid or missing p tag")
+		}
+		r.P = DMARCNone
+	}
+	if r.SP != DMARCNone && r.SP != "quarantine" && r.SP != "reject" {
+		r.SP = r.P
+	}
+	if r.ADKIM != "s" {
+		r.ADKIM = "r"
+	}
+	if r.ASPF != "s" {
+		r.ASPF = "r"
+	}
+	return r, nil
+}
+
+// getDMARCRecord returns DMARC record of domain (nil if there is none)
+func getDMARCRecord(domain string) (*dmarcRecord, error) {
+	txts, err := dmarcResolver.LookupTXT("_dmarc." + domain)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var record *dmarcRecord
+	for _, txt := range txts {
+		r, err := parseDMARCRecord(domain, txt)
+		if err != nil {
+			continue
+		}
+		// more than one record: no policy (RFC 7489 6.6.3)
+		if record != nil {
+			return nil, nil
+		}
+		record = r
+	}
+	return record, nil
+}
+
+// lookupDMARC returns DMARC record which applies to from domain: the one of
+// domain or, if there is none, the one of its organizational domain
+func lookupDMARC(domain string) (*dmarcRecord, error) {
+	record, err := getDMARCRecord(domain)
+	if err != nil || record != nil {
+		return record, err
+	}
+	if orgDomain := dmarcOrgDomain(domain); orgDomain != domain {
+		return getDMARCRecord(orgDomain)
+	}
+	return nil, nil
+}
+
+// dmarcOrgDomain returns organizational domain of domain
+func dmarcOrgDomain(domain string) string {
+	orgDomain, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return orgDomain
+}
+
+// dmarcAligned returns true if domain is aligned with from domain (mode is
+// r for relaxed or s for strict)
+func dmarcAligned(domain, from, mode string) bool {
+	domain, from = strings.ToLower(domain), strings.ToLower(from)
+	if mode == "s" {
+		return domain == from
+	}
+	return dmarcOrgDomain(domain) == dmarcOrgDomain(from)
+}
+
+// DMARCEvaluation is the result of a DMARC evaluation
+type DMARCEvaluation struct {
+	From        string // RFC5322.From domain
+	Result      string // pass, fail or temperror
+	Policy      string // policy which applies (p or sp)
+	Disposition string // none, quarantine or reject
+	DKIM        string // pass if an aligned DKIM signature is valid
+	SPF         string // pass if SPF passes for an aligned domain
+	record      *dmarcRecord
+}
+
+// evaluateDMARC evaluates DMARC policy of from domain
+func evaluateDMARC(from string, spfResult SPFResult, spfDomain string, dkimResults []DKIMResult) (*DMARCEvaluation, error) {
+	from = strings.ToLower(from)
+	record, err := lookupDMARC(from)
+	if err != nil {
+		return &DMARCEvaluation{From: from, Result: DMARCTemperror}, err
+	}
+	if record == nil {
+		return nil, nil
+	}
+	e := &DMARCEvaluation{From: from, Result: DMARCFail, Policy: record.P, Disposition: DMARCNone, DKIM: DMARCFail, SPF: DMARCFail, record: record}
+	if record.Domain != from {
+		e.Policy = record.SP
+	}
+	for _, r := range dkimResults {
+		if r.Result == DKIMPass && dmarcAligned(r.Domain, from, record.ADKIM) {
+			e.DKIM = DMARCPass
+			break
+		}
+	}
+	if spfResult == SPFPass && dmarcAligned(spfDomain, from, record.ASPF) {
+		e.SPF = DMARCPass
+	}
+	if e.DKIM == DMARCPass || e.SPF == DMARCPass {
+		e.Result = DMARCPass
+		return e, nil
+	}
+	e.Disposition = e.Policy
+	// RFC 7489 6.6.4: policy is applied to pct% of failing messages, others
+	// get the next less restrictive policy
+	if record.Pct < 100 && rand.Intn(100) >= record.Pct {
+		switch e.Disposition {
+		case "reject":
+			e.Disposition = "quarantine"
+		case "quarantine":
+			e.Disposition = DMARCNone
+		}
+	}
+	return e, nil
+}
+
+// checkDMARC evaluates DMARC policy of current inbound message, records
+// evaluation and applies disposition. It returns false if message has been
+// rejected.
+func (s *SMTPServerSession) checkDMARC() bool {
+	if !Cfg.GetSmtpdDMARC() || !s.isInbound() || s.dataSpool == nil {
+		return true
+	}
+	headers := s.dataSpool.Headers()
+	msg, err := message.New(&headers)
+	if err != nil {
+		s.Log("DMARC - unable to parse headers - " + err.Error())
+		return true
+	}
+	// RFC 7489 6.6.1: one and only one author domain
+	addresses, err := mail.ParseAddressList(msg.GetHeader("From"))
+	if err != nil || len(msg.GetHeaders("From")) != 1 || len(addresses) != 1 || !strings.Contains(addresses[0].Address, "@") {
+		s.Log("DMARC - no or more than one RFC5322.From domain, skipping")
+		return true
+	}
+	from := message.GetHostFromAddress(addresses[0].Address)
+	spfResult, spfDomain, _ := s.dmarcSPF()
+	e, err := evaluateDMARC(from, spfResult, spfDomain, s.DKIMResults)
+	if err != nil {
+		s.Log("DMARC - unable to get policy of " + from + " - " + err.Error())
+	}
+	s.DMARC = e
+	if e == nil || e.record == nil {
+		return true
+	}
+	s.Log(fmt.Sprintf("DMARC - %s: %s (dkim=%s spf=%s) policy %s disposition %s", from, e.Result, e.DKIM, e.SPF, e.Policy, e.Disposition))
+	if Cfg.GetSmtpdDMARCReports() && len(e.record.Rua) != 0 {
+		s.recordDMARCResult(e)
+	}
+	switch e.Disposition {
+	case "reject":
+		s.Out("550 5.7.1 message rejected by DMARC policy of " + from)
+		s.SMTPResponseCode = 550
+		s.Log("MAIL - rejected by DMARC policy of " + from)
+		s.Reset()
+		return false
+	case "quarantine":
+		s.PrependHeader("X-Spam-Flag: YES")
+	}
+	return true
+}
+
+// dmarcSPF returns SPF result, domain and scope (mfrom or helo) used by
+// DMARC: MAIL FROM identity, HELO identity for null senders (RFC 7489 4.1)
+func (s *SMTPServerSession) dmarcSPF() (result SPFResult, domain, scope string) {
+	if s.spfResult == "" {
+		return "", "", ""
+	}
+	if s.Envelope.MailFrom == "" {
+		return s.spfResult, s.helo, "helo"
+	}
+	return s.spfMailFrom, message.GetHostFromAddress(s.Envelope.MailFrom), "mfrom"
+}
+
+// DMARCResult represents DMARC evaluations of a day
+type DMARCResult struct {
+	Id           int64
+	Day          string // UTC YYYY-MM-DD
+	PolicyDomain string
+	PolicyAdkim  string
+	PolicyAspf   string
+	PolicyP      string
+	PolicySp     string
+	PolicyPct    int
+	SourceIp     string
+	HeaderFrom   string
+	Disposition  string
+	Dkim         string // DMARC DKIM result (aligned)
+	Spf          string // DMARC SPF result (aligned)
+	DkimResults  string `sql:"type:text;"` // domain selector result, separated by \n
+	SpfDomain    string
+	SpfScope     string // mfrom or helo
+	SpfResult    string
+	Count        int64
+	ClaimedBy    string // reporting process (see claimReportResults)
+	ClaimedAt    time.Time
+}
+
+// recordDMARCResult records DMARC evaluation e of current message
+func (s *SMTPServerSession) recordDMARCResult(e *DMARCEvaluation) {
+	r := DMARCResult{
+		Day:          time.Now().UTC().Format("2006-01-02"),
+		PolicyDomain: e.record.Domain,
+		PolicyAdkim:  e.record.ADKIM,
+		PolicyAspf:   e.record.ASPF,
+		PolicyP:      e.record.P,
+		PolicySp:     e.record.SP,
+		PolicyPct:    e.record.Pct,
+		HeaderFrom:   e.From,
+		Disposition:  e.Disposition,
+		Dkim:         e.DKIM,
+		Spf:          e.SPF,
+	}
+	r.SourceIp, _, _ = net.SplitHostPort(s.Conn.RemoteAddr().String())
+	dkimResults := []string{}
+	for _, d := range s.DKIMResults {
+		if d.Domain != "" {
+			dkimResults = append(dkimResults, d.Domain+" "+d.Selector+" "+d.Result)
+		}
+	}
+	r.DkimResults = strings.Join(dkimResults, "\n")
+	spfResult, spfDomain, spfScope := s.dmarcSPF()
+	r.SpfResult, r.SpfDomain, r.SpfScope = string(spfResult), spfDomain, spfScope
+
+	res := DB.Model(&DMARCResult{}).Where("day = ? AND policy_domain = ? AND source_ip = ? AND header_from = ? AND disposition = ? AND dkim = ? AND spf = ? AND dkim_results = ? AND spf_domain = ? AND spf_scope = ? AND spf_result = ?",
+		r.Day, r.PolicyDomain, r.SourceIp, r.HeaderFrom, r.Disposition, r.Dkim, r.Spf, r.DkimResults, r.SpfDomain, r.SpfScope, r.SpfResult).UpdateColumn("count", gorm.Expr("count + ?", 1))
+	if res.Error == nil && res.RowsAffected != 0 {
+		return
+	}
+	r.Count = 1
+	if err := DB.Create(&r).Error; err != nil {
+		s.LogError("DMARC - unable to record result - " + err.Error())
+	}
+}
+
+// dmarcReport is a RFC 7489 aggregate report (appendix C)
+type dmarcReport struct {
+	XMLName  xml.Name `xml:"feedback"`
+	Metadata struct {
+		OrgName   string `xml:"org_name"`
+		Email     string `xml:"email"`
+		ReportID  string `xml:"report_id"`
+		DateRange struct {
+			Begin int64 `xml:"begin"`
+			End   int64 `xml:"end"`
+		} `xml:"date_range"`
+	} `xml:"report_metadata"`
+	Policy struct {
+		Domain string `xml:"domain"`
+		ADKIM  string `xml:"adkim"`
+		ASPF   string `xml:"aspf"`
+		P      string `xml:"p"`
+		SP     string `xml:"sp"`
+		Pct    int    `xml:"pct"`
+	} `xml:"policy_published"`
+	Records []dmarcReportRecord `xml:"record"`
+}
+
+type dmarcReportRecord struct {
+	Row struct {
+		SourceIP        string `xml:"source_ip"`
+		Count           int64  `xml:"count"`
+		PolicyEvaluated struct {
+			Disposition string `xml:"disposition"`
+			DKIM        string `xml:"dkim"`
+			SPF         string `xml:"spf"`
+		} `xml:"policy_evaluated"`
+	} `xml:"row"`
+	Identifiers struct {
+		HeaderFrom string `xml:"header_from"`
+	} `xml:"identifiers"`
+	AuthResults struct {
+		DKIM []dmarcReportDKIM `xml:"dkim"`
+		SPF  []dmarcReportSPF  `xml:"spf"`
+	} `xml:"auth_results"`
+}
+
+type dmarcReportDKIM struct {
+	Domain   string `xml:"domain"`
+	Selector string `xml:"selector,omitempty"`
+	Result   string `xml:"result"`
+}
+
+type dmarcReportSPF struct {
+	Domain string `xml:"domain"`
+	Scope  string `xml:"scope"`
+	Result string `xml:"result"`
+}
+
+// newDMARCReport returns report for results (of the same day and domain)
+func newDMARCReport(day time.Time, results []DMARCResult) (*dmarcReport, error) {
+	id, err := NewUUID()
+	if err != nil {
+		return nil, err
+	}
+	report := &dmarcReport{}
+	report.Metadata.OrgName = Cfg.GetMe()
+	report.Metadata.Email = "postmaster@" + Cfg.GetMe()
+	report.Metadata.ReportID = id
+	report.Metadata.DateRange.Begin = day.Unix()
+	report.Metadata.DateRange.End = day.Add(24*time.Hour - time.Second).Unix()
+	// last published policy
+	last := results[len(results)-1]
+	report.Policy.Domain = last.PolicyDomain
+	report.Policy.ADKIM, report.Policy.ASPF = last.PolicyAdkim, last.PolicyAspf
+	report.Policy.P, report.Policy.SP, report.Policy.Pct = last.PolicyP, last.PolicySp, last.PolicyPct
+	for _, r := range results {
+		record := dmarcReportRecord{}
+		record.Row.SourceIP = r.SourceIp
+		record.Row.Count = r.Count
+		record.Row.PolicyEvaluated.Disposition = r.Disposition
+		record.Row.PolicyEvaluated.DKIM = r.Dkim
+		record.Row.PolicyEvaluated.SPF = r.Spf
+		record.Identifiers.HeaderFrom = r.HeaderFrom
+		if r.DkimResults != "" {
+			for _, line := range strings.Split(r.DkimResults, "\n") {
+				f := strings.Split(line, " ")
+				if len(f) == 3 {
+					record.AuthResults.DKIM = append(record.AuthResults.DKIM, dmarcReportDKIM{f[0], f[1], f[2]})
+				}
+			}
+		}
+		// spf is required
+		spf := dmarcReportSPF{r.SpfDomain, r.SpfScope, r.SpfResult}
+		if spf.Result == "" {
+			spf = dmarcReportSPF{r.HeaderFrom, "mfrom", string(SPFNone)}
+		}
+		record.AuthResults.SPF = []dmarcReportSPF{spf}
+		report.Records = append(report.Records, record)
+	}
+	return report, nil
+}
+
+// gzip returns gzipped XML report
+func (r *dmarcReport) gzip() ([]byte, error) {
+	raw, err := xml.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	if _, err = zw.Write([]byte(xml.Header)); err != nil {
+		return nil, err
+	}
+	if _, err = zw.Write(raw); err != nil {
+		return nil, err
+	}
+	if err = zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// dmarcExternalDestinationOK returns true if rcpt domain accepts reports for
+// domain (RFC 7489 7.1)
+func dmarcExternalDestinationOK(domain, rcpt string) (bool, error) {
+	rcptDomain := strings.ToLower(message.GetHostFromAddress(rcpt))
+	if dmarcOrgDomain(rcptDomain) == dmarcOrgDomain(domain) {
+		return true, nil
+	}
+	txts, err := dmarcResolver.LookupTXT(domain + "._report._dmarc." + rcptDomain)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, txt := range txts {
+		if strings.HasPrefix(strings.Replace(txt, " ", "", -1), "v=DMARC1") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// sendDMARCReport sends report to uri (only mailto: is supported)
+func sendDMARCReport(report *dmarcReport, domain, uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "mailto" {
+		return errors.New("unsupported rua scheme " + u.Scheme)
+	}
+	rcpt := strings.SplitN(u.Opaque, "?", 2)[0]
+	if rcpt, err = url.QueryUnescape(rcpt); err != nil {
+		return err
+	}
+	ok, err := dmarcExternalDestinationOK(domain, rcpt)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New(rcpt + " doesn't accept reports for " + domain)
+	}
+	gz, err := report.gzip()
+	if err != nil {
+		return err
+	}
+	me := Cfg.GetMe()
+	filename := fmt.Sprintf("%s!%s!%d!%d.xml.gz", me, domain, report.Metadata.DateRange.Begin, report.Metadata.DateRange.End)
+	boundary := report.Metadata.ReportID
+	mail := new(bytes.Buffer)
+	fmt.Fprintf(mail, "Date: %s\r\n", time.Now().Format(Time822))
+	fmt.Fprintf(mail, "From: postmaster@%s\r\n", me)
+	fmt.Fprintf(mail, "To: <%s>\r\n", rcpt)
+	fmt.Fprintf(mail, "Subject: Report Domain: %s Submitter: %s Report-ID: <%s>\r\n", domain, me, report.Metadata.ReportID)
+	fmt.Fprintf(mail, "Message-ID: <%s@%s>\r\n", report.Metadata.ReportID, me)
+	mail.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(mail, "Content-Type: multipart/mixed;\r\n\tboundary=\"%s\"\r\n\r\n", boundary)
+	fmt.Fprintf(mail, "--%s\r\n", boundary)
+	mail.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(mail, "This is an aggregate DMARC report from %s for %s.\r\n", me, domain)
+	fmt.Fprintf(mail, "\r\n--%s\r\n", boundary)
+	mail.WriteString("Content-Type: application/gzip\r\n")
+	mail.WriteString("Content-Transfer-Encoding: base64\r\n")
+	fmt.Fprintf(mail, "Content-Disposition: attachment; filename=\"%s\"\r\n\r\n", filename)
+	b64 := base64.StdEncoding.EncodeToString(gz)
+	for len(b64) > 76 {
+		mail.WriteString(b64[:76] + "\r\n")
+		b64 = b64[76:]
+	}
+	mail.WriteString(b64 + "\r\n")
+	fmt.Fprintf(mail, "--%s--\r\n", boundary)
+	envelope := message.Envelope{MailFrom: "postmaster@" + me, RcptTo: []string{rcpt}}
+	_, err = QueueAddMessage(mail, envelope, "")
+	return err
+}
+
+// SendDMARCReports sends reports for results of previous days and removes
+// them
+func SendDMARCReports() error {
+	today := time.Now().UTC().Format("2006-01-02")
+	results := []DMARCResult{}
+	if err := DB.Where("day < ?", today).Order("day, policy_domain, id").Find(&results).Error; err != nil {
+		return err
+	}
+	token, err := NewUUID()
+	if err != nil {
+		return err
+	}
+	for len(results) != 0 {
+		// results of the same day & domain
+		n := 1
+		for n < len(results) && results[n].Day == results[0].Day && results[n].PolicyDomain == results[0].PolicyDomain {
+			n++
+		}
+		day, domain := results[0].Day, results[0].PolicyDomain
+		results = results[n:]
+
+		// claim them (other nodes of a cluster may be reporting them)
+		ok, err := claimReportResults(&DMARCResult{}, day, domain, token)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		batch := []DMARCResult{}
+		if err = DB.Where("claimed_by = ?", token).Order("id").Find(&batch).Error; err != nil {
+			return err
+		}
+
+		record, err := getDMARCRecord(domain)
+		if err != nil {
+			// DNS failure, we'll retry later
+			Logger.Info("dmarc: unable to get DMARC record of " + domain + " - " + err.Error())
+			if err = releaseReportResults(&DMARCResult{}, token); err != nil {
+				return err
+			}
+			continue
+		}
+		if record != nil && len(record.Rua) != 0 {
+			start, err := time.Parse("2006-01-02", day)
+			if err != nil {
+				return err
+			}
+			report, err := newDMARCReport(start, batch)
+			if err != nil {
+				return err
+			}
+			for _, uri := range record.Rua {
+				if err = sendDMARCReport(report, domain, uri); err != nil {
+					Logger.Error("dmarc: unable to send report " + report.Metadata.ReportID + " for " + domain + " to " + uri + " - " + err.Error())
+					continue
+				}
+				Logger.Info("dmarc: report " + report.Metadata.ReportID + " for " + domain + " (" + day + ") sent to " + uri)
+			}
+		}
+		if err = DB.Where("claimed_by = ?", token).Delete(DMARCResult{}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LaunchDMARCReporter sends DMARC reports of previous days (checked hourly)
+func LaunchDMARCReporter() {
+	if !Cfg.GetSmtpdDMARC() || !Cfg.GetSmtpdDMARCReports() {
+		return
+	}
+	for {
+		if err := SendDMARCReports(); err != nil {
+			Logger.Error("dmarc: " + err.Error())
+		}
+		time.Sleep(time.Hour)
+	}
+}
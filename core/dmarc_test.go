@@ -0,0 +1,148 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseDMARCRecord(t *testing.T) {
+	tests := []struct {
+		txt   string
+		valid bool
+		want  dmarcRecord
+	}{
+		{"v=DMARC1; p=reject", true, dmarcRecord{P: "reject", SP: "reject", ADKIM: "r", ASPF: "r", Pct: 100}},
+		{"v = DMARC1 ;p=Quarantine; sp=none; adkim=s; aspf=s; pct=20", true, dmarcRecord{P: "quarantine", SP: "none", ADKIM: "s", ASPF: "s", Pct: 20}},
+		{"v=DMARC1; p=none; sp=foo; adkim=x; rua=mailto:a@example.com!10m, mailto:b@example.net", true, dmarcRecord{P: "none", SP: "none", ADKIM: "r", ASPF: "r", Pct: 100, Rua: []string{"mailto:a@example.com", "mailto:b@example.net"}}},
+		{"v=DMARC1; p=foo; rua=mailto:a@example.com", true, dmarcRecord{P: "none", SP: "none", ADKIM: "r", ASPF: "r", Pct: 100, Rua: []string{"mailto:a@example.com"}}},
+		{"v=DMARC1; p=foo", false, dmarcRecord{}},
+		{"v=DMARC1", false, dmarcRecord{}},
+		{"v=DMARC1; p=reject; pct=101", false, dmarcRecord{}},
+		{"v=DMARC1; p=reject; pct=x", false, dmarcRecord{}},
+		{"v=spf1 -all", false, dmarcRecord{}},
+		{"p=reject; v=DMARC1", false, dmarcRecord{}},
+	}
+	for _, tt := range tests {
+		r, err := parseDMARCRecord("example.com", tt.txt)
+		if !tt.valid {
+			assert.Error(t, err, tt.txt)
+			continue
+		}
+		assert.NoError(t, err, tt.txt)
+		tt.want.Domain = "example.com"
+		assert.Equal(t, &tt.want, r, tt.txt)
+	}
+}
+
+func Test_lookupDMARC(t *testing.T) {
+	dmarcResolver = stubTXTResolver{
+		"_dmarc.example.com":     {"v=spf1 -all", "v=DMARC1; p=reject; sp=quarantine"},
+		"_dmarc.sub.example.com": {"v=DMARC1; p=none"},
+		"_dmarc.two.com":         {"v=DMARC1; p=reject", "v=DMARC1; p=none"},
+		"_dmarc.temp.com":        {"SERVFAIL"},
+		"_dmarc.a.temp.com":      {"SERVFAIL"},
+	}
+	defer func() { dmarcResolver = netResolver{} }()
+
+	tests := []struct {
+		domain string
+		found  string // domain of record
+		err    bool
+	}{
+		{"example.com", "example.com", false},
+		{"sub.example.com", "sub.example.com", false},
+		{"a.b.example.com", "example.com", false},
+		{"two.com", "", false},
+		{"sub.two.com", "", false},
+		{"example.org", "", false},
+		{"temp.com", "", true},
+		{"a.temp.com", "", true},
+	}
+	for _, tt := range tests {
+		r, err := lookupDMARC(tt.domain)
+		assert.Equal(t, tt.err, err != nil, tt.domain)
+		if tt.found == "" {
+			assert.Nil(t, r, tt.domain)
+		} else if assert.NotNil(t, r, tt.domain) {
+			assert.Equal(t, tt.found, r.Domain, tt.domain)
+		}
+	}
+}
+
+func Test_dmarcAligned(t *testing.T) {
+	tests := []struct {
+		domain  string
+		from    string
+		relaxed bool
+		strict  bool
+	}{
+		{"example.com", "example.com", true, true},
+		{"Example.com", "example.COM", true, true},
+		{"mail.example.com", "example.com", true, false},
+		{"example.com", "news.example.com", true, false},
+		{"a.example.com", "b.example.com", true, false},
+		{"example.net", "example.com", false, false},
+		{"example.co.uk", "other.co.uk", false, false},
+		{"a.example.co.uk", "example.co.uk", true, false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.relaxed, dmarcAligned(tt.domain, tt.from, "r"), tt.domain+" "+tt.from)
+		assert.Equal(t, tt.strict, dmarcAligned(tt.domain, tt.from, "s"), tt.domain+" "+tt.from)
+	}
+}
+
+func Test_evaluateDMARC(t *testing.T) {
+	dmarcResolver = stubTXTResolver{
+		"_dmarc.example.com": {"v=DMARC1; p=reject; sp=quarantine"},
+		"_dmarc.strict.com":  {"v=DMARC1; p=reject; adkim=s; aspf=s"},
+		"_dmarc.pct.com":     {"v=DMARC1; p=reject; sp=quarantine; pct=0"},
+		"_dmarc.temp.com":    {"SERVFAIL"},
+	}
+	defer func() { dmarcResolver = netResolver{} }()
+	pass := func(domain string) []DKIMResult {
+		return []DKIMResult{{Domain: "other.org", Result: DKIMPass}, {Domain: domain, Result: DKIMPass}}
+	}
+
+	tests := []struct {
+		name        string
+		from        string
+		spfResult   SPFResult
+		spfDomain   string
+		dkim        []DKIMResult
+		result      string
+		disposition string
+		dkimResult  string
+		spfAligned  string
+	}{
+		{"DKIM", "example.com", SPFFail, "example.com", pass("example.com"), DMARCPass, DMARCNone, DMARCPass, DMARCFail},
+		{"relaxed DKIM", "example.com", SPFNone, "", pass("mail.example.com"), DMARCPass, DMARCNone, DMARCPass, DMARCFail},
+		{"SPF", "example.com", SPFPass, "bounces.example.com", nil, DMARCPass, DMARCNone, DMARCFail, DMARCPass},
+		{"not aligned", "example.com", SPFPass, "example.net", pass("example.net"), DMARCFail, "reject", DMARCFail, DMARCFail},
+		{"DKIM fail", "example.com", SPFSoftfail, "example.com", []DKIMResult{{Domain: "example.com", Result: DKIMFail}}, DMARCFail, "reject", DMARCFail, DMARCFail},
+		{"subdomain policy", "news.example.com", SPFFail, "news.example.com", nil, DMARCFail, "quarantine", DMARCFail, DMARCFail},
+		{"strict", "strict.com", SPFPass, "mail.strict.com", pass("mail.strict.com"), DMARCFail, "reject", DMARCFail, DMARCFail},
+		{"strict pass", "Strict.com", SPFPass, "strict.com", nil, DMARCPass, DMARCNone, DMARCFail, DMARCPass},
+		{"pct", "pct.com", SPFFail, "pct.com", nil, DMARCFail, "quarantine", DMARCFail, DMARCFail},
+		{"pct subdomain", "a.pct.com", SPFFail, "pct.com", nil, DMARCFail, DMARCNone, DMARCFail, DMARCFail},
+	}
+	for _, tt := range tests {
+		e, err := evaluateDMARC(tt.from, tt.spfResult, tt.spfDomain, tt.dkim)
+		assert.NoError(t, err, tt.name)
+		if !assert.NotNil(t, e, tt.name) {
+			continue
+		}
+		assert.Equal(t, tt.result, e.Result, tt.name)
+		assert.Equal(t, tt.disposition, e.Disposition, tt.name)
+		assert.Equal(t, tt.dkimResult, e.DKIM, tt.name)
+		assert.Equal(t, tt.spfAligned, e.SPF, tt.name)
+	}
+
+	// no policy, DNS failure
+	e, err := evaluateDMARC("example.org", SPFFail, "example.org", nil)
+	assert.NoError(t, err)
+	assert.Nil(t, e)
+	e, err = evaluateDMARC("temp.com", SPFPass, "temp.com", nil)
+	assert.Error(t, err)
+	assert.Equal(t, DMARCTemperror, e.Result)
+}
@@ -0,0 +1,290 @@
+package core
+
+// DNSBL (RFC 5782)
+// IP of SMTP clients are checked at connect against configured zones, each
+// listing zone adds its weight to the client score. Results are cached in
+// Bolt ("dnsbl" bucket).
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// dnsblZone is a DNSBL zone with its weight and the return codes which are
+// taken into account (all codes in 127.0.0.0/8 but error codes if empty)
+type dnsblZone struct {
+	Zone   string
+	Weight int
+	Codes  []string
+}
+
+// dnsblErrorCode returns true if code is an error code (127.255.255.0/24,
+// eg: Spamhaus returns 127.255.255.254 to queries from public resolvers)
+func dnsblErrorCode(code string) bool {
+	ip := net.ParseIP(code).To4()
+	return ip != nil && ip[0] == 127 && ip[1] == 255 && ip[2] == 255
+}
+
+// match returns true if one of codes is a listing code for zone
+func (z dnsblZone) match(codes []string) bool {
+	for _, code := range codes {
+		if len(z.Codes) == 0 {
+			if ip := net.ParseIP(code).To4(); ip != nil && ip[0] == 127 && !dnsblErrorCode(code) {
+				return true
+			}
+			continue
+		}
+		for _, c := range z.Codes {
+			if code == c {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseDNSBLZones parses zones config: zone[:weight[:code,code...]];...
+func parseDNSBLZones(config string) (zones []dnsblZone, err error) {
+	if config == "" || config == "_" {
+		return nil, nil
+	}
+	for _, z := range strings.Split(config, ";") {
+		parts := strings.Split(strings.TrimSpace(z), ":")
+		if parts[0] == "" {
+			continue
+		}
+		zone := dnsblZone{Zone: strings.ToLower(strings.TrimSuffix(parts[0], ".")), Weight: 1}
+		if len(parts) > 1 && parts[1] != "" {
+			if zone.Weight, err = strconv.Atoi(parts[1]); err != nil {
+				return nil, errors.New("bad weight for DNSBL zone " + parts[0])
+			}
+		}
+		if len(parts) > 2 && parts[2] != "" {
+			for _, code := range strings.Split(parts[2], ",") {
+				if net.ParseIP(code) == nil {
+					return nil, errors.New("bad return code " + code + " for DNSBL zone " + parts[0])
+				}
+				zone.Codes = append(zone.Codes, code)
+			}
+		}
+		if len(parts) > 3 {
+			return nil, errors.New("bad DNSBL zone " + z)
+		}
+		zones = append(zones, zone)
+	}
+	return zones, nil
+}
+
+// hostResolver looks up A records
+type hostResolver interface {
+	LookupHost(host string) ([]string, error)
+}
+
+// LookupHost implements hostResolver
+func (netResolver) LookupHost(host string) ([]string, error) {
+	return net.LookupHost(host)
+}
+
+// resolver used for DNSBL (can be replaced for tests)
+var dnsblResolver hostResolver = netResolver{}
+
+// dnsblReverse returns IP as used in DNSBL queries: reversed octets for IPv4,
+// reversed nibbles for IPv6
+func dnsblReverse(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	ip6 := ip.To16()
+	nibbles := make([]string, 0, 32)
+	for i := len(ip6) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, strconv.FormatInt(int64(ip6[i]&0xf), 16), strconv.FormatInt(int64(ip6[i]>>4), 16))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// dnsblCacheEntry is a cached DNSBL answer
+type dnsblCacheEntry struct {
+	Codes  []string // nil if not listed
+	Expire int64
+}
+
+// dnsblCacheGet returns cached codes of ip in zone (ok is false if there is
+// no valid entry)
+func dnsblCacheGet(zone, ip string) (codes []string, ok bool) {
+	if Bolt == nil {
+		return nil, false
+	}
+	Bolt.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("dnsbl"))
+		if b == nil {
+			return nil
+		}
+		raw := b.Get([]byte(zone + " " + ip))
+		if raw == nil {
+			return nil
+		}
+		entry := dnsblCacheEntry{}
+		if err := json.Unmarshal(raw, &entry); err != nil || entry.Expire < time.Now().Unix() {
+			return nil
+		}
+		codes, ok = entry.Codes, true
+		return nil
+	})
+	return
+}
+
+// dnsblCachePut caches codes of ip in zone
+func dnsblCachePut(zone, ip string, codes []string) {
+	if Bolt == nil || Cfg.GetSmtpdDNSBLCacheTTL() <= 0 {
+		return
+	}
+	raw, err := json.Marshal(dnsblCacheEntry{codes, time.Now().Unix() + int64(Cfg.GetSmtpdDNSBLCacheTTL())})
+	if err != nil {
+		return
+	}
+	if err = Bolt.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("dnsbl"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(zone+" "+ip), raw)
+	}); err != nil {
+		Logger.Error("dnsbl: unable to cache result for " + ip + " in " + zone + " - " + err.Error())
+	}
+}
+
+// dnsblPurgeCache removes expired entries from cache
+func dnsblPurgeCache() error {
+	now := time.Now().Unix()
+	return Bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("dnsbl"))
+		if b == nil {
+			return nil
+		}
+		expired := [][]byte{}
+		b.ForEach(func(k, v []byte) error {
+			entry := dnsblCacheEntry{}
+			if err := json.Unmarshal(v, &entry); err != nil || entry.Expire < now {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// dnsblLookup returns return codes of ip in zone (nil if not listed)
+func dnsblLookup(zone string, ip net.IP) ([]string, error) {
+	if codes, ok := dnsblCacheGet(zone, ip.String()); ok {
+		return codes, nil
+	}
+	codes, err := dnsblResolver.LookupHost(dnsblReverse(ip) + "." + zone)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			return nil, err
+		}
+		codes = nil
+	}
+	dnsblCachePut(zone, ip.String(), codes)
+	return codes, nil
+}
+
+// CheckDNSBL checks ip against zones (in parallel) and returns its score and
+// zones listing it. Zones which don't answer before timeout are ignored.
+func CheckDNSBL(ip net.IP, zones []dnsblZone, timeout time.Duration) (score int, listed []string) {
+	type answer struct {
+		zone  dnsblZone
+		codes []string
+		err   error
+	}
+	answers := make(chan answer, len(zones))
+	for _, zone := range zones {
+		go func(zone dnsblZone) {
+			codes, err := dnsblLookup(zone.Zone, ip)
+			answers <- answer{zone, codes, err}
+		}(zone)
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for range zones {
+		select {
+		case a := <-answers:
+			if a.err != nil {
+				Logger.Debug("dnsbl: lookup of " + ip.String() + " in " + a.zone.Zone + " failed - " + a.err.Error())
+				continue
+			}
+			for _, code := range a.codes {
+				if dnsblErrorCode(code) {
+					Logger.Info("dnsbl: " + a.zone.Zone + " returned error code " + code + " for " + ip.String())
+				}
+			}
+			if a.zone.match(a.codes) {
+				score += a.zone.Weight
+				listed = append(listed, a.zone.Zone)
+			}
+		case <-timer.C:
+			Logger.Debug("dnsbl: timeout while checking " + ip.String())
+			return
+		}
+	}
+	return
+}
+
+// checkDNSBL checks remote IP of session against DNSBL zones (clients
+// allowed to relay are exempted)
+func (s *SMTPServerSession) checkDNSBL() {
+	zones, err := parseDNSBLZones(Cfg.GetSmtpdDNSBLZones())
+	if err != nil {
+		s.LogError("DNSBL - " + err.Error())
+		return
+	}
+	if len(zones) == 0 {
+		return
+	}
+	if canRelay, err := IpCanRelay(s.Conn.RemoteAddr()); err != nil || canRelay {
+		return
+	}
+	host, _, err := net.SplitHostPort(s.Conn.RemoteAddr().String())
+	if err != nil {
+		return
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return
+	}
+	s.DNSBLScore, s.DNSBLListed = CheckDNSBL(ip, zones, time.Duration(Cfg.GetSmtpdDNSBLTimeout())*time.Second)
+	if len(s.DNSBLListed) != 0 {
+		s.Log(fmt.Sprintf("DNSBL - %s listed in %s - score %d", host, strings.Join(s.DNSBLListed, ", "), s.DNSBLScore))
+	}
+}
+
+// isDNSBLListed returns true if client score reaches threshold (authenticated
+// users are exempted)
+func (s *SMTPServerSession) isDNSBLListed() bool {
+	return s.user == nil && len(s.DNSBLListed) != 0 && s.DNSBLScore >= Cfg.GetSmtpdDNSBLThreshold()
+}
+
+// LaunchDNSBLCachePurger removes expired DNSBL results from cache (hourly)
+func LaunchDNSBLCachePurger() {
+	if Cfg.GetSmtpdDNSBLZones() == "" {
+		return
+	}
+	for {
+		time.Sleep(time.Hour)
+		if err := dnsblPurgeCache(); err != nil {
+			Logger.Error("dnsbl: unable to purge cache - " + err.Error())
+		}
+	}
+}
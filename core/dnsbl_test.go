@@ -0,0 +1,193 @@
+package core
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// stubHostResolver is a DNSBL resolver for tests, missing names are not
+// listed, SERVFAIL records are temporary errors and SLOW records time out
+// after 1s
+type stubHostResolver struct {
+	sync.Mutex
+	records map[string][]string
+	calls   int
+}
+
+func (r *stubHostResolver) LookupHost(host string) ([]string, error) {
+	r.Lock()
+	r.calls++
+	records, ok := r.records[host]
+	r.Unlock()
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	if len(records) == 1 && records[0] == "SERVFAIL" {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: host, IsTemporary: true}
+	}
+	if len(records) == 1 && records[0] == "SLOW" {
+		time.Sleep(time.Second)
+		return nil, &net.DNSError{Err: "i/o timeout", Name: host, IsTimeout: true}
+	}
+	return records, nil
+}
+
+// setupDNSBLTest replaces resolver and disables cache
+func setupDNSBLTest(t *testing.T, records map[string][]string) *stubHostResolver {
+	if Logger == nil {
+		Logger = logrus.New()
+	}
+	Cfg = &Config{}
+	Bolt = nil
+	resolver := &stubHostResolver{records: records}
+	dnsblResolver = resolver
+	t.Cleanup(func() { dnsblResolver = netResolver{} })
+	return resolver
+}
+
+func Test_parseDNSBLZones(t *testing.T) {
+	tests := []struct {
+		config string
+		valid  bool
+		zones  []dnsblZone
+	}{
+		{"", true, nil},
+		{"_", true, nil},
+		{"zen.example.org", true, []dnsblZone{{"zen.example.org", 1, nil}}},
+		{"Zen.Example.org.:3; bl.example.net ;", true, []dnsblZone{{"zen.example.org", 3, nil}, {"bl.example.net", 1, nil}}},
+		{"zen.example.org::127.0.0.2,127.0.0.3", true, []dnsblZone{{"zen.example.org", 1, []string{"127.0.0.2", "127.0.0.3"}}}},
+		{"zen.example.org:-2:127.0.0.4", true, []dnsblZone{{"zen.example.org", -2, []string{"127.0.0.4"}}}},
+		{"zen.example.org:x", false, nil},
+		{"zen.example.org:1:127.0.0", false, nil},
+		{"zen.example.org:1:127.0.0.2:x", false, nil},
+	}
+	for _, tt := range tests {
+		zones, err := parseDNSBLZones(tt.config)
+		assert.Equal(t, tt.valid, err == nil, tt.config)
+		assert.Equal(t, tt.zones, zones, tt.config)
+	}
+}
+
+func Test_dnsblZoneMatch(t *testing.T) {
+	all := dnsblZone{Zone: "zen.example.org", Weight: 1}
+	some := dnsblZone{Zone: "zen.example.org", Weight: 1, Codes: []string{"127.0.0.2", "127.255.255.254"}}
+	tests := []struct {
+		codes []string
+		all   bool
+		some  bool
+	}{
+		{nil, false, false},
+		{[]string{"127.0.0.2"}, true, true},
+		{[]string{"127.0.0.4"}, true, false},
+		{[]string{"127.0.0.4", "127.0.0.2"}, true, true},
+		{[]string{"10.0.0.1"}, false, false},
+		{[]string{"::1"}, false, false},
+		{[]string{"127.255.255.254"}, false, true},
+		{[]string{"127.255.255.252", "127.0.0.10"}, true, false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.all, all.match(tt.codes), "%v", tt.codes)
+		assert.Equal(t, tt.some, some.match(tt.codes), "%v", tt.codes)
+	}
+}
+
+func Test_dnsblReverse(t *testing.T) {
+	assert.Equal(t, "2.0.0.127", dnsblReverse(net.ParseIP("127.0.0.2")))
+	assert.Equal(t, "1.2.0.192", dnsblReverse(net.ParseIP("::ffff:192.0.2.1")))
+	assert.Equal(t, "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2", dnsblReverse(net.ParseIP("2001:db8::1")))
+}
+
+func Test_CheckDNSBL(t *testing.T) {
+	setupDNSBLTest(t, map[string][]string{
+		"1.2.0.192.zen.example.org":  {"127.0.0.2", "127.0.0.10"},
+		"1.2.0.192.bl.example.net":   {"127.0.0.4"},
+		"1.2.0.192.pbl.example.org":  {"127.0.0.10"},
+		"1.2.0.192.err.example.org":  {"127.255.255.254"},
+		"1.2.0.192.temp.example.org": {"SERVFAIL"},
+		"2.2.0.192.zen.example.org":  {"127.255.255.254"},
+	})
+	zones, err := parseDNSBLZones("zen.example.org:2:127.0.0.2,127.0.0.3;bl.example.net;pbl.example.org:5:127.0.0.11;err.example.org:10;temp.example.org:10")
+	assert.NoError(t, err)
+
+	score, listed := CheckDNSBL(net.ParseIP("192.0.2.1"), zones, time.Second)
+	assert.Equal(t, 3, score)
+	assert.ElementsMatch(t, []string{"zen.example.org", "bl.example.net"}, listed)
+
+	// error codes, not listed
+	for _, ip := range []string{"192.0.2.2", "192.0.2.3"} {
+		score, listed = CheckDNSBL(net.ParseIP(ip), zones, time.Second)
+		assert.Equal(t, 0, score, ip)
+		assert.Empty(t, listed, ip)
+	}
+}
+
+func Test_CheckDNSBLTimeout(t *testing.T) {
+	resolver := setupDNSBLTest(t, map[string][]string{
+		"1.2.0.192.zen.example.org":  {"127.0.0.2"},
+		"1.2.0.192.slow.example.org": {"SLOW"},
+	})
+	zones, err := parseDNSBLZones("zen.example.org;slow.example.org:10")
+	assert.NoError(t, err)
+	score, listed := CheckDNSBL(net.ParseIP("192.0.2.1"), zones, 100*time.Millisecond)
+	assert.Equal(t, 1, score)
+	assert.Equal(t, []string{"zen.example.org"}, listed)
+	resolver.Lock()
+	assert.Equal(t, 2, resolver.calls)
+	resolver.Unlock()
+}
+
+func Test_dnsblLookupCache(t *testing.T) {
+	resolver := setupDNSBLTest(t, map[string][]string{
+		"1.2.0.192.zen.example.org":  {"127.0.0.2"},
+		"1.2.0.192.temp.example.org": {"SERVFAIL"},
+	})
+	Cfg.cfg.SmtpdDNSBLCacheTTL = 3600
+	var err error
+	Bolt, err = bolt.Open(t.TempDir()+"/tmail.bolt", 0600, nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		Bolt.Close()
+		Bolt = nil
+	})
+	ip := net.ParseIP("192.0.2.1")
+
+	// listed and not listed IPs are cached
+	for i := 0; i < 2; i++ {
+		codes, err := dnsblLookup("zen.example.org", ip)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"127.0.0.2"}, codes)
+		codes, err = dnsblLookup("zen.example.org", net.ParseIP("192.0.2.2"))
+		assert.NoError(t, err)
+		assert.Nil(t, codes)
+	}
+	assert.Equal(t, 2, resolver.calls)
+
+	// errors are not cached
+	for i := 0; i < 2; i++ {
+		_, err = dnsblLookup("temp.example.org", ip)
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 4, resolver.calls)
+
+	// expired entries are ignored and purged
+	assert.NoError(t, Bolt.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("dnsbl")).Put([]byte("bl.example.net "+ip.String()), []byte(`{"Codes":["127.0.0.2"],"Expire":1}`))
+	}))
+	_, ok := dnsblCacheGet("bl.example.net", ip.String())
+	assert.False(t, ok)
+	assert.NoError(t, dnsblPurgeCache())
+	_, ok = dnsblCacheGet("zen.example.org", ip.String())
+	assert.True(t, ok)
+	assert.NoError(t, Bolt.View(func(tx *bolt.Tx) error {
+		assert.Nil(t, tx.Bucket([]byte("dnsbl")).Get([]byte("bl.example.net "+ip.String())))
+		return nil
+	}))
+}
@@ -0,0 +1,137 @@
+package core
+
+// Greylisting (RFC 6647)
+// Inbound mails from an unknown (client network, MAIL FROM, RCPT TO) triplet
+// are temporarily rejected, triplets are whitelisted after a successful
+// retry. State is stored in DB to be shared by all nodes of a cluster.
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// GreylistEntry represents a greylisted (or whitelisted) triplet
+type GreylistEntry struct {
+	Id        int64
+	Network   string // client /24 (IPv4) or /64 (IPv6)
+	MailFrom  string
+	RcptTo    string
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Passed    bool // whitelisted
+}
+
+// greylistNetwork returns network of ip used for greylisting
+func greylistNetwork(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}).String()
+}
+
+// CheckGreylist returns true if triplet (network, mailFrom, rcptTo) is
+// accepted: its first try is older than min delay and not older than max
+// delay, or it has already been whitelisted
+func CheckGreylist(network, mailFrom, rcptTo string) (bool, error) {
+	now := time.Now()
+	mailFrom, rcptTo = strings.ToLower(mailFrom), strings.ToLower(rcptTo)
+	entry := GreylistEntry{}
+	err := DB.Where("network = ? AND mail_from = ? AND rcpt_to = ?", network, mailFrom, rcptTo).First(&entry).Error
+	if err == gorm.ErrRecordNotFound {
+		entry = GreylistEntry{
+			Network:   network,
+			MailFrom:  mailFrom,
+			RcptTo:    rcptTo,
+			FirstSeen: now,
+			LastSeen:  now,
+		}
+		if err = DB.Create(&entry).Error; err == nil {
+			return false, nil
+		}
+		// the triplet may have been created by a concurrent session (unique
+		// index): its entry is evaluated, the error is only returned if
+		// there is none
+		entry = GreylistEntry{}
+		if DB.Where("network = ? AND mail_from = ? AND rcpt_to = ?", network, mailFrom, rcptTo).First(&entry).Error != nil {
+			return false, err
+		}
+	} else if err != nil {
+		return false, err
+	}
+
+	ttl := time.Duration(Cfg.GetSmtpdGreylistingTTL()) * time.Second
+	minDelay := time.Duration(Cfg.GetSmtpdGreylistingMinDelay()) * time.Second
+	maxDelay := time.Duration(Cfg.GetSmtpdGreylistingMaxDelay()) * time.Second
+	passed := false
+	switch {
+	case entry.Passed && now.Sub(entry.LastSeen) <= ttl:
+		passed = true
+	case entry.Passed || now.Sub(entry.FirstSeen) > maxDelay:
+		// expired: start again
+		entry.FirstSeen, entry.Passed = now, false
+	case now.Sub(entry.FirstSeen) < minDelay:
+		// retried too early
+	default:
+		passed = true
+	}
+	entry.LastSeen = now
+	if passed {
+		entry.Passed = true
+	}
+	return passed, DB.Save(&entry).Error
+}
+
+// purgeGreylist removes expired entries
+func purgeGreylist() error {
+	now := time.Now()
+	return DB.Where("(passed = ? AND last_seen < ?) OR (passed = ? AND first_seen < ?)",
+		true, now.Add(-time.Duration(Cfg.GetSmtpdGreylistingTTL())*time.Second),
+		false, now.Add(-time.Duration(Cfg.GetSmtpdGreylistingMaxDelay())*time.Second)).Delete(&GreylistEntry{}).Error
+}
+
+// checkGreylisting greylists current recipient of inbound mails (authenticated
+// users and clients allowed to relay are exempted). It returns false if
+// recipient has been rejected
+func (s *SMTPServerSession) checkGreylisting() bool {
+	if !Cfg.GetSmtpdGreylisting() || !s.isInbound() {
+		return true
+	}
+	host, _, err := net.SplitHostPort(s.Conn.RemoteAddr().String())
+	if err != nil {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return true
+	}
+	network := greylistNetwork(ip)
+	passed, err := CheckGreylist(network, s.Envelope.MailFrom, s.LastRcptTo)
+	if err != nil {
+		// DB errors must not block mails
+		s.LogError("greylisting - " + err.Error())
+		return true
+	}
+	if passed {
+		return true
+	}
+	s.Log("RCPT - greylisted " + network + " from " + s.Envelope.MailFrom + " to " + s.LastRcptTo)
+	s.Out("451 4.7.1 greylisted, please try again later")
+	s.SMTPResponseCode = 451
+	return false
+}
+
+// LaunchGreylistPurger removes expired greylisting entries (hourly)
+func LaunchGreylistPurger() {
+	if !Cfg.GetSmtpdGreylisting() {
+		return
+	}
+	for {
+		time.Sleep(time.Hour)
+		if err := purgeGreylist(); err != nil {
+			Logger.Error("greylisting: unable to purge entries - " + err.Error())
+		}
+	}
+}
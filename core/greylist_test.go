@@ -0,0 +1,119 @@
+package core
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupGreylistTest(t *testing.T) {
+	Cfg = &Config{}
+	Cfg.cfg.SmtpdGreylistingMinDelay = 300
+	Cfg.cfg.SmtpdGreylistingMaxDelay = 86400
+	Cfg.cfg.SmtpdGreylistingTTL = 3110400
+	var err error
+	DB, err = gorm.Open("sqlite3", ":memory:")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	// one connection: each connection has its own in-memory database
+	DB.DB().SetMaxOpenConns(1)
+	DB.LogMode(false)
+	// InitDB adds the unique index on triplets
+	if !assert.NoError(t, InitDB(DB)) {
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		DB.Close()
+		DB = nil
+	})
+}
+
+func Test_greylistNetwork(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"192.0.2.42", "192.0.2.0/24"},
+		{"::ffff:192.0.2.42", "192.0.2.0/24"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, greylistNetwork(net.ParseIP(tt.ip)), tt.ip)
+	}
+}
+
+func Test_CheckGreylist(t *testing.T) {
+	setupGreylistTest(t)
+	now := time.Now()
+	tests := []struct {
+		name      string
+		entry     *GreylistEntry // nil: unknown triplet
+		want      bool
+		wantEntry GreylistEntry
+	}{
+		{"first try", nil, false, GreylistEntry{}},
+		{"retried too early", &GreylistEntry{FirstSeen: now.Add(-time.Minute)}, false,
+			GreylistEntry{FirstSeen: now.Add(-time.Minute)}},
+		{"retried after min delay", &GreylistEntry{FirstSeen: now.Add(-10 * time.Minute)}, true,
+			GreylistEntry{FirstSeen: now.Add(-10 * time.Minute), Passed: true}},
+		{"retried after max delay", &GreylistEntry{FirstSeen: now.Add(-48 * time.Hour)}, false,
+			GreylistEntry{FirstSeen: now}},
+		{"whitelisted", &GreylistEntry{FirstSeen: now.Add(-48 * time.Hour), LastSeen: now.Add(-time.Hour), Passed: true}, true,
+			GreylistEntry{FirstSeen: now.Add(-48 * time.Hour), Passed: true}},
+		{"whitelist expired", &GreylistEntry{FirstSeen: now.Add(-48 * 24 * time.Hour), LastSeen: now.Add(-37 * 24 * time.Hour), Passed: true}, false,
+			GreylistEntry{FirstSeen: now}},
+	}
+	for i, tt := range tests {
+		network := greylistNetwork(net.IPv4(198, 51, byte(i), 1))
+		if tt.entry != nil {
+			tt.entry.Network, tt.entry.MailFrom, tt.entry.RcptTo = network, "sender@example.com", "rcpt@example.net"
+			if tt.entry.LastSeen.IsZero() {
+				tt.entry.LastSeen = tt.entry.FirstSeen
+			}
+			assert.NoError(t, DB.Create(tt.entry).Error)
+		}
+		passed, err := CheckGreylist(network, "Sender@example.com", "rcpt@Example.net")
+		assert.NoError(t, err, tt.name)
+		assert.Equal(t, tt.want, passed, tt.name)
+
+		entry := GreylistEntry{}
+		assert.NoError(t, DB.Where("network = ?", network).First(&entry).Error, tt.name)
+		assert.Equal(t, "sender@example.com", entry.MailFrom, tt.name)
+		assert.Equal(t, "rcpt@example.net", entry.RcptTo, tt.name)
+		assert.Equal(t, tt.wantEntry.Passed, entry.Passed, tt.name)
+		if !tt.wantEntry.FirstSeen.IsZero() {
+			assert.WithinDuration(t, tt.wantEntry.FirstSeen, entry.FirstSeen, 5*time.Second, tt.name)
+		}
+		assert.WithinDuration(t, now, entry.LastSeen, 5*time.Second, tt.name)
+	}
+}
+
+func Test_CheckGreylistConcurrent(t *testing.T) {
+	setupGreylistTest(t)
+	// a concurrent session creates the triplet between lookup and creation
+	firstSeen := time.Now().Add(-10 * time.Minute)
+	concurrent := true
+	DB.Callback().Create().Before("gorm:begin_transaction").Register("test:concurrent_session", func(scope *gorm.Scope) {
+		if _, ok := scope.Value.(*GreylistEntry); ok && concurrent {
+			concurrent = false
+			scope.NewDB().Create(&GreylistEntry{Network: "192.0.2.0/24", MailFrom: "sender@example.com",
+				RcptTo: "rcpt@example.net", FirstSeen: firstSeen, LastSeen: firstSeen})
+		}
+	})
+	passed, err := CheckGreylist("192.0.2.0/24", "sender@example.com", "rcpt@example.net")
+	assert.NoError(t, err)
+	// entry of the concurrent session is evaluated
+	assert.True(t, passed)
+	count := 0
+	assert.NoError(t, DB.Model(&GreylistEntry{}).Count(&count).Error)
+	assert.Equal(t, 1, count)
+
+	// other DB errors are returned
+	DB.Close()
+	_, err = CheckGreylist("192.0.2.0/24", "sender@example.com", "other@example.net")
+	assert.Error(t, err)
+}
@@ -1,9 +1,9 @@
 package core
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
+	"io"
 	"strings"
 	"sync"
 	"time"
@@ -20,6 +20,13 @@ type QMessage struct {
 	AuthUser                string // Si il y a eu authentification SMTP contient le login/user sert pour le routage
 	RcptTo                  string
 	MessageId               string
+	Body                    string // BODY parameter of MAIL command ("", "7BIT" or "8BITMIME")
+	SMTPUTF8                bool   // SMTPUTF8 parameter of MAIL command
+	DSNRet                  string // RET parameter of MAIL command (RFC 3461)
+	DSNEnvID                string // ENVID parameter of MAIL command (xtext)
+	DSNNotify               string // NOTIFY parameter of RCPT command
+	DSNOrcpt                string // ORCPT parameter of RCPT command
+	DelayWarningsSent       uint32 // number of delayed delivery warnings (DSN) sent
 	Host                    string
 	LastUpdate              time.Time
 	AddedAt                 time.Time
@@ -28,6 +35,16 @@ type QMessage struct {
 	DeliveryFailedCount     uint32
 }
 
+// dsnNotify returns true if sender wants to be notified for event
+// (SUCCESS, FAILURE or DELAY). Without NOTIFY parameter only failures
+// are notified
+func (q *QMessage) dsnNotify(event string) bool {
+	if q.DSNNotify == "" {
+		return event == "FAILURE"
+	}
+	return IsStringInSlice(event, strings.Split(q.DSNNotify, ","))
+}
+
 // Delete delete message from queue
 func (q *QMessage) Delete() error {
 	q.Lock()
@@ -113,7 +130,8 @@ func QueueGetExpiredMessages() (messages []QMessage, err error) {
 }
 
 // QueueAddMessage add a new mail in queue
-func QueueAddMessage(rawMess *[]byte, envelope message.Envelope, authUser string) (uuid string, err error) {
+// rawMess is streamed to the store
+func QueueAddMessage(rawMess io.Reader, envelope message.Envelope, authUser string) (uuid string, err error) {
 	qStore, err := NewStore(Cfg.GetStoreDriver(), Cfg.GetStoreSource())
 	if err != nil {
 		return
@@ -123,12 +141,15 @@ func QueueAddMessage(rawMess *[]byte, envelope message.Envelope, authUser string
 	if err != nil {
 		return
 	}
-	err = qStore.Put(uuid, bytes.NewReader(*rawMess))
+	// keep headers to get Message-ID
+	headers := &headersBuffer{}
+	err = qStore.Put(uuid, io.TeeReader(rawMess, headers))
 	if err != nil {
 		return
 	}
 
-	messageId := message.RawGetMessageId(rawMess)
+	rawHeaders := headers.Bytes()
+	messageId := message.RawGetMessageId(&rawHeaders)
 
 	cloop := 0
 	qmessages := []QMessage{}
@@ -139,6 +160,12 @@ func QueueAddMessage(rawMess *[]byte, envelope message.Envelope, authUser string
 			MailFrom:                envelope.MailFrom,
 			RcptTo:                  rcptTo,
 			MessageId:               string(messageId),
+			Body:                    envelope.Body,
+			SMTPUTF8:                envelope.SMTPUTF8,
+			DSNRet:                  envelope.DSNRet,
+			DSNEnvID:                envelope.DSNEnvID,
+			DSNNotify:               envelope.DSNRcpt[rcptTo].Notify,
+			DSNOrcpt:                envelope.DSNRcpt[rcptTo].Orcpt,
 			Host:                    message.GetHostFromAddress(rcptTo),
 			LastUpdate:              time.Now(),
 			AddedAt:                 time.Now(),
@@ -0,0 +1,321 @@
+package core
+
+// MTA-STS (RFC 8461)
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// mtastsMaxPolicySize is the max size of a policy file
+const mtastsMaxPolicySize = 64 * 1024
+
+// txtResolver looks up TXT records
+type txtResolver interface {
+	LookupTXT(name string) ([]string, error)
+}
+
+// mtastsPolicyFetcher fetches MTA-STS policy of a domain
+type mtastsPolicyFetcher interface {
+	FetchPolicy(domain string) ([]byte, error)
+}
+
+// netResolver is the default resolver
+type netResolver struct{}
+
+// LookupTXT implements txtResolver
+func (netResolver) LookupTXT(name string) ([]string, error) {
+	return net.LookupTXT(name)
+}
+
+// httpsPolicyFetcher is the default fetcher, it gets policy from
+// https://mta-sts.DOMAIN/.well-known/mta-sts.txt
+type httpsPolicyFetcher struct{}
+
+// FetchPolicy implements mtastsPolicyFetcher
+func (httpsPolicyFetcher) FetchPolicy(domain string) ([]byte, error) {
+	client := &http.Client{
+		Timeout: 60 * time.Second,
+		// RFC 8461 3.3: redirects must not be followed
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get("https://mta-sts." + domain + "/.well-known/mta-sts.txt")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status %d", resp.StatusCode)
+	}
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err != nil || mediaType != "text/plain" {
+		return nil, errors.New("bad content type " + resp.Header.Get("Content-Type"))
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, mtastsMaxPolicySize))
+}
+
+// resolver and fetcher used for MTA-STS (can be replaced for tests)
+var (
+	mtastsResolver txtResolver         = netResolver{}
+	mtastsFetcher  mtastsPolicyFetcher = httpsPolicyFetcher{}
+)
+
+// mtastsPolicy represents a MTA-STS policy
+type mtastsPolicy struct {
+	Domain    string
+	ID        string // id from TXT record
+	Mode      string // enforce, testing or none
+	MX        []string
+	MaxAge    int // seconds
+	FetchedAt time.Time
+}
+
+// expired returns true if policy has expired
+func (p *mtastsPolicy) expired() bool {
+	return time.Since(p.FetchedAt) > time.Duration(p.MaxAge)*time.Second
+}
+
+// enforced returns true if p is in enforce mode
+func (p *mtastsPolicy) enforced() bool {
+	return p != nil && p.Mode == "enforce"
+}
+
+// lines returns policy as text lines
+func (p *mtastsPolicy) lines() []string {
+	lines := []string{"version: STSv1", "mode: " + p.Mode}
+	for _, mx := range p.MX {
+		lines = append(lines, "mx: "+mx)
+	}
+	return append(lines, "max_age: "+strconv.Itoa(p.MaxAge))
+}
+
+// matchMX returns true if host is allowed by policy
+// "*.example.com" matches "mx.example.com" but not "a.mx.example.com"
+func (p *mtastsPolicy) matchMX(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range p.MX {
+		pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+		if strings.HasPrefix(pattern, "*.") {
+			if i := strings.Index(host, "."); i > 0 && host[i:] == pattern[1:] {
+				return true
+			}
+			continue
+		}
+		if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMTASTSPolicy parses a policy file
+func parseMTASTSPolicy(raw []byte) (*mtastsPolicy, error) {
+	p := &mtastsPolicy{MaxAge: -1}
+	version := ""
+	for _, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("bad policy line: " + line)
+		}
+		value := strings.TrimSpace(kv[1])
+		switch strings.TrimSpace(kv[0]) {
+		case "version":
+			version = value
+		case "mode":
+			p.Mode = value
+		case "max_age":
+			maxAge, err := strconv.Atoi(value)
+			if err != nil || maxAge < 0 || maxAge > 31557600 {
+				return nil, errors.New("bad max_age: " + value)
+			}
+			p.MaxAge = maxAge
+		case "mx":
+			p.MX = append(p.MX, value)
+		}
+	}
+	if version != "STSv1" {
+		return nil, errors.New("bad or missing version")
+	}
+	if p.Mode != "enforce" && p.Mode != "testing" && p.Mode != "none" {
+		return nil, errors.New("bad or missing mode")
+	}
+	if p.MaxAge == -1 {
+		return nil, errors.New("missing max_age")
+	}
+	if p.Mode != "none" && len(p.MX) == 0 {
+		return nil, errors.New("missing mx")
+	}
+	return p, nil
+}
+
+// mtastsLookupID returns id of the MTA-STS TXT record of domain
+// returns "" if domain has no (valid) record
+func mtastsLookupID(domain string) (string, error) {
+	records, err := mtastsResolver.LookupTXT("_mta-sts." + domain)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+	id := ""
+	for _, record := range records {
+		if !strings.HasPrefix(record, "v=STSv1") {
+			continue
+		}
+		// RFC 8461 3.1: if there is more than one record, there is no policy
+		if id != "" {
+			return "", nil
+		}
+		for _, field := range strings.Split(record, ";") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) == 2 && kv[0] == "id" {
+				id = kv[1]
+			}
+		}
+	}
+	return id, nil
+}
+
+// mtastsCache caches policies in memory and in Bolt (if available)
+var mtastsCache = struct {
+	sync.Mutex
+	policies map[string]*mtastsPolicy
+}{policies: make(map[string]*mtastsPolicy)}
+
+// mtastsCacheGet returns cached policy of domain (or nil)
+func mtastsCacheGet(domain string) *mtastsPolicy {
+	mtastsCache.Lock()
+	defer mtastsCache.Unlock()
+	if p, ok := mtastsCache.policies[domain]; ok {
+		return p
+	}
+	if Bolt == nil {
+		return nil
+	}
+	var p *mtastsPolicy
+	Bolt.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("mtasts"))
+		if b == nil {
+			return nil
+		}
+		if raw := b.Get([]byte(domain)); raw != nil {
+			p = &mtastsPolicy{}
+			if err := json.Unmarshal(raw, p); err != nil {
+				p = nil
+			}
+		}
+		return nil
+	})
+	if p != nil {
+		mtastsCache.policies[domain] = p
+	}
+	return p
+}
+
+// mtastsCachePut caches policy
+func mtastsCachePut(p *mtastsPolicy) {
+	mtastsCache.Lock()
+	defer mtastsCache.Unlock()
+	mtastsCache.policies[p.Domain] = p
+	if Bolt == nil {
+		return
+	}
+	raw, err := json.Marshal(p)
+	if err != nil {
+		return
+	}
+	if err = Bolt.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("mtasts"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(p.Domain), raw)
+	}); err != nil {
+		Logger.Error("mta-sts: unable to cache policy of " + p.Domain + " - " + err.Error())
+	}
+}
+
+// getMTASTSPolicy returns MTA-STS policy of domain (nil if there is none)
+func getMTASTSPolicy(domain string) (*mtastsPolicy, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	cached := mtastsCacheGet(domain)
+	if cached != nil && cached.expired() {
+		cached = nil
+	}
+	id, err := mtastsLookupID(domain)
+	if err != nil {
+		// RFC 8461 5.1: a valid cached policy is used
+		return cached, err
+	}
+	if id == "" {
+		return cached, nil
+	}
+	if cached != nil && cached.ID == id {
+		return cached, nil
+	}
+	raw, err := mtastsFetcher.FetchPolicy(domain)
+	if err != nil {
+		return cached, fmt.Errorf("unable to fetch policy - %s", err)
+	}
+	policy, err := parseMTASTSPolicy(raw)
+	if err != nil {
+		return cached, fmt.Errorf("invalid policy - %s", err)
+	}
+	policy.Domain = domain
+	policy.ID = id
+	policy.FetchedAt = time.Now()
+	mtastsCachePut(policy)
+	return policy, nil
+}
+
+// applyMTASTS applies MTA-STS policy of domain to MX routes and returns it
+// (nil if domain has no policy or its mode is none)
+// in enforce mode only routes to MX allowed by policy are kept and a verified
+// TLS connection is required. In testing mode policy failures are only logged.
+func applyMTASTS(domain string, routes []Route) (filtered []Route, policy *mtastsPolicy, err error) {
+	filtered = routes
+	if !Cfg.GetDeliverdMTASTS() || len(routes) == 0 || !routes[0].IsMX {
+		return
+	}
+	policy, perr := getMTASTSPolicy(domain)
+	if perr != nil {
+		Logger.Info("mta-sts: " + domain + " - " + perr.Error())
+	}
+	if policy == nil || policy.Mode == "none" {
+		return routes, nil, nil
+	}
+	matching := []Route{}
+	for _, route := range routes {
+		if policy.matchMX(route.RemoteHost) {
+			matching = append(matching, route)
+		}
+	}
+	if policy.Mode == "testing" {
+		if len(matching) != len(routes) {
+			Logger.Info(fmt.Sprintf("mta-sts: %s - %d/%d MX not allowed by policy %s (testing mode)", domain, len(routes)-len(matching), len(routes), policy.ID))
+		}
+		return
+	}
+	if len(matching) == 0 {
+		return nil, policy, errors.New("no MX of " + domain + " is allowed by its MTA-STS policy " + policy.ID)
+	}
+	return matching, policy, nil
+}
@@ -0,0 +1,216 @@
+package core
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// stubTXTResolver is a TXT resolver for tests, missing names don't exist and
+// SERVFAIL records are temporary errors
+type stubTXTResolver map[string][]string
+
+func (r stubTXTResolver) LookupTXT(name string) ([]string, error) {
+	records, ok := r[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	if len(records) == 1 && records[0] == "SERVFAIL" {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	return records, nil
+}
+
+// stubPolicyFetcher is a MTA-STS policy fetcher for tests
+type stubPolicyFetcher struct {
+	policies map[string]string
+	calls    int
+}
+
+func (f *stubPolicyFetcher) FetchPolicy(domain string) ([]byte, error) {
+	f.calls++
+	policy, ok := f.policies[domain]
+	if !ok {
+		return nil, errors.New("unexpected HTTP status 404")
+	}
+	return []byte(policy), nil
+}
+
+// setupMTASTSTest replaces resolver and fetcher and empties cache
+func setupMTASTSTest(t *testing.T, resolver stubTXTResolver, fetcher *stubPolicyFetcher) {
+	if Logger == nil {
+		Logger = logrus.New()
+	}
+	Cfg = &Config{}
+	Cfg.cfg.DeliverdMTASTS = true
+	Bolt = nil
+	mtastsCache.policies = make(map[string]*mtastsPolicy)
+	mtastsResolver, mtastsFetcher = resolver, fetcher
+	t.Cleanup(func() {
+		mtastsResolver, mtastsFetcher = netResolver{}, httpsPolicyFetcher{}
+	})
+}
+
+func Test_parseMTASTSPolicy(t *testing.T) {
+	tests := []struct {
+		raw   string
+		valid bool
+	}{
+		{"version: STSv1\r\nmode: enforce\r\nmx: mx1.example.com\r\nmx: *.example.net\r\nmax_age: 86400\r\n", true},
+		{"version: STSv1\nmode: testing\nmx: mx1.example.com\nmax_age: 0\n", true},
+		{"version: STSv1\nmode: none\nmax_age: 86400\n", true},
+		{"version: STSv1\nmode: enforce\nmx: mx1.example.com\nmax_age: 86400\nfoo: bar\n", true},
+		{"mode: enforce\nmx: mx1.example.com\nmax_age: 86400\n", false},
+		{"version: STSv2\nmode: enforce\nmx: mx1.example.com\nmax_age: 86400\n", false},
+		{"version: STSv1\nmode: reject\nmx: mx1.example.com\nmax_age: 86400\n", false},
+		{"version: STSv1\nmode: enforce\nmx: mx1.example.com\n", false},
+		{"version: STSv1\nmode: enforce\nmx: mx1.example.com\nmax_age: -1\n", false},
+		{"version: STSv1\nmode: enforce\nmx: mx1.example.com\nmax_age: 31557601\n", false},
+		{"version: STSv1\nmode: enforce\nmax_age: 86400\n", false},
+		{"version: STSv1\nmode enforce\nmx: mx1.example.com\nmax_age: 86400\n", false},
+	}
+	for _, tt := range tests {
+		_, err := parseMTASTSPolicy([]byte(tt.raw))
+		assert.Equal(t, tt.valid, err == nil, tt.raw)
+	}
+
+	p, err := parseMTASTSPolicy([]byte(tests[0].raw))
+	assert.NoError(t, err)
+	assert.Equal(t, "enforce", p.Mode)
+	assert.Equal(t, []string{"mx1.example.com", "*.example.net"}, p.MX)
+	assert.Equal(t, 86400, p.MaxAge)
+}
+
+func Test_mtastsPolicyMatchMX(t *testing.T) {
+	p := &mtastsPolicy{MX: []string{"mx1.example.com", "*.example.net."}}
+	tests := []struct {
+		host  string
+		match bool
+	}{
+		{"mx1.example.com", true},
+		{"MX1.Example.com.", true},
+		{"mx2.example.com", false},
+		{"mx.example.net", true},
+		{"mx.example.net.", true},
+		{"a.mx.example.net", false},
+		{"example.net", false},
+		{"mxexample.net", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.match, p.matchMX(tt.host), tt.host)
+	}
+}
+
+func Test_getMTASTSPolicy(t *testing.T) {
+	resolver := stubTXTResolver{"_mta-sts.example.com": {"v=STSv1; id=1;"}}
+	fetcher := &stubPolicyFetcher{policies: map[string]string{
+		"example.com": "version: STSv1\nmode: enforce\nmx: mx1.example.com\nmax_age: 86400\n",
+	}}
+	setupMTASTSTest(t, resolver, fetcher)
+
+	// fetched then cached
+	p, err := getMTASTSPolicy("Example.com.")
+	assert.NoError(t, err)
+	assert.Equal(t, "example.com", p.Domain)
+	assert.Equal(t, "1", p.ID)
+	assert.Equal(t, 1, fetcher.calls)
+	p, err = getMTASTSPolicy("example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", p.ID)
+	assert.Equal(t, 1, fetcher.calls)
+
+	// new id: policy is refreshed
+	resolver["_mta-sts.example.com"] = []string{"v=STSv1; id=2;"}
+	fetcher.policies["example.com"] = "version: STSv1\nmode: testing\nmx: mx1.example.com\nmax_age: 86400\n"
+	p, err = getMTASTSPolicy("example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "2", p.ID)
+	assert.Equal(t, "testing", p.Mode)
+	assert.Equal(t, 2, fetcher.calls)
+
+	// DNS failure or invalid new policy: cached policy is used
+	resolver["_mta-sts.example.com"] = []string{"SERVFAIL"}
+	p, err = getMTASTSPolicy("example.com")
+	assert.Error(t, err)
+	assert.Equal(t, "2", p.ID)
+	resolver["_mta-sts.example.com"] = []string{"v=STSv1; id=3;"}
+	fetcher.policies["example.com"] = "version: STSv1\nmode: enforce\n"
+	p, err = getMTASTSPolicy("example.com")
+	assert.Error(t, err)
+	assert.Equal(t, "2", p.ID)
+
+	// expired policy is not used
+	p.FetchedAt = time.Now().Add(-86401 * time.Second)
+	resolver["_mta-sts.example.com"] = []string{"SERVFAIL"}
+	p, err = getMTASTSPolicy("example.com")
+	assert.Error(t, err)
+	assert.Nil(t, p)
+
+	// no policy: no record, several records
+	p, err = getMTASTSPolicy("example.org")
+	assert.NoError(t, err)
+	assert.Nil(t, p)
+	resolver["_mta-sts.example.org"] = []string{"v=STSv1; id=1;", "v=STSv1; id=2;"}
+	p, err = getMTASTSPolicy("example.org")
+	assert.NoError(t, err)
+	assert.Nil(t, p)
+}
+
+func Test_applyMTASTS(t *testing.T) {
+	resolver := stubTXTResolver{
+		"_mta-sts.enforce.com": {"v=STSv1; id=1;"},
+		"_mta-sts.testing.com": {"v=STSv1; id=1;"},
+		"_mta-sts.none.com":    {"v=STSv1; id=1;"},
+	}
+	fetcher := &stubPolicyFetcher{policies: map[string]string{
+		"enforce.com": "version: STSv1\nmode: enforce\nmx: mx1.example.com\nmx: *.example.net\nmax_age: 86400\n",
+		"testing.com": "version: STSv1\nmode: testing\nmx: mx1.example.com\nmax_age: 86400\n",
+		"none.com":    "version: STSv1\nmode: none\nmax_age: 86400\n",
+	}}
+	setupMTASTSTest(t, resolver, fetcher)
+	routes := []Route{
+		{RemoteHost: "mx1.example.com.", IsMX: true},
+		{RemoteHost: "evil.example.org.", IsMX: true},
+		{RemoteHost: "mx.example.net.", IsMX: true},
+	}
+
+	// enforce mode: only allowed MX are kept
+	filtered, policy, err := applyMTASTS("enforce.com", routes)
+	assert.NoError(t, err)
+	assert.True(t, policy.enforced())
+	assert.Equal(t, []Route{routes[0], routes[2]}, filtered)
+	_, policy, err = applyMTASTS("enforce.com", routes[1:2])
+	assert.Error(t, err)
+	assert.True(t, policy.enforced())
+
+	// testing mode: routes are kept
+	filtered, policy, err = applyMTASTS("testing.com", routes)
+	assert.NoError(t, err)
+	assert.Equal(t, "testing", policy.Mode)
+	assert.False(t, policy.enforced())
+	assert.Equal(t, routes, filtered)
+
+	// none mode, no policy
+	for _, domain := range []string{"none.com", "example.org"} {
+		filtered, policy, err = applyMTASTS(domain, routes)
+		assert.NoError(t, err)
+		assert.Nil(t, policy)
+		assert.Equal(t, routes, filtered)
+	}
+
+	// routes from DB (not MX) and disabled MTA-STS
+	dbRoutes := []Route{{RemoteHost: "evil.example.org"}}
+	filtered, policy, err = applyMTASTS("enforce.com", dbRoutes)
+	assert.NoError(t, err)
+	assert.Nil(t, policy)
+	assert.Equal(t, dbRoutes, filtered)
+	Cfg.cfg.DeliverdMTASTS = false
+	filtered, policy, err = applyMTASTS("enforce.com", routes[1:2])
+	assert.NoError(t, err)
+	assert.Nil(t, policy)
+	assert.Equal(t, routes[1:2], filtered)
+}
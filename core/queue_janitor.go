@@ -0,0 +1,165 @@
+package core
+
+// Queue janitor
+// keeps DB queue and nsqd in sync (eg after a crash):
+// - messages stuck in delivery (status 0) or overdue are republished
+// - raw messages in store without QMessage are removed
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// storeWalker is implemented by stores which can list their keys
+type storeWalker interface {
+	// Walk calls fn for each key in store
+	Walk(fn func(key string, modTime time.Time) error) error
+}
+
+// QueueJanitorSummary is the summary of a queue janitor run
+type QueueJanitorSummary struct {
+	Stuck          int // messages in delivery for too long
+	Overdue        int // scheduled messages never delivered to deliverd
+	Republished    int
+	OrphansRemoved int // raw messages removed from store
+	Errors         int
+	Duration       time.Duration
+}
+
+// String implements fmt.Stringer
+func (s QueueJanitorSummary) String() string {
+	return fmt.Sprintf("%d stuck, %d overdue, %d republished, %d orphans removed from store, %d errors in %v", s.Stuck, s.Overdue, s.Republished, s.OrphansRemoved, s.Errors, s.Duration)
+}
+
+// QueueGetStuckMessages returns messages in delivery (status 0) not
+// updated since timeout
+func QueueGetStuckMessages(timeout time.Duration) (messages []QMessage, err error) {
+	messages = []QMessage{}
+	err = DB.Where("status = ? AND last_update < ?", 0, time.Now().Add(-timeout)).Find(&messages).Error
+	return
+}
+
+// QueueGetOverdueMessages returns messages waiting for delivery which should
+// have been processed by deliverd more than timeout ago
+// As deliverd requeues messages in nsqd at most maxNSQRequeueDelay (1h) a
+// message which is overdue for a long time has (very likely) been lost by nsqd
+func QueueGetOverdueMessages(timeout time.Duration) (messages []QMessage, err error) {
+	messages = []QMessage{}
+	err = DB.Where("status <> ? AND next_delivery_scheduled_at < ? AND last_update < ?", 0, time.Now().Add(-timeout), time.Now().Add(-timeout)).Find(&messages).Error
+	return
+}
+
+// queueRepublish claims m and publishes it to todeliver topic. The claim
+// (conditional update) ensures that only one janitor of a cluster republishes
+// m, ok is false if m has been handled by another process.
+// If m was in fact still in nsqd, deliverd gets two copies of it: only one
+// of them can claim it (see processMsg), the other one is requeued.
+func queueRepublish(m *QMessage, timeout time.Duration) (ok bool, err error) {
+	if NsqQueueProducer == nil {
+		if err = initMailQueueProducer(); err != nil {
+			return
+		}
+	}
+	status := m.Status
+	if status == 0 {
+		status = 2
+	}
+	now := time.Now()
+	res := DB.Model(&QMessage{}).Where("id = ? AND status = ? AND last_update < ?", m.Id, m.Status, now.Add(-timeout)).Updates(map[string]interface{}{"status": status, "next_delivery_scheduled_at": now, "last_update": now})
+	if res.Error != nil || res.RowsAffected != 1 {
+		return false, res.Error
+	}
+	m.Status, m.NextDeliveryScheduledAt, m.LastUpdate = status, now, now
+	jMsg, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	if err = NsqQueueProducer.Publish("todeliver", jMsg); err != nil {
+		return
+	}
+	return true, nil
+}
+
+// QueueJanitor runs the queue janitor once
+func QueueJanitor() (summary QueueJanitorSummary, err error) {
+	start := time.Now()
+	timeout := time.Duration(Cfg.GetDeliverdJanitorTimeout()) * time.Minute
+
+	// stuck & overdue messages
+	stuck, err := QueueGetStuckMessages(timeout)
+	if err != nil {
+		return
+	}
+	summary.Stuck = len(stuck)
+	overdue, err := QueueGetOverdueMessages(timeout)
+	if err != nil {
+		return
+	}
+	summary.Overdue = len(overdue)
+	toRepublish := append(stuck, overdue...)
+	for i := range toRepublish {
+		m := &toRepublish[i]
+		ok, err := queueRepublish(m, timeout)
+		if err != nil {
+			Logger.Error(fmt.Sprintf("queue janitor: unable to republish message %d (%s) - %s", m.Id, m.Uuid, err))
+			summary.Errors++
+			continue
+		}
+		if !ok {
+			Logger.Debug(fmt.Sprintf("queue janitor: message %d (%s) already handled by another process", m.Id, m.Uuid))
+			continue
+		}
+		Logger.Info(fmt.Sprintf("queue janitor: message %d (%s) from %s to %s republished", m.Id, m.Uuid, m.MailFrom, m.RcptTo))
+		summary.Republished++
+	}
+
+	// orphaned raw messages
+	// to not remove messages being queued, only "old" keys are checked
+	walker, ok := Store.(storeWalker)
+	if !ok {
+		Logger.Debug("queue janitor: store " + Cfg.GetStoreDriver() + " can't be walked, orphaned messages will not be removed")
+	} else {
+		err = walker.Walk(func(key string, modTime time.Time) error {
+			if time.Since(modTime) < timeout {
+				return nil
+			}
+			var c uint
+			if err := DB.Model(QMessage{}).Where("`uuid` = ?", key).Count(&c).Error; err != nil {
+				return err
+			}
+			if c != 0 {
+				return nil
+			}
+			if err := Store.Del(key); err != nil {
+				Logger.Error("queue janitor: unable to remove orphaned message " + key + " from store - " + err.Error())
+				summary.Errors++
+				return nil
+			}
+			Logger.Info("queue janitor: orphaned message " + key + " removed from store")
+			summary.OrphansRemoved++
+			return nil
+		})
+		if err != nil {
+			return
+		}
+	}
+	summary.Duration = time.Since(start)
+	Logger.Info("queue janitor: " + summary.String())
+	return
+}
+
+// LaunchQueueJanitor runs queue janitor periodically
+func LaunchQueueJanitor() {
+	interval := Cfg.GetDeliverdJanitorInterval()
+	if interval <= 0 {
+		Logger.Info("queue janitor disabled")
+		return
+	}
+	for {
+		time.Sleep(time.Duration(interval) * time.Minute)
+		if _, err := QueueJanitor(); err != nil {
+			Logger.Error("queue janitor: " + err.Error())
+		}
+	}
+}
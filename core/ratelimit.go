@@ -0,0 +1,191 @@
+package core
+
+// Rate limiting
+// Sliding windows on connections per client IP, messages per hour and
+// recipients per day of authenticated users. Messages and recipients events
+// are stored in DB to be shared by all nodes of a cluster, connections are
+// counted in memory by each node.
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimitEvent represents events (connections, messages or recipients)
+// counted by rate limits
+type RateLimitEvent struct {
+	Id      int64
+	Counter string // eg: "msg user@example.com", "rcpt user@example.com"
+	Created time.Time
+	Count   int
+}
+
+// rateLimitCount returns number of events of counter during window
+func rateLimitCount(counter string, window time.Duration) (n int, err error) {
+	err = DB.Model(&RateLimitEvent{}).Where("counter = ? AND created > ?", counter, time.Now().Add(-window)).Select("COALESCE(SUM(count), 0)").Row().Scan(&n)
+	return
+}
+
+// rateLimitRecord records count events of counter
+func rateLimitRecord(counter string, count int) error {
+	return DB.Create(&RateLimitEvent{Counter: counter, Created: time.Now(), Count: count}).Error
+}
+
+// RateLimitExceeded returns true if count more events of counter exceed limit
+// during window (0: unlimited)
+func RateLimitExceeded(counter string, limit, count int, window time.Duration) (bool, error) {
+	if limit <= 0 {
+		return false, nil
+	}
+	n, err := rateLimitCount(counter, window)
+	if err != nil {
+		return false, err
+	}
+	return n+count > limit, nil
+}
+
+// purgeRateLimits removes events older than the largest window
+func purgeRateLimits() error {
+	return DB.Where("created < ?", time.Now().Add(-24*time.Hour)).Delete(&RateLimitEvent{}).Error
+}
+
+// connRates holds, per client IP, times of its last connections (at most
+// limit)
+var connRates = struct {
+	sync.Mutex
+	conns map[string][]time.Time
+}{conns: make(map[string][]time.Time)}
+
+// connRateLimitHit records a connection of ip and returns true if there was
+// already limit connections of ip during window
+func connRateLimitHit(ip string, limit int, window time.Duration) bool {
+	now := time.Now()
+	connRates.Lock()
+	defer connRates.Unlock()
+	conns := connRates.conns[ip]
+	n := 0
+	for _, t := range conns {
+		if now.Sub(t) < window {
+			n++
+		}
+	}
+	conns = append(conns, now)
+	if len(conns) > limit {
+		conns = conns[len(conns)-limit:]
+	}
+	connRates.conns[ip] = conns
+	return n >= limit
+}
+
+// purgeConnRates removes IPs without connection during window
+func purgeConnRates(window time.Duration) {
+	now := time.Now()
+	connRates.Lock()
+	defer connRates.Unlock()
+	for ip, conns := range connRates.conns {
+		if now.Sub(conns[len(conns)-1]) >= window {
+			delete(connRates.conns, ip)
+		}
+	}
+}
+
+// checkConnRateLimit checks the connections rate of client IP (clients
+// allowed to relay are exempted). It returns false if the limit is exceeded
+func (s *SMTPServerSession) checkConnRateLimit() bool {
+	limit := Cfg.GetSmtpdRateLimitConnPerIP()
+	if limit <= 0 {
+		return true
+	}
+	ip, _, err := net.SplitHostPort(s.Conn.RemoteAddr().String())
+	if err != nil {
+		return true
+	}
+	if !connRateLimitHit(ip, limit, time.Duration(Cfg.GetSmtpdRateLimitConnWindow())*time.Second) {
+		return true
+	}
+	// DB errors must not block clients
+	if canRelay, err := IpCanRelay(s.Conn.RemoteAddr()); err != nil || canRelay {
+		return true
+	}
+	s.Log(fmt.Sprintf("GREETING - connection rate limit reached for %s (%d/%ds)", ip, limit, Cfg.GetSmtpdRateLimitConnWindow()))
+	s.Out("421 4.7.0 too many connections from your IP, try again later " + s.uuid)
+	s.SMTPResponseCode = 421
+	s.ExitAsap()
+	return false
+}
+
+// checkMsgRateLimit checks the messages rate of authenticated user. It
+// returns false if the limit is reached
+func (s *SMTPServerSession) checkMsgRateLimit() bool {
+	if s.user == nil {
+		return true
+	}
+	limit := s.user.msgPerHourLimit()
+	exceeded, err := RateLimitExceeded("msg "+s.user.Login, limit, 1, time.Hour)
+	if err != nil {
+		s.LogError("rate limit - " + err.Error())
+		return true
+	}
+	if !exceeded {
+		return true
+	}
+	s.Log(fmt.Sprintf("MAIL - message rate limit reached for %s (%d/hour)", s.user.Login, limit))
+	s.pause(2)
+	s.Out("451 4.7.1 message rate limit exceeded, try again later")
+	s.SMTPResponseCode = 451
+	return false
+}
+
+// checkRcptRateLimit checks the recipients rate of authenticated user,
+// including recipients of current transaction. It returns false if the limit
+// is reached
+func (s *SMTPServerSession) checkRcptRateLimit() bool {
+	if s.user == nil || IsStringInSlice(s.LastRcptTo, s.Envelope.RcptTo) {
+		return true
+	}
+	limit := s.user.rcptPerDayLimit()
+	exceeded, err := RateLimitExceeded("rcpt "+s.user.Login, limit, len(s.Envelope.RcptTo)+1, 24*time.Hour)
+	if err != nil {
+		s.LogError("rate limit - " + err.Error())
+		return true
+	}
+	if !exceeded {
+		return true
+	}
+	s.Log(fmt.Sprintf("RCPT - recipient rate limit reached for %s (%d/day)", s.user.Login, limit))
+	s.pause(2)
+	s.Out("451 4.7.1 recipient rate limit exceeded, try again later")
+	s.SMTPResponseCode = 451
+	return false
+}
+
+// recordRateLimits records current message and its recipients for rate
+// limits of authenticated user
+func (s *SMTPServerSession) recordRateLimits() {
+	if s.user == nil {
+		return
+	}
+	if s.user.msgPerHourLimit() > 0 {
+		if err := rateLimitRecord("msg "+s.user.Login, 1); err != nil {
+			s.LogError("rate limit - unable to record message - " + err.Error())
+		}
+	}
+	if s.user.rcptPerDayLimit() > 0 {
+		if err := rateLimitRecord("rcpt "+s.user.Login, len(s.Envelope.RcptTo)); err != nil {
+			s.LogError("rate limit - unable to record recipients - " + err.Error())
+		}
+	}
+}
+
+// LaunchRateLimitPurger removes expired rate limits events (hourly)
+func LaunchRateLimitPurger() {
+	for {
+		time.Sleep(time.Hour)
+		purgeConnRates(time.Duration(Cfg.GetSmtpdRateLimitConnWindow()) * time.Second)
+		if err := purgeRateLimits(); err != nil {
+			Logger.Error("rate limit: unable to purge events - " + err.Error())
+		}
+	}
+}
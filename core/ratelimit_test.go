@@ -0,0 +1,102 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_connRateLimitHit(t *testing.T) {
+	t.Cleanup(func() { connRates.conns = make(map[string][]time.Time) })
+	now := time.Now()
+	tests := []struct {
+		name  string
+		conns []time.Duration // age of previous connections
+		limit int
+		want  bool
+	}{
+		{"first connection", nil, 2, false},
+		{"under limit", []time.Duration{10 * time.Second}, 2, false},
+		{"limit reached", []time.Duration{30 * time.Second, 10 * time.Second}, 2, true},
+		{"expired connections", []time.Duration{2 * time.Minute, 90 * time.Second, 10 * time.Second}, 2, false},
+		{"limit of 1", []time.Duration{59 * time.Second}, 1, true},
+	}
+	for _, tt := range tests {
+		ip := "192.0.2.1"
+		connRates.conns[ip] = nil
+		for _, age := range tt.conns {
+			connRates.conns[ip] = append(connRates.conns[ip], now.Add(-age))
+		}
+		assert.Equal(t, tt.want, connRateLimitHit(ip, tt.limit, time.Minute), tt.name)
+		// connection is recorded, at most limit connections are kept
+		conns := connRates.conns[ip]
+		assert.True(t, len(conns) <= tt.limit, tt.name)
+		assert.WithinDuration(t, now, conns[len(conns)-1], 5*time.Second, tt.name)
+	}
+
+	// refused connections are counted
+	connRates.conns = make(map[string][]time.Time)
+	for i := 0; i < 3; i++ {
+		assert.False(t, connRateLimitHit("192.0.2.2", 3, time.Minute))
+	}
+	assert.True(t, connRateLimitHit("192.0.2.2", 3, time.Minute))
+	assert.False(t, connRateLimitHit("192.0.2.3", 3, time.Minute))
+
+	// purge
+	connRates.conns["192.0.2.4"] = []time.Time{now.Add(-2 * time.Minute)}
+	purgeConnRates(time.Minute)
+	assert.Len(t, connRates.conns, 2)
+	assert.NotContains(t, connRates.conns, "192.0.2.4")
+}
+
+func Test_RateLimitExceeded(t *testing.T) {
+	var err error
+	DB, err = gorm.Open("sqlite3", ":memory:")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.NoError(t, AutoMigrateDB(DB))
+	t.Cleanup(func() {
+		DB.Close()
+		DB = nil
+	})
+	now := time.Now()
+	for _, e := range []RateLimitEvent{
+		{Counter: "rcpt john@example.com", Created: now.Add(-25 * time.Hour), Count: 10},
+		{Counter: "rcpt john@example.com", Created: now.Add(-2 * time.Hour), Count: 3},
+		{Counter: "rcpt john@example.com", Created: now.Add(-time.Minute), Count: 2},
+		{Counter: "rcpt jane@example.com", Created: now.Add(-time.Minute), Count: 10},
+	} {
+		e := e
+		assert.NoError(t, DB.Create(&e).Error)
+	}
+	assert.NoError(t, rateLimitRecord("rcpt john@example.com", 1))
+
+	tests := []struct {
+		name   string
+		limit  int
+		count  int
+		window time.Duration
+		want   bool
+	}{
+		{"unlimited", 0, 100, 24 * time.Hour, false},
+		{"under limit", 10, 3, 24 * time.Hour, false},
+		{"limit reached", 10, 4, 24 * time.Hour, false},
+		{"limit exceeded", 10, 5, 24 * time.Hour, true},
+		{"smaller window", 5, 2, time.Hour, false},
+		{"smaller window exceeded", 5, 3, time.Hour, true},
+	}
+	for _, tt := range tests {
+		exceeded, err := RateLimitExceeded("rcpt john@example.com", tt.limit, tt.count, tt.window)
+		assert.NoError(t, err, tt.name)
+		assert.Equal(t, tt.want, exceeded, tt.name)
+	}
+
+	// purge removes events older than a day
+	assert.NoError(t, purgeRateLimits())
+	n, err := rateLimitCount("rcpt john@example.com", 48*time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, n)
+}
@@ -171,6 +171,12 @@ func InitBolt() error {
 		if _, err = tx.CreateBucketIfNotExists([]byte("koip")); err != nil {
 			return err
 		}
+		if _, err = tx.CreateBucketIfNotExists([]byte("mtasts")); err != nil {
+			return err
+		}
+		if _, err = tx.CreateBucketIfNotExists([]byte("dnsbl")); err != nil {
+			return err
+		}
 		return nil
 	})
 }
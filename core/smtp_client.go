@@ -3,6 +3,7 @@
 package core
 
 import (
+	"bufio"
 	"crypto/tls"
 	"database/sql"
 	"encoding/base64"
@@ -29,14 +30,39 @@ type smtpClient struct {
 	ext map[string]string
 	// whether the Client is using TLS
 	tls bool
+	// whether the server certificate has been verified
+	tlsVerified bool
+	// usable TLSA records of remote host (DANE)
+	daneRecords []tlsaRecord
 	// supported auth mechanisms
 	auth []string
 	// timeout per command
 	timeoutBasePerCmd int
+	// number of messages sent (connection pool)
+	messages int
+	// idle in pool since
+	idleSince time.Time
+	closed    bool
+}
+
+// errRemoteHostsBusy is returned by newSMTPClient when all remote hosts
+// have reached their max number of connections
+var errRemoteHostsBusy = errors.New("max connections per host reached for all remote hosts")
+
+// daneLookupError is returned by newSMTPClient when TLSA records of a remote
+// host can't be trusted
+type daneLookupError struct {
+	host string
+	err  error
+}
+
+func (e *daneLookupError) Error() string {
+	return "DANE failed for " + e.host + " - " + e.err.Error()
 }
 
 // newSMTPClient return a connected SMTP client
 func newSMTPClient(d *Delivery, routes []Route, timeoutBasePerCmd int) (client *smtpClient, err error) {
+	busy := false
 	for _, route := range routes {
 		localIPs := []net.IP{}
 		remoteAddresses := []net.TCPAddr{}
@@ -87,6 +113,13 @@ func newSMTPClient(d *Delivery, routes []Route, timeoutBasePerCmd int) (client *
 			localIPs = append(localIPs, ip)
 		}
 
+		// DANE: TLSA records of remote host, server certificate is checked
+		// against them during TLS handshake
+		var daneRecords []tlsaRecord
+		if daneRecords, err = getDANERecords(&route); err != nil {
+			return nil, &daneLookupError{route.RemoteHost, err}
+		}
+
 		// remoteAdresses
 		// Hostname or IP
 		// IP ?
@@ -130,11 +163,23 @@ func newSMTPClient(d *Delivery, routes []Route, timeoutBasePerCmd int) (client *
 					return nil, errors.New("bad local IP: " + localIP.String() + ". " + err.Error())
 				}
 
+				// max connections to remote host
+				// idle connections to this host which can't be used by
+				// this route (other key or unverified TLS) are closed first
+				if !smtpPool.acquireHost(route.RemoteHost) {
+					if !smtpPool.evictIdle(route.RemoteHost) || !smtpPool.acquireHost(route.RemoteHost) {
+						busy = true
+						continue
+					}
+				}
+
 				// Dial timeout
 				connectTimer := time.NewTimer(time.Duration(timeoutBasePerCmd) * time.Second)
 				done := make(chan error, 1)
 				var conn net.Conn
 				var client *smtpClient
+				var greetingCode int
+				var greetingMsg string
 				go func() {
 					conn, err = net.DialTCP("tcp", localAddr, &remoteAddr)
 					if err != nil {
@@ -144,10 +189,32 @@ func newSMTPClient(d *Delivery, routes []Route, timeoutBasePerCmd int) (client *
 					client = &smtpClient{
 						conn:              conn,
 						timeoutBasePerCmd: timeoutBasePerCmd,
+						daneRecords:       daneRecords,
 					}
 					client.route = &route
 					client.text = textproto.NewConn(conn)
-					_, _, err = client.text.ReadResponse(220)
+					// implicit TLS: handshake before greeting
+					if route.TLSImplicit {
+						var config *tls.Config
+						if config, err = d.remoteTLSConfig(&route, daneRecords); err != nil {
+							conn.Close()
+							done <- err
+							return
+						}
+						client.connTLS = tls.Client(conn, config)
+						if err = client.connTLS.Handshake(); err != nil {
+							conn.Close()
+							done <- err
+							return
+						}
+						client.tls = true
+						client.tlsVerified = !config.InsecureSkipVerify || config.VerifyPeerCertificate != nil
+						client.text = textproto.NewConn(client.connTLS)
+					}
+					greetingCode, greetingMsg, err = client.text.ReadResponse(220)
+					if err != nil {
+						conn.Close()
+					}
 					done <- err
 				}()
 
@@ -156,6 +223,11 @@ func newSMTPClient(d *Delivery, routes []Route, timeoutBasePerCmd int) (client *
 					if err == nil {
 						return client, nil
 					}
+					// greeting reply (eg: 421 from a remote host asking
+					// us to slow down) is kept for throttling
+					if greetingCode != 0 {
+						d.RemoteSMTPresponseCode, d.RemoteSMTPresponseMsg = greetingCode, greetingMsg
+					}
 
 					//client.text = textproto.NewConn(conn)
 					// timeout on response
@@ -186,16 +258,25 @@ func newSMTPClient(d *Delivery, routes []Route, timeoutBasePerCmd int) (client *
 						Logger.Error("Bolt - ", errBolt)
 					}
 				}
+				smtpPool.releaseHost(route.RemoteHost)
 				Logger.Info(fmt.Sprintf("deliverd-remote %s - unable to get a SMTP client for %s->%s:%d - %s ", d.ID, localIP, remoteAddr.IP.String(), remoteAddr.Port, err.Error()))
 			}
 		}
 	}
+	if busy {
+		return nil, errRemoteHostsBusy
+	}
 	// All routes have been tested -> Fail !
 	return nil, errors.New("unable to get a client, all routes have been tested")
 }
 
 // CloseConn close connection
 func (s *smtpClient) close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	smtpPool.releaseHost(s.route.RemoteHost)
 	return s.text.Close()
 }
 
@@ -333,6 +414,7 @@ func (s *smtpClient) Helo() (code int, msg string, err error) {
 // StartTLS sends the STARTTLS command and encrypts all further communication.
 func (s *smtpClient) StartTLS(config *tls.Config) (code int, msg string, err error) {
 	s.tls = false
+	s.tlsVerified = false
 	code, msg, err = s.cmd(2*s.timeoutBasePerCmd, 220, "STARTTLS")
 	if err != nil {
 		return
@@ -344,6 +426,7 @@ func (s *smtpClient) StartTLS(config *tls.Config) (code int, msg string, err err
 		return
 	}
 	s.tls = true
+	s.tlsVerified = !config.InsecureSkipVerify || config.VerifyPeerCertificate != nil
 	return
 }
 
@@ -389,13 +472,23 @@ func (s *smtpClient) Auth(a DeliverdAuth) (code int, msg string, err error) {
 }
 
 // MAIL
-func (s *smtpClient) Mail(from string) (code int, msg string, err error) {
-	return s.cmd(s.timeoutBasePerCmd, 250, "MAIL FROM:<%s>", from)
+// params are ESMTP parameters (eg: "BODY=8BITMIME")
+func (s *smtpClient) Mail(from string, params ...string) (code int, msg string, err error) {
+	p := ""
+	if len(params) != 0 {
+		p = " " + strings.Join(params, " ")
+	}
+	return s.cmd(s.timeoutBasePerCmd, 250, "MAIL FROM:<%s>%s", from, p)
 }
 
 // RCPT
-func (s *smtpClient) Rcpt(to string) (code int, msg string, err error) {
-	code, msg, err = s.cmd(s.timeoutBasePerCmd, -1, "RCPT TO:<%s>", to)
+// params are ESMTP parameters (eg: "NOTIFY=NEVER")
+func (s *smtpClient) Rcpt(to string, params ...string) (code int, msg string, err error) {
+	p := ""
+	if len(params) != 0 {
+		p = " " + strings.Join(params, " ")
+	}
+	code, msg, err = s.cmd(s.timeoutBasePerCmd, -1, "RCPT TO:<%s>%s", to, p)
 	if code != 250 && code != 251 {
 		err = errors.New(msg)
 	}
@@ -419,10 +512,81 @@ func (s *smtpClient) Data() (*dataCloser, int, string, error) {
 	return &dataCloser{s, s.text.DotWriter()}, code, msg, nil
 }
 
+// BDAT (RFC 3030)
+// Bdat sends data in chunks of chunkSize bytes (last chunk with LAST)
+// and returns reply to the last BDAT command
+func (s *smtpClient) Bdat(data io.Reader, chunkSize int) (code int, msg string, err error) {
+	r := bufio.NewReaderSize(data, chunkSize)
+	chunk := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(r, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, "", err
+		}
+		// last chunk ?
+		last := err != nil
+		if !last {
+			_, err = r.Peek(1)
+			last = err == io.EOF
+		}
+		code, msg, err = s.bdatChunk(3*s.timeoutBasePerCmd, chunk[:n], last)
+		if err != nil || last {
+			return code, msg, err
+		}
+	}
+}
+
+// bdatChunk sends a BDAT command followed by chunk and return reply
+// timeout covers the whole exchange: a server which accepts data but never
+// replies must not block the delivery
+func (s *smtpClient) bdatChunk(timeoutSeconds int, chunk []byte, last bool) (int, string, error) {
+	cmd := fmt.Sprintf("BDAT %d", len(chunk))
+	if last {
+		cmd += " LAST"
+	}
+	if err := s.conn.SetDeadline(time.Now().Add(time.Duration(timeoutSeconds) * time.Second)); err != nil {
+		return 0, "", err
+	}
+	defer s.conn.SetDeadline(time.Time{})
+
+	s.logDebug(">", "%s", cmd)
+	id := s.text.Next()
+	s.text.StartRequest(id)
+	_, err := s.text.W.WriteString(cmd + "\r\n")
+	if err == nil {
+		_, err = s.text.W.Write(chunk)
+	}
+	if err == nil {
+		err = s.text.W.Flush()
+	}
+	s.text.EndRequest(id)
+	if err != nil {
+		return 0, "", bdatTimeoutError(err)
+	}
+	s.text.StartResponse(id)
+	defer s.text.EndResponse(id)
+	code, msg, err := s.text.ReadResponse(250)
+	s.logDebug("<", "%d-%s", code, strings.Replace(msg, "\n", " ", -1))
+	return code, msg, bdatTimeoutError(err)
+}
+
+// bdatTimeoutError replaces timeout err by a readable one
+func bdatTimeoutError(err error) error {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return errors.New("server do not reply in time -> timeout")
+	}
+	return err
+}
+
+// RSET
+func (s *smtpClient) Reset() (code int, msg string, err error) {
+	return s.cmd(s.timeoutBasePerCmd, 250, "RSET")
+}
+
 // QUIT
 func (s *smtpClient) Quit() (code int, msg string, err error) {
 	code, msg, err = s.cmd(s.timeoutBasePerCmd, 221, "QUIT")
-	s.text.Close()
+	s.close()
 	return
 }
 
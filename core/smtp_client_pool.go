@@ -0,0 +1,189 @@
+package core
+
+// SMTP connection pool
+// Connections to remote hosts (EHLO, STARTTLS and AUTH done) are kept
+// open and reused for next messages sent through the same route.
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// smtpClientPool keeps idle SMTP clients and counts connections
+// opened to each remote host
+type smtpClientPool struct {
+	sync.Mutex
+	idle       map[string][]*smtpClient // idle clients by key (see routePoolKey)
+	conns      map[string]int           // opened connections by remote host
+	reaperOnce sync.Once
+}
+
+var smtpPool = &smtpClientPool{
+	idle:  make(map[string][]*smtpClient),
+	conns: make(map[string]int),
+}
+
+// routePoolKey returns pool key for route: local IP(s), remote address, auth
+// identity and TLS settings
+func routePoolKey(route Route) string {
+	localIP := route.LocalIp.String
+	if localIP == "" {
+		localIP = Cfg.GetLocalIps()
+	}
+	return localIP + "|" + strings.ToLower(route.RemoteHost) + ":" + strconv.FormatInt(route.RemotePort.Int64, 10) + "|" + route.SmtpAuthLogin.String + "|" + routeTLSKey(route)
+}
+
+// routeTLSKey returns a key identifying TLS settings of route
+func routeTLSKey(route Route) string {
+	return route.TLSMode.String + "," + route.TLSServerName.String + "," + route.TLSCAFile.String + "," + route.TLSClientCert.String + "," + strconv.FormatBool(route.TLSImplicit)
+}
+
+// acquireHost reserves a connection to remote host
+// returns false if max connections to host is reached
+func (p *smtpClientPool) acquireHost(host string) bool {
+	host = strings.ToLower(host)
+	max := Cfg.GetDeliverdRemoteMaxConnPerHost()
+	p.Lock()
+	defer p.Unlock()
+	if max > 0 && p.conns[host] >= max {
+		return false
+	}
+	p.conns[host]++
+	return true
+}
+
+// releaseHost releases a connection to remote host
+func (p *smtpClientPool) releaseHost(host string) {
+	host = strings.ToLower(host)
+	p.Lock()
+	defer p.Unlock()
+	if p.conns[host] > 0 {
+		p.conns[host]--
+	}
+	if p.conns[host] == 0 {
+		delete(p.conns, host)
+	}
+}
+
+// evictIdle closes the oldest idle client connected to remote host (whatever
+// its key) to free its connection slot. It returns false if there is none.
+func (p *smtpClientPool) evictIdle(host string) bool {
+	host = strings.ToLower(host)
+	p.Lock()
+	var oldest *smtpClient
+	oldestKey, oldestIndex := "", 0
+	for key, idle := range p.idle {
+		for i, client := range idle {
+			if strings.ToLower(client.route.RemoteHost) != host {
+				continue
+			}
+			if oldest == nil || client.idleSince.Before(oldest.idleSince) {
+				oldest, oldestKey, oldestIndex = client, key, i
+			}
+		}
+	}
+	if oldest == nil {
+		p.Unlock()
+		return false
+	}
+	idle := p.idle[oldestKey]
+	p.idle[oldestKey] = append(idle[:oldestIndex], idle[oldestIndex+1:]...)
+	if len(p.idle[oldestKey]) == 0 {
+		delete(p.idle, oldestKey)
+	}
+	p.Unlock()
+	// releases its slot
+	oldest.Quit()
+	return true
+}
+
+// get returns an idle client for one of routes (in routes order) or nil
+// clients are checked with a RSET
+// if requireTLS only clients using TLS with a verified certificate are returned
+func (p *smtpClientPool) get(routes []Route, requireTLS bool) *smtpClient {
+	idleTimeout := time.Duration(Cfg.GetDeliverdRemotePoolIdleTimeout()) * time.Second
+	for _, route := range routes {
+		key := routePoolKey(route)
+		for {
+			client := p.pop(key, requireTLS)
+			if client == nil {
+				break
+			}
+			if time.Since(client.idleSince) > idleTimeout {
+				client.Quit()
+				continue
+			}
+			if _, _, err := client.Reset(); err != nil {
+				client.close()
+				continue
+			}
+			return client
+		}
+	}
+	return nil
+}
+
+// pop removes and returns the last idle client for key (or nil)
+func (p *smtpClientPool) pop(key string, requireTLS bool) *smtpClient {
+	p.Lock()
+	defer p.Unlock()
+	idle := p.idle[key]
+	for i := len(idle) - 1; i >= 0; i-- {
+		if requireTLS && !idle[i].tlsVerified {
+			continue
+		}
+		client := idle[i]
+		p.idle[key] = append(idle[:i], idle[i+1:]...)
+		return client
+	}
+	return nil
+}
+
+// put puts client back in pool (or closes it if it has sent max messages)
+func (p *smtpClientPool) put(client *smtpClient) {
+	client.messages++
+	max := Cfg.GetDeliverdRemotePoolMaxMessages()
+	if client.closed || max <= 0 || client.messages >= max {
+		client.Quit()
+		return
+	}
+	client.idleSince = time.Now()
+	key := routePoolKey(*client.route)
+	p.Lock()
+	p.idle[key] = append(p.idle[key], client)
+	p.Unlock()
+	p.reaperOnce.Do(func() {
+		go p.reaper()
+	})
+}
+
+// reaper closes idle clients after idle timeout
+func (p *smtpClientPool) reaper() {
+	for {
+		time.Sleep(10 * time.Second)
+		idleTimeout := time.Duration(Cfg.GetDeliverdRemotePoolIdleTimeout()) * time.Second
+		expired := []*smtpClient{}
+		p.Lock()
+		for key, idle := range p.idle {
+			kept := idle[:0]
+			for _, client := range idle {
+				if time.Since(client.idleSince) > idleTimeout {
+					expired = append(expired, client)
+				} else {
+					kept = append(kept, client)
+				}
+			}
+			if len(kept) == 0 {
+				delete(p.idle, key)
+			} else {
+				p.idle[key] = kept
+			}
+		}
+		p.Unlock()
+		for _, client := range expired {
+			client.Quit()
+		}
+	}
+}
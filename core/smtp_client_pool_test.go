@@ -0,0 +1,129 @@
+package core
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setupPoolTest replaces the SMTP pool (its reaper is not launched)
+func setupPoolTest(t *testing.T) *smtpClientPool {
+	Cfg = &Config{}
+	Cfg.cfg.DeliverdPoolIdleTimeout = 30
+	Cfg.cfg.DeliverdPoolMaxMessages = 3
+	Cfg.cfg.DeliverdRemoteMaxConnPerHost = 2
+	saved := smtpPool
+	smtpPool = &smtpClientPool{idle: make(map[string][]*smtpClient), conns: make(map[string]int)}
+	smtpPool.reaperOnce.Do(func() {})
+	t.Cleanup(func() { smtpPool = saved })
+	return smtpPool
+}
+
+// newPoolTestClient returns a client of route connected to a server replying
+// rsetCode to RSET, commands received by the server are sent to cmds
+func newPoolTestClient(t *testing.T, route Route, rsetCode int) (*smtpClient, chan string) {
+	assert.True(t, smtpPool.acquireHost(route.RemoteHost))
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	cmds := make(chan string, 10)
+	go func() {
+		r := bufio.NewReader(server)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.TrimSpace(line)
+			cmds <- cmd
+			switch cmd {
+			case "RSET":
+				fmt.Fprintf(server, "%d reset\r\n", rsetCode)
+			case "QUIT":
+				fmt.Fprintf(server, "221 bye\r\n")
+				return
+			}
+		}
+	}()
+	return &smtpClient{conn: client, text: textproto.NewConn(client), route: &route, timeoutBasePerCmd: 1}, cmds
+}
+
+func Test_smtpClientPool(t *testing.T) {
+	pool := setupPoolTest(t)
+	route := Route{RemoteHost: "MX.example.com", RemotePort: sql.NullInt64{Int64: 25, Valid: true}}
+	other := Route{RemoteHost: "mx.example.com", RemotePort: sql.NullInt64{Int64: 25, Valid: true},
+		SmtpAuthLogin: sql.NullString{String: "john", Valid: true}}
+
+	// reuse: client is checked with a RSET
+	client, cmds := newPoolTestClient(t, route, 250)
+	pool.put(client)
+	assert.Nil(t, pool.get([]Route{other}, false))
+	assert.Equal(t, client, pool.get([]Route{other, route}, false))
+	assert.Equal(t, "RSET", <-cmds)
+	assert.Equal(t, 1, client.messages)
+
+	// only clients with a verified certificate are returned if TLS is
+	// required
+	pool.put(client)
+	assert.Nil(t, pool.get([]Route{route}, true))
+	client.tlsVerified = true
+	assert.Equal(t, client, pool.get([]Route{route}, true))
+	assert.Equal(t, "RSET", <-cmds)
+
+	// client is closed once it has sent max messages
+	pool.put(client)
+	assert.Equal(t, "QUIT", <-cmds)
+	assert.True(t, client.closed)
+	assert.Empty(t, pool.idle[routePoolKey(route)])
+	assert.Empty(t, pool.conns)
+
+	// expired client
+	client, cmds = newPoolTestClient(t, route, 250)
+	pool.put(client)
+	client.idleSince = time.Now().Add(-time.Minute)
+	assert.Nil(t, pool.get([]Route{route}, false))
+	assert.Equal(t, "QUIT", <-cmds)
+	assert.True(t, client.closed)
+
+	// RSET failed
+	client, cmds = newPoolTestClient(t, route, 421)
+	pool.put(client)
+	assert.Nil(t, pool.get([]Route{route}, false))
+	assert.Equal(t, "RSET", <-cmds)
+	assert.True(t, client.closed)
+	assert.Empty(t, pool.conns)
+}
+
+func Test_smtpClientPoolConnsPerHost(t *testing.T) {
+	pool := setupPoolTest(t)
+	route := Route{RemoteHost: "mx.example.com"}
+	other := Route{RemoteHost: "mx.example.com", TLSImplicit: true}
+
+	client, cmds := newPoolTestClient(t, route, 250)
+	assert.True(t, pool.acquireHost("MX.example.com"))
+	assert.False(t, pool.acquireHost("mx.example.com"))
+	assert.True(t, pool.acquireHost("mx.example.net"))
+	assert.False(t, pool.evictIdle("mx.example.com"))
+
+	// an idle client of another key frees its slot
+	pool.put(client)
+	assert.Nil(t, pool.get([]Route{other}, false))
+	assert.True(t, pool.evictIdle("mx.example.com"))
+	assert.Equal(t, "QUIT", <-cmds)
+	assert.True(t, pool.acquireHost("mx.example.com"))
+
+	pool.releaseHost("mx.example.com")
+	pool.releaseHost("mx.example.com")
+	pool.releaseHost("mx.example.com")
+	pool.releaseHost("mx.example.net")
+	assert.Empty(t, pool.conns)
+}
@@ -0,0 +1,71 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestSMTPClient returns a client connected to server (net.Pipe)
+func newTestSMTPClient(t *testing.T) (*smtpClient, net.Conn) {
+	Cfg = &Config{}
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return &smtpClient{conn: client, text: textproto.NewConn(client), timeoutBasePerCmd: 1}, server
+}
+
+func Test_smtpClientBdat(t *testing.T) {
+	client, server := newTestSMTPClient(t)
+	received := make(chan []string, 1)
+	go func() {
+		r := bufio.NewReader(server)
+		cmds := []string{}
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				break
+			}
+			cmd := strings.TrimSpace(line)
+			var size int
+			fmt.Sscanf(cmd, "BDAT %d", &size)
+			chunk := make([]byte, size)
+			if _, err = io.ReadFull(r, chunk); err != nil {
+				break
+			}
+			cmds = append(cmds, cmd+" "+string(chunk))
+			fmt.Fprintf(server, "250 %d octets received\r\n", size)
+			if strings.HasSuffix(cmd, "LAST") {
+				break
+			}
+		}
+		received <- cmds
+	}()
+
+	code, msg, err := client.Bdat(strings.NewReader("Subject: test\r\n\r\nbody\r\n"), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 250, code)
+	assert.Equal(t, "3 octets received", msg)
+	assert.Equal(t, []string{"BDAT 10 Subject: t", "BDAT 10 est\r\n\r\nbod", "BDAT 3 LAST y\r\n"}, <-received)
+}
+
+func Test_smtpClientBdatTimeout(t *testing.T) {
+	client, server := newTestSMTPClient(t)
+	// data is read but server never replies
+	go io.Copy(io.Discard, server)
+
+	start := time.Now()
+	code, _, err := client.Bdat(strings.NewReader("Subject: test\r\n\r\nbody\r\n"), 1024)
+	assert.Error(t, err)
+	assert.Equal(t, 0, code)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
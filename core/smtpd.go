@@ -55,7 +55,7 @@ func (s *Smtpd) ListenAndServe() {
 				go func(conn net.Conn) {
 					ChSmtpSessionsCount <- 1
 					defer func() { ChSmtpSessionsCount <- -1 }()
-					sss, err := NewSMTPServerSession(conn, s.dsn.ssl)
+					sss, err := NewSMTPServerSession(conn, s.dsn.ssl, s.dsn.policy)
 					if err != nil {
 						log.Println("unable to get new SmtpServerSession.", err)
 					} else {
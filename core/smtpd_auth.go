@@ -0,0 +1,291 @@
+// Server side SASL mechanisms used by smtpd AUTH command (RFC 4954)
+
+package core
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrSMTPdAuthMalformed when client sends something we can't decode
+	ErrSMTPdAuthMalformed = errors.New("malformed auth input")
+	// ErrSMTPdAuthFailed when credentials are wrong
+	ErrSMTPdAuthFailed = errors.New("authentication failed")
+	// ErrSMTPdAuthNoSecret when user has no CRAM-MD5 secret (his password
+	// has not been set since CRAM-MD5 support was added)
+	ErrSMTPdAuthNoSecret = errors.New("no CRAM-MD5 secret for user, password must be set again")
+)
+
+// SMTPdAuthMechanism is implemented by a server side SASL mechanism.
+// A new instance is created for each AUTH command.
+type SMTPdAuthMechanism interface {
+	// Next continues the exchange. On first call fromClient is the initial
+	// response sent with the AUTH command (nil if there is none).
+	// If the exchange is not over, Next returns the challenge to send to
+	// the client and a nil user. Once the client is authenticated it returns
+	// the user.
+	// Next must return ErrSMTPdAuthMalformed, ErrSMTPdAuthFailed or
+	// ErrSMTPdAuthNoSecret when the client (or its account) is responsible of
+	// the failure, any other error will be handled as a temporary failure.
+	Next(fromClient []byte) (toClient []byte, user *User, err error)
+}
+
+// SMTPdAuthMechanismFactory returns a new mechanism for session s
+type SMTPdAuthMechanismFactory func(s *SMTPServerSession) SMTPdAuthMechanism
+
+// SMTPdAuthMechanisms is a map of available SASL mechanisms (name -> factory)
+var SMTPdAuthMechanisms map[string]SMTPdAuthMechanismFactory
+
+func init() {
+	SMTPdAuthMechanisms = make(map[string]SMTPdAuthMechanismFactory)
+	RegisterSMTPdAuthMechanism("PLAIN", func(s *SMTPServerSession) SMTPdAuthMechanism {
+		return &smtpdPlainAuth{}
+	})
+	RegisterSMTPdAuthMechanism("LOGIN", func(s *SMTPServerSession) SMTPdAuthMechanism {
+		return &smtpdLoginAuth{}
+	})
+	RegisterSMTPdAuthMechanism("CRAM-MD5", func(s *SMTPServerSession) SMTPdAuthMechanism {
+		return &smtpdCramMD5Auth{uuid: s.uuid}
+	})
+}
+
+// RegisterSMTPdAuthMechanism registers (or replaces) a SASL mechanism
+// Mechanism must also be enabled via smtpd_auth_mechanisms config
+func RegisterSMTPdAuthMechanism(name string, factory SMTPdAuthMechanismFactory) {
+	SMTPdAuthMechanisms[strings.ToUpper(name)] = factory
+}
+
+// smtpdAuthCheckPasswd returns user if login/passwd match
+func smtpdAuthCheckPasswd(login, passwd string) (*User, error) {
+	if len(login) == 0 || len(passwd) == 0 {
+		return nil, ErrSMTPdAuthFailed
+	}
+	user, err := UserGet(login, passwd)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound || err == bcrypt.ErrMismatchedHashAndPassword {
+			return nil, ErrSMTPdAuthFailed
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// PLAIN RFC 4616
+type smtpdPlainAuth struct {
+	started bool
+}
+
+func (a *smtpdPlainAuth) Next(fromClient []byte) ([]byte, *User, error) {
+	// no initial response -> empty challenge
+	if fromClient == nil && !a.started {
+		a.started = true
+		return []byte{}, nil, nil
+	}
+	// "authorize-id\0userid\0passwd"
+	t := bytes.Split(fromClient, []byte{0})
+	if len(t) != 3 {
+		return nil, nil, ErrSMTPdAuthMalformed
+	}
+	user, err := smtpdAuthCheckPasswd(string(t[1]), string(t[2]))
+	if err != nil {
+		return nil, nil, err
+	}
+	// we do not support authorization identity different from login
+	if len(t[0]) != 0 && string(t[0]) != user.Login {
+		return nil, nil, ErrSMTPdAuthFailed
+	}
+	return nil, user, nil
+}
+
+// LOGIN (draft-murchison-sasl-login)
+type smtpdLoginAuth struct {
+	login string
+	step  int
+}
+
+func (a *smtpdLoginAuth) Next(fromClient []byte) ([]byte, *User, error) {
+	switch a.step {
+	case 0:
+		a.step++
+		// initial response is the login
+		if fromClient != nil {
+			a.login = string(fromClient)
+			a.step++
+			return []byte("Password:"), nil, nil
+		}
+		return []byte("Username:"), nil, nil
+	case 1:
+		a.login = string(fromClient)
+		a.step++
+		return []byte("Password:"), nil, nil
+	case 2:
+		a.step++
+		user, err := smtpdAuthCheckPasswd(a.login, string(fromClient))
+		return nil, user, err
+	}
+	return nil, nil, ErrSMTPdAuthMalformed
+}
+
+// CRAM-MD5 RFC 2195
+// As we only store passwd hashes, user must have a CRAM-MD5 secret (see
+// cramMD5Secret) which is generated when password is set.
+type smtpdCramMD5Auth struct {
+	uuid      string
+	challenge []byte
+}
+
+func (a *smtpdCramMD5Auth) Next(fromClient []byte) ([]byte, *User, error) {
+	if a.challenge == nil {
+		// no initial response allowed
+		if len(fromClient) != 0 {
+			return nil, nil, ErrSMTPdAuthMalformed
+		}
+		a.challenge = []byte(fmt.Sprintf("<%s.%d@%s>", a.uuid, time.Now().UnixNano(), Cfg.GetMe()))
+		return a.challenge, nil, nil
+	}
+	// "login hexdigest"
+	p := bytes.LastIndexByte(fromClient, ' ')
+	if p < 1 {
+		return nil, nil, ErrSMTPdAuthMalformed
+	}
+	digest, err := hex.DecodeString(string(fromClient[p+1:]))
+	if err != nil {
+		return nil, nil, ErrSMTPdAuthMalformed
+	}
+	user, err := UserGetByLogin(string(fromClient[:p]))
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil, ErrSMTPdAuthFailed
+		}
+		return nil, nil, err
+	}
+	if user.CramMd5Secret == "" {
+		return nil, nil, ErrSMTPdAuthNoSecret
+	}
+	expected, err := cramMD5Sum(user.CramMd5Secret, a.challenge)
+	if err != nil {
+		return nil, nil, ErrSMTPdAuthNoSecret
+	}
+	if !hmac.Equal(expected, digest) {
+		return nil, nil, ErrSMTPdAuthFailed
+	}
+	return nil, user, nil
+}
+
+// cramMD5Enabled returns true if CRAM-MD5 is enabled for smtpd AUTH (users
+// CRAM-MD5 secrets are only stored if it is)
+func cramMD5Enabled() bool {
+	for _, m := range Cfg.GetSmtpdAuthMechanisms() {
+		if m == "CRAM-MD5" {
+			return true
+		}
+	}
+	return false
+}
+
+// cramMD5UsersTTL is how long cramMD5Available result is cached (users may
+// be managed by another process)
+const cramMD5UsersTTL = time.Minute
+
+// cramMD5Users caches whether some users have a CRAM-MD5 secret
+var cramMD5Users struct {
+	sync.Mutex
+	available bool
+	checkedAt time.Time
+}
+
+// cramMD5Available returns true if at least one user has a CRAM-MD5 secret
+func cramMD5Available() bool {
+	cramMD5Users.Lock()
+	defer cramMD5Users.Unlock()
+	if time.Since(cramMD5Users.checkedAt) < cramMD5UsersTTL {
+		return cramMD5Users.available
+	}
+	count := 0
+	if err := DB.Model(&User{}).Where("cram_md5_secret IS NOT NULL AND cram_md5_secret <> ?", "").Count(&count).Error; err != nil {
+		Logger.Error("smtpd: unable to count users with a CRAM-MD5 secret - " + err.Error())
+		return false
+	}
+	cramMD5Users.available, cramMD5Users.checkedAt = count != 0, time.Now()
+	return cramMD5Users.available
+}
+
+// cramMD5UsersChanged invalidates cramMD5Available cache
+func cramMD5UsersChanged() {
+	cramMD5Users.Lock()
+	cramMD5Users.checkedAt = time.Time{}
+	cramMD5Users.Unlock()
+}
+
+// cramMD5Secret returns HMAC-MD5 intermediate states for passwd
+// (same idea as dovecot CRAM-MD5 scheme) so passwd is never stored in clear
+func cramMD5Secret(passwd string) (string, error) {
+	key := []byte(passwd)
+	if len(key) > 64 {
+		h := md5.Sum(key)
+		key = h[:]
+	}
+	ipad := make([]byte, 64)
+	opad := make([]byte, 64)
+	copy(ipad, key)
+	copy(opad, key)
+	for i := range ipad {
+		ipad[i] ^= 0x36
+		opad[i] ^= 0x5c
+	}
+	secret := []string{}
+	for _, pad := range [][]byte{ipad, opad} {
+		h := md5.New()
+		h.Write(pad)
+		state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return "", err
+		}
+		secret = append(secret, base64.StdEncoding.EncodeToString(state))
+	}
+	return strings.Join(secret, ":"), nil
+}
+
+// cramMD5Sum returns HMAC-MD5 of challenge using secret from cramMD5Secret
+func cramMD5Sum(secret string, challenge []byte) ([]byte, error) {
+	t := strings.Split(secret, ":")
+	if len(t) != 2 {
+		return nil, errors.New("no CRAM-MD5 secret available")
+	}
+	restore := func(s string) (hash.Hash, error) {
+		state, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		d := md5.New()
+		if err = d.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+	inner, err := restore(t[0])
+	if err != nil {
+		return nil, err
+	}
+	outer, err := restore(t[1])
+	if err != nil {
+		return nil, err
+	}
+	inner.Write(challenge)
+	outer.Write(inner.Sum(nil))
+	return outer.Sum(nil), nil
+}
@@ -0,0 +1,64 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_cramMD5Sum(t *testing.T) {
+	challenge := []byte("<1896.697170952@postoffice.reston.mci.net>")
+	for _, passwd := range []string{"tanstaaftanstaaf", string(make([]byte, 100))} {
+		secret, err := cramMD5Secret(passwd)
+		assert.NoError(t, err)
+		sum, err := cramMD5Sum(secret, challenge)
+		assert.NoError(t, err)
+		mac := hmac.New(md5.New, []byte(passwd))
+		mac.Write(challenge)
+		assert.Equal(t, mac.Sum(nil), sum)
+	}
+	_, err := cramMD5Sum("", challenge)
+	assert.Error(t, err)
+}
+
+func Test_cramMD5Secrets(t *testing.T) {
+	Cfg = &Config{}
+	var err error
+	DB, err = gorm.Open("sqlite3", ":memory:")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.NoError(t, AutoMigrateDB(DB))
+	t.Cleanup(func() {
+		DB.Close()
+		DB = nil
+		cramMD5UsersChanged()
+	})
+	user := &User{Login: "john@example.com"}
+	assert.NoError(t, DB.Save(user).Error)
+
+	// CRAM-MD5 disabled: no secret is stored
+	Cfg.cfg.SmtpdAuthMechanisms = "plain;login"
+	assert.NoError(t, user.ChangePasswd("secret1"))
+	assert.Equal(t, "", user.CramMd5Secret)
+	assert.False(t, cramMD5Available())
+
+	// CRAM-MD5 enabled
+	Cfg.cfg.SmtpdAuthMechanisms = "plain;login;cram-md5"
+	assert.NoError(t, user.ChangePasswd("secret2"))
+	assert.NotEqual(t, "", user.CramMd5Secret)
+	assert.True(t, cramMD5Available())
+
+	// availability is cached
+	assert.NoError(t, DB.Model(&User{}).UpdateColumn("cram_md5_secret", "").Error)
+	assert.True(t, cramMD5Available())
+
+	// secret is cleared if CRAM-MD5 is disabled
+	Cfg.cfg.SmtpdAuthMechanisms = "plain"
+	assert.NoError(t, user.ChangePasswd("secret3"))
+	assert.Equal(t, "", user.CramMd5Secret)
+	assert.False(t, cramMD5Available())
+}
@@ -7,10 +7,22 @@ import (
 	"strings"
 )
 
+const (
+	// SmtpdPolicyMX is the policy for MX listener (port 25)
+	SmtpdPolicyMX = "mx"
+	// SmtpdPolicySubmission is the policy for submission listener (port 587)
+	// STARTTLS and AUTH are mandatory before MAIL
+	SmtpdPolicySubmission = "submission"
+	// SmtpdPolicySubmissions is the policy for submission over implicit TLS
+	// listener (port 465). AUTH is mandatory before MAIL
+	SmtpdPolicySubmissions = "submissions"
+)
+
 // DSN IP port and secured (none, tls, ssl)
 type dsn struct {
 	tcpAddr net.TCPAddr
 	ssl     bool
+	policy  string
 }
 
 // String return string representation of a dsn
@@ -19,7 +31,7 @@ func (d *dsn) String() string {
 	if d.ssl {
 		s = " SSL"
 	}
-	return d.tcpAddr.String() + s
+	return d.tcpAddr.String() + s + " " + d.policy
 }
 
 //getDsnsFromString Get dsn string from config and returns slice of dsn struct
@@ -32,7 +44,9 @@ func GetDsnsFromString(dsnsStr string) (dsns []dsn, err error) {
 
 	// parse
 	for _, dsnStr := range strings.Split(dsnsStr, ";") {
-		if strings.Count(dsnStr, ":") != 2 {
+		// IP:PORT:SSL[:POLICY]
+		c := strings.Count(dsnStr, ":")
+		if c != 2 && c != 3 {
 			return dsns, errors.New("bad smtpd.dsn " + dsnStr + " found in config" + dsnsStr)
 		}
 		t := strings.Split(dsnStr, ":")
@@ -45,7 +59,21 @@ func GetDsnsFromString(dsnsStr string) (dsns []dsn, err error) {
 		if err != nil {
 			return dsns, ErrBadDsn(err)
 		}
-		dsns = append(dsns, dsn{*tcpAddr, ssl})
+		// policy
+		policy := SmtpdPolicyMX
+		if c == 3 {
+			policy = strings.TrimSpace(t[3])
+		}
+		switch policy {
+		case SmtpdPolicyMX, SmtpdPolicySubmission:
+		case SmtpdPolicySubmissions:
+			if !ssl {
+				return dsns, ErrBadDsn(errors.New("policy " + policy + " needs SSL in dsn " + dsnStr))
+			}
+		default:
+			return dsns, ErrBadDsn(errors.New("unknown policy " + policy + " in dsn " + dsnStr))
+		}
+		dsns = append(dsns, dsn{*tcpAddr, ssl, policy})
 	}
 	return
 }
@@ -0,0 +1,39 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_GetDsnsFromString(t *testing.T) {
+	tests := []struct {
+		dsns     string
+		policies []string
+		ssl      []bool
+		valid    bool
+	}{
+		{"127.0.0.1:25:false", []string{SmtpdPolicyMX}, []bool{false}, true},
+		{"127.0.0.1:25:false:mx;127.0.0.1:587:false:Submission;127.0.0.1:465:true:submissions",
+			[]string{SmtpdPolicyMX, SmtpdPolicySubmission, SmtpdPolicySubmissions}, []bool{false, false, true}, true},
+		{"127.0.0.1:465:false:submissions", nil, nil, false},
+		{"127.0.0.1:25:false:relay", nil, nil, false},
+		{"127.0.0.1:25", nil, nil, false},
+		{"127.0.0.1:25:yes", nil, nil, false},
+		{"", nil, nil, false},
+	}
+	for _, tt := range tests {
+		dsns, err := GetDsnsFromString(tt.dsns)
+		if !tt.valid {
+			assert.Error(t, err, tt.dsns)
+			continue
+		}
+		assert.NoError(t, err, tt.dsns)
+		if assert.Len(t, dsns, len(tt.policies), tt.dsns) {
+			for i, d := range dsns {
+				assert.Equal(t, tt.policies[i], d.policy, tt.dsns)
+				assert.Equal(t, tt.ssl[i], d.ssl, tt.dsns)
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package core
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// parseSMTPPathAndParams parses arguments of MAIL and RCPT commands
+// msg is the splitted command line (eg: ["MAIL", "FROM:<user@domain>", "SIZE=1000"])
+// prefix is the expected prefix ("from:" or "to:").
+// It returns the path (without brackets) and ESMTP parameters (keyword are
+// uppercased, value is "" if the parameter has no value).
+func parseSMTPPathAndParams(prefix string, msg []string) (path string, params map[string]string, err error) {
+	params = make(map[string]string)
+	if len(msg) < 2 {
+		return "", params, errors.New("missing argument")
+	}
+	args := strings.Join(msg[1:], " ")
+	if !strings.HasPrefix(strings.ToLower(args), prefix) {
+		return "", params, errors.New("argument must start with " + prefix)
+	}
+	// "FROM: <user>" is tolerated
+	args = strings.TrimLeft(args[len(prefix):], " ")
+
+	// path
+	end := 0
+	if strings.HasPrefix(args, "<") {
+		inQuote := false
+		for end = 1; end < len(args); end++ {
+			if args[end] == '\\' && inQuote {
+				end++
+				continue
+			}
+			if args[end] == '"' {
+				inQuote = !inQuote
+			}
+			if args[end] == '>' && !inQuote {
+				break
+			}
+		}
+		if end == len(args) {
+			return "", params, errors.New("unbalanced brackets")
+		}
+		path = args[1:end]
+		end++
+	} else {
+		end = strings.IndexByte(args, ' ')
+		if end == -1 {
+			end = len(args)
+		}
+		path = args[:end]
+	}
+
+	// ESMTP parameters
+	for _, param := range strings.Split(args[end:], " ") {
+		if param == "" {
+			continue
+		}
+		keyValue := strings.SplitN(param, "=", 2)
+		keyword := strings.ToUpper(keyValue[0])
+		if keyword == "" {
+			return "", params, errors.New("empty parameter keyword")
+		}
+		if _, found := params[keyword]; found {
+			return "", params, errors.New("duplicate parameter " + keyword)
+		}
+		params[keyword] = ""
+		if len(keyValue) == 2 {
+			if keyValue[1] == "" {
+				return "", params, errors.New("empty value for parameter " + keyword)
+			}
+			params[keyword] = keyValue[1]
+		}
+	}
+	return path, params, nil
+}
+
+// isASCII returns true if s contains only 7 bits chars
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] > 127 {
+			return false
+		}
+	}
+	return true
+}
+
+// xtextDecode decodes xtext (RFC 3461 4)
+func xtextDecode(s string) (string, error) {
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 33 || c > 126 || c == '=' {
+			return "", errors.New("invalid char in xtext")
+		}
+		if c != '+' {
+			out = append(out, c)
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", errors.New("truncated hexchar in xtext")
+		}
+		b, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil || strings.ToUpper(s[i+1:i+3]) != s[i+1:i+3] {
+			return "", errors.New("invalid hexchar in xtext")
+		}
+		out = append(out, b[0])
+		i += 2
+	}
+	return string(out), nil
+}
+
+// xtextEncode encodes s as xtext (RFC 3461 4)
+func xtextEncode(s string) string {
+	out := ""
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 33 || c > 126 || c == '+' || c == '=' {
+			out += fmt.Sprintf("+%02X", c)
+			continue
+		}
+		out += string(c)
+	}
+	return out
+}
@@ -0,0 +1,90 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseSMTPPathAndParams(t *testing.T) {
+	tests := []struct {
+		prefix string
+		msg    []string
+		path   string
+		params map[string]string
+		valid  bool
+	}{
+		{"from:", []string{"MAIL", "FROM:<john@example.com>"}, "john@example.com", map[string]string{}, true},
+		{"from:", []string{"MAIL", "From:<>"}, "", map[string]string{}, true},
+		{"from:", []string{"MAIL", "FROM:", "<john@example.com>"}, "john@example.com", map[string]string{}, true},
+		{"from:", []string{"MAIL", "FROM:john@example.com", "SIZE=1000"}, "john@example.com", map[string]string{"SIZE": "1000"}, true},
+		{"from:", []string{"MAIL", "FROM:<john@example.com>", "body=8BITMIME", "SMTPUTF8"}, "john@example.com",
+			map[string]string{"BODY": "8BITMIME", "SMTPUTF8": ""}, true},
+		{"from:", []string{"MAIL", "FROM:<\"john doe>\"@example.com>", "SIZE=10"}, "\"john doe>\"@example.com", map[string]string{"SIZE": "10"}, true},
+		{"from:", []string{"MAIL", "FROM:<\"john\\\"> doe\"@example.com>"}, "\"john\\\"> doe\"@example.com", map[string]string{}, true},
+		{"from:", []string{"MAIL", "FROM:<jöhn@exämple.com>"}, "jöhn@exämple.com", map[string]string{}, true},
+		{"to:", []string{"RCPT", "TO:<jane@example.com>", "NOTIFY=SUCCESS,FAILURE"}, "jane@example.com",
+			map[string]string{"NOTIFY": "SUCCESS,FAILURE"}, true},
+		{"from:", []string{"MAIL"}, "", nil, false},
+		{"from:", []string{"MAIL", "TO:<john@example.com>"}, "", nil, false},
+		{"from:", []string{"MAIL", "FROM:<john@example.com"}, "", nil, false},
+		{"from:", []string{"MAIL", "FROM:<john@example.com>", "=1000"}, "", nil, false},
+		{"from:", []string{"MAIL", "FROM:<john@example.com>", "SIZE="}, "", nil, false},
+		{"from:", []string{"MAIL", "FROM:<john@example.com>", "SIZE=10", "size=20"}, "", nil, false},
+	}
+	for _, tt := range tests {
+		path, params, err := parseSMTPPathAndParams(tt.prefix, tt.msg)
+		if !tt.valid {
+			assert.Error(t, err, tt.msg)
+			continue
+		}
+		assert.NoError(t, err, tt.msg)
+		assert.Equal(t, tt.path, path, tt.msg)
+		assert.Equal(t, tt.params, params, tt.msg)
+	}
+}
+
+func Test_isASCII(t *testing.T) {
+	assert.True(t, isASCII("john@example.com"))
+	assert.True(t, isASCII(""))
+	assert.False(t, isASCII("jöhn@example.com"))
+}
+
+func Test_xtext(t *testing.T) {
+	tests := []struct {
+		xtext string
+		text  string
+		valid bool
+	}{
+		{"rfc822;john@example.com", "rfc822;john@example.com", true},
+		{"rfc822;john+2Bdoe@example.com", "rfc822;john+doe@example.com", true},
+		{"rfc822;john+20doe+3D@example.com", "rfc822;john doe=@example.com", true},
+		{"+41", "A", true},
+		{"", "", true},
+		{"john doe", "", false},
+		{"john=doe", "", false},
+		{"john+2", "", false},
+		{"john+", "", false},
+		{"john+2b", "", false},
+		{"john+ZZ", "", false},
+		{"jöhn", "", false},
+	}
+	for _, tt := range tests {
+		text, err := xtextDecode(tt.xtext)
+		if !tt.valid {
+			assert.Error(t, err, tt.xtext)
+			continue
+		}
+		assert.NoError(t, err, tt.xtext)
+		assert.Equal(t, tt.text, text, tt.xtext)
+	}
+
+	for _, text := range []string{"rfc822;john+doe@example.com", "john doe=\x01\x7f", "jöhn@example.com", ""} {
+		xtext := xtextEncode(text)
+		assert.True(t, isASCII(xtext), text)
+		decoded, err := xtextDecode(xtext)
+		assert.NoError(t, err, text)
+		assert.Equal(t, text, decoded)
+	}
+	assert.Equal(t, "rfc822;john+2Bdoe+3D+20@example.com", xtextEncode("rfc822;john+doe= @example.com"))
+}
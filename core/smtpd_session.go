@@ -1,17 +1,22 @@
 package core
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/rand"
 	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/mail"
 	"path"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jinzhu/gorm"
@@ -32,15 +37,20 @@ type SMTPServerSession struct {
 	uuid    string
 	Conn    net.Conn
 	connTLS *tls.Conn
+	reader  *bufio.Reader // buffered reader on Conn (pipelining)
+	writer  *bufio.Writer // buffered replies, flushed before blocking on read
+	outLock sync.Mutex
 	//logger           *logrus.Logger
 	timer            *time.Timer // for timeout
 	timeout          time.Duration
 	tls              bool
 	tlsVersion       string
+	policy           string
 	RelayGranted     bool
 	user             *User
 	seenHelo         bool
 	seenMail         bool
+	chunking         bool // BDAT transaction in progress
 	lastClientCmd    []byte
 	helo             string
 	Envelope         message.Envelope
@@ -54,11 +64,24 @@ type SMTPServerSession struct {
 	dataBytes        uint32
 	startAt          time.Time
 	exiting          bool
-	CurrentRawMail   []byte
+	dataSpool        *mailSpool   // current message (DATA or BDAT)
+	dataPrefix       []byte       // headers prepended to current message
+	spfResult        SPFResult    // SPF result of current transaction
+	spfIdentity      string       // mailfrom or helo
+	spfSender        string       // checked sender
+	spfMailFrom      SPFResult    // SPF result of MAIL FROM identity (DMARC)
+	spfHeader        string       // Received-SPF header of current transaction
+	DKIMResults      []DKIMResult // DKIM signatures of current message
+	dkimChecked      bool
+	ARCResult        string           // ARC chain validation of current message
+	DMARC            *DMARCEvaluation // DMARC evaluation of current message
+	DNSBLScore       int              // DNSBL score of client
+	DNSBLListed      []string         // DNSBL zones listing client
 }
 
 // NewSMTPServerSession returns a new SMTP session
-func NewSMTPServerSession(conn net.Conn, isTLS bool) (sss *SMTPServerSession, err error) {
+// policy is the listener policy (see SmtpdPolicyMX, SmtpdPolicySubmission,...)
+func NewSMTPServerSession(conn net.Conn, isTLS bool, policy string) (sss *SMTPServerSession, err error) {
 	sss = new(SMTPServerSession)
 	sss.uuid, err = NewUUID()
 	if err != nil {
@@ -67,10 +90,13 @@ func NewSMTPServerSession(conn net.Conn, isTLS bool) (sss *SMTPServerSession, er
 	sss.startAt = time.Now()
 
 	sss.Conn = conn
+	sss.reader = bufio.NewReader(conn)
+	sss.writer = bufio.NewWriter(conn)
 	if isTLS {
 		sss.connTLS = conn.(*tls.Conn)
 		sss.tls = true
 	}
+	sss.policy = policy
 
 	sss.remoteAddr = conn.RemoteAddr().String()
 	//sss.logger = Log
@@ -107,8 +133,9 @@ func (s *SMTPServerSession) GetEnvelope() *message.Envelope {
 // timeout
 func (s *SMTPServerSession) raiseTimeout() {
 	s.Log("client timeout")
-	s.Out("420 Client timeout")
-	s.SMTPResponseCode = 420
+	s.Out("421 4.4.2 Client timeout")
+	s.SMTPResponseCode = 421
+	s.flush()
 	s.ExitAsap()
 }
 
@@ -116,7 +143,8 @@ func (s *SMTPServerSession) raiseTimeout() {
 func (s *SMTPServerSession) recoverOnPanic() {
 	if err := recover(); err != nil {
 		s.LogError(fmt.Sprintf("PANIC: %s - Stack: %s", err.(error).Error(), debug.Stack()))
-		s.Out("421 sorry I have an emergency")
+		s.Out("421 4.3.0 sorry I have an emergency")
+		s.flush()
 		s.ExitAsap()
 	}
 }
@@ -150,17 +178,104 @@ func (s *SMTPServerSession) Reset() {
 	s.Envelope.MailFrom = ""
 	s.seenMail = false
 	s.Envelope.RcptTo = []string{}
+	s.Envelope.Body = ""
+	s.Envelope.SMTPUTF8 = false
+	s.Envelope.DSNRet = ""
+	s.Envelope.DSNEnvID = ""
+	s.Envelope.DSNRcpt = nil
+	s.chunking = false
 	s.rcptCount = 0
+	s.spfResult = ""
+	s.spfIdentity = ""
+	s.spfSender = ""
+	s.spfMailFrom = ""
+	s.spfHeader = ""
+	s.DKIMResults = nil
+	s.dkimChecked = false
+	s.ARCResult = ""
+	s.DMARC = nil
+	s.resetData()
 	s.resetTimeout()
 }
 
+// isInbound returns true if session is an inbound one: MX listener, no
+// authenticated user and remote IP not allowed to relay
+func (s *SMTPServerSession) isInbound() bool {
+	if s.policy != SmtpdPolicyMX || s.user != nil {
+		return false
+	}
+	canRelay, err := IpCanRelay(s.Conn.RemoteAddr())
+	return err == nil && !canRelay
+}
+
+// resetData removes current message
+func (s *SMTPServerSession) resetData() {
+	if s.dataSpool != nil {
+		if err := s.dataSpool.Close(); err != nil {
+			s.LogError("unable to remove spool file - " + err.Error())
+		}
+		s.dataSpool = nil
+	}
+	s.dataPrefix = nil
+}
+
+// newDataSpool creates spool for a new message
+func (s *SMTPServerSession) newDataSpool() (err error) {
+	s.resetData()
+	if s.dataSpool, err = newMailSpool(Cfg.GetTempDir()); err == nil {
+		s.dataSpool.filter = s.filterHeader
+	}
+	return
+}
+
+// GetRawMail returns a reader on current message (with prepended headers)
+// mainly used for plugin
+func (s *SMTPServerSession) GetRawMail() (io.Reader, error) {
+	if s.dataSpool == nil {
+		return nil, errors.New("no message")
+	}
+	r, err := s.dataSpool.Reader()
+	if err != nil {
+		return nil, err
+	}
+	return io.MultiReader(bytes.NewReader(s.dataPrefix), r), nil
+}
+
+// PrependHeader adds header (which must be folded) on top of current message
+func (s *SMTPServerSession) PrependHeader(header string) {
+	s.dataPrefix = append([]byte(header+"\r\n"), s.dataPrefix...)
+}
+
 // Out : to client
+// replies are buffered (PIPELINING) and sent when we are waiting for
+// the client (see flush)
 func (s *SMTPServerSession) Out(msg string) {
-	s.Conn.Write([]byte(msg + "\r\n"))
+	s.outLock.Lock()
+	s.writer.WriteString(msg + "\r\n")
+	s.outLock.Unlock()
 	s.LogDebug(">", msg)
 	s.resetTimeout()
 }
 
+// flush sends buffered replies to client
+func (s *SMTPServerSession) flush() {
+	s.outLock.Lock()
+	defer s.outLock.Unlock()
+	if err := s.writer.Flush(); err != nil {
+		s.LogDebug("unable to flush replies -", err.Error())
+	}
+}
+
+// readByte reads a byte from client
+// Replies are flushed only when we have to wait for client, so pipelined
+// commands get their replies in one shot (RFC 2920 3.2)
+func (s *SMTPServerSession) readByte() (byte, error) {
+	if s.reader.Buffered() == 0 {
+		s.flush()
+	}
+	return s.reader.ReadByte()
+}
+
 // Log helper for INFO log
 func (s *SMTPServerSession) Log(msg ...string) {
 	Logger.Info("smtpd ", s.uuid, "-", s.Conn.RemoteAddr().String(), "-", strings.Join(msg, " "))
@@ -182,14 +297,13 @@ func (s *SMTPServerSession) LogDebug(msg ...string) {
 // LF withour CR
 func (s *SMTPServerSession) strayNewline() {
 	s.Log("LF not preceded by CR")
-	s.Out("451 You send me LF not preceded by a CR, your SMTP client is broken.")
+	s.Out("451 4.5.0 You send me LF not preceded by a CR, your SMTP client is broken.")
 }
 
 // purgeConn Purge connexion buffer
 func (s *SMTPServerSession) purgeConn() (err error) {
-	ch := make([]byte, 1)
 	for {
-		_, err = s.Conn.Read(ch)
+		_, err = s.readByte()
 		if err != nil {
 			return
 		}
@@ -213,13 +327,21 @@ func (s *SMTPServerSession) smtpGreeting() {
 	time.Sleep(100 * time.Nanosecond)
 	if SmtpSessionsCount > Cfg.GetSmtpdConcurrencyIncoming() {
 		s.Log(fmt.Sprintf("GREETING - max connections reached %d/%d", SmtpSessionsCount, Cfg.GetSmtpdConcurrencyIncoming()))
-		s.Out(fmt.Sprintf("421 sorry, the maximum number of connections has been reached, try again later %s", s.uuid))
+		s.Out(fmt.Sprintf("421 4.7.0 sorry, the maximum number of connections has been reached, try again later %s", s.uuid))
 		s.SMTPResponseCode = 421
 		s.ExitAsap()
 		return
 	}
 	s.Log(fmt.Sprintf("starting new transaction %d/%d", SmtpSessionsCount, Cfg.GetSmtpdConcurrencyIncoming()))
 
+	// Rate limit
+	if !s.checkConnRateLimit() {
+		return
+	}
+
+	// DNSBL
+	s.checkDNSBL()
+
 	// Plugins
 	if execSMTPdPlugins("connect", s) {
 		return
@@ -243,7 +365,7 @@ func (s *SMTPServerSession) heloBase(msg []string) (cont bool) {
 	if s.seenHelo {
 		s.Log("EHLO|HELO already received")
 		s.pause(1)
-		s.Out("503 bad sequence, ehlo already recieved")
+		s.Out("503 5.5.1 bad sequence, ehlo already recieved")
 		return false
 	}
 
@@ -260,13 +382,13 @@ func (s *SMTPServerSession) heloBase(msg []string) (cont bool) {
 				ok, err := isFQN(msg[1])
 				if err != nil {
 					s.Log("fail to do lookup on helo host. " + err.Error())
-					s.Out("404 unable to resolve " + msg[1] + ". Need fqdn or address in helo command")
-					s.SMTPResponseCode = 404
+					s.Out("451 4.4.3 unable to resolve " + msg[1] + ". Need fqdn or address in helo command")
+					s.SMTPResponseCode = 451
 					return false
 				}
 				if !ok {
 					s.Log("helo command rejected, need fully-qualified hostname or address" + msg[1] + " given")
-					s.Out("504 helo command rejected, need fully-qualified hostname or address #5.5.2")
+					s.Out("504 5.5.2 helo command rejected, need fully-qualified hostname or address")
 					s.SMTPResponseCode = 504
 					return false
 				}
@@ -275,7 +397,7 @@ func (s *SMTPServerSession) heloBase(msg []string) (cont bool) {
 		s.helo = strings.Join(msg[1:], " ")
 	} else if Cfg.getRFCHeloNeedsFqnOrAddress() {
 		s.Log("helo command rejected, need fully-qualified hostname. None given")
-		s.Out("504 helo command rejected, need fully-qualified hostname or address #5.5.2")
+		s.Out("504 5.5.2 helo command rejected, need fully-qualified hostname or address")
 		s.SMTPResponseCode = 504
 		return false
 	}
@@ -295,24 +417,39 @@ func (s *SMTPServerSession) smtpHelo(msg []string) {
 func (s *SMTPServerSession) smtpEhlo(msg []string) {
 	defer s.recoverOnPanic()
 	if s.heloBase(msg) {
-		s.Out(fmt.Sprintf("250-%s", Cfg.GetMe()))
 		// Extensions
+		extensions := []string{Cfg.GetMe()}
 		// Size
-		s.Out(fmt.Sprintf("250-SIZE %d", Cfg.GetSmtpdMaxDataBytes()))
-		s.Out("250-X-PEPPER")
+		extensions = append(extensions, fmt.Sprintf("SIZE %d", Cfg.GetSmtpdMaxDataBytes()))
+		extensions = append(extensions, "X-PEPPER")
+		extensions = append(extensions, "PIPELINING")
+		extensions = append(extensions, "8BITMIME")
+		extensions = append(extensions, "ENHANCEDSTATUSCODES")
+		extensions = append(extensions, "SMTPUTF8")
+		extensions = append(extensions, "CHUNKING")
+		extensions = append(extensions, "DSN")
 		// STARTTLS
 		if !s.tls {
-			s.Out("250-STARTTLS")
+			extensions = append(extensions, "STARTTLS")
 		}
 		// Auth
-		s.Out("250 AUTH PLAIN")
+		if mechanisms := s.authMechanisms(); len(mechanisms) != 0 {
+			extensions = append(extensions, "AUTH "+strings.Join(mechanisms, " "))
+		}
+		last := len(extensions) - 1
+		for i, extension := range extensions {
+			if i == last {
+				s.Out("250 " + extension)
+			} else {
+				s.Out("250-" + extension)
+			}
+		}
 	}
 }
 
 // MAIL FROM
 func (s *SMTPServerSession) smtpMailFrom(msg []string) {
 	defer s.recoverOnPanic()
-	extension := []string{}
 
 	// Reset
 	s.Reset()
@@ -324,12 +461,33 @@ func (s *SMTPServerSession) smtpMailFrom(msg []string) {
 		s.SMTPResponseCode = 503
 		return
 	}
-	msgLen := len(msg)
+	// AUTH is mandatory on submission listeners
+	if s.policy != SmtpdPolicyMX && s.user == nil {
+		s.Log("MAIL - authentication required on " + s.policy + " listener")
+		s.pause(2)
+		s.Out("530 5.7.0 Authentication required")
+		s.SMTPResponseCode = 530
+		return
+	}
+	// DNSBL
+	if s.isDNSBLListed() && Cfg.GetSmtpdDNSBLAction() == "reject" {
+		s.Log("MAIL - client listed in " + strings.Join(s.DNSBLListed, ", "))
+		s.pause(2)
+		s.Out("554 5.7.1 client host blocked using " + strings.Join(s.DNSBLListed, ", "))
+		s.SMTPResponseCode = 554
+		return
+	}
+	// Rate limit
+	if !s.checkMsgRateLimit() {
+		return
+	}
+
 	// mail from ?
-	if msgLen == 1 || !strings.HasPrefix(strings.ToLower(msg[1]), "from:") || msgLen > 4 {
-		s.Log("MAIL - Bad syntax: %s" + strings.Join(msg, " "))
+	mailFrom, params, err := parseSMTPPathAndParams("from:", msg)
+	if err != nil {
+		s.Log("MAIL - Bad syntax: " + strings.Join(msg, " ") + " - " + err.Error())
 		s.pause(2)
-		s.Out("501 5.5.4 Syntax: MAIL FROM:<address> [SIZE]")
+		s.Out("501 5.5.4 Syntax: MAIL FROM:<address> [parameters]")
 		s.SMTPResponseCode = 501
 		return
 	}
@@ -337,76 +495,91 @@ func (s *SMTPServerSession) smtpMailFrom(msg []string) {
 	// Plugin - hook "mailpre"
 	execSMTPdPlugins("mailpre", s)
 
-	// mail from:<user> EXT || mail from: <user> EXT
-	if len(msg[1]) > 5 { // mail from:<user> EXT
-		t := strings.Split(msg[1], ":")
-		s.Envelope.MailFrom = t[1]
-		if msgLen > 2 {
-			extension = append(extension, msg[2:]...)
-		}
-	} else if msgLen > 2 { // mail from: user EXT
-		s.Envelope.MailFrom = msg[2]
-		if msgLen > 3 {
-			extension = append(extension, msg[3:]...)
-		}
-	} else { // null sender
-		s.Envelope.MailFrom = ""
-	}
+	s.Envelope.MailFrom = mailFrom
 
-	// Extensions size
-	if len(extension) != 0 {
-		// Only SIZE is supported (and announced)
-		if len(extension) > 1 {
-			s.Log("MAIL - Bad syntax: " + strings.Join(msg, " "))
-			s.pause(2)
-			s.Out("501 5.5.4 Syntax: MAIL FROM:<address> [SIZE]")
-			s.SMTPResponseCode = 501
-			return
-		}
-		// SIZE
-		extValue := strings.Split(extension[0], "=")
-		if len(extValue) != 2 {
-			s.Log(fmt.Sprintf("MAIL FROM - Bad syntax : %s ", strings.Join(msg, " ")))
-			s.pause(2)
-			s.Out("501 5.5.4 Syntax: MAIL FROM:<address> [SIZE]")
-			s.SMTPResponseCode = 501
-			return
-		}
-		if strings.ToLower(extValue[0]) != "size" {
-			s.Log(fmt.Sprintf("MAIL FROM - Unsuported extension : %s ", extValue[0]))
-			s.pause(2)
-			s.Out("501 5.5.4 Invalid arguments")
-			s.SMTPResponseCode = 501
-			return
-		}
-		if Cfg.GetSmtpdMaxDataBytes() != 0 {
-			size, err := strconv.ParseInt(extValue[1], 10, 64)
+	// ESMTP parameters
+	for keyword, value := range params {
+		switch keyword {
+		case "SIZE":
+			size, err := strconv.ParseInt(value, 10, 64)
 			if err != nil {
-				s.Log(fmt.Sprintf("MAIL FROM - bad value for size extension SIZE=%v", extValue[1]))
+				s.Log(fmt.Sprintf("MAIL FROM - bad value for size extension SIZE=%v", value))
 				s.pause(2)
 				s.Out("501 5.5.4 Invalid arguments")
 				s.SMTPResponseCode = 501
 				return
 			}
-			if int(size) > Cfg.GetSmtpdMaxDataBytes() {
+			if Cfg.GetSmtpdMaxDataBytes() != 0 && int(size) > Cfg.GetSmtpdMaxDataBytes() {
 				s.Log(fmt.Sprintf("MAIL FROM - message exceeds fixed maximum message size %d/%d", size, Cfg.GetSmtpdMaxDataBytes()))
-				s.Out("552 message exceeds fixed maximum message size")
+				s.Out("552 5.3.4 message exceeds fixed maximum message size")
 				s.SMTPResponseCode = 552
 				s.pause(1)
 				return
 			}
+		case "BODY":
+			value = strings.ToUpper(value)
+			if value != "7BIT" && value != "8BITMIME" {
+				s.Log("MAIL FROM - bad value for BODY parameter: " + value)
+				s.pause(2)
+				s.Out("501 5.5.4 Invalid BODY value")
+				s.SMTPResponseCode = 501
+				return
+			}
+			s.Envelope.Body = value
+		case "SMTPUTF8":
+			if value != "" {
+				s.Log("MAIL FROM - SMTPUTF8 parameter does not take value: " + value)
+				s.pause(2)
+				s.Out("501 5.5.4 Invalid arguments")
+				s.SMTPResponseCode = 501
+				return
+			}
+			s.Envelope.SMTPUTF8 = true
+		// DSN (RFC 3461)
+		case "RET":
+			value = strings.ToUpper(value)
+			if value != "FULL" && value != "HDRS" {
+				s.Log("MAIL FROM - bad value for RET parameter: " + value)
+				s.pause(2)
+				s.Out("501 5.5.4 Invalid RET value")
+				s.SMTPResponseCode = 501
+				return
+			}
+			s.Envelope.DSNRet = value
+		case "ENVID":
+			envID, err := xtextDecode(value)
+			if err != nil || len(envID) == 0 || len(envID) > 100 {
+				s.Log("MAIL FROM - bad value for ENVID parameter: " + value)
+				s.pause(2)
+				s.Out("501 5.5.4 Invalid ENVID value")
+				s.SMTPResponseCode = 501
+				return
+			}
+			s.Envelope.DSNEnvID = value
+		default:
+			s.Log(fmt.Sprintf("MAIL FROM - Unsuported extension : %s ", keyword))
+			s.pause(2)
+			s.Out("555 5.5.4 Unsupported option: " + keyword)
+			s.SMTPResponseCode = 555
+			return
 		}
 	}
 
-	// remove <>
-	s.Envelope.MailFrom = RemoveBrackets(s.Envelope.MailFrom)
+	// RFC 6531 3.4: non ASCII address needs SMTPUTF8
+	if !s.Envelope.SMTPUTF8 && !isASCII(s.Envelope.MailFrom) {
+		s.Log("MAIL FROM - non ASCII address without SMTPUTF8: " + s.Envelope.MailFrom)
+		s.pause(2)
+		s.Out("553 5.6.7 non-ASCII addresses require SMTPUTF8")
+		s.SMTPResponseCode = 553
+		return
+	}
 
 	// mail from is valid ?
 	reversePathlen := len(s.Envelope.MailFrom)
 	if reversePathlen > 0 { // 0 -> null reverse path (bounce)
 		if reversePathlen > 256 { // RFC 5321 4.3.5.1.3
 			s.Log("MAIL - reverse path is too long: " + s.Envelope.MailFrom)
-			s.Out("550 reverse path must be lower than 255 char (RFC 5321 4.5.1.3.1)")
+			s.Out("550 5.1.7 reverse path must be lower than 255 char (RFC 5321 4.5.1.3.1)")
 			s.SMTPResponseCode = 550
 			s.pause(2)
 			return
@@ -425,14 +598,14 @@ func (s *SMTPServerSession) smtpMailFrom(msg []string) {
 		}
 		if Cfg.getRFCMailFromLocalpartSize() && len(localDomain[0]) > 64 {
 			s.Log("MAIL - local part is too long: " + s.Envelope.MailFrom)
-			s.Out("550 local part of reverse path MUST be lower than 65 char (RFC 5321 4.5.3.1.1)")
+			s.Out("550 5.1.7 local part of reverse path MUST be lower than 65 char (RFC 5321 4.5.3.1.1)")
 			s.SMTPResponseCode = 550
 			s.pause(2)
 			return
 		}
 		if len(localDomain[1]) > 255 {
 			s.Log("MAIL - domain part is too long: " + s.Envelope.MailFrom)
-			s.Out("550 domain part of reverse path MUST be lower than 255 char (RFC 5321 4.5.3.1.2)")
+			s.Out("550 5.1.7 domain part of reverse path MUST be lower than 255 char (RFC 5321 4.5.3.1.2)")
 			s.SMTPResponseCode = 550
 			s.pause(2)
 			return
@@ -441,7 +614,7 @@ func (s *SMTPServerSession) smtpMailFrom(msg []string) {
 		ok, err := isFQN(localDomain[1])
 		if err != nil {
 			s.LogError("MAIL - fail to do lookup on domain part. " + err.Error())
-			s.Out("451 unable to resolve " + localDomain[1] + " due to timeout or srv failure")
+			s.Out("451 4.4.3 unable to resolve " + localDomain[1] + " due to timeout or srv failure")
 			s.SMTPResponseCode = 451
 			return
 		}
@@ -452,11 +625,17 @@ func (s *SMTPServerSession) smtpMailFrom(msg []string) {
 			return
 		}
 	}
+
+	// SPF
+	if !s.checkSPF() {
+		return
+	}
+
 	// Plugin - hook "mailpost"
 	execSMTPdPlugins("mailpost", s)
 	s.seenMail = true
 	s.Log("MAIL FROM " + s.Envelope.MailFrom)
-	s.Out("250 ok")
+	s.Out("250 2.1.0 ok")
 	s.SMTPResponseCode = 250
 }
 
@@ -485,30 +664,69 @@ func (s *SMTPServerSession) smtpRcptTo(msg []string) {
 		return
 	}
 
-	if len(msg) == 1 || !strings.HasPrefix(strings.ToLower(msg[1]), "to:") {
+	rcptTo, params, err := parseSMTPPathAndParams("to:", msg)
+	if err != nil || len(rcptTo) == 0 {
 		s.Log(fmt.Sprintf("RCPT TO - Bad syntax : %s ", strings.Join(msg, " ")))
 		s.pause(2)
 		s.Out("501 5.5.4 syntax: RCPT TO:<address>")
 		s.SMTPResponseCode = 501
 		return
 	}
-
-	// rcpt to: user
-	if len(msg[1]) > 3 {
-		t := strings.Split(msg[1], ":")
-		s.LastRcptTo = strings.Join(t[1:], ":")
-	} else if len(msg) > 2 {
-		s.LastRcptTo = msg[2]
+	rcptDSN := message.RcptDSN{}
+	for keyword, value := range params {
+		switch keyword {
+		// DSN (RFC 3461)
+		case "NOTIFY":
+			value = strings.ToUpper(value)
+			valid := value != ""
+			for _, n := range strings.Split(value, ",") {
+				if !IsStringInSlice(n, []string{"SUCCESS", "FAILURE", "DELAY"}) && (n != "NEVER" || value != "NEVER") {
+					valid = false
+				}
+			}
+			if !valid {
+				s.Log("RCPT TO - bad value for NOTIFY parameter: " + value)
+				s.pause(2)
+				s.Out("501 5.5.4 Invalid NOTIFY value")
+				s.SMTPResponseCode = 501
+				return
+			}
+			rcptDSN.Notify = value
+		case "ORCPT":
+			t := strings.SplitN(value, ";", 2)
+			if len(t) != 2 || len(t[0]) == 0 {
+				s.Log("RCPT TO - bad value for ORCPT parameter: " + value)
+				s.pause(2)
+				s.Out("501 5.5.4 Invalid ORCPT value")
+				s.SMTPResponseCode = 501
+				return
+			}
+			if _, err := xtextDecode(t[1]); err != nil {
+				s.Log("RCPT TO - bad value for ORCPT parameter: " + value)
+				s.pause(2)
+				s.Out("501 5.5.4 Invalid ORCPT value")
+				s.SMTPResponseCode = 501
+				return
+			}
+			rcptDSN.Orcpt = value
+		default:
+			s.Log(fmt.Sprintf("RCPT TO - Unsuported extension : %s ", keyword))
+			s.pause(2)
+			s.Out("555 5.5.4 Unsupported option: " + keyword)
+			s.SMTPResponseCode = 555
+			return
+		}
 	}
+	s.LastRcptTo = rcptTo
 
-	if len(s.LastRcptTo) == 0 {
-		s.Log("RCPT - Bad syntax : %s " + strings.Join(msg, " "))
+	// RFC 6531 3.4: non ASCII address needs SMTPUTF8
+	if !s.Envelope.SMTPUTF8 && !isASCII(s.LastRcptTo) {
+		s.Log("RCPT TO - non ASCII address without SMTPUTF8: " + s.LastRcptTo)
 		s.pause(2)
-		s.Out("501 5.5.4 syntax: RCPT TO:<address>")
-		s.SMTPResponseCode = 501
+		s.Out("553 5.6.7 non-ASCII addresses require SMTPUTF8")
+		s.SMTPResponseCode = 553
 		return
 	}
-	s.LastRcptTo = RemoveBrackets(s.LastRcptTo)
 
 	// We MUST recognize source route syntax but SHOULD strip off source routing
 	// RFC 5321 4.1.1.3
@@ -612,12 +830,28 @@ func (s *SMTPServerSession) smtpRcptTo(msg []string) {
 		return
 	}
 
+	// Greylisting
+	if !s.checkGreylisting() {
+		return
+	}
+
+	// Rate limit
+	if !s.checkRcptRateLimit() {
+		return
+	}
+
 	// Check if there is already this recipient
 	if !IsStringInSlice(s.LastRcptTo, s.Envelope.RcptTo) {
 		s.Envelope.RcptTo = append(s.Envelope.RcptTo, s.LastRcptTo)
+		if rcptDSN.Notify != "" || rcptDSN.Orcpt != "" {
+			if s.Envelope.DSNRcpt == nil {
+				s.Envelope.DSNRcpt = make(map[string]message.RcptDSN)
+			}
+			s.Envelope.DSNRcpt[s.LastRcptTo] = rcptDSN
+		}
 		s.Log("RCPT - + " + s.LastRcptTo)
 	}
-	s.Out("250 ok")
+	s.Out("250 2.1.5 ok")
 	s.SMTPResponseCode = 250
 }
 
@@ -712,11 +946,11 @@ func (s *SMTPServerSession) smtpVrfy(msg []string) {
 				s.SMTPResponseCode = 551
 				return
 			}
-			s.Out("250 <" + rcptto + ">")
+			s.Out("250 2.1.5 <" + rcptto + ">")
 			s.SMTPResponseCode = 250
 			// relay
 		} else {
-			s.Out("252 <" + rcptto + ">")
+			s.Out("252 2.1.5 <" + rcptto + ">")
 			s.SMTPResponseCode = 252
 		}
 	} else {
@@ -729,7 +963,7 @@ func (s *SMTPServerSession) smtpVrfy(msg []string) {
 
 // SMTPExpn EXPN SMTP command
 func (s *SMTPServerSession) smtpExpn(msg []string) {
-	s.Out("252")
+	s.Out("252 2.1.5 Cannot EXPN")
 	s.SMTPResponseCode = 252
 	return
 }
@@ -749,6 +983,15 @@ func (s *SMTPServerSession) smtpData(msg []string) {
 		return
 	}
 
+	// RFC 3030 2: DATA and BDAT can't be mixed in a transaction
+	if s.chunking {
+		s.Log("DATA - not allowed in BDAT transaction")
+		s.pause(2)
+		s.Out("503 5.5.1 DATA not allowed after BDAT")
+		s.SMTPResponseCode = 503
+		return
+	}
+
 	if len(msg) > 1 {
 		s.Log("DATA - invalid syntax: " + strings.Join(msg, " "))
 		s.pause(2)
@@ -756,12 +999,19 @@ func (s *SMTPServerSession) smtpData(msg []string) {
 		s.SMTPResponseCode = 551
 		return
 	}
+	// spool
+	if err := s.newDataSpool(); err != nil {
+		s.LogError("DATA - unable to create spool file. " + err.Error())
+		s.Out("451 4.3.0 temporary local problem")
+		s.SMTPResponseCode = 451
+		return
+	}
+
 	s.Out("354 End data with <CR><LF>.<CR><LF>")
 	s.SMTPResponseCode = 354
 
 	// Get RAW mail
-	//var s.CurrentRawMail []byte
-	s.CurrentRawMail = []byte{}
+	var err error
 	ch := make([]byte, 1)
 	//state := 0
 	pos := 0        // position in current line
@@ -780,13 +1030,13 @@ func (s *SMTPServerSession) smtpData(msg []string) {
 			break
 		}
 		s.resetTimeout()
-		_, err := s.Conn.Read(ch)
+		ch[0], err = s.readByte()
 		if err != nil {
 			// we will tryc to send an error message to client, but there is a LOT of
 			// chance that is gone
 			s.LogError("DATA - unable to read byte from conn. " + err.Error())
-			s.Out("454 something wrong append will reading data from you")
-			s.SMTPResponseCode = 454
+			s.Out("451 4.3.0 something wrong append will reading data from you")
+			s.SMTPResponseCode = 451
 			s.ExitAsap()
 			return
 		}
@@ -834,7 +1084,7 @@ func (s *SMTPServerSession) smtpData(msg []string) {
 			}
 			if ch[0] == CR {
 				state = 4
-				s.CurrentRawMail = append(s.CurrentRawMail, ch[0])
+				s.dataSpool.WriteByte(ch[0])
 				s.dataBytes++
 				continue
 			}
@@ -852,7 +1102,7 @@ func (s *SMTPServerSession) smtpData(msg []string) {
 			// "\r"
 			if ch[0] == CR {
 				state = 4
-				s.CurrentRawMail = append(s.CurrentRawMail, ch[0])
+				s.dataSpool.WriteByte(ch[0])
 				s.dataBytes++
 				continue
 			}
@@ -866,7 +1116,7 @@ func (s *SMTPServerSession) smtpData(msg []string) {
 			}
 			if ch[0] == CR {
 				state = 3
-				s.CurrentRawMail = append(s.CurrentRawMail, ch[0])
+				s.dataSpool.WriteByte(ch[0])
 				s.dataBytes++
 				continue
 			}
@@ -876,14 +1126,14 @@ func (s *SMTPServerSession) smtpData(msg []string) {
 		case 3:
 			if ch[0] == LF {
 				doLoop = false
-				s.CurrentRawMail = append(s.CurrentRawMail, ch[0])
+				s.dataSpool.WriteByte(ch[0])
 				s.dataBytes++
 				continue
 			}
 
 			if ch[0] == CR {
 				state = 4
-				s.CurrentRawMail = append(s.CurrentRawMail, ch[0])
+				s.dataSpool.WriteByte(ch[0])
 				s.dataBytes++
 				continue
 			}
@@ -896,11 +1146,11 @@ func (s *SMTPServerSession) smtpData(msg []string) {
 				break
 			}
 			if ch[0] != CR {
-				s.CurrentRawMail = append(s.CurrentRawMail, 10)
+				s.dataSpool.WriteByte(LF)
 				state = 0
 			}
 		}
-		s.CurrentRawMail = append(s.CurrentRawMail, ch[0])
+		s.dataSpool.WriteByte(ch[0])
 		s.dataBytes++
 
 		// Max hops reached ?
@@ -924,10 +1174,23 @@ func (s *SMTPServerSession) smtpData(msg []string) {
 		}
 	}
 
+	s.queueCurrentMessage()
+}
+
+// queueCurrentMessage scans and queues message received via DATA or BDAT
+func (s *SMTPServerSession) queueCurrentMessage() {
 	// scan
 	// clamav
+	rawMail, err := s.GetRawMail()
+	if err != nil {
+		s.LogError("MAIL - unable to read spooled message -", err.Error())
+		s.Out("451 4.3.0 temporary local problem")
+		s.SMTPResponseCode = 451
+		s.Reset()
+		return
+	}
 	if Cfg.GetSmtpdClamavEnabled() {
-		found, virusName, err := NewClamav().ScanStream(bytes.NewReader(s.CurrentRawMail))
+		found, virusName, err := NewClamav().ScanStream(rawMail)
 		Logger.Debug("clamav scan result", found, virusName, err)
 		if err != nil {
 			s.LogError("MAIL - clamav: " + err.Error())
@@ -947,15 +1210,24 @@ func (s *SMTPServerSession) smtpData(msg []string) {
 		}
 	}
 
+	// DKIM
+	s.verifyDKIM()
+
+	// DMARC
+	if !s.checkDMARC() {
+		return
+	}
+
 	// Message-ID
-	HeaderMessageID := message.RawGetMessageId(&s.CurrentRawMail)
+	headers := s.dataSpool.Headers()
+	HeaderMessageID := message.RawGetMessageId(&headers)
 	if len(HeaderMessageID) == 0 {
 		atDomain := Cfg.GetMe()
 		if strings.Count(s.Envelope.MailFrom, "@") != 0 {
 			atDomain = strings.ToLower(strings.Split(s.Envelope.MailFrom, "@")[1])
 		}
 		HeaderMessageID = []byte(fmt.Sprintf("%d.%s@%s", time.Now().Unix(), s.uuid, atDomain))
-		s.CurrentRawMail = append([]byte(fmt.Sprintf("Message-ID: <%s>\r\n", HeaderMessageID)), s.CurrentRawMail...)
+		s.PrependHeader(fmt.Sprintf("Message-ID: <%s>", HeaderMessageID))
 
 	}
 	s.Log("message-id:", string(HeaderMessageID))
@@ -1004,11 +1276,29 @@ func (s *SMTPServerSession) smtpData(msg []string) {
 	recieved += "; " + time.Now().Format(Time822)
 	h := []byte(recieved)
 	message.FoldHeader(&h)
-	h = append(h, []byte{13, 10}...)
-	s.CurrentRawMail = append(h, s.CurrentRawMail...)
+	s.PrependHeader(string(h))
 	recieved = ""
 
-	s.CurrentRawMail = append([]byte("X-Env-From: "+s.Envelope.MailFrom+"\r\n"), s.CurrentRawMail...)
+	// Received-SPF (above Received)
+	if s.spfHeader != "" {
+		h = []byte(s.spfHeader)
+		message.FoldHeader(&h)
+		s.PrependHeader(string(h))
+	}
+
+	// Authentication-Results
+	if authResults := s.authResultsHeader(); authResults != "" {
+		h = []byte(authResults)
+		message.FoldHeader(&h)
+		s.PrependHeader(string(h))
+	}
+
+	// DNSBL
+	if s.isDNSBLListed() {
+		s.PrependHeader(fmt.Sprintf("X-DNSBL: score=%d; listed=%s", s.DNSBLScore, strings.Join(s.DNSBLListed, ",")))
+	}
+
+	s.PrependHeader("X-Env-From: " + s.Envelope.MailFrom)
 
 	// Plugins
 	if execSMTPdPlugins("data", s) {
@@ -1023,21 +1313,143 @@ func (s *SMTPServerSession) smtpData(msg []string) {
 
 	// Plugins
 	execSMTPdPlugins("beforequeue", s)
-	id, err := QueueAddMessage(&s.CurrentRawMail, s.Envelope, authUser)
+	if rawMail, err = s.GetRawMail(); err != nil {
+		s.LogError("MAIL - unable to read spooled message -", err.Error())
+		s.Out("451 4.3.0 temporary local problem")
+		s.SMTPResponseCode = 451
+		s.Reset()
+		return
+	}
+	id, err := QueueAddMessage(rawMail, s.Envelope, authUser)
 	if err != nil {
 		s.LogError("MAIL - unable to put message in queue -", err.Error())
-		s.Out("451 temporary queue error")
+		s.Out("451 4.3.0 temporary queue error")
 		s.SMTPResponseCode = 451
 		s.Reset()
 		return
 	}
 	s.Log("message queued as", id)
+	s.recordRateLimits()
 	s.Out(fmt.Sprintf("250 2.0.0 Ok: queued %s", id))
 	s.SMTPResponseCode = 250
 	s.Reset()
 	return
 }
 
+// BDAT (RFC 3030)
+// BDAT chunk-size [LAST]
+func (s *SMTPServerSession) smtpBdat(msg []string) {
+	defer s.recoverOnPanic()
+	var size uint64
+	var err error
+	last := len(msg) == 3 && strings.ToLower(msg[2]) == "last"
+	syntaxOK := len(msg) == 2 || last
+	if syntaxOK {
+		size, err = strconv.ParseUint(msg[1], 10, 32)
+		syntaxOK = err == nil
+	}
+	if !syntaxOK {
+		// we don't know how many bytes we have to read -> bye
+		s.Log("BDAT - invalid syntax: " + strings.Join(msg, " "))
+		s.Out("501 5.5.4 Syntax: BDAT chunk-size [LAST]")
+		s.SMTPResponseCode = 501
+		s.ExitAsap()
+		return
+	}
+
+	// whatever happens chunk must be read
+	if !s.seenMail || len(s.Envelope.RcptTo) == 0 {
+		s.Log("BDAT - out of sequence")
+		if err = s.readChunk(size, ioutil.Discard); err != nil {
+			s.LogError("BDAT - unable to read chunk from conn. " + err.Error())
+			s.ExitAsap()
+			return
+		}
+		s.Out("503 5.5.1 command out of sequence")
+		s.SMTPResponseCode = 503
+		return
+	}
+
+	if !s.chunking {
+		if err = s.newDataSpool(); err != nil {
+			s.LogError("BDAT - unable to create spool file. " + err.Error())
+			if err = s.readChunk(size, ioutil.Discard); err != nil {
+				s.ExitAsap()
+				return
+			}
+			s.Out("451 4.3.0 temporary local problem")
+			s.SMTPResponseCode = 451
+			s.Reset()
+			return
+		}
+		s.chunking = true
+		s.dataBytes = 0
+	}
+
+	// Max databytes reached ?
+	if Cfg.GetSmtpdMaxDataBytes() != 0 && uint64(s.dataBytes)+size > uint64(Cfg.GetSmtpdMaxDataBytes()) {
+		s.Log(fmt.Sprintf("MAIL - Message size (%d) exceeds maxDataBytes (%d).", uint64(s.dataBytes)+size, Cfg.GetSmtpdMaxDataBytes()))
+		if err = s.readChunk(size, ioutil.Discard); err != nil {
+			s.LogError("BDAT - unable to read chunk from conn. " + err.Error())
+			s.ExitAsap()
+			return
+		}
+		s.Out("552 5.3.4 sorry, that message size exceeds my databytes limit")
+		s.SMTPResponseCode = 552
+		s.Reset()
+		return
+	}
+
+	if err = s.readChunk(size, s.dataSpool); err != nil {
+		s.LogError("BDAT - unable to read chunk from conn. " + err.Error())
+		s.Out("451 4.3.0 something wrong append will reading data from you")
+		s.SMTPResponseCode = 451
+		s.ExitAsap()
+		return
+	}
+	s.dataBytes += uint32(size)
+
+	if !last {
+		s.Out(fmt.Sprintf("250 2.0.0 %d octets received", size))
+		s.SMTPResponseCode = 250
+		return
+	}
+
+	// Max hops reached ?
+	headers := s.dataSpool.Headers()
+	if hops := message.RawCountHops(&headers); hops > Cfg.GetSmtpdMaxHops() {
+		s.Log(fmt.Sprintf("MAIL - Message is looping. Hops : %d", hops))
+		s.Out("554 5.4.6 too many hops, this message is looping")
+		s.SMTPResponseCode = 554
+		s.Reset()
+		return
+	}
+	s.queueCurrentMessage()
+}
+
+// readChunk reads size bytes from client and writes them to dst
+func (s *SMTPServerSession) readChunk(size uint64, dst io.Writer) error {
+	buf := make([]byte, 32*1024)
+	for size > 0 {
+		if s.reader.Buffered() == 0 {
+			s.flush()
+		}
+		s.resetTimeout()
+		if size < uint64(len(buf)) {
+			buf = buf[:size]
+		}
+		n, err := s.reader.Read(buf)
+		size -= uint64(n)
+		if err != nil && size != 0 {
+			return err
+		}
+		if _, err = dst.Write(buf[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // QUIT
 func (s *SMTPServerSession) smtpQuit() {
 	// Plugins
@@ -1051,7 +1463,7 @@ func (s *SMTPServerSession) smtpQuit() {
 // Starttls
 func (s *SMTPServerSession) smtpStartTLS() {
 	if s.tls {
-		s.Out("454 - transaction is already over SSL/TLS")
+		s.Out("454 5.5.1 transaction is already over SSL/TLS")
 		s.SMTPResponseCode = 454
 		return
 	}
@@ -1059,7 +1471,7 @@ func (s *SMTPServerSession) smtpStartTLS() {
 	if err != nil {
 		msg := "TLS failed unable to load server keys: " + err.Error()
 		s.LogError(msg)
-		s.Out("454 " + msg)
+		s.Out("454 4.7.0 " + msg)
 		s.SMTPResponseCode = 454
 		return
 	}
@@ -1070,8 +1482,16 @@ func (s *SMTPServerSession) smtpStartTLS() {
 	}
 	tlsConfig.Rand = rand.Reader
 
-	s.Out("220 Ready to start TLS nego")
+	s.Out("220 2.0.0 Ready to start TLS nego")
 	s.SMTPResponseCode = 220
+	s.flush()
+
+	// RFC 3207 6: client must not pipeline commands after STARTTLS,
+	// discard what was sent in clear
+	if n := s.reader.Buffered(); n > 0 {
+		s.Log(fmt.Sprintf("STARTTLS - %d bytes sent before TLS negotiation discarded", n))
+		s.reader.Discard(n)
+	}
 
 	//var tlsConn *tls.Conn
 	//tlsConn = tls.Server(client.socket, TLSconfig)
@@ -1080,7 +1500,7 @@ func (s *SMTPServerSession) smtpStartTLS() {
 	// errors.New("tls: unsupported SSLv2 handshake received")
 	err = s.connTLS.Handshake()
 	if err != nil {
-		msg := "454 - TLS handshake failed: " + err.Error()
+		msg := "454 4.7.0 TLS handshake failed: " + err.Error()
 		s.SMTPResponseCode = 454
 		if err.Error() == "tls: unsupported SSLv2 handshake received" {
 			s.Log(msg)
@@ -1093,106 +1513,167 @@ func (s *SMTPServerSession) smtpStartTLS() {
 	s.Log("connection upgraded to " + tlsGetVersion(s.connTLS.ConnectionState().Version) + " " + tlsGetCipherSuite(s.connTLS.ConnectionState().CipherSuite))
 	//s.Conn = net.Conn(tlsConn)
 	s.Conn = s.connTLS
+	s.reader = bufio.NewReader(s.connTLS)
+	s.writer = bufio.NewWriter(s.connTLS)
 	s.tls = true
 	s.seenHelo = false
 }
 
-// SMTP AUTH
-// Return boolean closeCon
-// Pour le moment in va juste implémenter PLAIN
-func (s *SMTPServerSession) smtpAuth(rawMsg string) {
-	defer s.recoverOnPanic()
-	// TODO si pas TLS
-	//var authType, user, passwd string
-	//TODO si pas plain
-
-	//
-	splitted := strings.Split(rawMsg, " ")
-	var encoded string
-	if len(splitted) == 3 {
-		encoded = splitted[2]
-	} else if len(splitted) == 2 {
-		// refactor: readline function
-		var line []byte
-		ch := make([]byte, 1)
-		// return a
-		s.Out("334 ")
-		s.SMTPResponseCode = 334
-		// get encoded by reading next line
-		for {
-			s.resetTimeout()
-			_, err := s.Conn.Read(ch)
-			if err != nil {
-				s.Out("501 malformed auth input (#5.5.4)")
-				s.SMTPResponseCode = 501
-				s.Log("error reading auth err:" + err.Error())
-				s.ExitAsap()
-				return
-			}
-			if ch[0] == 10 {
-				s.timer.Stop()
-				s.LogDebug("< " + string(line))
-				break
-			}
-			line = append(line, ch[0])
+// authNeedsTLS returns true if TLS must be up before AUTH
+func (s *SMTPServerSession) authNeedsTLS() bool {
+	return !s.tls && (Cfg.GetSmtpdAuthRequireTLS() || s.policy != SmtpdPolicyMX)
+}
+
+// authMechanisms returns SASL mechanisms enabled & available
+// (none if TLS is required and not up, CRAM-MD5 only if some users have a
+// CRAM-MD5 secret)
+func (s *SMTPServerSession) authMechanisms() (mechanisms []string) {
+	if s.authNeedsTLS() {
+		return
+	}
+	for _, m := range Cfg.GetSmtpdAuthMechanisms() {
+		if m == "CRAM-MD5" && !cramMD5Available() {
+			continue
 		}
+		if _, found := SMTPdAuthMechanisms[m]; found {
+			mechanisms = append(mechanisms, m)
+		}
+	}
+	return
+}
 
-	} else {
-		s.Out("501 malformed auth input (#5.5.4)")
+// readLine reads a line from client (used for AUTH continuation)
+func (s *SMTPServerSession) readLine() (line []byte, err error) {
+	var ch byte
+	for {
+		s.resetTimeout()
+		if ch, err = s.readByte(); err != nil {
+			return nil, err
+		}
+		if ch == LF {
+			break
+		}
+		line = append(line, ch)
+		// RFC 4954 4: 12288 octets is the max for an AUTH line
+		if len(line) > 12288 {
+			return nil, ErrSMTPdAuthMalformed
+		}
+	}
+	s.timer.Stop()
+	return bytes.TrimSuffix(line, []byte{CR}), nil
+}
+
+// SMTP AUTH
+// AUTH mechanism [initial-response]
+func (s *SMTPServerSession) smtpAuth(msg []string) {
+	defer s.recoverOnPanic()
+	if s.user != nil {
+		s.Out("503 5.5.1 already authenticated")
+		s.SMTPResponseCode = 503
+		return
+	}
+	// RFC 4954 4: AUTH command is not permitted during a mail transaction
+	if s.seenMail {
+		s.Out("503 5.5.1 AUTH not permitted during a mail transaction")
+		s.SMTPResponseCode = 503
+		return
+	}
+	if s.authNeedsTLS() {
+		s.Out("538 5.7.11 encryption required for requested authentication mechanism")
+		s.SMTPResponseCode = 538
+		s.Log("AUTH - rejected, TLS is required")
+		return
+	}
+	if len(msg) < 2 || len(msg) > 3 {
+		s.Out("501 5.5.4 malformed auth input")
 		s.SMTPResponseCode = 501
-		s.Log("malformed auth input: " + rawMsg)
-		s.ExitAsap()
+		s.Log("AUTH - malformed auth input: " + strings.Join(msg, " "))
 		return
 	}
 
-	// decode  "authorize-id\0userid\0passwd\0"
-	authData, err := base64.StdEncoding.DecodeString(encoded)
-	if err != nil {
-		s.Out("501 malformed auth input (#5.5.4)")
-		s.SMTPResponseCode = 501
-		s.Log("malformed auth input: " + rawMsg + " err:" + err.Error())
-		s.ExitAsap()
+	// mechanism
+	mechanismName := strings.ToUpper(msg[1])
+	if !IsStringInSlice(mechanismName, s.authMechanisms()) {
+		s.Out("504 5.5.4 unrecognized authentication type")
+		s.SMTPResponseCode = 504
+		s.Log("AUTH - unsupported mechanism: " + mechanismName)
 		return
 	}
+	mechanism := SMTPdAuthMechanisms[mechanismName](s)
 
-	// split
-	t := make([][]byte, 3)
-	i := 0
-	for _, b := range authData {
-		if b == 0 {
-			i++
-			continue
+	// initial response, "=" means empty
+	var fromClient []byte
+	var err error
+	if len(msg) == 3 {
+		if msg[2] == "=" {
+			fromClient = []byte{}
+		} else if fromClient, err = base64.StdEncoding.DecodeString(msg[2]); err != nil {
+			s.Out("501 5.5.2 malformed auth input")
+			s.SMTPResponseCode = 501
+			s.Log("AUTH - " + mechanismName + " unable to decode initial response: " + err.Error())
+			s.ExitAsap()
+			return
 		}
-		t[i] = append(t[i], b)
 	}
-	//authId := string(t[0])
-	authLogin := string(t[1])
-	authPasswd := string(t[2])
 
-	s.user, err = UserGet(authLogin, authPasswd)
-	if err != nil {
-		if err == gorm.ErrRecordNotFound {
-			s.Out("535 authentication failed - No such user (#5.7.1)")
-			s.SMTPResponseCode = 535
-			s.Log("auth failed: " + rawMsg + " err:" + err.Error())
+	// SASL exchange
+	for {
+		toClient, user, err := mechanism.Next(fromClient)
+		if err != nil {
+			switch err {
+			case ErrSMTPdAuthMalformed:
+				s.Out("501 5.5.2 malformed auth input")
+				s.SMTPResponseCode = 501
+				s.Log("AUTH - " + mechanismName + " malformed auth input")
+			case ErrSMTPdAuthFailed:
+				s.Out("535 5.7.8 authentication failed")
+				s.SMTPResponseCode = 535
+				s.Log("AUTH - " + mechanismName + " authentication failed")
+			case ErrSMTPdAuthNoSecret:
+				s.Out("535 5.7.8 authentication failed")
+				s.SMTPResponseCode = 535
+				s.Log("AUTH - " + mechanismName + " authentication failed - " + err.Error())
+			default:
+				s.Out("454 4.7.0 oops, problem with auth")
+				s.SMTPResponseCode = 454
+				s.LogError("AUTH - " + mechanismName + " " + err.Error())
+			}
 			s.ExitAsap()
 			return
 		}
-		if err.Error() == "crypto/bcrypt: hashedPassword is not the hash of the given password" {
-			s.Out("535 authentication failed (#5.7.1)")
-			s.SMTPResponseCode = 535
-			s.Log("auth failed: " + rawMsg + " err:" + err.Error())
+		if user != nil {
+			s.user = user
+			break
+		}
+
+		// challenge
+		s.Out("334 " + base64.StdEncoding.EncodeToString(toClient))
+		s.SMTPResponseCode = 334
+		line, err := s.readLine()
+		if err != nil {
+			s.Out("501 5.5.2 malformed auth input")
+			s.SMTPResponseCode = 501
+			s.Log("AUTH - error reading auth response: " + err.Error())
+			s.ExitAsap()
+			return
+		}
+		// cancelled by client
+		if string(line) == "*" {
+			s.Out("501 5.0.0 authentication cancelled")
+			s.SMTPResponseCode = 501
+			s.Log("AUTH - " + mechanismName + " cancelled by client")
+			return
+		}
+		if fromClient, err = base64.StdEncoding.DecodeString(string(line)); err != nil {
+			s.Out("501 5.5.2 malformed auth input")
+			s.SMTPResponseCode = 501
+			s.Log("AUTH - " + mechanismName + " unable to decode response: " + err.Error())
 			s.ExitAsap()
 			return
 		}
-		s.Out("454 oops, problem with auth (#4.3.0)")
-		s.SMTPResponseCode = 454
-		s.Log("ERROR auth " + rawMsg + " err:" + err.Error())
-		s.ExitAsap()
-		return
 	}
-	s.Log("auth succeed for user " + s.user.Login)
-	s.Out("235 ok, go ahead (#2.0.0)")
+	s.Log("AUTH - " + mechanismName + " succeed for user " + s.user.Login)
+	s.Out("235 2.7.0 ok, go ahead")
 	s.SMTPResponseCode = 235
 }
 
@@ -1217,7 +1698,7 @@ func (s *SMTPServerSession) handle() {
 	// Init some var
 	//var msg []byte
 
-	buffer := make([]byte, 1)
+	var ch byte
 
 	// welcome (
 	s.smtpGreeting()
@@ -1225,7 +1706,8 @@ func (s *SMTPServerSession) handle() {
 	go func() {
 		defer s.recoverOnPanic()
 		for {
-			_, err := s.Conn.Read(buffer)
+			var err error
+			ch, err = s.readByte()
 			if err != nil {
 				if err.Error() == "EOF" {
 					s.LogDebug(s.Conn.RemoteAddr().String(), "- Client send EOF")
@@ -1238,11 +1720,11 @@ func (s *SMTPServerSession) handle() {
 				break
 			}
 
-			if buffer[0] == 0x00 {
+			if ch == 0x00 {
 				continue
 			}
 
-			if buffer[0] == 10 {
+			if ch == 10 {
 				s.timer.Stop()
 				var rmsg string
 				strMsg := strings.TrimSpace(string(s.lastClientCmd))
@@ -1259,6 +1741,10 @@ func (s *SMTPServerSession) handle() {
 				// TODO Use textproto / scanner
 				if len(splittedMsg) != 0 {
 					verb := strings.ToLower(splittedMsg[0])
+					// submission: STARTTLS is mandatory
+					if s.policy == SmtpdPolicySubmission && !s.tls && !IsStringInSlice(verb, []string{"helo", "ehlo", "starttls", "noop", "rset", "quit"}) {
+						verb = "mustStartTLS"
+					}
 					switch verb {
 					case "helo":
 						s.smtpHelo(splittedMsg)
@@ -1275,16 +1761,22 @@ func (s *SMTPServerSession) handle() {
 						s.smtpRcptTo(splittedMsg)
 					case "data":
 						s.smtpData(splittedMsg)
+					case "bdat":
+						s.smtpBdat(splittedMsg)
 					case "starttls":
 						s.smtpStartTLS()
 					case "auth":
-						s.smtpAuth(strMsg)
+						s.smtpAuth(splittedMsg)
 					case "rset":
 						s.rset()
 					case "noop":
 						s.noop()
 					case "quit":
 						s.smtpQuit()
+					case "mustStartTLS":
+						s.Log("command " + strings.ToUpper(splittedMsg[0]) + " refused before STARTTLS on " + s.policy + " listener")
+						s.Out("530 5.7.0 Must issue a STARTTLS command first")
+						s.SMTPResponseCode = 530
 					default:
 						rmsg = "502 5.5.1 unimplemented"
 						s.Log("unimplemented command from client:", strMsg)
@@ -1295,12 +1787,14 @@ func (s *SMTPServerSession) handle() {
 				//s.resetTimeout()
 				s.lastClientCmd = []byte{}
 			} else {
-				s.lastClientCmd = append(s.lastClientCmd, buffer[0])
+				s.lastClientCmd = append(s.lastClientCmd, ch)
 			}
 		}
 	}()
 	<-s.exitasap
+	s.flush()
 	s.Conn.Close()
+	s.resetData()
 	s.Log("EOT")
 	s.exiting = false
 	return
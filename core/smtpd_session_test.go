@@ -0,0 +1,217 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestSMTPServerSession returns a session of a policy listener reading
+// client input from in, replies are written to the returned buffer
+func newTestSMTPServerSession(t *testing.T, policy, in string) (*SMTPServerSession, *bytes.Buffer) {
+	if Logger == nil {
+		Logger = logrus.New()
+	}
+	client, server := net.Pipe()
+	s, err := NewSMTPServerSession(server, false, policy)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	out := &bytes.Buffer{}
+	s.reader = bufio.NewReader(strings.NewReader(in))
+	s.writer = bufio.NewWriter(out)
+	t.Cleanup(func() {
+		s.timer.Stop()
+		s.resetData()
+		client.Close()
+		server.Close()
+	})
+	return s, out
+}
+
+// replies returns replies sent to client
+func replies(s *SMTPServerSession, out *bytes.Buffer) string {
+	s.flush()
+	r := out.String()
+	out.Reset()
+	return r
+}
+
+func Test_authMechanisms(t *testing.T) {
+	Cfg = &Config{}
+	Cfg.cfg.SmtpdServerTimeout = 300
+	Cfg.cfg.SmtpdAuthMechanisms = "plain;login"
+	tests := []struct {
+		policy     string
+		tls        bool
+		requireTLS bool
+		want       []string
+	}{
+		{SmtpdPolicyMX, false, true, nil},
+		{SmtpdPolicyMX, true, true, []string{"PLAIN", "LOGIN"}},
+		{SmtpdPolicyMX, false, false, []string{"PLAIN", "LOGIN"}},
+		{SmtpdPolicySubmission, false, false, nil},
+		{SmtpdPolicySubmission, true, false, []string{"PLAIN", "LOGIN"}},
+		{SmtpdPolicySubmissions, true, true, []string{"PLAIN", "LOGIN"}},
+	}
+	for _, tt := range tests {
+		s, out := newTestSMTPServerSession(t, tt.policy, "")
+		s.tls = tt.tls
+		Cfg.cfg.SmtpdAuthRequireTLS = tt.requireTLS
+		assert.Equal(t, tt.want, s.authMechanisms(), tt)
+
+		// EHLO advertises AUTH only when it is allowed
+		s.smtpEhlo([]string{"EHLO", "client.example.com"})
+		assert.Equal(t, tt.want != nil, strings.Contains(replies(s, out), "250 AUTH PLAIN LOGIN\r\n"), tt)
+		s.smtpAuth([]string{"AUTH", "PLAIN"})
+		if tt.want == nil {
+			assert.Equal(t, "538 5.7.11 encryption required for requested authentication mechanism\r\n", replies(s, out), tt)
+		}
+	}
+}
+
+func Test_smtpMailFromAuthRequired(t *testing.T) {
+	Cfg = &Config{}
+	Cfg.cfg.SmtpdServerTimeout = 300
+	s, out := newTestSMTPServerSession(t, SmtpdPolicySubmission, "")
+	s.tls = true
+	s.smtpMailFrom([]string{"MAIL", "FROM:<>"})
+	assert.Equal(t, "530 5.7.0 Authentication required\r\n", replies(s, out))
+	assert.False(t, s.seenMail)
+
+	s, out = newTestSMTPServerSession(t, SmtpdPolicyMX, "")
+	s.smtpMailFrom([]string{"MAIL", "FROM:<>"})
+	assert.Equal(t, "250 2.1.0 ok\r\n", replies(s, out))
+	assert.True(t, s.seenMail)
+}
+
+func Test_smtpEhloExtensions(t *testing.T) {
+	Cfg = &Config{}
+	Cfg.cfg.SmtpdServerTimeout = 300
+	Cfg.cfg.Me = "mx.example.com"
+	s, out := newTestSMTPServerSession(t, SmtpdPolicyMX, "")
+	s.smtpEhlo([]string{"EHLO", "client.example.com"})
+	ehlo := replies(s, out)
+	assert.True(t, strings.HasPrefix(ehlo, "250-mx.example.com\r\n"))
+	for _, extension := range []string{"PIPELINING", "8BITMIME", "ENHANCEDSTATUSCODES", "SMTPUTF8"} {
+		assert.Contains(t, ehlo, "250-"+extension+"\r\n")
+	}
+}
+
+func Test_smtpMailFromBodySMTPUTF8(t *testing.T) {
+	Cfg = &Config{}
+	Cfg.cfg.SmtpdServerTimeout = 300
+	tests := []struct {
+		msg      []string
+		reply    string
+		body     string
+		smtputf8 bool
+	}{
+		{[]string{"MAIL", "FROM:<>"}, "250 2.1.0 ok", "", false},
+		{[]string{"MAIL", "FROM:<>", "BODY=7bit"}, "250 2.1.0 ok", "7BIT", false},
+		{[]string{"MAIL", "FROM:<>", "BODY=8BITMIME", "SMTPUTF8"}, "250 2.1.0 ok", "8BITMIME", true},
+		{[]string{"MAIL", "FROM:<>", "BODY=BINARYMIME"}, "501 5.5.4 Invalid BODY value", "", false},
+		{[]string{"MAIL", "FROM:<>", "SMTPUTF8=yes"}, "501 5.5.4 Invalid arguments", "", false},
+		{[]string{"MAIL", "FROM:<jöhn@example.com>"}, "553 5.6.7 non-ASCII addresses require SMTPUTF8", "", false},
+	}
+	s, out := newTestSMTPServerSession(t, SmtpdPolicyMX, "")
+	for _, tt := range tests {
+		s.smtpMailFrom(tt.msg)
+		assert.Equal(t, tt.reply+"\r\n", replies(s, out), tt.msg)
+		if tt.reply[0] == '2' {
+			assert.Equal(t, tt.body, s.Envelope.Body, tt.msg)
+			assert.Equal(t, tt.smtputf8, s.Envelope.SMTPUTF8, tt.msg)
+		}
+	}
+	// parameters are reset by the next transaction
+	s.Reset()
+	assert.Equal(t, "", s.Envelope.Body)
+	assert.False(t, s.Envelope.SMTPUTF8)
+}
+
+func Test_smtpPipelining(t *testing.T) {
+	Cfg = &Config{}
+	Cfg.cfg.SmtpdServerTimeout = 300
+	// replies of pipelined commands are sent when the session waits for the
+	// client
+	in := "NOOP\r\nNOOP\r\n"
+	s, out := newTestSMTPServerSession(t, SmtpdPolicyMX, in)
+	for i := 0; i < len(in); i++ {
+		_, err := s.readByte()
+		assert.NoError(t, err)
+		if i == len(in)/2-1 || i == len(in)-1 {
+			s.noop()
+		}
+	}
+	assert.Equal(t, "", out.String())
+	_, err := s.readByte()
+	assert.Error(t, err)
+	assert.Equal(t, "250 2.0.0 ok\r\n250 2.0.0 ok\r\n", out.String())
+}
+
+func Test_smtpBdat(t *testing.T) {
+	Cfg = &Config{}
+	Cfg.cfg.SmtpdServerTimeout = 300
+	Cfg.cfg.Me = "mx.example.com"
+	Cfg.cfg.TempDir = t.TempDir()
+
+	// chunk is read even if command is out of sequence
+	s, out := newTestSMTPServerSession(t, SmtpdPolicyMX, "0123456789NOOP\r\n")
+	s.smtpBdat([]string{"BDAT", "10"})
+	assert.Equal(t, "503 5.5.1 command out of sequence\r\n", replies(s, out))
+	line, _ := s.reader.ReadString('\n')
+	assert.Equal(t, "NOOP\r\n", line)
+
+	// chunks are appended to message
+	raw := "Received: from client.example.com\r\nSubject: test\r\n\r\nbody\r\n"
+	s, out = newTestSMTPServerSession(t, SmtpdPolicyMX, raw)
+	s.seenMail = true
+	s.Envelope.RcptTo = []string{"jane@example.com"}
+	s.smtpBdat([]string{"BDAT", "20"})
+	assert.Equal(t, "250 2.0.0 20 octets received\r\n", replies(s, out))
+	s.smtpBdat([]string{"BDAT", "0"})
+	assert.Equal(t, "250 2.0.0 0 octets received\r\n", replies(s, out))
+	s.smtpBdat([]string{"BDAT", "25"})
+	assert.Equal(t, "250 2.0.0 25 octets received\r\n", replies(s, out))
+	assert.True(t, s.chunking)
+	assert.Equal(t, uint32(45), s.dataBytes)
+	// message is checked on the last chunk (max hops: 0)
+	s.smtpBdat([]string{"BDAT", strconv.Itoa(len(raw) - 45), "LAST"})
+	assert.Equal(t, "554 5.4.6 too many hops, this message is looping\r\n", replies(s, out))
+	assert.False(t, s.chunking)
+
+	// max databytes
+	Cfg.cfg.SmtpdMaxDataBytes = 30
+	s, out = newTestSMTPServerSession(t, SmtpdPolicyMX, raw+"NOOP\r\n")
+	s.seenMail = true
+	s.Envelope.RcptTo = []string{"jane@example.com"}
+	s.smtpBdat([]string{"BDAT", "20"})
+	assert.Equal(t, "250 2.0.0 20 octets received\r\n", replies(s, out))
+	s.smtpBdat([]string{"BDAT", strconv.Itoa(len(raw) - 20), "LAST"})
+	assert.Equal(t, "552 5.3.4 sorry, that message size exceeds my databytes limit\r\n", replies(s, out))
+	line, _ = s.reader.ReadString('\n')
+	assert.Equal(t, "NOOP\r\n", line)
+
+	// invalid syntax: session is closed
+	for _, msg := range [][]string{{"BDAT"}, {"BDAT", "-1"}, {"BDAT", "10", "NOW"}} {
+		s, out = newTestSMTPServerSession(t, SmtpdPolicyMX, "")
+		s.smtpBdat(msg)
+		assert.Equal(t, "501 5.5.4 Syntax: BDAT chunk-size [LAST]\r\n", replies(s, out), msg)
+		assert.True(t, s.exiting, msg)
+	}
+
+	// truncated chunk
+	Cfg.cfg.SmtpdMaxDataBytes = 0
+	s, out = newTestSMTPServerSession(t, SmtpdPolicyMX, "Subject: test\r\n")
+	s.seenMail = true
+	s.Envelope.RcptTo = []string{"jane@example.com"}
+	s.smtpBdat([]string{"BDAT", "100"})
+	assert.Equal(t, "451 4.3.0 something wrong append will reading data from you\r\n", replies(s, out))
+	assert.True(t, s.exiting)
+}
@@ -0,0 +1,673 @@
+package core
+
+// SPF (RFC 7208)
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// SPFResult is the result of a SPF check
+type SPFResult string
+
+// SPF results
+const (
+	SPFNone      SPFResult = "none"
+	SPFNeutral   SPFResult = "neutral"
+	SPFPass      SPFResult = "pass"
+	SPFFail      SPFResult = "fail"
+	SPFSoftfail  SPFResult = "softfail"
+	SPFTemperror SPFResult = "temperror"
+	SPFPermerror SPFResult = "permerror"
+)
+
+const (
+	// spfMaxLookups is the max number of DNS queries (include, a, mx, ptr,
+	// exists and redirect) during a check (RFC 7208 4.6.4)
+	spfMaxLookups = 10
+	// spfMaxVoidLookups is the max number of DNS queries returning no
+	// records during a check
+	spfMaxVoidLookups = 2
+	// spfMaxNames is the max number of names returned by a MX or PTR query
+	// which are evaluated
+	spfMaxNames = 10
+)
+
+// spfResolver is the DNS resolver used by SPF checks
+type spfResolver interface {
+	LookupTXT(name string) ([]string, error)
+	LookupIP(host string) ([]net.IP, error)
+	LookupMX(name string) ([]*net.MX, error)
+	LookupAddr(addr string) ([]string, error)
+}
+
+// netSPFResolver is the default SPF resolver
+type netSPFResolver struct{}
+
+func (netSPFResolver) LookupTXT(name string) ([]string, error)  { return net.LookupTXT(name) }
+func (netSPFResolver) LookupIP(host string) ([]net.IP, error)   { return net.LookupIP(host) }
+func (netSPFResolver) LookupMX(name string) ([]*net.MX, error)  { return net.LookupMX(name) }
+func (netSPFResolver) LookupAddr(addr string) ([]string, error) { return net.LookupAddr(addr) }
+
+// resolver used for SPF checks (can be replaced for tests)
+var spfDNS spfResolver = netSPFResolver{}
+
+// errSPFPerm and errSPFTemp are returned by check functions on permanent
+// and temporary errors
+var (
+	errSPFPerm = errors.New("permerror")
+	errSPFTemp = errors.New("temperror")
+)
+
+// isNotFound returns true if err is a "no such host" DNS error
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+// spfCheck is a SPF check in progress
+type spfCheck struct {
+	ip      net.IP
+	sender  string // local-part@domain
+	helo    string
+	lookups int
+	voids   int
+}
+
+// CheckSPF returns SPF result for ip and sender (MAIL FROM or
+// postmaster@HELO), helo is the HELO/EHLO domain
+func CheckSPF(ip net.IP, sender, helo string) (SPFResult, error) {
+	p := strings.LastIndex(sender, "@")
+	if p == -1 {
+		sender = "postmaster@" + sender
+		p = strings.LastIndex(sender, "@")
+	}
+	if p == 0 {
+		sender = "postmaster" + sender
+		p = len("postmaster")
+	}
+	c := &spfCheck{ip: ip, sender: sender, helo: helo}
+	return c.checkHost(strings.TrimSuffix(sender[p+1:], "."))
+}
+
+// checkHost implements the check_host() function (RFC 7208 4)
+func (c *spfCheck) checkHost(domain string) (SPFResult, error) {
+	if !isValidSPFDomain(domain) {
+		return SPFNone, nil
+	}
+
+	// SPF record
+	txts, err := spfDNS.LookupTXT(domain)
+	if err != nil && !isNotFound(err) {
+		return SPFTemperror, err
+	}
+	record := ""
+	for _, txt := range txts {
+		if strings.ToLower(txt) == "v=spf1" || strings.HasPrefix(strings.ToLower(txt), "v=spf1 ") {
+			if record != "" {
+				return SPFPermerror, errors.New("multiple SPF records for " + domain)
+			}
+			record = txt
+		}
+	}
+	if record == "" {
+		return SPFNone, nil
+	}
+
+	// terms
+	redirect := ""
+	seenRedirect, seenExp := false, false
+	for _, term := range strings.Fields(record)[1:] {
+		// modifier ?
+		if p := strings.Index(term, "="); p > 0 && isSPFName(term[:p]) {
+			switch strings.ToLower(term[:p]) {
+			case "redirect":
+				if seenRedirect {
+					return SPFPermerror, errors.New("duplicated redirect modifier in SPF record of " + domain)
+				}
+				seenRedirect = true
+				redirect = term[p+1:]
+			case "exp":
+				if seenExp {
+					return SPFPermerror, errors.New("duplicated exp modifier in SPF record of " + domain)
+				}
+				seenExp = true
+			}
+			continue
+		}
+
+		// mechanism
+		result := SPFPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			result, term = SPFFail, term[1:]
+		case '~':
+			result, term = SPFSoftfail, term[1:]
+		case '?':
+			result, term = SPFNeutral, term[1:]
+		}
+		match, err := c.matchMechanism(domain, term)
+		if err != nil {
+			switch err {
+			case errSPFTemp:
+				return SPFTemperror, fmt.Errorf("%s: DNS failure for mechanism %s", domain, term)
+			case errSPFPerm:
+				return SPFPermerror, fmt.Errorf("%s: bad mechanism %s", domain, term)
+			}
+			return SPFPermerror, fmt.Errorf("%s: %s", domain, err.Error())
+		}
+		if match {
+			return result, nil
+		}
+	}
+
+	// redirect
+	// (ignored if there is an all mechanism, but it would have matched)
+	if seenRedirect {
+		if err := c.countLookup(); err != nil {
+			return SPFPermerror, err
+		}
+		target, err := c.expand(redirect, domain)
+		if err != nil {
+			return SPFPermerror, err
+		}
+		result, err := c.checkHost(target)
+		if result == SPFNone {
+			return SPFPermerror, errors.New("redirect to " + target + " which has no SPF record")
+		}
+		return result, err
+	}
+	return SPFNeutral, nil
+}
+
+// countLookup counts a DNS query and returns an error if limit is reached
+func (c *spfCheck) countLookup() error {
+	c.lookups++
+	if c.lookups > spfMaxLookups {
+		return errors.New("too many DNS lookups")
+	}
+	return nil
+}
+
+// countVoid counts a DNS query without result and returns an error if limit
+// is reached
+func (c *spfCheck) countVoid() error {
+	c.voids++
+	if c.voids > spfMaxVoidLookups {
+		return errors.New("too many void DNS lookups")
+	}
+	return nil
+}
+
+// lookupIP returns IPs of host of the same family as checked IP
+func (c *spfCheck) lookupIP(host string) ([]net.IP, error) {
+	ips, err := spfDNS.LookupIP(host)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, c.countVoid()
+		}
+		return nil, errSPFTemp
+	}
+	filtered := []net.IP{}
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (c.ip.To4() != nil) {
+			filtered = append(filtered, ip)
+		}
+	}
+	if len(filtered) == 0 {
+		return nil, c.countVoid()
+	}
+	return filtered, nil
+}
+
+// matchIP returns true if c.ip is in ip/cidr
+func (c *spfCheck) matchIP(ip net.IP, cidr4, cidr6 int) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		if c.ip.To4() == nil {
+			return false
+		}
+		return ip4.Mask(net.CIDRMask(cidr4, 32)).Equal(c.ip.To4().Mask(net.CIDRMask(cidr4, 32)))
+	}
+	if c.ip.To4() != nil {
+		return false
+	}
+	return ip.Mask(net.CIDRMask(cidr6, 128)).Equal(c.ip.To16().Mask(net.CIDRMask(cidr6, 128)))
+}
+
+// matchMechanism returns true if mechanism matches
+// errors are errSPFTemp (DNS failure) or permanent errors
+func (c *spfCheck) matchMechanism(domain, mechanism string) (bool, error) {
+	name, arg := mechanism, ""
+	if p := strings.IndexAny(mechanism, ":/"); p != -1 {
+		name, arg = mechanism[:p], mechanism[p:]
+	}
+	switch strings.ToLower(name) {
+	case "all":
+		if arg != "" {
+			return false, errSPFPerm
+		}
+		return true, nil
+
+	case "include":
+		if !strings.HasPrefix(arg, ":") {
+			return false, errSPFPerm
+		}
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := c.expand(arg[1:], domain)
+		if err != nil {
+			return false, err
+		}
+		result, _ := c.checkHost(target)
+		switch result {
+		case SPFPass:
+			return true, nil
+		case SPFTemperror:
+			return false, errSPFTemp
+		case SPFPermerror, SPFNone:
+			return false, errSPFPerm
+		}
+		return false, nil
+
+	case "a", "mx":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target, cidr4, cidr6, err := c.parseDomainCIDR(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		hosts := []string{target}
+		if strings.ToLower(name) == "mx" {
+			mxs, err := spfDNS.LookupMX(target)
+			if err != nil && !isNotFound(err) {
+				return false, errSPFTemp
+			}
+			if len(mxs) == 0 {
+				return false, c.countVoid()
+			}
+			if len(mxs) > spfMaxNames {
+				return false, errors.New("too many MX for " + target)
+			}
+			hosts = []string{}
+			for _, mx := range mxs {
+				hosts = append(hosts, mx.Host)
+			}
+		}
+		for _, host := range hosts {
+			ips, err := c.lookupIP(host)
+			if err != nil {
+				return false, err
+			}
+			for _, ip := range ips {
+				if c.matchIP(ip, cidr4, cidr6) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+
+	case "ptr":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target := domain
+		if arg != "" {
+			if !strings.HasPrefix(arg, ":") {
+				return false, errSPFPerm
+			}
+			var err error
+			if target, err = c.expand(arg[1:], domain); err != nil {
+				return false, err
+			}
+		}
+		names, err := spfDNS.LookupAddr(c.ip.String())
+		if err != nil {
+			// RFC 7208 5.5: DNS errors are ignored
+			return false, nil
+		}
+		if len(names) > spfMaxNames {
+			names = names[:spfMaxNames]
+		}
+		target = strings.ToLower(strings.TrimSuffix(target, "."))
+		for _, n := range names {
+			n = strings.ToLower(strings.TrimSuffix(n, "."))
+			if n != target && !strings.HasSuffix(n, "."+target) {
+				continue
+			}
+			ips, err := spfDNS.LookupIP(n)
+			if err != nil {
+				continue
+			}
+			for _, ip := range ips {
+				if ip.Equal(c.ip) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+
+	case "ip4", "ip6":
+		if !strings.HasPrefix(arg, ":") {
+			return false, errSPFPerm
+		}
+		arg = arg[1:]
+		ipStr, cidr := arg, -1
+		if p := strings.Index(arg, "/"); p != -1 {
+			var err error
+			ipStr = arg[:p]
+			if cidr, err = strconv.Atoi(arg[p+1:]); err != nil {
+				return false, errSPFPerm
+			}
+		}
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			return false, errSPFPerm
+		}
+		if strings.ToLower(name) == "ip4" {
+			if ip.To4() == nil || cidr > 32 {
+				return false, errSPFPerm
+			}
+			if cidr == -1 {
+				cidr = 32
+			}
+			return c.matchIP(ip.To4(), cidr, 0), nil
+		}
+		if ip.To4() != nil || cidr > 128 {
+			return false, errSPFPerm
+		}
+		if cidr == -1 {
+			cidr = 128
+		}
+		return c.matchIP(ip, 0, cidr), nil
+
+	case "exists":
+		if !strings.HasPrefix(arg, ":") {
+			return false, errSPFPerm
+		}
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := c.expand(arg[1:], domain)
+		if err != nil {
+			return false, err
+		}
+		// A record, whatever the family of the checked IP
+		ips, err := spfDNS.LookupIP(target)
+		if err != nil {
+			if isNotFound(err) {
+				return false, c.countVoid()
+			}
+			return false, errSPFTemp
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				return true, nil
+			}
+		}
+		return false, c.countVoid()
+	}
+	return false, errSPFPerm
+}
+
+// parseDomainCIDR parses [:domain-spec][/cidr4][//cidr6] (a and mx
+// mechanisms)
+func (c *spfCheck) parseDomainCIDR(arg, domain string) (target string, cidr4, cidr6 int, err error) {
+	target, cidr4, cidr6 = domain, 32, 128
+	if p := strings.Index(arg, "//"); p != -1 {
+		if cidr6, err = strconv.Atoi(arg[p+2:]); err != nil || cidr6 < 0 || cidr6 > 128 {
+			return "", 0, 0, errSPFPerm
+		}
+		arg = arg[:p]
+	}
+	if p := strings.LastIndex(arg, "/"); p != -1 {
+		if cidr4, err = strconv.Atoi(arg[p+1:]); err != nil || cidr4 < 0 || cidr4 > 32 {
+			return "", 0, 0, errSPFPerm
+		}
+		arg = arg[:p]
+	}
+	if arg != "" {
+		if !strings.HasPrefix(arg, ":") {
+			return "", 0, 0, errSPFPerm
+		}
+		if target, err = c.expand(arg[1:], domain); err != nil {
+			return "", 0, 0, err
+		}
+	}
+	return
+}
+
+// expand expands macros in domain-spec (RFC 7208 7)
+func (c *spfCheck) expand(spec, domain string) (string, error) {
+	out := ""
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			out += string(spec[i])
+			continue
+		}
+		if i+1 >= len(spec) {
+			return "", errSPFPerm
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			out += "%"
+			continue
+		case '_':
+			out += " "
+			continue
+		case '-':
+			out += "%20"
+			continue
+		case '{':
+		default:
+			return "", errSPFPerm
+		}
+		end := strings.Index(spec[i:], "}")
+		if end < 2 {
+			return "", errSPFPerm
+		}
+		macro := spec[i+1 : i+end]
+		i += end
+
+		// letter
+		letter := macro[0]
+		value := ""
+		p := strings.LastIndex(c.sender, "@")
+		switch letter | 0x20 {
+		case 's':
+			value = c.sender
+		case 'l':
+			value = c.sender[:p]
+		case 'o':
+			value = c.sender[p+1:]
+		case 'd':
+			value = domain
+		case 'i':
+			value = spfDottedIP(c.ip)
+		case 'p':
+			value = "unknown"
+		case 'v':
+			value = "in-addr"
+			if c.ip.To4() == nil {
+				value = "ip6"
+			}
+		case 'h':
+			value = c.helo
+		default:
+			// c, r and t are only allowed in exp
+			return "", errSPFPerm
+		}
+
+		// transformers & delimiters
+		macro = macro[1:]
+		digits := 0
+		for len(macro) != 0 && macro[0] >= '0' && macro[0] <= '9' {
+			digits = digits*10 + int(macro[0]-'0')
+			macro = macro[1:]
+		}
+		reverse := false
+		if len(macro) != 0 && (macro[0] == 'r' || macro[0] == 'R') {
+			reverse = true
+			macro = macro[1:]
+		}
+		delimiters := "."
+		if macro != "" {
+			if strings.Trim(macro, ".-+,/_=") != "" {
+				return "", errSPFPerm
+			}
+			delimiters = macro
+		}
+		parts := strings.FieldsFunc(value, func(r rune) bool {
+			return strings.ContainsRune(delimiters, r)
+		})
+		if reverse {
+			for l, r := 0, len(parts)-1; l < r; l, r = l+1, r-1 {
+				parts[l], parts[r] = parts[r], parts[l]
+			}
+		}
+		if digits != 0 && digits < len(parts) {
+			parts = parts[len(parts)-digits:]
+		}
+		value = strings.Join(parts, ".")
+		// uppercase macro letter: URL escaped
+		if letter >= 'A' && letter <= 'Z' {
+			value = url.QueryEscape(value)
+		}
+		out += value
+	}
+	// RFC 7208 7.3: domain is truncated to 253 chars (left labels removed)
+	for len(out) > 253 {
+		p := strings.Index(out, ".")
+		if p == -1 {
+			return "", errSPFPerm
+		}
+		out = out[p+1:]
+	}
+	return out, nil
+}
+
+// spfDottedIP returns IP for i macro: dotted for IPv4, dot separated
+// nibbles for IPv6
+func spfDottedIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	nibbles := []string{}
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, strconv.FormatInt(int64(b>>4), 16), strconv.FormatInt(int64(b&0xf), 16))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// isSPFName returns true if s is a valid modifier name
+func isSPFName(s string) bool {
+	for i, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		case i != 0 && (r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.'):
+		default:
+			return false
+		}
+	}
+	return s != ""
+}
+
+// isValidSPFDomain returns true if domain is a (multi labels) domain name
+func isValidSPFDomain(domain string) bool {
+	if len(domain) == 0 || len(domain) > 253 || !strings.Contains(domain, ".") {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+// spfReceivedHeader returns the Received-SPF header (RFC 7208 9.1)
+func spfReceivedHeader(result SPFResult, ip net.IP, sender, helo, identity string, err error) string {
+	comment := ""
+	switch result {
+	case SPFPass:
+		comment = fmt.Sprintf("%s: domain of %s designates %s as permitted sender", Cfg.GetMe(), sender, ip)
+	case SPFFail, SPFSoftfail:
+		comment = fmt.Sprintf("%s: domain of %s does not designate %s as permitted sender", Cfg.GetMe(), sender, ip)
+	case SPFNeutral, SPFNone:
+		comment = fmt.Sprintf("%s: %s is neither permitted nor denied by domain of %s", Cfg.GetMe(), ip, sender)
+	default:
+		comment = fmt.Sprintf("%s: error in processing during lookup of %s", Cfg.GetMe(), sender)
+		if err != nil {
+			comment += " - " + err.Error()
+		}
+	}
+	comment = strings.NewReplacer("(", "", ")", "", "\\", "").Replace(comment)
+	return fmt.Sprintf("Received-SPF: %s (%s) client-ip=%s; envelope-from=\"%s\"; helo=%s; identity=%s; receiver=%s;",
+		result, comment, ip, strings.Replace(sender, "\"", "", -1), helo, identity, Cfg.GetMe())
+}
+
+// checkSPF checks SPF of HELO and MAIL FROM (smtpd_spf policy, or if DMARC
+// is enabled) and sets Received-SPF header of the transaction. It returns false if MAIL FROM has
+// been rejected.
+func (s *SMTPServerSession) checkSPF() bool {
+	policy := Cfg.GetSmtpdSPF()
+	if policy != "tag" && policy != "reject" && !Cfg.GetSmtpdDMARC() {
+		return true
+	}
+	if !s.isInbound() {
+		return true
+	}
+	host, _, err := net.SplitHostPort(s.Conn.RemoteAddr().String())
+	if err != nil {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return true
+	}
+
+	// HELO identity (RFC 7208 2.3)
+	result, identity, sender := SPFNone, "helo", "postmaster@"+s.helo
+	if s.helo != "" && net.ParseIP(strings.Trim(s.helo, "[]")) == nil {
+		result, err = CheckSPF(ip, sender, s.helo)
+	}
+	// MAIL FROM identity (null sender or HELO fail: HELO result is used)
+	if s.Envelope.MailFrom != "" && result != SPFFail {
+		identity, sender = "mailfrom", s.Envelope.MailFrom
+		result, err = CheckSPF(ip, sender, s.helo)
+		s.spfMailFrom = result
+	}
+	if err != nil {
+		s.Log(fmt.Sprintf("SPF - %s %s - %s", identity, sender, err.Error()))
+	}
+	s.Log(fmt.Sprintf("SPF - %s %s: %s", identity, sender, result))
+	s.spfResult, s.spfIdentity, s.spfSender = result, identity, sender
+	if policy == "tag" || policy == "reject" {
+		s.spfHeader = spfReceivedHeader(result, ip, sender, s.helo, identity, err)
+	}
+
+	if policy == "reject" && result == SPFFail {
+		s.pause(2)
+		s.Out("550 5.7.23 SPF validation failed for " + sender)
+		s.SMTPResponseCode = 550
+		return false
+	}
+
+	// DMARC is based on MAIL FROM identity (RFC 7489 4.1), even if HELO failed
+	if s.Envelope.MailFrom != "" && identity == "helo" && Cfg.GetSmtpdDMARC() {
+		s.spfMailFrom, err = CheckSPF(ip, s.Envelope.MailFrom, s.helo)
+		if err != nil {
+			s.Log(fmt.Sprintf("SPF - mailfrom %s - %s", s.Envelope.MailFrom, err.Error()))
+		}
+		s.Log(fmt.Sprintf("SPF - mailfrom %s: %s (DMARC)", s.Envelope.MailFrom, s.spfMailFrom))
+	}
+	return true
+}
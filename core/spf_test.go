@@ -0,0 +1,178 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// stubSPFResolver is a SPF resolver for tests, records are indexed by
+// "TYPE name" (TXT, IP, MX or PTR), missing names don't exist and SERVFAIL
+// records are temporary errors
+type stubSPFResolver map[string][]string
+
+func (r stubSPFResolver) lookup(rrType, name string) ([]string, error) {
+	records, ok := r[rrType+" "+strings.ToLower(strings.TrimSuffix(name, "."))]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	if len(records) == 1 && records[0] == "SERVFAIL" {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	return records, nil
+}
+
+func (r stubSPFResolver) LookupTXT(name string) ([]string, error) {
+	return r.lookup("TXT", name)
+}
+
+func (r stubSPFResolver) LookupIP(host string) (ips []net.IP, err error) {
+	records, err := r.lookup("IP", host)
+	for _, ip := range records {
+		ips = append(ips, net.ParseIP(ip))
+	}
+	return ips, err
+}
+
+func (r stubSPFResolver) LookupMX(name string) (mxs []*net.MX, err error) {
+	records, err := r.lookup("MX", name)
+	for _, host := range records {
+		mxs = append(mxs, &net.MX{Host: host})
+	}
+	return mxs, err
+}
+
+func (r stubSPFResolver) LookupAddr(addr string) ([]string, error) {
+	return r.lookup("PTR", addr)
+}
+
+func Test_CheckSPF(t *testing.T) {
+	zone := stubSPFResolver{
+		"TXT example.com":                       {"v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 -all"},
+		"TXT a.example.com":                     {"v=spf1 a -all"},
+		"IP a.example.com":                      {"192.0.2.10", "2001:db8::10"},
+		"TXT acidr.example.com":                 {"v=spf1 a:host.example.net/24 -all"},
+		"IP host.example.net":                   {"198.51.100.1"},
+		"TXT mx.example.com":                    {"v=spf1 mx ~all"},
+		"MX mx.example.com":                     {"mx1.example.com"},
+		"IP mx1.example.com":                    {"198.51.100.25"},
+		"TXT ptr.example.com":                   {"v=spf1 ptr ?all"},
+		"PTR 203.0.113.5":                       {"mail.ptr.example.com."},
+		"IP mail.ptr.example.com":               {"203.0.113.5"},
+		"TXT exists.example.com":                {"v=spf1 exists:%{ir}.%{l}.allow.example.com -all"},
+		"IP 5.113.0.203.john.allow.example.com": {"127.0.0.2"},
+		"TXT include.example.com":               {"v=spf1 include:example.com -all"},
+		"TXT include-none.example.com":          {"v=spf1 include:none.example.com -all"},
+		"TXT include-temp.example.com":          {"v=spf1 include:temp.example.com -all"},
+		"TXT temp.example.com":                  {"SERVFAIL"},
+		"TXT redirect.example.com":              {"v=spf1 redirect=example.com"},
+		"TXT redirect-none.example.com":         {"v=spf1 redirect=none.example.com"},
+		"TXT two.example.com":                   {"v=spf1 -all", "v=spf1 +all"},
+		"TXT other.example.com":                 {"google-site-verification=x"},
+		"TXT neutral.example.com":               {"v=spf1 ip4:192.0.2.1"},
+		"TXT bad.example.com":                   {"v=spf1 ip4:300.1.1.1 -all"},
+		"TXT void2.example.com":                 {"v=spf1 a:nx1.example.com a:nx2.example.com -all"},
+		"TXT void3.example.com":                 {"v=spf1 a:nx1.example.com a:nx2.example.com a:nx3.example.com -all"},
+	}
+	// chain of includes: checking lN needs 11-N lookups
+	for i := 0; i <= 10; i++ {
+		zone[fmt.Sprintf("TXT l%d.example.com", i)] = []string{fmt.Sprintf("v=spf1 include:l%d.example.com -all", i+1)}
+	}
+	zone["TXT l11.example.com"] = []string{"v=spf1 ip4:192.0.2.0/24 -all"}
+	spfDNS = zone
+	defer func() { spfDNS = netSPFResolver{} }()
+
+	tests := []struct {
+		name   string
+		ip     string
+		sender string
+		want   SPFResult
+	}{
+		{"ip4", "192.0.2.1", "john@example.com", SPFPass},
+		{"ip6", "2001:db8::1", "john@example.com", SPFPass},
+		{"-all", "198.51.100.1", "john@example.com", SPFFail},
+		{"a", "192.0.2.10", "john@a.example.com", SPFPass},
+		{"a ipv6", "2001:db8::10", "john@a.example.com", SPFPass},
+		{"a no match", "192.0.2.11", "john@a.example.com", SPFFail},
+		{"a cidr", "198.51.100.200", "john@acidr.example.com", SPFPass},
+		{"mx", "198.51.100.25", "john@mx.example.com", SPFPass},
+		{"~all", "198.51.100.26", "john@mx.example.com", SPFSoftfail},
+		{"ptr", "203.0.113.5", "john@ptr.example.com", SPFPass},
+		{"?all", "203.0.113.6", "john@ptr.example.com", SPFNeutral},
+		{"exists", "203.0.113.5", "john@exists.example.com", SPFPass},
+		{"exists no match", "203.0.113.5", "jane@exists.example.com", SPFFail},
+		{"include", "192.0.2.1", "john@include.example.com", SPFPass},
+		{"include no match", "198.51.100.1", "john@include.example.com", SPFFail},
+		{"include without record", "192.0.2.1", "john@include-none.example.com", SPFPermerror},
+		{"include DNS failure", "192.0.2.1", "john@include-temp.example.com", SPFTemperror},
+		{"redirect", "192.0.2.1", "john@redirect.example.com", SPFPass},
+		{"redirect fail", "198.51.100.1", "john@redirect.example.com", SPFFail},
+		{"redirect without record", "192.0.2.1", "john@redirect-none.example.com", SPFPermerror},
+		{"no record", "192.0.2.1", "john@nx.example.com", SPFNone},
+		{"no SPF record", "192.0.2.1", "john@other.example.com", SPFNone},
+		{"DNS failure", "192.0.2.1", "john@temp.example.com", SPFTemperror},
+		{"multiple records", "192.0.2.1", "john@two.example.com", SPFPermerror},
+		{"default result", "192.0.2.2", "john@neutral.example.com", SPFNeutral},
+		{"bad mechanism", "192.0.2.1", "john@bad.example.com", SPFPermerror},
+		{"2 void lookups", "192.0.2.1", "john@void2.example.com", SPFFail},
+		{"3 void lookups", "192.0.2.1", "john@void3.example.com", SPFPermerror},
+		{"10 lookups", "192.0.2.1", "john@l1.example.com", SPFPass},
+		{"11 lookups", "192.0.2.1", "john@l0.example.com", SPFPermerror},
+		{"HELO identity", "192.0.2.1", "example.com", SPFPass},
+		{"invalid domain", "192.0.2.1", "john@localhost", SPFNone},
+	}
+	for _, tt := range tests {
+		result, _ := CheckSPF(net.ParseIP(tt.ip), tt.sender, "mx.example.org")
+		assert.Equal(t, tt.want, result, tt.name)
+	}
+}
+
+// RFC 7208 7.4
+func Test_spfCheckExpand(t *testing.T) {
+	c := &spfCheck{ip: net.ParseIP("192.0.2.3"), sender: "strong-bad@email.example.com", helo: "mx.example.org"}
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"%{s}", "strong-bad@email.example.com"},
+		{"%{o}", "email.example.com"},
+		{"%{d}", "email.example.com"},
+		{"%{d4}", "email.example.com"},
+		{"%{d3}", "email.example.com"},
+		{"%{d2}", "example.com"},
+		{"%{d1}", "com"},
+		{"%{dr}", "com.example.email"},
+		{"%{d2r}", "example.email"},
+		{"%{l}", "strong-bad"},
+		{"%{l-}", "strong.bad"},
+		{"%{lr}", "strong-bad"},
+		{"%{lr-}", "bad.strong"},
+		{"%{l1r-}", "strong"},
+		{"%{h}", "mx.example.org"},
+		{"%{ir}.%{v}._spf.%{d2}", "3.2.0.192.in-addr._spf.example.com"},
+		{"%{lr-}.lp._spf.%{d2}", "bad.strong.lp._spf.example.com"},
+		{"%{lr-}.lp.%{ir}.%{v}._spf.%{d2}", "bad.strong.lp.3.2.0.192.in-addr._spf.example.com"},
+		{"%{ir}.%{v}.%{l1r-}.lp._spf.%{d2}", "3.2.0.192.in-addr.strong.lp._spf.example.com"},
+		{"%{d2}.trusted-domains.example.net", "example.com.trusted-domains.example.net"},
+		{"%{S}", "strong-bad%40email.example.com"},
+		{"%%%_%-", "% %20"},
+	}
+	for _, tt := range tests {
+		got, err := c.expand(tt.spec, "email.example.com")
+		assert.NoError(t, err, tt.spec)
+		assert.Equal(t, tt.want, got, tt.spec)
+	}
+
+	c.ip = net.ParseIP("2001:db8::cb01")
+	got, err := c.expand("%{ir}.%{v}._spf.%{d2}", "email.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com", got)
+
+	for _, spec := range []string{"%", "%{x}", "%{c}", "%{d", "%a"} {
+		_, err := c.expand(spec, "email.example.com")
+		assert.Equal(t, errSPFPerm, err, spec)
+	}
+}
@@ -0,0 +1,189 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// maxSpoolHeadersSize is the max size of headers kept in memory
+const maxSpoolHeadersSize = 256 * 1024
+
+// headersBuffer is a writer which keeps (in memory) the header section
+// of what is written to it, the body is ignored
+type headersBuffer struct {
+	headers []byte
+	done    bool
+}
+
+// Write implements io.Writer
+func (h *headersBuffer) Write(p []byte) (int, error) {
+	for _, c := range p {
+		if h.done {
+			break
+		}
+		h.WriteByte(c)
+	}
+	return len(p), nil
+}
+
+// WriteByte implements io.ByteWriter
+func (h *headersBuffer) WriteByte(c byte) error {
+	if h.done {
+		return nil
+	}
+	h.headers = append(h.headers, c)
+	l := len(h.headers)
+	if (c == LF && l > 3 && bytes.Equal(h.headers[l-4:], []byte{CR, LF, CR, LF})) || l >= maxSpoolHeadersSize {
+		h.done = true
+	}
+	return nil
+}
+
+// Bytes returns headers
+func (h *headersBuffer) Bytes() []byte {
+	return h.headers
+}
+
+// mailSpool spools a message in a temporary file
+// so we don't have to keep whole message in memory
+type mailSpool struct {
+	file    *os.File
+	writer  *bufio.Writer
+	headers headersBuffer
+	size    int64
+	err     error
+
+	// filter, if set, is called with each header (with its continuation
+	// lines and its CRLF) of the message, it returns the header to spool
+	// (nil to remove it)
+	filter  func(header []byte) []byte
+	pending []byte // current header (not yet filtered)
+	body    bool   // headers have been filtered
+}
+
+// newMailSpool returns a new spool in directory dir
+func newMailSpool(dir string) (*mailSpool, error) {
+	f, err := ioutil.TempFile(dir, "tmail-spool-")
+	if err != nil {
+		return nil, err
+	}
+	return &mailSpool{
+		file:   f,
+		writer: bufio.NewWriterSize(f, 64*1024),
+	}, nil
+}
+
+// WriteByte implements io.ByteWriter
+// error is sticky and will be returned by Reader
+func (m *mailSpool) WriteByte(c byte) error {
+	if m.filter != nil && !m.body {
+		return m.filterByte(c)
+	}
+	return m.writeByte(c)
+}
+
+// Write implements io.Writer
+func (m *mailSpool) Write(p []byte) (n int, err error) {
+	for ; m.filter != nil && !m.body && n < len(p); n++ {
+		if err = m.filterByte(p[n]); err != nil {
+			return n, err
+		}
+	}
+	if n == len(p) {
+		return n, nil
+	}
+	written, err := m.write(p[n:])
+	return n + written, err
+}
+
+// filterByte adds c to current header, previous header is filtered and
+// spooled once it is complete (next line is not a continuation line)
+func (m *mailSpool) filterByte(c byte) error {
+	l := len(m.pending)
+	if l != 0 && m.pending[l-1] == LF && c != ' ' && c != '\t' {
+		if err := m.flushHeader(); err != nil {
+			return err
+		}
+	}
+	m.pending = append(m.pending, c)
+	if bytes.Equal(m.pending, []byte{CR, LF}) || len(m.pending) >= maxSpoolHeadersSize {
+		// end of headers (or headers too large to be filtered)
+		m.body = true
+		_, err := m.write(m.pending)
+		m.pending = nil
+		return err
+	}
+	return nil
+}
+
+// flushHeader filters and spools current header
+func (m *mailSpool) flushHeader() error {
+	header := m.filter(m.pending)
+	m.pending = m.pending[:0]
+	_, err := m.write(header)
+	return err
+}
+
+// writeByte spools c
+func (m *mailSpool) writeByte(c byte) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.headers.WriteByte(c)
+	if m.err = m.writer.WriteByte(c); m.err == nil {
+		m.size++
+	}
+	return m.err
+}
+
+// write spools p
+func (m *mailSpool) write(p []byte) (n int, err error) {
+	if m.err != nil {
+		return 0, m.err
+	}
+	m.headers.Write(p)
+	n, m.err = m.writer.Write(p)
+	m.size += int64(n)
+	return n, m.err
+}
+
+// endHeaders spools pending header of a message without body (message must
+// be complete)
+func (m *mailSpool) endHeaders() {
+	if len(m.pending) != 0 {
+		m.flushHeader()
+	}
+	m.body = true
+}
+
+// Headers returns headers section of spooled message
+func (m *mailSpool) Headers() []byte {
+	m.endHeaders()
+	return m.headers.Bytes()
+}
+
+// Size returns size of spooled message
+func (m *mailSpool) Size() int64 {
+	return m.size
+}
+
+// Reader returns a reader on spooled message
+func (m *mailSpool) Reader() (io.Reader, error) {
+	m.endHeaders()
+	if m.err != nil {
+		return nil, m.err
+	}
+	if m.err = m.writer.Flush(); m.err != nil {
+		return nil, m.err
+	}
+	return io.NewSectionReader(m.file, 0, m.size), nil
+}
+
+// Close closes and removes spool file
+func (m *mailSpool) Close() error {
+	m.file.Close()
+	return os.Remove(m.file.Name())
+}
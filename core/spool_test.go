@@ -0,0 +1,206 @@
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/stretchr/testify/assert"
+	"github.com/teamnsrg/tmail/message"
+)
+
+func Test_mailSpool(t *testing.T) {
+	raw := "Message-ID: <foo@bar>\r\nSubject: test\r\n\r\nbody\r\n\r\nend\r\n"
+	spool, err := newMailSpool(os.TempDir())
+	assert.NoError(t, err)
+	defer spool.Close()
+	for i := 0; i < 10; i++ {
+		spool.WriteByte(raw[i])
+	}
+	_, err = spool.Write([]byte(raw[10:]))
+	assert.NoError(t, err)
+	assert.Equal(t, "Message-ID: <foo@bar>\r\nSubject: test\r\n\r\n", string(spool.Headers()))
+	assert.Equal(t, int64(len(raw)), spool.Size())
+	r, err := spool.Reader()
+	assert.NoError(t, err)
+	b, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, raw, string(b))
+}
+
+func Test_mailSpoolFilter(t *testing.T) {
+	raw := "Authentication-Results: mx.example.com;\r\n spf=pass\r\nSubject: test\r\nX-Drop: 1\r\n\r\nX-Drop: body\r\n"
+	spool, err := newMailSpool(os.TempDir())
+	assert.NoError(t, err)
+	defer spool.Close()
+	filtered := []string{}
+	spool.filter = func(header []byte) []byte {
+		filtered = append(filtered, string(header))
+		if string(header[:6]) == "X-Drop" {
+			return nil
+		}
+		return header
+	}
+	for i := 0; i < 10; i++ {
+		spool.WriteByte(raw[i])
+	}
+	_, err = spool.Write([]byte(raw[10:]))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Authentication-Results: mx.example.com;\r\n spf=pass\r\n", "Subject: test\r\n", "X-Drop: 1\r\n"}, filtered)
+	expected := "Authentication-Results: mx.example.com;\r\n spf=pass\r\nSubject: test\r\n\r\nX-Drop: body\r\n"
+	assert.Equal(t, int64(len(expected)), spool.Size())
+	r, err := spool.Reader()
+	assert.NoError(t, err)
+	b, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, string(b))
+
+	// message without body
+	spool2, err := newMailSpool(os.TempDir())
+	assert.NoError(t, err)
+	defer spool2.Close()
+	spool2.filter = spool.filter
+	spool2.Write([]byte("Subject: test\r\nX-Drop: 1\r\n"))
+	assert.Equal(t, "Subject: test\r\n", string(spool2.Headers()))
+}
+
+// stubNsqd is a minimal nsqd (TCP protocol V2): every command is
+// acknowledged
+func stubNsqd(tb testing.TB) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { ln.Close() })
+	respond := func(w io.Writer, data string) {
+		frame := make([]byte, 8, 8+len(data))
+		binary.BigEndian.PutUint32(frame, uint32(4+len(data)))
+		w.Write(append(frame, data...))
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				if _, err := io.ReadFull(r, make([]byte, 4)); err != nil {
+					return
+				}
+				for {
+					cmd, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch strings.Fields(cmd)[0] {
+					case "IDENTIFY", "PUB":
+						var size uint32
+						if binary.Read(r, binary.BigEndian, &size) != nil {
+							return
+						}
+						if _, err = io.CopyN(ioutil.Discard, r, int64(size)); err != nil {
+							return
+						}
+						respond(conn, "OK")
+					case "CLS":
+						respond(conn, "CLOSE_WAIT")
+					case "NOP":
+					default:
+						respond(conn, "OK")
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// spool a message of size bytes (as smtpd does), queue it (as
+// QueueAddMessage does) and read it back DKIM signed (as deliverd-remote
+// does)
+// B/op must not depend on message size
+func benchmarkMailSpool(b *testing.B, size int) {
+	setupARCTest(b, "example.com")
+	Cfg.cfg.StoreDriver = "disk"
+	Cfg.cfg.StroreSource = b.TempDir()
+	var err error
+	if NsqQueueProducer, err = nsq.NewProducer(stubNsqd(b), nsq.NewConfig()); err != nil {
+		b.Fatal(err)
+	}
+	NsqQueueProducer.SetLogger(nil, nsq.LogLevelError)
+	b.Cleanup(func() {
+		NsqQueueProducer.Stop()
+		NsqQueueProducer = nil
+	})
+	qStore, err := NewStore(Cfg.GetStoreDriver(), Cfg.GetStoreSource())
+	if err != nil {
+		b.Fatal(err)
+	}
+	dkc, err := DkimGetConfig("example.com")
+	if err != nil {
+		b.Fatal(err)
+	}
+	envelope := message.Envelope{MailFrom: "john@example.com", RcptTo: []string{"jane@example.net"}}
+
+	line := []byte("Lorem ipsum dolor sit amet, consectetur adipiscing elit, sed do eiusmod t\r\n")
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// smtpd
+		spool, err := newMailSpool(os.TempDir())
+		if err != nil {
+			b.Fatal(err)
+		}
+		spool.Write([]byte("From: john@example.com\r\nSubject: benchmark\r\n\r\n"))
+		for written := 0; written < size; written += len(line) {
+			for _, c := range line {
+				spool.WriteByte(c)
+			}
+		}
+		r, err := spool.Reader()
+		if err != nil {
+			b.Fatal(err)
+		}
+		uuid, err := QueueAddMessage(r, envelope, "")
+		if err != nil {
+			b.Fatal(err)
+		}
+		spool.Close()
+
+		// deliverd-remote
+		raw, err := qStore.Get(uuid)
+		if err != nil {
+			b.Fatal(err)
+		}
+		sig, err := DKIMSign(raw, "example.com", dkc)
+		raw.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if raw, err = qStore.Get(uuid); err != nil {
+			b.Fatal(err)
+		}
+		if _, err = io.Copy(ioutil.Discard, io.MultiReader(strings.NewReader(sig+"Received: tmail deliverd remote\r\n"), raw)); err != nil {
+			b.Fatal(err)
+		}
+		raw.Close()
+		qStore.Del(uuid)
+	}
+}
+
+func BenchmarkMailSpool5MB(b *testing.B) {
+	benchmarkMailSpool(b, 5*1024*1024)
+}
+
+func BenchmarkMailSpool50MB(b *testing.B) {
+	benchmarkMailSpool(b, 50*1024*1024)
+}
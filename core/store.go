@@ -8,7 +8,8 @@ import (
 // Storer is a interface for stores
 type Storer interface {
 	//TODO should return perm or temp failure
-	Get(key string) (io.Reader, error)
+	// Get returns a reader on value, caller must close it
+	Get(key string) (io.ReadCloser, error)
 	Put(key string, reader io.Reader) error
 	Del(key string) error
 }
@@ -1,12 +1,12 @@
 package core
 
 import (
-	"bytes"
 	"errors"
 	"io"
-	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"time"
 )
 
 // DiskStore represents a physical disk store
@@ -34,17 +34,17 @@ func NewDiskStore() (*diskStore, error) {
 	return &diskStore{basePath}, nil
 }
 
-// Get returns io.Reader corresponding to key
-func (s *diskStore) Get(key string) (io.Reader, error) {
+// Get returns io.ReadCloser corresponding to key
+func (s *diskStore) Get(key string) (io.ReadCloser, error) {
 	if key == "" {
 		return nil, errors.New("diskStore.Get: key is empty")
 	}
 	spath := s.getStoragePath(key)
-	raw, err := ioutil.ReadFile(spath)
+	f, err := os.Open(spath)
 	if err != nil {
 		return nil, errors.New("diskStore.Get: unable to open " + spath + " for reading." + err.Error())
 	}
-	return io.Reader(bytes.NewReader(raw)), nil
+	return f, nil
 }
 
 // Put save key value in store
@@ -69,7 +69,11 @@ func (s *diskStore) Put(key string, reader io.Reader) error {
 		return err
 	}
 	_, err = io.Copy(f, reader)
-	return err
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
 // Del
@@ -80,6 +84,19 @@ func (s *diskStore) Del(key string) error {
 	return os.Remove(s.getStoragePath(key))
 }
 
+// Walk implements storeWalker
+func (s *diskStore) Walk(fn func(key string, modTime time.Time) error) error {
+	return filepath.Walk(s.basePath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Name() == "testingIfIsWritable" {
+			return nil
+		}
+		return fn(info.Name(), info.ModTime())
+	})
+}
+
 // getStoragePath returns storage path associated with key key
 func (s *diskStore) getStoragePath(key string) string {
 	lenKey := len(key)
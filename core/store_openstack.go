@@ -3,6 +3,7 @@ package core
 import (
 	"errors"
 	"io"
+	"io/ioutil"
 	"strings"
 
 	"github.com/toorop/gopenstack/objectstorage/v1"
@@ -54,8 +55,8 @@ func (s *openstackStore) Put(key string, reader io.Reader) error {
 	})
 }
 
-// Get returns io.Reader corresponding to key
-func (s *openstackStore) Get(key string) (io.Reader, error) {
+// Get returns io.ReadCloser corresponding to key
+func (s *openstackStore) Get(key string) (io.ReadCloser, error) {
 	if key == "" {
 		return nil, errors.New("store.Get: key is empty")
 	}
@@ -68,7 +69,10 @@ func (s *openstackStore) Get(key string) (io.Reader, error) {
 	if err != nil {
 		return nil, err
 	}
-	return object.RawData, nil
+	if rc, ok := object.RawData.(io.ReadCloser); ok {
+		return rc, nil
+	}
+	return ioutil.NopCloser(object.RawData), nil
 }
 
 // Del
@@ -0,0 +1,404 @@
+package core
+
+// SMTP TLS Reporting (RFC 8460)
+// TLS negotiation results of remote deliveries are recorded in DB, aggregated
+// by day and policy domain, and reported to domains publishing a TLSRPT record
+// (_smtp._tls.DOMAIN).
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/teamnsrg/tmail/message"
+)
+
+// TLSRPTResult represents TLS negotiation results of a day
+type TLSRPTResult struct {
+	Id            int64
+	Day           string // UTC YYYY-MM-DD
+	PolicyDomain  string
+	PolicyType    string // sts, tlsa or no-policy-found
+	PolicyString  string // policy lines separated by \n
+	PolicyMXHost  string // separated by spaces
+	ResultType    string // "" for success, RFC 8460 result type otherwise
+	SendingIP     string
+	ReceivingMX   string
+	ReceivingIP   string
+	FailureReason string
+	Sessions      int64
+	ClaimedBy     string // reporting process (see claimReportResults)
+	ClaimedAt     time.Time
+}
+
+// tlsResultType returns RFC 8460 result type of TLS negotiation error
+// policy failures are reported when a DANE or MTA-STS policy applies
+func tlsResultType(err error, dane, sts bool) string {
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var authorityErr x509.UnknownAuthorityError
+	switch {
+	case dane && errors.Is(err, errDANEMismatch):
+		return "tlsa-invalid"
+	case sts && (errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) || errors.As(err, &authorityErr)):
+		return "sts-webpki-invalid"
+	case errors.As(err, &hostnameErr):
+		return "certificate-host-mismatch"
+	case errors.As(err, &invalidErr) && invalidErr.Reason == x509.Expired:
+		return "certificate-expired"
+	case errors.As(err, &authorityErr):
+		return "certificate-not-trusted"
+	}
+	return "validation-failure"
+}
+
+// recordTLSResult records result of TLS negotiation with client
+// resultType is "" on success
+func (d *Delivery) recordTLSResult(client *smtpClient, daneRecords []tlsaRecord, resultType, reason string) {
+	if !Cfg.GetDeliverdTLSRPT() {
+		return
+	}
+	r := TLSRPTResult{
+		Day:           time.Now().UTC().Format("2006-01-02"),
+		PolicyDomain:  strings.ToLower(d.QMsg.Host),
+		PolicyType:    "no-policy-found",
+		ResultType:    resultType,
+		FailureReason: reason,
+	}
+	switch {
+	case daneRecords != nil:
+		r.PolicyType = "tlsa"
+		lines := []string{}
+		for _, record := range daneRecords {
+			lines = append(lines, record.String())
+		}
+		r.PolicyString = strings.Join(lines, "\n")
+		r.PolicyMXHost = strings.TrimSuffix(client.route.RemoteHost, ".")
+	case d.MTASTSPolicy != nil:
+		r.PolicyType = "sts"
+		r.PolicyString = strings.Join(d.MTASTSPolicy.lines(), "\n")
+		r.PolicyMXHost = strings.Join(d.MTASTSPolicy.MX, " ")
+	}
+	if client != nil {
+		r.SendingIP, _, _ = net.SplitHostPort(client.LocalAddr())
+		r.ReceivingIP, _, _ = net.SplitHostPort(client.RemoteAddr())
+		r.ReceivingMX = strings.TrimSuffix(client.route.RemoteHost, ".")
+	}
+	if r.ResultType == "" {
+		Logger.Debug(fmt.Sprintf("deliverd-remote %s - TLS-RPT: %s success (%s policy)", d.ID, r.PolicyDomain, r.PolicyType))
+	} else {
+		Logger.Info(fmt.Sprintf("deliverd-remote %s - TLS-RPT: %s %s (%s policy) %s", d.ID, r.PolicyDomain, r.ResultType, r.PolicyType, r.FailureReason))
+	}
+
+	// successful sessions are aggregated without details
+	if r.ResultType == "" {
+		r.SendingIP, r.ReceivingIP, r.ReceivingMX, r.FailureReason = "", "", "", ""
+	}
+	res := DB.Model(&TLSRPTResult{}).Where("day = ? AND policy_domain = ? AND policy_type = ? AND policy_string = ? AND policy_mx_host = ? AND result_type = ? AND sending_ip = ? AND receiving_mx = ? AND receiving_ip = ? AND failure_reason = ?",
+		r.Day, r.PolicyDomain, r.PolicyType, r.PolicyString, r.PolicyMXHost, r.ResultType, r.SendingIP, r.ReceivingMX, r.ReceivingIP, r.FailureReason).UpdateColumn("sessions", gorm.Expr("sessions + ?", 1))
+	if res.Error == nil && res.RowsAffected != 0 {
+		return
+	}
+	r.Sessions = 1
+	if err := DB.Create(&r).Error; err != nil {
+		Logger.Error(fmt.Sprintf("deliverd-remote %s - TLS-RPT: unable to record result - %s", d.ID, err))
+	}
+}
+
+// tlsReport is a RFC 8460 aggregate report
+type tlsReport struct {
+	OrganizationName string            `json:"organization-name"`
+	DateRange        tlsReportRange    `json:"date-range"`
+	ContactInfo      string            `json:"contact-info"`
+	ReportID         string            `json:"report-id"`
+	Policies         []tlsReportPolicy `json:"policies"`
+}
+
+type tlsReportRange struct {
+	Start time.Time `json:"start-datetime"`
+	End   time.Time `json:"end-datetime"`
+}
+
+type tlsReportPolicy struct {
+	Policy struct {
+		Type   string   `json:"policy-type"`
+		String []string `json:"policy-string,omitempty"`
+		Domain string   `json:"policy-domain"`
+		MXHost []string `json:"mx-host,omitempty"`
+	} `json:"policy"`
+	Summary struct {
+		Success int64 `json:"total-successful-session-count"`
+		Failure int64 `json:"total-failure-session-count"`
+	} `json:"summary"`
+	FailureDetails []tlsReportFailure `json:"failure-details,omitempty"`
+}
+
+type tlsReportFailure struct {
+	ResultType    string `json:"result-type"`
+	SendingIP     string `json:"sending-mta-ip,omitempty"`
+	ReceivingMX   string `json:"receiving-mx-hostname,omitempty"`
+	ReceivingIP   string `json:"receiving-ip,omitempty"`
+	Count         int64  `json:"failed-session-count"`
+	FailureReason string `json:"failure-reason-code,omitempty"`
+}
+
+// newTLSReport returns report for results (of the same day and domain)
+func newTLSReport(day time.Time, results []TLSRPTResult) (*tlsReport, error) {
+	id, err := NewUUID()
+	if err != nil {
+		return nil, err
+	}
+	report := &tlsReport{
+		OrganizationName: Cfg.GetMe(),
+		DateRange:        tlsReportRange{day, day.Add(24*time.Hour - time.Second)},
+		ContactInfo:      "postmaster@" + Cfg.GetMe(),
+		ReportID:         id,
+		Policies:         []tlsReportPolicy{},
+	}
+	// policies by type and policy string
+	index := map[string]int{}
+	for _, r := range results {
+		key := r.PolicyType + "\n" + r.PolicyString
+		i, ok := index[key]
+		if !ok {
+			p := tlsReportPolicy{}
+			p.Policy.Type = r.PolicyType
+			if r.PolicyString != "" {
+				p.Policy.String = strings.Split(r.PolicyString, "\n")
+			}
+			p.Policy.Domain = r.PolicyDomain
+			if r.PolicyMXHost != "" {
+				p.Policy.MXHost = strings.Split(r.PolicyMXHost, " ")
+			}
+			report.Policies = append(report.Policies, p)
+			i = len(report.Policies) - 1
+			index[key] = i
+		}
+		p := &report.Policies[i]
+		if r.ResultType == "" {
+			p.Summary.Success += r.Sessions
+			continue
+		}
+		p.Summary.Failure += r.Sessions
+		p.FailureDetails = append(p.FailureDetails, tlsReportFailure{r.ResultType, r.SendingIP, r.ReceivingMX, r.ReceivingIP, r.Sessions, r.FailureReason})
+	}
+	return report, nil
+}
+
+// gzip returns gzipped JSON report
+func (r *tlsReport) gzip() ([]byte, error) {
+	raw, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	if _, err = zw.Write(raw); err != nil {
+		return nil, err
+	}
+	if err = zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// tlsrptResolver is used to get TLSRPT records (can be replaced for tests)
+var tlsrptResolver txtResolver = netResolver{}
+
+// getTLSRPTRua returns report URIs (rua) of domain
+func getTLSRPTRua(domain string) (rua []string, err error) {
+	records, err := tlsrptResolver.LookupTXT("_smtp._tls." + domain)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	for _, record := range records {
+		if !strings.HasPrefix(record, "v=TLSRPTv1") {
+			continue
+		}
+		for _, field := range strings.Split(record, ";") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) != 2 || kv[0] != "rua" {
+				continue
+			}
+			for _, uri := range strings.Split(kv[1], ",") {
+				rua = append(rua, strings.TrimSpace(uri))
+			}
+		}
+		break
+	}
+	return
+}
+
+// sendTLSReport sends report to uri (mailto: or https:)
+func sendTLSReport(report *tlsReport, domain, uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	gz, err := report.gzip()
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "https":
+		client := &http.Client{Timeout: 60 * time.Second}
+		resp, err := client.Post(uri, "application/tlsrpt+gzip", bytes.NewReader(gz))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("unexpected HTTP status %d", resp.StatusCode)
+		}
+		return nil
+	case "mailto":
+		rcpt := strings.SplitN(u.Opaque, "?", 2)[0]
+		if rcpt, err = url.QueryUnescape(rcpt); err != nil {
+			return err
+		}
+		me := Cfg.GetMe()
+		filename := fmt.Sprintf("%s!%s!%d!%d!%s.json.gz", me, domain, report.DateRange.Start.Unix(), report.DateRange.End.Unix(), report.ReportID)
+		boundary := report.ReportID
+		mail := new(bytes.Buffer)
+		fmt.Fprintf(mail, "Date: %s\r\n", time.Now().Format(Time822))
+		fmt.Fprintf(mail, "From: postmaster@%s\r\n", me)
+		fmt.Fprintf(mail, "To: <%s>\r\n", rcpt)
+		fmt.Fprintf(mail, "Subject: Report Domain: %s Submitter: %s Report-ID: <%s>\r\n", domain, me, report.ReportID)
+		fmt.Fprintf(mail, "Message-ID: <%s@%s>\r\n", report.ReportID, me)
+		fmt.Fprintf(mail, "TLS-Report-Domain: %s\r\n", domain)
+		fmt.Fprintf(mail, "TLS-Report-Submitter: %s\r\n", me)
+		mail.WriteString("MIME-Version: 1.0\r\n")
+		fmt.Fprintf(mail, "Content-Type: multipart/report; report-type=\"tlsrpt\";\r\n\tboundary=\"%s\"\r\n\r\n", boundary)
+		fmt.Fprintf(mail, "--%s\r\n", boundary)
+		mail.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+		fmt.Fprintf(mail, "This is an aggregate TLS report from %s for %s.\r\n", me, domain)
+		fmt.Fprintf(mail, "\r\n--%s\r\n", boundary)
+		mail.WriteString("Content-Type: application/tlsrpt+gzip\r\n")
+		mail.WriteString("Content-Transfer-Encoding: base64\r\n")
+		fmt.Fprintf(mail, "Content-Disposition: attachment; filename=\"%s\"\r\n\r\n", filename)
+		b64 := base64.StdEncoding.EncodeToString(gz)
+		for len(b64) > 76 {
+			mail.WriteString(b64[:76] + "\r\n")
+			b64 = b64[76:]
+		}
+		mail.WriteString(b64 + "\r\n")
+		fmt.Fprintf(mail, "--%s--\r\n", boundary)
+		envelope := message.Envelope{MailFrom: "postmaster@" + me, RcptTo: []string{rcpt}}
+		_, err = QueueAddMessage(mail, envelope, "")
+		return err
+	}
+	return errors.New("unsupported rua scheme " + u.Scheme)
+}
+
+// reportClaimTimeout is the delay after which report results claimed by a
+// process which has not removed them can be claimed again
+const reportClaimTimeout = 6 * time.Hour
+
+// claimReportResults claims results (model is TLSRPTResult or DMARCResult) of
+// day and domain for token, so only one node of a cluster reports them.
+// It returns false if they have been claimed by another process.
+func claimReportResults(model interface{}, day, domain, token string) (bool, error) {
+	now := time.Now()
+	res := DB.Model(model).Where("day = ? AND policy_domain = ? AND (claimed_by IS NULL OR claimed_by = ? OR claimed_at < ?)", day, domain, "", now.Add(-reportClaimTimeout)).Updates(map[string]interface{}{"claimed_by": token, "claimed_at": now})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected != 0, nil
+}
+
+// releaseReportResults releases results claimed by token
+func releaseReportResults(model interface{}, token string) error {
+	return DB.Model(model).Where("claimed_by = ?", token).Updates(map[string]interface{}{"claimed_by": ""}).Error
+}
+
+// SendTLSReports sends reports for results of previous days and removes them
+func SendTLSReports() error {
+	today := time.Now().UTC().Format("2006-01-02")
+	results := []TLSRPTResult{}
+	if err := DB.Where("day < ?", today).Order("day, policy_domain, id").Find(&results).Error; err != nil {
+		return err
+	}
+	token, err := NewUUID()
+	if err != nil {
+		return err
+	}
+	for len(results) != 0 {
+		// results of the same day & domain
+		n := 1
+		for n < len(results) && results[n].Day == results[0].Day && results[n].PolicyDomain == results[0].PolicyDomain {
+			n++
+		}
+		day, domain := results[0].Day, results[0].PolicyDomain
+		results = results[n:]
+
+		// claim them (other nodes of a cluster may be reporting them)
+		ok, err := claimReportResults(&TLSRPTResult{}, day, domain, token)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		batch := []TLSRPTResult{}
+		if err = DB.Where("claimed_by = ?", token).Order("id").Find(&batch).Error; err != nil {
+			return err
+		}
+
+		rua, err := getTLSRPTRua(domain)
+		if err != nil {
+			// DNS failure, we'll retry later
+			Logger.Info("tlsrpt: unable to get TLSRPT record of " + domain + " - " + err.Error())
+			if err = releaseReportResults(&TLSRPTResult{}, token); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(rua) != 0 {
+			start, err := time.Parse("2006-01-02", day)
+			if err != nil {
+				return err
+			}
+			report, err := newTLSReport(start, batch)
+			if err != nil {
+				return err
+			}
+			for _, uri := range rua {
+				if err = sendTLSReport(report, domain, uri); err != nil {
+					Logger.Error("tlsrpt: unable to send report " + report.ReportID + " for " + domain + " to " + uri + " - " + err.Error())
+					continue
+				}
+				Logger.Info("tlsrpt: report " + report.ReportID + " for " + domain + " (" + day + ") sent to " + uri)
+			}
+		}
+		if err = DB.Where("claimed_by = ?", token).Delete(TLSRPTResult{}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LaunchTLSReporter sends TLS reports of previous days (checked hourly)
+func LaunchTLSReporter() {
+	if !Cfg.GetDeliverdTLSRPT() {
+		return
+	}
+	for {
+		if err := SendTLSReports(); err != nil {
+			Logger.Error("tlsrpt: " + err.Error())
+		}
+		time.Sleep(time.Hour)
+	}
+}
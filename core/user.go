@@ -12,16 +12,19 @@ import (
 
 // User represents a tmail user.
 type User struct {
-	Id           int64
-	Login        string `sql:"unique"`
-	Passwd       string `sql:"not null"`
-	DovePasswd   string `sql:"null"`                     // SHA512 passwd workaround (glibc on most linux flavor doesn't have bcrypt support)
-	Active       string `sql:"type:char(1);default:'Y'"` //rune `sql:"type:char(1);not null;default:'Y'`
-	AuthRelay    bool   `sql:"default:false"`            // authorization of relaying
-	HaveMailbox  bool   `sql:"default:false"`
-	IsCatchall   bool   `sql:"default:false"`
-	MailboxQuota string `sql:"null"`
-	Home         string `sql:"null"` // used by dovecot to store mailbox
+	Id            int64
+	Login         string `sql:"unique"`
+	Passwd        string `sql:"not null"`
+	DovePasswd    string `sql:"null"`                     // SHA512 passwd workaround (glibc on most linux flavor doesn't have bcrypt support)
+	CramMd5Secret string `sql:"null"`                     // HMAC-MD5 states for smtpd AUTH CRAM-MD5
+	Active        string `sql:"type:char(1);default:'Y'"` //rune `sql:"type:char(1);not null;default:'Y'`
+	AuthRelay     bool   `sql:"default:false"`            // authorization of relaying
+	HaveMailbox   bool   `sql:"default:false"`
+	IsCatchall    bool   `sql:"default:false"`
+	MailboxQuota  string `sql:"null"`
+	Home          string `sql:"null"`      // used by dovecot to store mailbox
+	MaxMsgPerHour int    `sql:"default:0"` // rate limit override (0: smtpd default, -1: unlimited)
+	MaxRcptPerDay int    `sql:"default:0"` // rate limit override (0: smtpd default, -1: unlimited)
 }
 
 // UserAdd add an user
@@ -130,7 +133,19 @@ func UserAdd(login, passwd, mbQuota string, haveMailbox, authRelay, isCatchall b
 	if err != nil {
 		return err
 	}
-	return DB.Save(user).Error
+
+	// CRAM-MD5 (the secret is password-equivalent, it is only stored if
+	// CRAM-MD5 is enabled)
+	if cramMD5Enabled() {
+		if user.CramMd5Secret, err = cramMD5Secret(passwd); err != nil {
+			return err
+		}
+	}
+	if err = DB.Save(user).Error; err != nil {
+		return err
+	}
+	cramMD5UsersChanged()
+	return nil
 }
 
 // UserGet return an user by is login/passwd
@@ -186,7 +201,11 @@ func UserDel(login string) error {
 		return errors.New("User " + login + " doesn't exists")
 	}
 	// TODO on doit verifier si l'host doit etre supprimé de rcpthost
-	return DB.Where("login = ?", login).Delete(&User{}).Error
+	if err = DB.Where("login = ?", login).Delete(&User{}).Error; err != nil {
+		return err
+	}
+	cramMD5UsersChanged()
+	return nil
 }
 
 // UserExists checks if an user exists
@@ -210,6 +229,38 @@ func UserChangePassword(login, password string) error {
 	return user.ChangePasswd(password)
 }
 
+// UserSetRateLimits sets rate limits overrides of an user
+// (0: smtpd default, -1: unlimited)
+func UserSetRateLimits(login string, msgPerHour, rcptPerDay int) error {
+	if msgPerHour < -1 || rcptPerDay < -1 {
+		return errors.New("rate limits must be positive, 0 (default) or -1 (unlimited)")
+	}
+	user, err := UserGetByLogin(login)
+	if err != nil {
+		return err
+	}
+	user.MaxMsgPerHour, user.MaxRcptPerDay = msgPerHour, rcptPerDay
+	return DB.Save(user).Error
+}
+
+// msgPerHourLimit returns max number of messages per hour the user can send
+// (0: unlimited)
+func (u *User) msgPerHourLimit() int {
+	if u.MaxMsgPerHour != 0 {
+		return u.MaxMsgPerHour
+	}
+	return Cfg.GetSmtpdRateLimitMsgPerHour()
+}
+
+// rcptPerDayLimit returns max number of recipients per day the user can send
+// to (0: unlimited)
+func (u *User) rcptPerDayLimit() int {
+	if u.MaxRcptPerDay != 0 {
+		return u.MaxRcptPerDay
+	}
+	return Cfg.GetSmtpdRateLimitRcptPerDay()
+}
+
 // ChangePasswd is used to change user password
 func (u *User) ChangePasswd(passwd string) error {
 	if len(passwd) < 6 {
@@ -220,6 +271,13 @@ func (u *User) ChangePasswd(passwd string) error {
 		return err
 	}
 	u.Passwd = string(hashed)
+	// CRAM-MD5 secret is cleared if CRAM-MD5 is disabled
+	u.CramMd5Secret = ""
+	if cramMD5Enabled() {
+		if u.CramMd5Secret, err = cramMD5Secret(passwd); err != nil {
+			return err
+		}
+	}
 	if u.HaveMailbox {
 		salt, err := NewUUID()
 		if err != nil {
@@ -231,5 +289,9 @@ func (u *User) ChangePasswd(passwd string) error {
 			return err
 		}
 	}
-	return DB.Save(u).Error
+	if err = DB.Save(u).Error; err != nil {
+		return err
+	}
+	cramMD5UsersChanged()
+	return nil
 }
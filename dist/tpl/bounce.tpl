@@ -1,6 +1,4 @@
-Date: {{.Date}}
 From: MAILER-DAEMON@{{.Me}}
-To: {{.RcptTo}}
 Subject: failure notice
 
 Hi. This is the tmail deliverd program at {{.Me}}
@@ -8,9 +6,7 @@ I'm afraid I wasn't able to deliver your message to the
 following addresses. This is a permanent error; I've given up.
 Sorry it didn't work out.
 
-<{{.RcptTo}}>:
+<{{.OriRcptTo}}>:
 {{.ErrMsg}}
 
---- Below this line is a copy of the message.
-
-{{.BouncedMail}}
\ No newline at end of file
+The original message is attached.
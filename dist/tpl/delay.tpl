@@ -0,0 +1,12 @@
+From: MAILER-DAEMON@{{.Me}}
+Subject: delivery delayed notice
+
+Hi. This is the tmail deliverd program at {{.Me}}
+Your message to the following addresses has not been delivered yet.
+This is only a warning, I will keep on trying.
+You do not need to resend your message.
+
+<{{.OriRcptTo}}>:
+{{.ErrMsg}}
+
+The headers of the original message are attached.
@@ -0,0 +1,10 @@
+From: MAILER-DAEMON@{{.Me}}
+Subject: delivery status notification (success)
+
+Hi. This is the tmail deliverd program at {{.Me}}
+As you requested, this is a notification that your message
+was successfully delivered (or relayed) to the following addresses.
+
+<{{.OriRcptTo}}>
+
+The headers of the original message are attached.
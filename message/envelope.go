@@ -4,6 +4,24 @@ package message
 type Envelope struct {
 	MailFrom string
 	RcptTo   []string
+	// BODY parameter of MAIL command (RFC 6152): "", "7BIT" or "8BITMIME"
+	Body string
+	// SMTPUTF8 parameter of MAIL command (RFC 6531)
+	SMTPUTF8 bool
+	// RET parameter of MAIL command (RFC 3461): "", "FULL" or "HDRS"
+	DSNRet string
+	// ENVID parameter of MAIL command (RFC 3461), xtext encoded
+	DSNEnvID string
+	// DSN parameters of RCPT commands (key is the recipient)
+	DSNRcpt map[string]RcptDSN
+}
+
+// RcptDSN represents DSN parameters (RFC 3461) of a recipient
+type RcptDSN struct {
+	// NOTIFY parameter: "" or comma separated list (NEVER or SUCCESS,FAILURE,DELAY)
+	Notify string
+	// ORCPT parameter: addr-type;xtext
+	Orcpt string
 }
 
 func (e Envelope) String() string {
@@ -39,3 +39,15 @@ func RawGetMessageId(raw *[]byte) []byte {
 	}
 	return []byte{}
 }
+
+// RawCountHops returns the number of Received and Delivered(-To) headers
+func RawCountHops(raw *[]byte) int {
+	hops := 0
+	for _, line := range bytes.Split(RawGetHeaders(raw), []byte{13, 10}) {
+		line = bytes.ToLower(line)
+		if bytes.HasPrefix(line, []byte("received")) || bytes.HasPrefix(line, []byte("delivered")) {
+			hops++
+		}
+	}
+	return hops
+}
@@ -0,0 +1,12 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_RawCountHops(t *testing.T) {
+	raw := []byte("Received: from a by b\r\n\tfoo\r\nDelivered-To: toorop@tmail.io\r\nRECEIVED: from c by d\r\nSubject: received\r\n\r\nReceived: in body\r\n")
+	assert.Equal(t, 3, RawCountHops(&raw))
+}
@@ -0,0 +1,28 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/teamnsrg/tmail/api"
+)
+
+// deliverdGetThrottle returns throttle state by destination domain
+func deliverdGetThrottle(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	js, err := json.Marshal(api.DeliverdThrottleStates())
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// addDeliverdHandlers add deliverd handlers to router
+func addDeliverdHandlers(router *httprouter.Router) {
+	// get throttle state
+	router.GET("/deliverd/throttle", wrapHandler(deliverdGetThrottle))
+}
@@ -31,6 +31,8 @@ func LaunchServer() {
 	addUsersHandlers(router)
 	// Queue
 	addQueueHandlers(router)
+	// Deliverd
+	addDeliverdHandlers(router)
 
 	// Microservice data handler
 	router.Handler("GET", "/msdata/:id", http.StripPrefix("/msdata/", http.FileServer(http.Dir(core.Cfg.GetTempDir()))))
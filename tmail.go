@@ -175,6 +175,10 @@ func main() {
 					// TODO at this point we don't know if serveur is launched
 					core.Logger.Info("smtpd " + dsn.String() + " launched.")
 				}
+				go core.LaunchDMARCReporter()
+				go core.LaunchDNSBLCachePurger()
+				go core.LaunchGreylistPurger()
+				go core.LaunchRateLimitPurger()
 			}
 
 			// deliverd